@@ -7,6 +7,8 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
+
+	"github.com/rancher/longhorn-manager/types"
 )
 
 type HandleFuncWithError func(http.ResponseWriter, *http.Request) error
@@ -18,11 +20,34 @@ func HandleError(s *client.Schemas, t HandleFuncWithError) http.Handler {
 		if err := t(rw, req); err != nil {
 			logrus.Warnf("HTTP handling error %v", err)
 			apiContext := api.GetApiContext(req)
-			apiContext.WriteErr(err)
+			switch {
+			case types.IsConflict(err):
+				// tells the client to read the volume again and retry
+				writeErrStatus(apiContext, rw, http.StatusConflict, "Conflict", err)
+			case types.IsUnsupported(err):
+				// retrying won't help until the engine image is upgraded
+				writeErrStatus(apiContext, rw, http.StatusNotImplemented, "Unsupported", err)
+			default:
+				apiContext.WriteErr(err)
+			}
 		}
 	}))
 }
 
+func writeErrStatus(apiContext *api.ApiContext, rw http.ResponseWriter, status int, code string, err error) {
+	rw.WriteHeader(status)
+	if writeErr := apiContext.WriteResource(&client.ServerApiError{
+		Resource: client.Resource{
+			Type: "error",
+		},
+		Status:  status,
+		Code:    code,
+		Message: err.Error(),
+	}); writeErr != nil {
+		logrus.Errorf("Failed to write err: %v", err)
+	}
+}
+
 func Handler(s *Server) http.Handler {
 	r := mux.NewRouter().StrictSlash(true)
 	schemas := NewSchema()
@@ -44,26 +69,45 @@ func Handler(s *Server) http.Handler {
 	r.Methods("GET").Path("/v1/volumes").Handler(f(schemas, s.ListVolume))
 	r.Methods("GET").Path("/v1/volumes/{name}").Handler(f(schemas, s.GetVolume))
 	r.Methods("DELETE").Path("/v1/volumes/{name}").Handler(f(schemas, s.DeleteVolume))
+	r.Methods("POST").Path("/v1/volumes").Queries("action", "engineUpgrade").Handler(f(schemas, s.EngineUpgradeDetached))
 	r.Methods("POST").Path("/v1/volumes").Handler(f(schemas, s.CreateVolume))
 
 	volumeActions := map[string]func(http.ResponseWriter, *http.Request) error{
-		"attach":          s.fwd.Handler(HostIDFromAttachReq, s.AttachVolume),
-		"detach":          s.fwd.Handler(HostIDFromVolume(s.man), s.DetachVolume),
-		"snapshotPurge":   s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Purge),
-		"snapshotCreate":  s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Create),
-		"snapshotList":    s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.List),
-		"snapshotGet":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Get),
-		"snapshotDelete":  s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Delete),
-		"snapshotRevert":  s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Revert),
-		"snapshotBackup":  s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Backup),
-		"recurringUpdate": s.fwd.Handler(HostIDFromVolume(s.man), s.UpdateRecurring),
-		"bgTaskQueue":     s.fwd.Handler(HostIDFromVolume(s.man), s.BgTaskQueue),
-		"replicaRemove":   s.fwd.Handler(HostIDFromVolume(s.man), s.ReplicaRemove),
+		"attach":             s.fwd.Handler(HostIDFromAttachReq, s.AttachVolume),
+		"detach":             s.fwd.Handler(HostIDFromVolume(s.man), s.DetachVolume),
+		"snapshotPurge":      s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Purge),
+		"snapshotCreate":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Create),
+		"snapshotList":       s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.List),
+		"snapshotGet":        s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Get),
+		"snapshotDelete":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Delete),
+		"snapshotRevert":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Revert),
+		"snapshotBackup":     s.fwd.Handler(HostIDFromVolume(s.man), s.snapshots.Backup),
+		"recurringUpdate":    s.fwd.Handler(HostIDFromVolume(s.man), s.UpdateRecurring),
+		"bgTaskQueue":        s.fwd.Handler(HostIDFromVolume(s.man), s.BgTaskQueue),
+		"replicaRemove":      s.fwd.Handler(HostIDFromVolume(s.man), s.ReplicaRemove),
+		"expand":             s.fwd.Handler(HostIDFromVolume(s.man), s.ExpandVolume),
+		"updateReplicaCount": s.fwd.Handler(HostIDFromVolume(s.man), s.UpdateReplicaCount),
+		"engineUpgrade":      s.fwd.Handler(HostIDFromVolume(s.man), s.EngineUpgrade),
+		"backupRestore":      s.fwd.Handler(HostIDFromVolume(s.man), s.RestoreBackup),
 	}
 	for name, action := range volumeActions {
 		r.Methods("POST").Path("/v1/volumes/{name}").Queries("action", name).Handler(f(schemas, action))
 	}
 
+	r.Methods("GET").Path("/v1/backuptargets").Handler(f(schemas, s.targets.List))
+	r.Methods("POST").Path("/v1/backuptargets").Handler(f(schemas, s.targets.Create))
+	r.Methods("GET").Path("/v1/backuptargets/{name}").Handler(f(schemas, s.targets.Get))
+	r.Methods("PUT").Path("/v1/backuptargets/{name}").Handler(f(schemas, s.targets.Update))
+	r.Methods("DELETE").Path("/v1/backuptargets/{name}").Handler(f(schemas, s.targets.Delete))
+	r.Methods("GET").Path("/v1/backuptargetstatuses").Handler(f(schemas, s.targets.ListStatus))
+	r.Methods("GET").Path("/v1/backuptargetstatuses/{name}").Handler(f(schemas, s.targets.GetStatus))
+
+	r.Methods("GET").Path("/v1/credentials").Handler(f(schemas, s.credentials.List))
+	r.Methods("POST").Path("/v1/credentials").Handler(f(schemas, s.credentials.Create))
+	r.Methods("GET").Path("/v1/credentials/{name}").Handler(f(schemas, s.credentials.Get))
+	r.Methods("PUT").Path("/v1/credentials/{name}").Handler(f(schemas, s.credentials.Update))
+	r.Methods("DELETE").Path("/v1/credentials/{name}").Handler(f(schemas, s.credentials.Delete))
+
 	r.Methods("GET").Path("/v1/backupvolumes").Handler(f(schemas, s.backups.ListVolume))
 	r.Methods("GET").Path("/v1/backupvolumes/{volName}").Handler(f(schemas, s.backups.GetVolume))
 	backupActions := map[string]func(http.ResponseWriter, *http.Request) error{
@@ -77,6 +121,16 @@ func Handler(s *Server) http.Handler {
 
 	r.Methods("GET").Path("/v1/hosts").Handler(f(schemas, s.ListHost))
 	r.Methods("GET").Path("/v1/hosts/{id}").Handler(f(schemas, s.GetHost))
+	r.Methods("PUT").Path("/v1/hosts/{id}").Handler(f(schemas, s.UpdateHost))
+	hostActions := map[string]func(http.ResponseWriter, *http.Request) error{
+		"updateLabels":       s.UpdateHostLabels,
+		"enableMaintenance":  s.EnableHostMaintenance,
+		"disableMaintenance": s.DisableHostMaintenance,
+		"evict":              s.EvictHost,
+	}
+	for name, action := range hostActions {
+		r.Methods("POST").Path("/v1/hosts/{id}").Queries("action", name).Handler(f(schemas, action))
+	}
 
 	// Internal API
 	r.Methods("POST").Path("/v1/schedule").Handler(f(schemas, s.Schedule))
@@ -16,26 +16,39 @@ type BackupsHandlers struct {
 	man types.VolumeManager
 }
 
-func (bh *BackupsHandlers) ListVolume(w http.ResponseWriter, req *http.Request) error {
-	apiContext := api.GetApiContext(req)
-
+// backupTarget returns the target in the backupTarget query parameter, the
+// default one if not specified
+func (bh *BackupsHandlers) backupTarget(req *http.Request) (*types.BackupTarget, error) {
 	settings, err := bh.man.Settings().GetSettings()
 	if err != nil || settings == nil {
-		return errors.New("cannot backup: unable to read settings")
+		return nil, errors.New("cannot backup: unable to read settings")
 	}
-	backupTarget := settings.BackupTarget
-	if backupTarget == "" {
-		return errors.New("cannot backup: backupTarget not set")
+	target, err := settings.GetBackupTarget(req.URL.Query().Get("backupTarget"))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot backup")
 	}
+	return target, nil
+}
 
-	backups := bh.man.ManagerBackupOps(backupTarget)
+func (bh *BackupsHandlers) ListVolume(w http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+
+	target, err := bh.backupTarget(req)
+	if err != nil {
+		return err
+	}
+	backupTarget := target.URL
+	backups, err := bh.man.ManagerBackupOps(target)
+	if err != nil {
+		return err
+	}
 
 	volumes, err := backups.ListVolumes()
 	if err != nil {
 		return errors.Wrapf(err, "error listing backups, backupTarget '%s'", backupTarget)
 	}
 	logrus.Debugf("success: list backup volumes, backupTarget '%s'", backupTarget)
-	apiContext.Write(toBackupVolumeCollection(volumes, apiContext))
+	apiContext.Write(toBackupVolumeCollection(volumes, target.Name, apiContext))
 	return nil
 }
 
@@ -44,40 +57,38 @@ func (bh *BackupsHandlers) GetVolume(w http.ResponseWriter, req *http.Request) e
 
 	volName := mux.Vars(req)["volName"]
 
-	settings, err := bh.man.Settings().GetSettings()
-	if err != nil || settings == nil {
-		return errors.New("cannot backup: unable to read settings")
+	target, err := bh.backupTarget(req)
+	if err != nil {
+		return err
 	}
-	backupTarget := settings.BackupTarget
-	if backupTarget == "" {
-		return errors.New("cannot backup: backupTarget not set")
+	backupTarget := target.URL
+	backups, err := bh.man.ManagerBackupOps(target)
+	if err != nil {
+		return err
 	}
 
-	backups := bh.man.ManagerBackupOps(backupTarget)
-
 	bv, err := backups.GetVolume(volName)
 	if err != nil {
 		return errors.Wrapf(err, "error get backup volume, backupTarget '%s', volume '%s'", backupTarget, volName)
 	}
 	logrus.Debugf("success: get backup volume, volume '%s', backupTarget '%s'", volName, backupTarget)
-	apiContext.Write(toBackupVolumeResource(bv, apiContext))
+	apiContext.Write(toBackupVolumeResource(bv, target.Name, apiContext))
 	return nil
 }
 
 func (bh *BackupsHandlers) List(w http.ResponseWriter, req *http.Request) error {
 	volName := mux.Vars(req)["volName"]
 
-	settings, err := bh.man.Settings().GetSettings()
-	if err != nil || settings == nil {
-		return errors.New("cannot backup: unable to read settings")
+	target, err := bh.backupTarget(req)
+	if err != nil {
+		return err
 	}
-	backupTarget := settings.BackupTarget
-	if backupTarget == "" {
-		return errors.New("cannot backup: backupTarget not set")
+	backupTarget := target.URL
+	backups, err := bh.man.ManagerBackupOps(target)
+	if err != nil {
+		return err
 	}
 
-	backups := bh.man.ManagerBackupOps(backupTarget)
-
 	bs, err := backups.List(volName)
 	if err != nil {
 		return errors.Wrapf(err, "error listing backups, backupTarget '%s', volume '%s'", backupTarget, volName)
@@ -104,17 +115,16 @@ func (bh *BackupsHandlers) Get(w http.ResponseWriter, req *http.Request) error {
 	}
 	volName := mux.Vars(req)["volName"]
 
-	settings, err := bh.man.Settings().GetSettings()
-	if err != nil || settings == nil {
-		return errors.New("cannot backup: unable to read settings")
+	target, err := bh.backupTarget(req)
+	if err != nil {
+		return err
 	}
-	backupTarget := settings.BackupTarget
-	if backupTarget == "" {
-		return errors.New("cannot backup: backupTarget not set")
+	backupTarget := target.URL
+	backups, err := bh.man.ManagerBackupOps(target)
+	if err != nil {
+		return err
 	}
 
-	backups := bh.man.ManagerBackupOps(backupTarget)
-
 	url := backupURL(backupTarget, input.Name, volName)
 	backup, err := backups.Get(url)
 	if err != nil {
@@ -144,17 +154,16 @@ func (bh *BackupsHandlers) Delete(w http.ResponseWriter, req *http.Request) erro
 
 	volName := mux.Vars(req)["volName"]
 
-	settings, err := bh.man.Settings().GetSettings()
-	if err != nil || settings == nil {
-		return errors.New("cannot backup: unable to read settings")
+	target, err := bh.backupTarget(req)
+	if err != nil {
+		return err
 	}
-	backupTarget := settings.BackupTarget
-	if backupTarget == "" {
-		return errors.New("cannot backup: backupTarget not set")
+	backupTarget := target.URL
+	backups, err := bh.man.ManagerBackupOps(target)
+	if err != nil {
+		return err
 	}
 
-	backups := bh.man.ManagerBackupOps(backupTarget)
-
 	url := backupURL(backupTarget, input.Name, volName)
 	if err := backups.Delete(url); err != nil {
 		return errors.Wrapf(err, "error deleting backup '%s'", url)
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/api"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// BackupTargetsHandlers manage the named backup targets. The default target
+// is the backupTarget setting, it's listed but changed through the setting.
+type BackupTargetsHandlers struct {
+	man types.VolumeManager
+}
+
+func (th *BackupTargetsHandlers) List(w http.ResponseWriter, req *http.Request) error {
+	settings, err := th.man.Settings().GetSettings()
+	if err != nil || settings == nil {
+		return errors.Wrap(err, "fail to read settings")
+	}
+	api.GetApiContext(req).Write(toBackupTargetCollection(settings.ListBackupTargets()))
+	return nil
+}
+
+func (th *BackupTargetsHandlers) Get(w http.ResponseWriter, req *http.Request) error {
+	name := mux.Vars(req)["name"]
+
+	settings, err := th.man.Settings().GetSettings()
+	if err != nil || settings == nil {
+		return errors.Wrap(err, "fail to read settings")
+	}
+	target, err := settings.GetBackupTarget(name)
+	if err != nil {
+		return err
+	}
+	api.GetApiContext(req).Write(toBackupTargetResource(target))
+	return nil
+}
+
+func (th *BackupTargetsHandlers) Create(w http.ResponseWriter, req *http.Request) error {
+	var input BackupTarget
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return err
+	}
+	if input.Name == types.DefaultBackupTargetName {
+		return errors.Errorf("backup target '%s' is the backupTarget setting", input.Name)
+	}
+	if input.Name == "" || strings.ContainsAny(input.Name, " \t\n/?&#%") {
+		return errors.Errorf("invalid backup target name '%s'", input.Name)
+	}
+	if input.URL == "" {
+		return errors.Errorf("empty URL of backup target '%s'", input.Name)
+	}
+	if err := checkCredential(th.man.Credentials(), input.Credential); err != nil {
+		return err
+	}
+
+	settings, err := th.man.Settings().GetSettings()
+	if err != nil || settings == nil {
+		return errors.Wrap(err, "fail to read settings")
+	}
+	if _, err := settings.GetBackupTarget(input.Name); err == nil {
+		return errors.Errorf("backup target '%s' already exists", input.Name)
+	}
+	target := &types.BackupTarget{Name: input.Name, URL: input.URL, Credential: input.Credential}
+	if err := th.man.CheckBackupTarget(target); err != nil {
+		return errors.Wrapf(err, "fail to create backup target '%s'", input.Name)
+	}
+	settings.BackupTargets = append(settings.BackupTargets, target)
+	if err := th.man.Settings().SetSettings(settings); err != nil {
+		return errors.Wrapf(err, "fail to create backup target '%s'", input.Name)
+	}
+	apiContext.Write(toBackupTargetResource(target))
+	return nil
+}
+
+func (th *BackupTargetsHandlers) Update(w http.ResponseWriter, req *http.Request) error {
+	var input BackupTarget
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return err
+	}
+	name := mux.Vars(req)["name"]
+	if input.URL == "" {
+		return errors.Errorf("empty URL of backup target '%s'", name)
+	}
+	if err := checkCredential(th.man.Credentials(), input.Credential); err != nil {
+		return err
+	}
+
+	settings, err := th.man.Settings().GetSettings()
+	if err != nil || settings == nil {
+		return errors.Wrap(err, "fail to read settings")
+	}
+	target := findBackupTarget(settings, name)
+	if target == nil {
+		return errors.Errorf("cannot find backup target '%s'", name)
+	}
+	target.URL = input.URL
+	target.Credential = input.Credential
+	if err := th.man.CheckBackupTarget(target); err != nil {
+		return errors.Wrapf(err, "fail to update backup target '%s'", name)
+	}
+	if err := th.man.Settings().SetSettings(settings); err != nil {
+		return errors.Wrapf(err, "fail to update backup target '%s'", name)
+	}
+	apiContext.Write(toBackupTargetResource(target))
+	return nil
+}
+
+// Delete refuses to delete the target used by the recurring backups
+func (th *BackupTargetsHandlers) Delete(w http.ResponseWriter, req *http.Request) error {
+	name := mux.Vars(req)["name"]
+
+	settings, err := th.man.Settings().GetSettings()
+	if err != nil || settings == nil {
+		return errors.Wrap(err, "fail to read settings")
+	}
+	if findBackupTarget(settings, name) == nil {
+		return errors.Errorf("cannot find backup target '%s'", name)
+	}
+	volumes, err := th.man.List()
+	if err != nil {
+		return errors.Wrap(err, "unable to list volumes")
+	}
+	for _, volume := range volumes {
+		for _, job := range volume.RecurringJobs {
+			if job.Task == types.BackupTaskName && job.BackupTarget == name {
+				return errors.Errorf("backup target '%s' is used by recurring job '%s' of volume '%s'", name, job.Name, volume.Name)
+			}
+		}
+	}
+	targets := []*types.BackupTarget{}
+	for _, target := range settings.BackupTargets {
+		if target.Name != name {
+			targets = append(targets, target)
+		}
+	}
+	settings.BackupTargets = targets
+	if err := th.man.Settings().SetSettings(settings); err != nil {
+		return errors.Wrapf(err, "fail to delete backup target '%s'", name)
+	}
+	api.GetApiContext(req).Write(&Empty{})
+	return nil
+}
+
+func (th *BackupTargetsHandlers) ListStatus(w http.ResponseWriter, req *http.Request) error {
+	statuses, err := th.man.ListBackupTargetStatus()
+	if err != nil {
+		return errors.Wrap(err, "unable to list backup target status")
+	}
+	api.GetApiContext(req).Write(toBackupTargetStatusCollection(statuses))
+	return nil
+}
+
+func (th *BackupTargetsHandlers) GetStatus(w http.ResponseWriter, req *http.Request) error {
+	name := mux.Vars(req)["name"]
+
+	status, err := th.man.GetBackupTargetStatus(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get status of backup target '%s'", name)
+	}
+	api.GetApiContext(req).Write(toBackupTargetStatusResource(status))
+	return nil
+}
+
+func findBackupTarget(settings *types.SettingsInfo, name string) *types.BackupTarget {
+	for _, target := range settings.BackupTargets {
+		if target.Name == name {
+			return target
+		}
+	}
+	return nil
+}
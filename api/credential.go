@@ -0,0 +1,136 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/api"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// CredentialsHandlers manage the credentials of the backup targets. The
+// values are encrypted before they're stored, and never shown.
+type CredentialsHandlers struct {
+	man types.VolumeManager
+}
+
+func (ch *CredentialsHandlers) List(w http.ResponseWriter, req *http.Request) error {
+	credentials, err := ch.man.Credentials().ListCredentials()
+	if err != nil {
+		return errors.Wrap(err, "unable to list credentials")
+	}
+	api.GetApiContext(req).Write(toCredentialCollection(credentials))
+	return nil
+}
+
+func (ch *CredentialsHandlers) Get(w http.ResponseWriter, req *http.Request) error {
+	name := mux.Vars(req)["name"]
+
+	credential, err := ch.man.Credentials().GetCredential(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get credential '%s'", name)
+	}
+	if credential == nil {
+		return errors.Errorf("cannot find credential '%s'", name)
+	}
+	api.GetApiContext(req).Write(toCredentialResource(credential))
+	return nil
+}
+
+func (ch *CredentialsHandlers) Create(w http.ResponseWriter, req *http.Request) error {
+	var input Credential
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return err
+	}
+	if input.Name == "" || strings.ContainsAny(input.Name, " \t\n/?&#%") {
+		return errors.Errorf("invalid credential name '%s'", input.Name)
+	}
+	existing, err := ch.man.Credentials().GetCredential(input.Name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get credential '%s'", input.Name)
+	}
+	if existing != nil {
+		return errors.Errorf("credential '%s' already exists", input.Name)
+	}
+	credential, err := ch.setCredential(input.Name, input.Values)
+	if err != nil {
+		return errors.Wrapf(err, "fail to create credential '%s'", input.Name)
+	}
+	apiContext.Write(toCredentialResource(credential))
+	return nil
+}
+
+func (ch *CredentialsHandlers) Update(w http.ResponseWriter, req *http.Request) error {
+	var input Credential
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return err
+	}
+	name := mux.Vars(req)["name"]
+	if err := checkCredential(ch.man.Credentials(), name); err != nil {
+		return err
+	}
+	credential, err := ch.setCredential(name, input.Values)
+	if err != nil {
+		return errors.Wrapf(err, "fail to update credential '%s'", name)
+	}
+	apiContext.Write(toCredentialResource(credential))
+	return nil
+}
+
+func (ch *CredentialsHandlers) setCredential(name string, values map[string]string) (*types.CredentialInfo, error) {
+	credential := &types.CredentialInfo{Name: name, Values: values}
+	if err := orch.ValidateCredential(credential); err != nil {
+		return nil, err
+	}
+	encrypted, err := orch.EncryptCredential(credential)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.man.Credentials().SetCredential(encrypted); err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// Delete refuses to delete the credential used by the backup targets
+func (ch *CredentialsHandlers) Delete(w http.ResponseWriter, req *http.Request) error {
+	name := mux.Vars(req)["name"]
+
+	settings, err := ch.man.Settings().GetSettings()
+	if err != nil || settings == nil {
+		return errors.Wrap(err, "fail to read settings")
+	}
+	for _, target := range settings.ListBackupTargets() {
+		if target.Credential == name {
+			return errors.Errorf("credential '%s' is used by backup target '%s'", name, target.Name)
+		}
+	}
+	if err := ch.man.Credentials().DeleteCredential(name); err != nil {
+		return errors.Wrapf(err, "fail to delete credential '%s'", name)
+	}
+	api.GetApiContext(req).Write(&Empty{})
+	return nil
+}
+
+// checkCredential makes sure the credential exists, unless name is empty
+func checkCredential(credentials types.Credentials, name string) error {
+	if name == "" {
+		return nil
+	}
+	credential, err := credentials.GetCredential(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get credential '%s'", name)
+	}
+	if credential == nil {
+		return errors.Errorf("cannot find credential '%s'", name)
+	}
+	return nil
+}
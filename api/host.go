@@ -15,7 +15,7 @@ func (s *Server) ListHost(rw http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return errors.Wrap(err, "fail to list host")
 	}
-	apiContext.Write(toHostCollection(hosts))
+	apiContext.Write(toHostCollection(hosts, apiContext))
 	return nil
 }
 
@@ -27,6 +27,71 @@ func (s *Server) GetHost(rw http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return errors.Wrap(err, "fail to get host")
 	}
-	apiContext.Write(toHostResource(host))
+	apiContext.Write(toHostResource(host, apiContext))
 	return nil
 }
+
+func (s *Server) UpdateHostLabels(rw http.ResponseWriter, req *http.Request) error {
+	var input UpdateLabelsInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read updateLabelsInput")
+	}
+
+	id := mux.Vars(req)["id"]
+
+	host, err := s.man.UpdateHostLabels(id, input.Labels)
+	if err != nil {
+		return errors.Wrap(err, "unable to update host labels")
+	}
+	apiContext.Write(toHostResource(host, apiContext))
+	return nil
+}
+
+func (s *Server) UpdateHost(rw http.ResponseWriter, req *http.Request) error {
+	var input Host
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read host")
+	}
+
+	id := mux.Vars(req)["id"]
+
+	host, err := s.man.UpdateHostTags(id, input.Tags, input.DiskTags)
+	if err != nil {
+		return errors.Wrap(err, "unable to update host tags")
+	}
+	apiContext.Write(toHostResource(host, apiContext))
+	return nil
+}
+
+func (s *Server) EnableHostMaintenance(rw http.ResponseWriter, req *http.Request) error {
+	return s.updateHostMaintenance(rw, req, true)
+}
+
+func (s *Server) DisableHostMaintenance(rw http.ResponseWriter, req *http.Request) error {
+	return s.updateHostMaintenance(rw, req, false)
+}
+
+func (s *Server) updateHostMaintenance(rw http.ResponseWriter, req *http.Request, maintenance bool) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+
+	host, err := s.man.UpdateHostMaintenance(id, maintenance)
+	if err != nil {
+		return errors.Wrap(err, "unable to update host maintenance")
+	}
+	apiContext.Write(toHostResource(host, apiContext))
+	return nil
+}
+
+func (s *Server) EvictHost(rw http.ResponseWriter, req *http.Request) error {
+	id := mux.Vars(req)["id"]
+
+	if err := s.man.EvictHost(id); err != nil {
+		return errors.Wrap(err, "unable to evict host")
+	}
+	return s.GetHost(rw, req)
+}
@@ -8,25 +8,42 @@ import (
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"time"
 )
 
+// Volume is the volume resource. FromVolume and FromSnapshot clone the
+// snapshot of another volume when the volume is created: the snapshot is
+// backed up to the default backup target, which must be set, and restored
+// into the new volume. The source volume is attached for the backup if it's
+// detached. The backup is removed once the restore is done, failed or not.
 type Volume struct {
 	client.Resource
 
-	Name                string `json:"name,omitempty"`
-	Size                string `json:"size,omitempty"`
-	BaseImage           string `json:"baseImage,omitempty"`
-	FromBackup          string `json:"fromBackup,omitempty"`
-	NumberOfReplicas    int    `json:"numberOfReplicas,omitempty"`
-	StaleReplicaTimeout int    `json:"staleReplicaTimeout,omitempty"`
-	State               string `json:"state,omitempty"`
-	EngineImage         string `json:"engineImage,omitempty"`
-	Endpoint            string `json:"endpoint,omitemtpy"`
-	Created             string `json:"created,omitemtpy"`
-
-	RecurringJobs []*types.RecurringJob `json:"recurringJobs,omitempty"`
+	Name                  string   `json:"name,omitempty"`
+	Size                  string   `json:"size,omitempty"`
+	BaseImage             string   `json:"baseImage,omitempty"`
+	FromBackup            string   `json:"fromBackup,omitempty"`
+	FromVolume            string   `json:"fromVolume,omitempty"`
+	FromSnapshot          string   `json:"fromSnapshot,omitempty"`
+	NumberOfReplicas      int      `json:"numberOfReplicas,omitempty"`
+	StaleReplicaTimeout   int      `json:"staleReplicaTimeout,omitempty"`
+	ReplicaSchedulePolicy string   `json:"replicaSchedulePolicy,omitempty"`
+	HostSelector          []string `json:"hostSelector,omitempty"`
+	DiskSelector          []string `json:"diskSelector,omitempty"`
+	FailoverPolicy        string   `json:"failoverPolicy,omitempty"`
+	State                 string   `json:"state,omitempty"`
+	EngineImage           string   `json:"engineImage,omitempty"`
+	Endpoint              string   `json:"endpoint,omitemtpy"`
+	Created               string   `json:"created,omitemtpy"`
+
+	RecurringJobs []*types.RecurringJob    `json:"recurringJobs,omitempty"`
+	EngineUpgrade *types.EngineUpgradeInfo `json:"engineUpgrade,omitempty"`
+	Lease         *types.VolumeLease       `json:"lease,omitempty"`
+	Failover      *types.FailoverInfo      `json:"failover,omitempty"`
+	Restore       *types.RestoreInfo       `json:"restore,omitempty"`
 
 	Replicas   []Replica   `json:"replicas,omitempty"`
 	Controller *Controller `json:"controller,omitempty"`
@@ -40,14 +57,47 @@ type Snapshot struct {
 type Host struct {
 	client.Resource
 
-	UUID    string `json:"uuid,omitempty"`
-	Name    string `json:"name,omitempty"`
-	Address string `json:"address,omitempty"`
+	UUID    string            `json:"uuid,omitempty"`
+	Name    string            `json:"name,omitempty"`
+	Address string            `json:"address,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+
+	Tags     []string `json:"tags"`
+	DiskTags []string `json:"diskTags"`
+
+	Storage *types.HostStorage `json:"storage,omitempty"`
+
+	Maintenance bool                `json:"maintenance"`
+	Eviction    *types.EvictionInfo `json:"eviction,omitempty"`
+
+	Status   types.HostStatus `json:"status,omitempty"`
+	LastSeen string           `json:"lastSeen,omitempty"`
 }
 
 type BackupVolume struct {
 	client.Resource
 	types.BackupVolumeInfo
+	BackupTarget string `json:"backupTarget"`
+}
+
+type BackupTarget struct {
+	client.Resource
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Credential string `json:"credential,omitempty"`
+}
+
+type BackupTargetStatus struct {
+	client.Resource
+	types.BackupTargetStatus
+}
+
+// Credential only shows the keys, the values are write only
+type Credential struct {
+	client.Resource
+	Name   string            `json:"name"`
+	Keys   []string          `json:"keys"`
+	Values map[string]string `json:"values,omitempty"`
 }
 
 type Backup struct {
@@ -77,6 +127,13 @@ type Replica struct {
 	Name         string `json:"name,omitempty"`
 	Mode         string `json:"mode,omitempty"`
 	BadTimestamp string `json:"badTimestamp,omitempty"`
+	// StaleCountdown is the number of seconds before the bad replica is
+	// removed
+	StaleCountdown int `json:"staleCountdown,omitempty"`
+
+	Rebuild *types.RebuildInfo `json:"rebuild,omitempty"`
+	// RebuildElapsed is the number of seconds since the rebuild started
+	RebuildElapsed int `json:"rebuildElapsed,omitempty"`
 }
 
 type AttachInput struct {
@@ -96,6 +153,10 @@ type SnapshotInput struct {
 	Name string `json:"name,omitempty"`
 
 	Labels map[string]string `json:"labels,omitempty"`
+
+	// BackupTarget is the name of the target of snapshotBackup, the
+	// default one if empty
+	BackupTarget string `json:"backupTarget,omitempty"`
 }
 
 type BackupInput struct {
@@ -110,6 +171,26 @@ type ReplicaRemoveInput struct {
 	Name string `json:"name"`
 }
 
+type ExpandInput struct {
+	Size string `json:"size"`
+}
+
+type BackupRestoreInput struct {
+	Backup string `json:"backup"`
+}
+
+type EngineUpgradeInput struct {
+	Image string `json:"image"`
+}
+
+type UpdateLabelsInput struct {
+	Labels map[string]string `json:"labels"`
+}
+
+type UpdateReplicaCountInput struct {
+	ReplicaCount int `json:"replicaCount"`
+}
+
 func NewSchema() *client.Schemas {
 	schemas := &client.Schemas{}
 
@@ -124,11 +205,19 @@ func NewSchema() *client.Schemas {
 	schemas.AddType("recurringJob", types.RecurringJob{})
 	schemas.AddType("bgTask", BgTask{})
 	schemas.AddType("replicaRemoveInput", ReplicaRemoveInput{})
+	schemas.AddType("expandInput", ExpandInput{})
+	schemas.AddType("updateReplicaCountInput", UpdateReplicaCountInput{})
+	schemas.AddType("backupRestoreInput", BackupRestoreInput{})
+	schemas.AddType("engineUpgradeInput", EngineUpgradeInput{})
+	schemas.AddType("updateLabelsInput", UpdateLabelsInput{})
 
 	hostSchema(schemas.AddType("host", Host{}))
 	volumeSchema(schemas.AddType("volume", Volume{}))
 	backupVolumeSchema(schemas.AddType("backupVolume", BackupVolume{}))
 	settingSchema(schemas.AddType("setting", Setting{}))
+	backupTargetSchema(schemas.AddType("backupTarget", BackupTarget{}))
+	credentialSchema(schemas.AddType("credential", Credential{}))
+	backupTargetStatusSchema(schemas.AddType("backupTargetStatus", BackupTargetStatus{}))
 	recurringSchema(schemas.AddType("recurringInput", RecurringInput{}))
 
 	return schemas
@@ -140,6 +229,50 @@ func recurringSchema(recurring *client.Schema) {
 	recurring.ResourceFields["jobs"] = jobs
 }
 
+func backupTargetSchema(target *client.Schema) {
+	target.CollectionMethods = []string{"GET", "POST"}
+	target.ResourceMethods = []string{"GET", "PUT", "DELETE"}
+
+	targetName := target.ResourceFields["name"]
+	targetName.Required = true
+	targetName.Unique = true
+	targetName.Create = true
+	target.ResourceFields["name"] = targetName
+
+	targetURL := target.ResourceFields["url"]
+	targetURL.Required = true
+	targetURL.Create = true
+	targetURL.Update = true
+	target.ResourceFields["url"] = targetURL
+
+	targetCredential := target.ResourceFields["credential"]
+	targetCredential.Create = true
+	targetCredential.Update = true
+	target.ResourceFields["credential"] = targetCredential
+}
+
+func backupTargetStatusSchema(status *client.Schema) {
+	status.CollectionMethods = []string{"GET"}
+	status.ResourceMethods = []string{"GET"}
+}
+
+func credentialSchema(credential *client.Schema) {
+	credential.CollectionMethods = []string{"GET", "POST"}
+	credential.ResourceMethods = []string{"GET", "PUT", "DELETE"}
+
+	credentialName := credential.ResourceFields["name"]
+	credentialName.Required = true
+	credentialName.Unique = true
+	credentialName.Create = true
+	credential.ResourceFields["name"] = credentialName
+
+	credentialValues := credential.ResourceFields["values"]
+	credentialValues.Required = true
+	credentialValues.Create = true
+	credentialValues.Update = true
+	credential.ResourceFields["values"] = credentialValues
+}
+
 func settingSchema(setting *client.Schema) {
 	setting.CollectionMethods = []string{"GET"}
 	setting.ResourceMethods = []string{"GET", "PUT"}
@@ -157,7 +290,30 @@ func settingSchema(setting *client.Schema) {
 
 func hostSchema(host *client.Schema) {
 	host.CollectionMethods = []string{"GET"}
-	host.ResourceMethods = []string{"GET"}
+	host.ResourceMethods = []string{"GET", "PUT"}
+	host.ResourceActions = map[string]client.Action{
+		"updateLabels": {
+			Input:  "updateLabelsInput",
+			Output: "host",
+		},
+		"enableMaintenance": {
+			Output: "host",
+		},
+		"disableMaintenance": {
+			Output: "host",
+		},
+		"evict": {
+			Output: "host",
+		},
+	}
+
+	hostTags := host.ResourceFields["tags"]
+	hostTags.Update = true
+	host.ResourceFields["tags"] = hostTags
+
+	hostDiskTags := host.ResourceFields["diskTags"]
+	hostDiskTags.Update = true
+	host.ResourceFields["diskTags"] = hostDiskTags
 }
 
 func volumeSchema(volume *client.Schema) {
@@ -201,11 +357,36 @@ func volumeSchema(volume *client.Schema) {
 			Input:  "replicaRemoveInput",
 			Output: "volume",
 		},
+		"expand": {
+			Input:  "expandInput",
+			Output: "volume",
+		},
+		"updateReplicaCount": {
+			Input:  "updateReplicaCountInput",
+			Output: "volume",
+		},
+		"engineUpgrade": {
+			Input:  "engineUpgradeInput",
+			Output: "volume",
+		},
+		"backupRestore": {
+			Input:  "backupRestoreInput",
+			Output: "volume",
+		},
+	}
+	volume.CollectionActions = map[string]client.Action{
+		"engineUpgrade": {
+			Input: "engineUpgradeInput",
+		},
 	}
 	volume.ResourceFields["controller"] = client.Field{
 		Type:     "struct",
 		Nullable: true,
 	}
+	volume.ResourceFields["engineUpgrade"] = client.Field{
+		Type:     "struct",
+		Nullable: true,
+	}
 	volumeName := volume.ResourceFields["name"]
 	volumeName.Create = true
 	volumeName.Required = true
@@ -222,6 +403,14 @@ func volumeSchema(volume *client.Schema) {
 	volumeFromBackup.Create = true
 	volume.ResourceFields["fromBackup"] = volumeFromBackup
 
+	volumeFromVolume := volume.ResourceFields["fromVolume"]
+	volumeFromVolume.Create = true
+	volume.ResourceFields["fromVolume"] = volumeFromVolume
+
+	volumeFromSnapshot := volume.ResourceFields["fromSnapshot"]
+	volumeFromSnapshot.Create = true
+	volume.ResourceFields["fromSnapshot"] = volumeFromSnapshot
+
 	volumeNumberOfReplicas := volume.ResourceFields["numberOfReplicas"]
 	volumeNumberOfReplicas.Create = true
 	volumeNumberOfReplicas.Required = true
@@ -232,6 +421,22 @@ func volumeSchema(volume *client.Schema) {
 	volumeStaleReplicaTimeout.Create = true
 	volumeStaleReplicaTimeout.Default = 20
 	volume.ResourceFields["staleReplicaTimeout"] = volumeStaleReplicaTimeout
+
+	volumeReplicaSchedulePolicy := volume.ResourceFields["replicaSchedulePolicy"]
+	volumeReplicaSchedulePolicy.Create = true
+	volume.ResourceFields["replicaSchedulePolicy"] = volumeReplicaSchedulePolicy
+
+	volumeHostSelector := volume.ResourceFields["hostSelector"]
+	volumeHostSelector.Create = true
+	volume.ResourceFields["hostSelector"] = volumeHostSelector
+
+	volumeDiskSelector := volume.ResourceFields["diskSelector"]
+	volumeDiskSelector.Create = true
+	volume.ResourceFields["diskSelector"] = volumeDiskSelector
+
+	volumeFailoverPolicy := volume.ResourceFields["failoverPolicy"]
+	volumeFailoverPolicy.Create = true
+	volume.ResourceFields["failoverPolicy"] = volumeFailoverPolicy
 }
 
 func backupVolumeSchema(backupVolume *client.Schema) {
@@ -264,7 +469,10 @@ func toSettingResource(name, value string) *Setting {
 func toSettingCollection(settings *types.SettingsInfo) *client.GenericCollection {
 	data := []interface{}{
 		toSettingResource("backupTarget", settings.BackupTarget),
+		toSettingResource("backupTargetCredential", settings.BackupTargetCredential),
 		toSettingResource("engineImage", settings.EngineImage),
+		toSettingResource("replicaSchedulePolicy", string(settings.ReplicaSchedulePolicy)),
+		toSettingResource("storageOverProvisioningPercentage", strconv.Itoa(settings.StorageOverProvisioningPercentage)),
 	}
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "setting"}}
 }
@@ -277,8 +485,12 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 			mode = string(r.Mode)
 		}
 		badTimestamp := ""
+		staleCountdown := 0
 		if !r.BadTimestamp.IsZero() {
 			badTimestamp = util.FormatTimeZ(r.BadTimestamp)
+			if remaining := r.StaleDeadline.Sub(time.Now()); remaining > 0 {
+				staleCountdown = int(remaining / time.Second)
+			}
 		}
 		replicas = append(replicas, Replica{
 			Instance: Instance{
@@ -286,9 +498,12 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 				Address: r.Address,
 				HostID:  r.HostID,
 			},
-			Name:         r.Name,
-			Mode:         mode,
-			BadTimestamp: badTimestamp,
+			Name:           r.Name,
+			Mode:           mode,
+			BadTimestamp:   badTimestamp,
+			StaleCountdown: staleCountdown,
+			Rebuild:        r.Rebuild,
+			RebuildElapsed: rebuildElapsed(r.Rebuild),
 		})
 	}
 
@@ -310,17 +525,27 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 			Actions: map[string]string{},
 			Links:   map[string]string{},
 		},
-		Name:                v.Name,
-		Size:                strconv.FormatInt(v.Size, 10),
-		BaseImage:           v.BaseImage,
-		FromBackup:          v.FromBackup,
-		NumberOfReplicas:    v.NumberOfReplicas,
-		State:               string(v.State),
-		EngineImage:         v.EngineImage,
-		RecurringJobs:       v.RecurringJobs,
-		StaleReplicaTimeout: int(v.StaleReplicaTimeout / time.Minute),
-		Endpoint:            v.Endpoint,
-		Created:             v.Created,
+		Name:                  v.Name,
+		Size:                  strconv.FormatInt(v.Size, 10),
+		BaseImage:             v.BaseImage,
+		FromBackup:            v.FromBackup,
+		FromVolume:            v.FromVolume,
+		FromSnapshot:          v.FromSnapshot,
+		NumberOfReplicas:      v.NumberOfReplicas,
+		State:                 string(v.State),
+		EngineImage:           v.EngineImage,
+		RecurringJobs:         v.RecurringJobs,
+		EngineUpgrade:         v.EngineUpgrade,
+		Lease:                 v.Lease,
+		Failover:              v.Failover,
+		Restore:               v.Restore,
+		StaleReplicaTimeout:   int(v.StaleReplicaTimeout / time.Minute),
+		ReplicaSchedulePolicy: string(v.ReplicaSchedulePolicy),
+		HostSelector:          v.HostSelector,
+		DiskSelector:          v.DiskSelector,
+		FailoverPolicy:        string(v.FailoverPolicy),
+		Endpoint:              v.Endpoint,
+		Created:               v.Created,
 
 		Controller: controller,
 		Replicas:   replicas,
@@ -333,6 +558,7 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 		actions["attach"] = struct{}{}
 		actions["recurringUpdate"] = struct{}{}
 		actions["replicaRemove"] = struct{}{}
+		actions["backupRestore"] = struct{}{}
 	case types.VolumeStateHealthy:
 		actions["detach"] = struct{}{}
 		actions["snapshotPurge"] = struct{}{}
@@ -360,6 +586,12 @@ func toVolumeResource(v *types.VolumeInfo, apiContext *api.ApiContext) *Volume {
 	case types.VolumeStateCreated:
 		actions["recurringUpdate"] = struct{}{}
 	case types.VolumeStateFaulted:
+		// the failed restore can be tried again
+		if v.Restore != nil && v.Restore.State == types.RestoreStateFailed && v.Controller == nil {
+			actions["backupRestore"] = struct{}{}
+		}
+	case types.VolumeStateRestoring:
+		// the restore attaches and detaches the volume by itself
 	}
 
 	for action := range actions {
@@ -393,6 +625,44 @@ func toBgTaskRes(bt *types.BgTask) *BgTask {
 	}
 }
 
+func rebuildElapsed(rebuild *types.RebuildInfo) int {
+	if rebuild == nil {
+		return 0
+	}
+	started, err := time.Parse(time.RFC3339, rebuild.Started)
+	if err != nil {
+		return 0
+	}
+	return int(time.Since(started) / time.Second)
+}
+
+// toRebuildBgTasks shows the replicas being rebuilt as background tasks
+func toRebuildBgTasks(v *types.VolumeInfo) []interface{} {
+	data := []interface{}{}
+	for _, r := range v.Replicas {
+		if r.Rebuild == nil {
+			continue
+		}
+		data = append(data, &BgTask{
+			Resource: client.Resource{
+				Id:   "rebuild-" + r.Name,
+				Type: "bgTask",
+			},
+			BgTask: types.BgTask{
+				Started:   r.Rebuild.Started,
+				Submitted: r.Rebuild.Started,
+				Task: &types.RebuildBgTask{
+					Replica:     r.Name,
+					Address:     r.Address,
+					Elapsed:     rebuildElapsed(r.Rebuild),
+					RebuildInfo: *r.Rebuild,
+				},
+			},
+		})
+	}
+	return data
+}
+
 func toBgTaskCollection(bts []*types.BgTask) *client.GenericCollection {
 	data := []interface{}{}
 	for _, v := range bts {
@@ -409,16 +679,16 @@ func toSnapshotCollection(ss []*types.SnapshotInfo) *client.GenericCollection {
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "snapshot"}}
 }
 
-func toHostCollection(hosts map[string]*types.HostInfo) *client.GenericCollection {
+func toHostCollection(hosts map[string]*types.HostInfo, apiContext *api.ApiContext) *client.GenericCollection {
 	data := []interface{}{}
 	for _, v := range hosts {
-		data = append(data, toHostResource(v))
+		data = append(data, toHostResource(v, apiContext))
 	}
 	return &client.GenericCollection{Data: data}
 }
 
-func toHostResource(h *types.HostInfo) *Host {
-	return &Host{
+func toHostResource(h *types.HostInfo, apiContext *api.ApiContext) *Host {
+	host := &Host{
 		Resource: client.Resource{
 			Id:      h.UUID,
 			Type:    "host",
@@ -427,10 +697,31 @@ func toHostResource(h *types.HostInfo) *Host {
 		UUID:    h.UUID,
 		Name:    h.Name,
 		Address: h.Address,
+		Labels:  h.Labels,
+		Storage: h.Storage,
+
+		Tags:     h.Tags,
+		DiskTags: h.DiskTags,
+
+		Maintenance: h.Maintenance,
+		Eviction:    h.Eviction,
+
+		Status:   h.Status,
+		LastSeen: h.LastSeen,
+	}
+	actions := []string{"updateLabels"}
+	if h.Maintenance {
+		actions = append(actions, "disableMaintenance", "evict")
+	} else {
+		actions = append(actions, "enableMaintenance")
 	}
+	for _, action := range actions {
+		host.Actions[action] = apiContext.UrlBuilder.ActionLink(host.Resource, action)
+	}
+	return host
 }
 
-func toBackupVolumeResource(bv *types.BackupVolumeInfo, apiContext *api.ApiContext) *BackupVolume {
+func toBackupVolumeResource(bv *types.BackupVolumeInfo, backupTarget string, apiContext *api.ApiContext) *BackupVolume {
 	if bv == nil {
 		logrus.Warnf("weird: nil backupVolume")
 		return nil
@@ -442,19 +733,23 @@ func toBackupVolumeResource(bv *types.BackupVolumeInfo, apiContext *api.ApiConte
 			Links: map[string]string{},
 		},
 		BackupVolumeInfo: *bv,
+		BackupTarget:     backupTarget,
 	}
-	b.Actions = map[string]string{
-		"backupList":   apiContext.UrlBuilder.ActionLink(b.Resource, "backupList"),
-		"backupGet":    apiContext.UrlBuilder.ActionLink(b.Resource, "backupGet"),
-		"backupDelete": apiContext.UrlBuilder.ActionLink(b.Resource, "backupDelete"),
+	b.Actions = map[string]string{}
+	for _, action := range []string{"backupList", "backupGet", "backupDelete"} {
+		link := apiContext.UrlBuilder.ActionLink(b.Resource, action)
+		if backupTarget != types.DefaultBackupTargetName {
+			link += "&backupTarget=" + url.QueryEscape(backupTarget)
+		}
+		b.Actions[action] = link
 	}
 	return b
 }
 
-func toBackupVolumeCollection(bv []*types.BackupVolumeInfo, apiContext *api.ApiContext) *client.GenericCollection {
+func toBackupVolumeCollection(bv []*types.BackupVolumeInfo, backupTarget string, apiContext *api.ApiContext) *client.GenericCollection {
 	data := []interface{}{}
 	for _, v := range bv {
-		data = append(data, toBackupVolumeResource(v, apiContext))
+		data = append(data, toBackupVolumeResource(v, backupTarget, apiContext))
 	}
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "backupVolume"}}
 }
@@ -482,14 +777,83 @@ func toBackupCollection(bs []*types.BackupInfo) *client.GenericCollection {
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "backup"}}
 }
 
+func toBackupTargetResource(target *types.BackupTarget) *BackupTarget {
+	return &BackupTarget{
+		Resource: client.Resource{
+			Id:   target.Name,
+			Type: "backupTarget",
+		},
+		Name:       target.Name,
+		URL:        target.URL,
+		Credential: target.Credential,
+	}
+}
+
+func toBackupTargetCollection(targets []*types.BackupTarget) *client.GenericCollection {
+	data := []interface{}{}
+	for _, target := range targets {
+		data = append(data, toBackupTargetResource(target))
+	}
+	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "backupTarget"}}
+}
+
+func toBackupTargetStatusResource(status *types.BackupTargetStatus) *BackupTargetStatus {
+	return &BackupTargetStatus{
+		Resource: client.Resource{
+			Id:   status.Name,
+			Type: "backupTargetStatus",
+		},
+		BackupTargetStatus: *status,
+	}
+}
+
+func toBackupTargetStatusCollection(statuses []*types.BackupTargetStatus) *client.GenericCollection {
+	data := []interface{}{}
+	for _, status := range statuses {
+		data = append(data, toBackupTargetStatusResource(status))
+	}
+	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "backupTargetStatus"}}
+}
+
+func toCredentialResource(credential *types.CredentialInfo) *Credential {
+	keys := []string{}
+	for key := range credential.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return &Credential{
+		Resource: client.Resource{
+			Id:   credential.Name,
+			Type: "credential",
+		},
+		Name: credential.Name,
+		Keys: keys,
+	}
+}
+
+func toCredentialCollection(credentials map[string]*types.CredentialInfo) *client.GenericCollection {
+	names := []string{}
+	for name := range credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data := []interface{}{}
+	for _, name := range names {
+		data = append(data, toCredentialResource(credentials[name]))
+	}
+	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "credential"}}
+}
+
 type Server struct {
-	man       types.VolumeManager
-	sl        types.ServiceLocator
-	proxy     http.Handler
-	fwd       *Fwd
-	snapshots *SnapshotHandlers
-	settings  *SettingsHandlers
-	backups   *BackupsHandlers
+	man         types.VolumeManager
+	sl          types.ServiceLocator
+	proxy       http.Handler
+	fwd         *Fwd
+	snapshots   *SnapshotHandlers
+	settings    *SettingsHandlers
+	backups     *BackupsHandlers
+	targets     *BackupTargetsHandlers
+	credentials *CredentialsHandlers
 }
 
 func NewServer(m types.VolumeManager, sl types.ServiceLocator, proxy http.Handler) *Server {
@@ -503,9 +867,16 @@ func NewServer(m types.VolumeManager, sl types.ServiceLocator, proxy http.Handle
 		},
 		settings: &SettingsHandlers{
 			m.Settings(),
+			m,
 		},
 		backups: &BackupsHandlers{
 			m,
 		},
+		targets: &BackupTargetsHandlers{
+			m,
+		},
+		credentials: &CredentialsHandlers{
+			m,
+		},
 	}
 }
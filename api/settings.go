@@ -2,16 +2,19 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
 
+	"github.com/rancher/longhorn-manager/orch"
 	"github.com/rancher/longhorn-manager/types"
 )
 
 type SettingsHandlers struct {
 	settings types.Settings
+	man      types.VolumeManager
 }
 
 func (s *SettingsHandlers) List(w http.ResponseWriter, req *http.Request) error {
@@ -37,8 +40,14 @@ func (s *SettingsHandlers) Get(w http.ResponseWriter, req *http.Request) error {
 	switch name {
 	case "backupTarget":
 		value = si.BackupTarget
+	case "backupTargetCredential":
+		value = si.BackupTargetCredential
 	case "engineImage":
 		value = si.EngineImage
+	case "replicaSchedulePolicy":
+		value = string(si.ReplicaSchedulePolicy)
+	case "storageOverProvisioningPercentage":
+		value = strconv.Itoa(si.StorageOverProvisioningPercentage)
 	default:
 		return errors.Errorf("invalid setting name %v", name)
 	}
@@ -63,9 +72,38 @@ func (s *SettingsHandlers) Set(w http.ResponseWriter, req *http.Request) error {
 
 	switch name {
 	case "backupTarget":
+		// the backup target can be unset, but not set to one that
+		// doesn't work
+		if setting.Value != "" {
+			target := &types.BackupTarget{
+				Name:       types.DefaultBackupTargetName,
+				URL:        setting.Value,
+				Credential: si.BackupTargetCredential,
+			}
+			if err := s.man.CheckBackupTarget(target); err != nil {
+				return errors.Wrap(err, "fail to set backupTarget")
+			}
+		}
 		si.BackupTarget = setting.Value
+	case "backupTargetCredential":
+		if err := checkCredential(s.man.Credentials(), setting.Value); err != nil {
+			return err
+		}
+		si.BackupTargetCredential = setting.Value
 	case "engineImage":
 		si.EngineImage = setting.Value
+	case "replicaSchedulePolicy":
+		binding := types.SchedulePolicyBinding(setting.Value)
+		if err := orch.ValidateSchedulePolicyBinding(binding); err != nil {
+			return err
+		}
+		si.ReplicaSchedulePolicy = binding
+	case "storageOverProvisioningPercentage":
+		percentage, err := strconv.Atoi(setting.Value)
+		if err != nil || percentage < 0 {
+			return errors.Errorf("invalid storage over-provisioning percentage '%s'", setting.Value)
+		}
+		si.StorageOverProvisioningPercentage = percentage
 	default:
 		return errors.Wrapf(err, "invalid setting name %v", name)
 	}
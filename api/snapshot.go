@@ -205,9 +205,14 @@ func (sh *SnapshotHandlers) Backup(w http.ResponseWriter, req *http.Request) err
 	if err != nil || settings == nil {
 		return errors.New("cannot backup: unable to read settings")
 	}
-	backupTarget := settings.BackupTarget
-	if backupTarget == "" {
-		return errors.New("cannot backup: backupTarget not set")
+	target, err := settings.GetBackupTarget(input.BackupTarget)
+	if err != nil {
+		return errors.Wrap(err, "cannot backup")
+	}
+	backupTarget := target.URL
+	env, err := sh.man.BackupTargetEnv(target)
+	if err != nil {
+		return errors.Wrap(err, "cannot backup")
 	}
 
 	backups, err := sh.man.VolumeBackupOps(volName)
@@ -215,7 +220,7 @@ func (sh *SnapshotHandlers) Backup(w http.ResponseWriter, req *http.Request) err
 		return errors.Wrapf(err, "error getting VolumeBackupOps for volume '%s'", volName)
 	}
 
-	if err := backups.StartBackup(input.Name, backupTarget); err != nil {
+	if err := backups.StartBackup(input.Name, backupTarget, env); err != nil {
 		return errors.Wrapf(err, "error creating backup: snapshot '%s', volume '%s', dest '%s'", input.Name, volName, backupTarget)
 	}
 	logrus.Debugf("success: started backup: snapshot '%s', volume '%s', dest '%s'", input.Name, volName, backupTarget)
@@ -84,7 +84,17 @@ func (s *Server) BgTaskQueue(rw http.ResponseWriter, req *http.Request) error {
 		return errors.Wrapf(err, "unable to get VolumeBackupOps for volume '%s'", name)
 	}
 
-	apiContext.Write(toBgTaskCollection(append(controller.LatestBgTasks(), controller.BgTaskQueue().List()...)))
+	volume, err := s.man.Get(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get volume '%s'", name)
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s'", name)
+	}
+
+	resp := toBgTaskCollection(append(controller.LatestBgTasks(), controller.BgTaskQueue().List()...))
+	resp.Data = append(resp.Data, toRebuildBgTasks(volume)...)
+	apiContext.Write(resp)
 	return nil
 }
 
@@ -125,18 +135,41 @@ func filterCreateVolumeInput(v *Volume) (*types.VolumeInfo, error) {
 		return nil, errors.Wrapf(err, "error converting size '%s'", v.Size)
 	}
 	return &types.VolumeInfo{
-		Name:                v.Name,
-		Size:                util.RoundUpSize(size),
-		BaseImage:           v.BaseImage,
-		FromBackup:          v.FromBackup,
-		NumberOfReplicas:    v.NumberOfReplicas,
-		StaleReplicaTimeout: time.Duration(v.StaleReplicaTimeout) * time.Minute,
+		Name:                  v.Name,
+		Size:                  util.RoundUpSize(size),
+		BaseImage:             v.BaseImage,
+		FromBackup:            v.FromBackup,
+		FromVolume:            v.FromVolume,
+		FromSnapshot:          v.FromSnapshot,
+		NumberOfReplicas:      v.NumberOfReplicas,
+		StaleReplicaTimeout:   time.Duration(v.StaleReplicaTimeout) * time.Minute,
+		ReplicaSchedulePolicy: types.SchedulePolicyBinding(v.ReplicaSchedulePolicy),
+		HostSelector:          v.HostSelector,
+		DiskSelector:          v.DiskSelector,
+		FailoverPolicy:        types.FailoverPolicy(v.FailoverPolicy),
 	}, nil
 }
 
+// checkNotRestoring refuses to attach or detach the volume being restored,
+// which is left to the restore
+func (s *Server) checkNotRestoring(name string) error {
+	volume, err := s.man.Get(name)
+	if err != nil {
+		return errors.Wrap(err, "unable to get volume")
+	}
+	if volume != nil && volume.State == types.VolumeStateRestoring {
+		return errors.Errorf("volume '%s' is being restored", name)
+	}
+	return nil
+}
+
 func (s *Server) AttachVolume(rw http.ResponseWriter, req *http.Request) error {
 	id := mux.Vars(req)["name"]
 
+	if err := s.checkNotRestoring(id); err != nil {
+		return errors.Wrap(err, "unable to attach volume")
+	}
+
 	if err := s.man.Attach(id); err != nil {
 		return errors.Wrap(err, "unable to attach volume")
 	}
@@ -147,6 +180,10 @@ func (s *Server) AttachVolume(rw http.ResponseWriter, req *http.Request) error {
 func (s *Server) DetachVolume(rw http.ResponseWriter, req *http.Request) error {
 	id := mux.Vars(req)["name"]
 
+	if err := s.checkNotRestoring(id); err != nil {
+		return errors.Wrap(err, "unable to detach volume")
+	}
+
 	if err := s.man.Detach(id); err != nil {
 		return errors.Wrap(err, "unable to detach volume")
 	}
@@ -170,3 +207,102 @@ func (s *Server) ReplicaRemove(rw http.ResponseWriter, req *http.Request) error
 
 	return s.GetVolume(rw, req)
 }
+
+func (s *Server) ExpandVolume(rw http.ResponseWriter, req *http.Request) error {
+	var input ExpandInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read expandInput")
+	}
+
+	if input.Size == "" {
+		return errors.Errorf("size required")
+	}
+	size, err := util.ConvertSize(input.Size)
+	if err != nil {
+		return errors.Wrapf(err, "error converting size '%s'", input.Size)
+	}
+
+	id := mux.Vars(req)["name"]
+
+	if err := s.man.Expand(id, util.RoundUpSize(size)); err != nil {
+		return errors.Wrap(err, "unable to expand volume")
+	}
+
+	return s.GetVolume(rw, req)
+}
+
+func (s *Server) RestoreBackup(rw http.ResponseWriter, req *http.Request) error {
+	var input BackupRestoreInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read backupRestoreInput")
+	}
+
+	if input.Backup == "" {
+		return errors.Errorf("backup required")
+	}
+
+	id := mux.Vars(req)["name"]
+
+	if err := s.man.RestoreBackup(id, input.Backup); err != nil {
+		return errors.Wrap(err, "unable to restore backup")
+	}
+
+	return s.GetVolume(rw, req)
+}
+
+func (s *Server) UpdateReplicaCount(rw http.ResponseWriter, req *http.Request) error {
+	var input UpdateReplicaCountInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read updateReplicaCountInput")
+	}
+
+	id := mux.Vars(req)["name"]
+
+	if err := s.man.UpdateReplicaCount(id, input.ReplicaCount); err != nil {
+		return errors.Wrap(err, "unable to update replica count")
+	}
+
+	return s.GetVolume(rw, req)
+}
+
+// EngineUpgrade starts moving the volume to the engine image, the replicas
+// are replaced one at a time and the progress is shown in engineUpgrade
+func (s *Server) EngineUpgrade(rw http.ResponseWriter, req *http.Request) error {
+	var input EngineUpgradeInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read engineUpgradeInput")
+	}
+
+	id := mux.Vars(req)["name"]
+
+	if err := s.man.EngineUpgrade(id, input.Image); err != nil {
+		return errors.Wrap(err, "unable to upgrade engine")
+	}
+
+	return s.GetVolume(rw, req)
+}
+
+// EngineUpgradeDetached starts upgrading all the detached volumes, the
+// attached ones are upgraded one by one on their hosts
+func (s *Server) EngineUpgradeDetached(rw http.ResponseWriter, req *http.Request) error {
+	var input EngineUpgradeInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read engineUpgradeInput")
+	}
+
+	if err := s.man.EngineUpgradeDetached(input.Image); err != nil {
+		return errors.Wrap(err, "unable to upgrade engine of detached volumes")
+	}
+
+	return s.ListVolume(rw, req)
+}
@@ -8,12 +8,13 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rancher/longhorn-manager/types"
 	"io"
-	"os/exec"
 	"strings"
 )
 
 type backups struct {
 	BackupTarget string
+
+	engine types.EngineCLI
 }
 
 type backupVolume struct {
@@ -25,8 +26,17 @@ type backupVolume struct {
 	Backups        map[string]interface{}
 }
 
-func New(backupTarget string) types.ManagerBackupOps {
-	return &backups{backupTarget}
+// New returns the GetManagerBackupOps running the longhorn engine backup
+// commands with cli, which could be a fake for testing. The commands of a
+// target run with env for the credential of the target.
+func New(cli types.EngineCLI) types.GetManagerBackupOps {
+	return func(backupTarget string, env []string) types.ManagerBackupOps {
+		return &backups{BackupTarget: backupTarget, engine: cli.WithEnv(env)}
+	}
+}
+
+func isNotFound(output string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(output)), "cannot find ")
 }
 
 func parseBackup(v interface{}) (*types.BackupInfo, error) {
@@ -100,40 +110,38 @@ func parseOneBackup(stdout io.Reader) (*types.BackupInfo, error) {
 }
 
 func (b *backups) ListVolumes() ([]*types.BackupVolumeInfo, error) {
-	cmd := exec.Command("longhorn", "backup", "ls", "--volume-only", b.BackupTarget)
-	stdout, err := cmd.StdoutPipe()
+	output, err := b.engine.Execute("backup", "ls", "--volume-only", b.BackupTarget)
+	if err != nil && !isNotFound(output) {
+		return nil, errors.Wrapf(err, "error listing backup volumes")
+	}
+	return parseBackupVolumesList(strings.NewReader(output))
+}
+
+// Check lists the volumes in the backup target, unlike ListVolumes any
+// failure counts, including "cannot find"
+func (b *backups) Check() error {
+	output, err := b.engine.Execute("backup", "ls", "--volume-only", b.BackupTarget)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error getting stdout from cmd '%v'", cmd)
+		return errors.Wrapf(err, "cannot reach backup target, output: %s", strings.TrimSpace(output))
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Wrapf(err, "error starting cmd '%v'", cmd)
+	if _, err := parseBackupVolumesList(strings.NewReader(output)); err != nil {
+		return errors.Wrap(err, "cannot reach backup target")
 	}
-	defer func() {
-		if err := cmd.Wait(); err != nil {
-			logrus.Errorf("%+v", errors.Wrapf(err, "error waiting for cmd '%v'", cmd))
-		}
-	}()
-	return parseBackupVolumesList(stdout)
+	return nil
 }
 
 func (b *backups) GetVolume(volumeName string) (*types.BackupVolumeInfo, error) {
-	cmd := exec.Command("longhorn", "backup", "ls", "--volume", volumeName, "--volume-only", b.BackupTarget)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, errors.Wrapf(err, "error getting stdout from cmd '%v'", cmd)
+	output, err := b.engine.Execute("backup", "ls", "--volume", volumeName, "--volume-only", b.BackupTarget)
+	if err != nil && !isNotFound(output) {
+		return nil, errors.Wrapf(err, "error getting backup volume '%s'", volumeName)
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Wrapf(err, "error starting cmd '%v'", cmd)
-	}
-	defer func() {
-		if err := cmd.Wait(); err != nil {
-			logrus.Errorf("%+v", errors.Wrapf(err, "error waiting for cmd '%v'", cmd))
-		}
-	}()
-	list, err := parseBackupVolumesList(stdout)
+	list, err := parseBackupVolumesList(strings.NewReader(output))
 	if err != nil {
 		return nil, err
 	}
+	if len(list) == 0 {
+		return nil, nil
+	}
 	return list[0], nil
 }
 
@@ -141,51 +149,29 @@ func (b *backups) List(volumeName string) ([]*types.BackupInfo, error) {
 	if volumeName == "" {
 		return nil, nil
 	}
-	cmd := exec.Command("longhorn", "backup", "ls", "--volume", volumeName, b.BackupTarget)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, errors.Wrapf(err, "error getting stdout from cmd '%v'", cmd)
-	}
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Wrapf(err, "error starting cmd '%v'", cmd)
+	output, err := b.engine.Execute("backup", "ls", "--volume", volumeName, b.BackupTarget)
+	if err != nil && !isNotFound(output) {
+		return nil, errors.Wrapf(err, "error listing backups of volume '%s'", volumeName)
 	}
-	defer func() {
-		if err := cmd.Wait(); err != nil {
-			logrus.Errorf("%+v", errors.Wrapf(err, "error waiting for cmd '%v'", cmd))
-		}
-	}()
-	return parseBackupsList(stdout, volumeName)
+	return parseBackupsList(strings.NewReader(output), volumeName)
 }
 
 func (b *backups) Get(url string) (*types.BackupInfo, error) {
-	cmd := exec.Command("longhorn", "backup", "inspect", url)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, errors.Wrapf(err, "error getting stdout from cmd '%v'", cmd)
+	output, err := b.engine.Execute("backup", "inspect", url)
+	if err != nil && !isNotFound(output) {
+		return nil, errors.Wrapf(err, "error getting backup '%s'", url)
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Wrapf(err, "error starting cmd '%v'", cmd)
-	}
-	defer func() {
-		if err := cmd.Wait(); err != nil {
-			logrus.Errorf("%+v", errors.Wrapf(err, "error waiting for cmd '%v'", cmd))
-		}
-	}()
-	return parseOneBackup(stdout)
+	return parseOneBackup(strings.NewReader(output))
 }
 
 func (b *backups) Delete(url string) error {
-	cmd := exec.Command("longhorn", "backup", "rm", url)
-	errBuff := new(bytes.Buffer)
-	cmd.Stderr = errBuff
-	out, err := cmd.Output()
+	output, err := b.engine.Execute("backup", "rm", url)
 	if err != nil {
-		s := string(out)
-		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(s)), "cannot find ") {
+		if isNotFound(output) {
 			logrus.Warnf("delete: could not find the backup: '%s'", url)
 			return nil
 		}
-		return errors.Wrapf(err, "Error deleting backup: %s", errBuff)
+		return errors.Wrapf(err, "Error deleting backup")
 	}
 	return nil
 }
@@ -2,6 +2,8 @@ package backups
 
 import (
 	"bytes"
+	"github.com/pkg/errors"
+	"github.com/rancher/longhorn-manager/engine"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -103,3 +105,74 @@ func TestParseBackupsList2(t *testing.T) {
 	assert.Nil(err)
 	assert.Nil(bs)
 }
+
+func TestBackupOps(t *testing.T) {
+	assert := require.New(t)
+
+	target := "vfs:///var/lib/longhorn/backups/default"
+	fake := engine.NewFake()
+	fake.LaunchController("10.42.0.1", "qq", 1024, []string{"tcp://10.42.0.2:9502"})
+	ctrlURL := "http://10.42.0.1:9501"
+	for _, snap := range []string{"snap1", "snap2"} {
+		_, err := fake.Execute("--url", ctrlURL, "snapshot", "create", snap)
+		assert.Nil(err)
+		_, err = fake.Execute("--url", ctrlURL, "backup", "create", "--dest", target, snap)
+		assert.Nil(err)
+	}
+	b := &backups{BackupTarget: target, engine: fake}
+
+	volumes, err := b.ListVolumes()
+	assert.Nil(err)
+	assert.Equal([]*types.BackupVolumeInfo{{Name: "qq", Size: "1024", Created: volumes[0].Created}}, volumes)
+
+	volume, err := b.GetVolume("qq")
+	assert.Nil(err)
+	assert.Equal("qq", volume.Name)
+	volume, err = b.GetVolume("nonexistent")
+	assert.Nil(err)
+	assert.Nil(volume)
+
+	bs, err := b.List("qq")
+	assert.Nil(err)
+	assert.Len(bs, 2)
+	bs, err = b.List("nonexistent")
+	assert.Nil(err)
+	assert.Len(bs, 0)
+
+	urls := fake.BackupURLs(target, "qq")
+	backup, err := b.Get(urls[0])
+	assert.Nil(err)
+	assert.Equal("snap1", backup.SnapshotName)
+	assert.Equal("qq", backup.VolumeName)
+
+	assert.Nil(b.Delete(urls[0]))
+	assert.Nil(b.Delete(urls[0]))
+	backup, err = b.Get(urls[0])
+	assert.Nil(err)
+	assert.Nil(backup)
+	assert.Len(fake.BackupURLs(target, "qq"), 1)
+	assert.Nil(b.Check())
+
+	fake.Inject(&engine.Injection{
+		Args:   []string{"backup", "ls"},
+		Output: "permission denied",
+		Err:    errors.New("exit status 1"),
+	})
+	_, err = b.ListVolumes()
+	assert.NotNil(err)
+	_, err = b.List("qq")
+	assert.NotNil(err)
+	assert.NotNil(b.Check())
+
+	// a missing backupstore is empty for ListVolumes, but not reachable
+	fake.ClearInjections()
+	fake.Inject(&engine.Injection{
+		Args:   []string{"backup", "ls"},
+		Output: "cannot find backupstore\n",
+		Err:    errors.New("exit status 1"),
+	})
+	volumes, err = b.ListVolumes()
+	assert.Nil(err)
+	assert.Len(volumes, 0)
+	assert.NotNil(b.Check())
+}
@@ -1,16 +1,17 @@
 package controller
 
 import (
+	"strings"
+
 	"github.com/pkg/errors"
 	"github.com/rancher/longhorn-manager/types"
-	"github.com/rancher/longhorn-manager/util"
 )
 
 func (c *controller) BackupOps() types.VolumeBackupOps {
 	return c
 }
 
-func (c *controller) StartBackup(snapName, backupTarget string) error {
+func (c *controller) StartBackup(snapName, backupTarget string, env []string) error {
 	snap, err := c.Get(snapName)
 	if err != nil {
 		return errors.Wrapf(err, "error getting snapshot '%s', volume '%s'", snapName, c.name)
@@ -18,19 +19,27 @@ func (c *controller) StartBackup(snapName, backupTarget string) error {
 	if snap == nil {
 		return errors.Errorf("could not find snapshot '%s' to backup, volume '%s'", snapName, c.name)
 	}
-	c.bgTaskQueue.Put(&types.BgTask{Task: &types.BackupBgTask{Snapshot: snapName, BackupTarget: backupTarget}})
+	c.bgTaskQueue.Put(&types.BgTask{Task: &types.BackupBgTask{Snapshot: snapName, BackupTarget: backupTarget, Env: env}})
 	return nil
 }
 
-func (c *controller) Restore(backup string) error {
-	if _, err := util.Execute("longhorn", "--url", c.url, "backup", "restore", backup); err != nil {
+func (c *controller) Backup(snapName, backupTarget string, env []string) (string, error) {
+	output, err := c.engine.WithEnv(env).ExecuteWithTimeout(backupTimeout, "--url", c.url, "backup", "create", "--dest", backupTarget, snapName)
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating backup for snapshot '%s', backupTarget '%s'", snapName, backupTarget)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+func (c *controller) Restore(backup string, env []string) error {
+	if _, err := c.engine.WithEnv(env).ExecuteWithTimeout(restoreTimeout, "--url", c.url, "backup", "restore", backup); err != nil {
 		return errors.Wrapf(err, "error restoring backup '%s'", backup)
 	}
 	return nil
 }
 
-func (c *controller) DeleteBackup(backup string) error {
-	if _, err := util.Execute("longhorn", "--url", c.url, "backup", "rm", backup); err != nil {
+func (c *controller) DeleteBackup(backup string, env []string) error {
+	if _, err := c.engine.WithEnv(env).Execute("--url", c.url, "backup", "rm", backup); err != nil {
 		return errors.Wrapf(err, "error deleting backup '%s'", backup)
 	}
 	return nil
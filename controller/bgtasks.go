@@ -1,15 +1,20 @@
 package controller
 
 import (
-	"bytes"
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
-	"os/exec"
 	"time"
 )
 
+const (
+	backupTimeout  = 24 * time.Hour
+	restoreTimeout = 24 * time.Hour
+)
+
+// LatestBgTasks returns copies of the last task run and the running one, the
+// tasks are updated by the goroutine running them
 func (c *controller) LatestBgTasks() []*types.BgTask {
 	c.bgTaskLock.Lock()
 	defer c.bgTaskLock.Unlock()
@@ -17,10 +22,12 @@ func (c *controller) LatestBgTasks() []*types.BgTask {
 	r := []*types.BgTask{}
 
 	if c.lastRunBgTask != nil {
-		r = append(r, c.lastRunBgTask)
+		t := *c.lastRunBgTask
+		r = append(r, &t)
 	}
 	if c.runningBgTask != nil {
-		r = append(r, c.runningBgTask)
+		t := *c.runningBgTask
+		r = append(r, &t)
 	}
 
 	return r
@@ -41,12 +48,11 @@ func (c *controller) runBgTasks() {
 }
 
 func (c *controller) runTask(t *types.BgTask) {
-	t.Started = util.FormatTimeZ(time.Now())
-
 	func() {
 		c.bgTaskLock.Lock()
 		defer c.bgTaskLock.Unlock()
 
+		t.Started = util.FormatTimeZ(time.Now())
 		c.runningBgTask = t
 	}()
 	var err error
@@ -80,15 +86,9 @@ func (c *controller) runBackup(t *types.BackupBgTask) error {
 		}()
 	}
 
-	var stdout, stderr bytes.Buffer
-	cmd := exec.Command("longhorn", "--url", c.url, "backup", "create", "--dest", t.BackupTarget, t.Snapshot)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-
-	if err == nil {
-		logrus.Infof("completed backup: volume '%s', snapshot '%s', backupTarget '%s'", c.name, t.Snapshot, t.BackupTarget)
+	if _, err := c.Backup(t.Snapshot, t.BackupTarget, t.Env); err != nil {
+		return err
 	}
-	return errors.Wrapf(err, "error creating backup for snapshot '%s', backupTarget '%s': %s", t.Snapshot, t.BackupTarget, &stderr)
+	logrus.Infof("completed backup: volume '%s', snapshot '%s', backupTarget '%s'", c.name, t.Snapshot, t.BackupTarget)
+	return nil
 }
@@ -2,22 +2,17 @@ package controller
 
 import (
 	"encoding/json"
-	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
+	"github.com/rancher/longhorn-manager/engine"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 )
 
-func init() {
-	go holdControllers()
-}
-
-var reqCh = make(chan *req)
-
 type req struct {
 	volume *types.VolumeInfo
 	result chan *controller
@@ -40,10 +35,37 @@ func getIPFromURL(url string) string {
 	return strings.TrimPrefix(strings.Split(url, ":")[1], "//")
 }
 
-func holdControllers() {
+// Controllers keeps a controller for every attached volume, running the
+// engine commands with the engine it's created with
+type Controllers struct {
+	engine types.EngineCLI
+	// useEngineAPI makes the controllers talk to the engine REST API where
+	// possible, instead of running the CLI for every operation
+	useEngineAPI bool
+	// newReplicaAPI connects to the replicas to follow their rebuilds
+	newReplicaAPI func(address string) engine.ReplicaAPI
+
+	reqCh chan *req
+}
+
+// NewControllers returns the Controllers running the engine commands with
+// cli and connecting to the replicas with newReplicaAPI. A fake engine can
+// stand in for both for testing.
+func NewControllers(cli types.EngineCLI, newReplicaAPI func(address string) engine.ReplicaAPI, useEngineAPI bool) *Controllers {
+	ctrls := &Controllers{
+		engine:        cli,
+		useEngineAPI:  useEngineAPI,
+		newReplicaAPI: newReplicaAPI,
+		reqCh:         make(chan *req),
+	}
+	go ctrls.holdControllers()
+	return ctrls
+}
+
+func (ctrls *Controllers) holdControllers() {
 	cs := map[string]*controller{}
 
-	for r := range reqCh {
+	for r := range ctrls.reqCh {
 		if r.volume.Controller == nil || !r.volume.Controller.Running {
 			c := cs[r.volume.Name]
 			if c != nil {
@@ -55,8 +77,11 @@ func holdControllers() {
 		c := cs[r.volume.Name]
 		cURL := getControllerURL(r.volume.Controller.Address)
 		if c == nil || c.url != cURL {
-			c = &controller{name: r.volume.Name, url: cURL, bgTaskQueue: TaskQueue(), purgeQueue: make(chan struct{}, 2)}
-			go c.runBgTasks()
+			var client *engine.Client
+			if ctrls.useEngineAPI {
+				client = engine.NewClient(cURL)
+			}
+			c = newController(r.volume.Name, cURL, ctrls.engine, client, ctrls.newReplicaAPI)
 			cs[r.volume.Name] = c
 		}
 		r.result <- c
@@ -66,8 +91,15 @@ func holdControllers() {
 type controller struct {
 	sync.Mutex
 
-	name string
-	url  string
+	name   string
+	url    string
+	engine types.EngineCLI
+	// client is nil if the engine REST API is not used. The CLI is still
+	// needed to list, remove and purge snapshots and for the backups, because
+	// these go through the replicas.
+	client *engine.Client
+	// newReplicaAPI connects to the replicas to follow their rebuilds
+	newReplicaAPI func(address string) engine.ReplicaAPI
 
 	lastRunBgTask *types.BgTask
 	runningBgTask *types.BgTask
@@ -78,25 +110,43 @@ type controller struct {
 	purgeQueue chan struct{}
 }
 
+func newController(name, url string, cli types.EngineCLI, client *engine.Client, newReplicaAPI func(address string) engine.ReplicaAPI) *controller {
+	c := &controller{
+		name:          name,
+		url:           url,
+		engine:        cli,
+		client:        client,
+		newReplicaAPI: newReplicaAPI,
+		bgTaskQueue:   TaskQueue(),
+		purgeQueue:    make(chan struct{}, 2),
+	}
+	go c.runBgTasks()
+	return c
+}
+
 type volumeInfo struct {
 	Name         string `json:"name"`
+	Size         string `json:"size"`
 	ReplicaCount int    `json:"replicaCount"`
 	Endpoint     string `json:"endpoint"`
 }
 
-func Get(volume *types.VolumeInfo) types.Controller {
+// Get returns the controller of the attached volume, or nil if the volume
+// is detached
+func (ctrls *Controllers) Get(volume *types.VolumeInfo) types.Controller {
 	if volume == nil || volume.Controller == nil || !volume.Controller.Running {
 		return nil
 	}
 	req := ctrlReq(volume)
-	reqCh <- req
+	ctrls.reqCh <- req
 	return <-req.result
 }
 
-func Cleanup(volume *types.VolumeInfo) {
+// Cleanup drops the controller of the volume and stops its background tasks
+func (ctrls *Controllers) Cleanup(volume *types.VolumeInfo) {
 	volume = util.CopyVolumeProperties(volume)
 	volume.Controller = nil
-	reqCh <- ctrlReq(volume)
+	ctrls.reqCh <- ctrlReq(volume)
 }
 
 func (c *controller) Name() string {
@@ -127,42 +177,57 @@ func parseReplica(s string) (*types.ReplicaInfo, error) {
 }
 
 func (c *controller) GetReplicaStates() ([]*types.ReplicaInfo, error) {
+	if c.client != nil {
+		return c.getReplicaStates()
+	}
+	output, err := c.engine.Execute("--url", c.url, "ls")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list replicas of controller '%s'", c.name)
+	}
 	replicas := []*types.ReplicaInfo{}
-	cancel := make(chan interface{})
-	defer close(cancel)
-	lineCh, cliErrCh := util.CmdOutLines(exec.Command("longhorn", "--url", c.url, "ls"), cancel)
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	parsingErrCh := make(chan error)
-	go func() {
-		defer wg.Done()
-		defer close(parsingErrCh)
-		for s := range lineCh {
-			if strings.HasPrefix(s, "ADDRESS") {
-				continue
-			}
-			replica, err := parseReplica(s)
-			if err != nil {
-				parsingErrCh <- errors.Wrapf(err, "error parsing replica status from `%s`", s)
-				break
-			}
-			replicas = append(replicas, replica)
+	for _, s := range strings.Split(output, "\n") {
+		if strings.TrimSpace(s) == "" || strings.HasPrefix(s, "ADDRESS") {
+			continue
 		}
-	}()
-	for err := range parsingErrCh {
-		return nil, err
-	}
-	for err := range cliErrCh {
-		return nil, err
+		replica, err := parseReplica(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing replica status from `%s`", s)
+		}
+		replicas = append(replicas, replica)
 	}
+	return replicas, nil
+}
 
-	wg.Wait()
+func (c *controller) getReplicaStates() ([]*types.ReplicaInfo, error) {
+	list, err := c.client.ListReplicas()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list replicas of controller '%s'", c.name)
+	}
+	replicas := []*types.ReplicaInfo{}
+	for _, r := range list {
+		mode, ok := modes[r.Mode]
+		if !ok {
+			mode = types.ReplicaModeERR
+		}
+		replicas = append(replicas, &types.ReplicaInfo{
+			InstanceInfo: types.InstanceInfo{
+				Address: getIPFromURL(r.Address),
+			},
+			Mode: mode,
+		})
+	}
 	return replicas, nil
 }
 
 func (c *controller) AddReplica(replica *types.ReplicaInfo) error {
 	rURL := getReplicaURL(replica.Address)
-	if _, err := util.Execute("longhorn", "--url", c.url, "add", rURL); err != nil {
+	if c.client != nil {
+		if _, err := c.client.CreateReplica(rURL); err != nil {
+			return errors.Wrapf(err, "failed to add replica address='%s' to controller '%s'", rURL, c.name)
+		}
+		return nil
+	}
+	if _, err := c.engine.Execute("--url", c.url, "add", rURL); err != nil {
 		return errors.Wrapf(err, "failed to add replica address='%s' to controller '%s'", rURL, c.name)
 	}
 	return nil
@@ -170,7 +235,13 @@ func (c *controller) AddReplica(replica *types.ReplicaInfo) error {
 
 func (c *controller) RemoveReplica(replica *types.ReplicaInfo) error {
 	rURL := getReplicaURL(replica.Address)
-	if _, err := util.Execute("longhorn", "--url", c.url, "rm", rURL); err != nil {
+	if c.client != nil {
+		if err := c.client.DeleteReplica(rURL); err != nil {
+			return errors.Wrapf(err, "failed to rm replica address='%s' from controller '%s'", rURL, c.name)
+		}
+		return nil
+	}
+	if _, err := c.engine.Execute("--url", c.url, "rm", rURL); err != nil {
 		return errors.Wrapf(err, "failed to rm replica address='%s' from controller '%s'", rURL, c.name)
 	}
 	return nil
@@ -186,8 +257,119 @@ func (c *controller) Endpoint() string {
 	return info.Endpoint
 }
 
+// Expand grows the volume and all its replicas to size, it does nothing if the
+// volume is already that large. The engines without expansion don't report
+// the size, Expand fails with UnsupportedError for them.
+func (c *controller) Expand(size int64) error {
+	info, err := c.info()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get size of volume '%s'", c.name)
+	}
+	if info.Size == "" {
+		return errors.Wrapf(&types.UnsupportedError{Operation: "expand volumes"}, "cannot expand volume '%s'", c.name)
+	}
+	current, err := strconv.ParseInt(info.Size, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse size '%s' of volume '%s'", info.Size, c.name)
+	}
+	if current >= size {
+		return nil
+	}
+	if c.client != nil {
+		if err := c.client.Expand(size); err != nil {
+			return errors.Wrapf(err, "failed to expand volume '%s' to %v", c.name, size)
+		}
+		return nil
+	}
+	if _, err := c.engine.Execute("--url", c.url, "expand", "--size", strconv.FormatInt(size, 10)); err != nil {
+		return errors.Wrapf(err, "failed to expand volume '%s' to %v", c.name, size)
+	}
+	return nil
+}
+
+// RebuildStatus returns the progress of the replicas at the addresses being
+// rebuilt. The engine doesn't report the progress itself, so it's counted
+// from the snapshot files the sync agents of the replicas have copied, out of
+// the snapshot files of a RW replica.
+func (c *controller) RebuildStatus(addresses []string) (map[string]*types.RebuildStatus, error) {
+	replicas, err := c.GetReplicaStates()
+	if err != nil {
+		return nil, err
+	}
+	var source *types.ReplicaInfo
+	for _, r := range replicas {
+		if r.Mode == types.ReplicaModeRW {
+			source = r
+			break
+		}
+	}
+	if source == nil {
+		return nil, errors.Errorf("no RW replica to rebuild the replicas of volume '%s' from", c.name)
+	}
+	sizes, err := snapshotFileSizes(c.newReplicaAPI(source.Address))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get snapshot sizes of replica '%s' of volume '%s'", source.Address, c.name)
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	status := map[string]*types.RebuildStatus{}
+	for _, address := range addresses {
+		processes, err := c.newReplicaAPI(address).ListSyncProcesses()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get sync processes of replica '%s' of volume '%s'", address, c.name)
+		}
+		// the agent keeps the finished processes, of other types as well,
+		// and can list the same file more than once
+		var synced int64
+		copied := map[string]bool{}
+		for _, p := range processes {
+			if p.ProcessType != "sync" || p.ExitCode != 0 || copied[p.DestFile] {
+				continue
+			}
+			copied[p.DestFile] = true
+			synced += sizes[p.DestFile]
+		}
+		if synced > total {
+			synced = total
+		}
+		status[address] = &types.RebuildStatus{SyncedBytes: synced, TotalBytes: total}
+	}
+	return status, nil
+}
+
+// snapshotFileSizes returns the sizes of the snapshot files of the replica by
+// file name, the volume head isn't copied by the rebuild
+func snapshotFileSizes(api engine.ReplicaAPI) (map[string]int64, error) {
+	replica, err := api.GetReplica()
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for i, file := range replica.Chain {
+		disk := replica.Disks[file]
+		if i == 0 || disk == nil {
+			continue
+		}
+		size, err := strconv.ParseInt(disk.Size, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse size '%s' of '%s'", disk.Size, file)
+		}
+		sizes[file] = size
+	}
+	return sizes, nil
+}
+
 func (c *controller) info() (*volumeInfo, error) {
-	output, err := util.Execute("longhorn", "--url", c.url, "info")
+	if c.client != nil {
+		volume, err := c.client.GetVolume()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get volume info")
+		}
+		return &volumeInfo{Name: volume.Name, Size: volume.Size, ReplicaCount: volume.ReplicaCount, Endpoint: volume.Endpoint}, nil
+	}
+	output, err := c.engine.Execute("--url", c.url, "info")
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot get volume info")
 	}
@@ -1,9 +1,21 @@
 package controller
 
 import (
+	"github.com/pkg/errors"
+	"github.com/rancher/longhorn-manager/engine"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/stretchr/testify/require"
+	"net/http/httptest"
 	"testing"
+	"time"
+)
+
+const (
+	testVolumeName = "test-vol"
+	testVolumeSize = 8 * 1024 * 1024
+	testCtrlAddr   = "10.42.0.1"
+	testRep1Addr   = "10.42.0.2"
+	testRep2Addr   = "10.42.0.3"
 )
 
 func TestParseReplica(t *testing.T) {
@@ -21,3 +33,320 @@ func TestParseReplica(t *testing.T) {
 	assert.Equal("replica-79VrD86STQ.volume-qq", replica.Address)
 	assert.Equal(types.ReplicaModeRW, replica.Mode)
 }
+
+// newFakeController returns a controller talking to the fake engine through
+// the CLI and, if useAPI is set, through the REST API as well
+func newFakeController(useAPI bool) (*engine.Fake, *controller, func()) {
+	fake := engine.NewFake()
+	fake.LaunchController(testCtrlAddr, testVolumeName, testVolumeSize,
+		[]string{getReplicaURL(testRep1Addr), getReplicaURL(testRep2Addr)})
+	if !useAPI {
+		c := newController(testVolumeName, getControllerURL(testCtrlAddr), fake, nil, fake.ReplicaAPI)
+		return fake, c, func() { c.bgTaskQueue.Close() }
+	}
+	server := httptest.NewServer(fake.Handler(testCtrlAddr))
+	c := newController(testVolumeName, getControllerURL(testCtrlAddr), fake, engine.NewClient(server.URL), fake.ReplicaAPI)
+	return fake, c, func() {
+		c.bgTaskQueue.Close()
+		server.Close()
+	}
+}
+
+func TestGetReplicaStates(t *testing.T) {
+	testGetReplicaStates(t, false)
+	testGetReplicaStates(t, true)
+}
+
+func testGetReplicaStates(t *testing.T, useAPI bool) {
+	assert := require.New(t)
+
+	fake, c, cleanup := newFakeController(useAPI)
+	defer cleanup()
+
+	assert.Nil(fake.SetReplicaMode(testCtrlAddr, testRep2Addr, types.ReplicaModeERR))
+	replicas, err := c.GetReplicaStates()
+	assert.Nil(err)
+	assert.Len(replicas, 2)
+	assert.Equal(testRep1Addr, replicas[0].Address)
+	assert.Equal(types.ReplicaModeRW, replicas[0].Mode)
+	assert.Equal(testRep2Addr, replicas[1].Address)
+	assert.Equal(types.ReplicaModeERR, replicas[1].Mode)
+
+	assert.Nil(c.RemoveReplica(replicas[1]))
+	assert.Nil(c.AddReplica(&types.ReplicaInfo{InstanceInfo: types.InstanceInfo{Address: "10.42.0.4"}}))
+	replicas, err = c.GetReplicaStates()
+	assert.Nil(err)
+	assert.Len(replicas, 2)
+	assert.Equal("10.42.0.4", replicas[1].Address)
+	assert.Equal(types.ReplicaModeRW, replicas[1].Mode)
+	assert.NotNil(c.RemoveReplica(&types.ReplicaInfo{InstanceInfo: types.InstanceInfo{Address: "10.42.0.5"}}))
+
+	assert.Equal("/dev/longhorn/"+testVolumeName, c.Endpoint())
+	for _, call := range fake.Calls() {
+		// the REST API calls are recorded as method and URL
+		assert.Equal(useAPI, call[0] != "--url", "unexpected call %v", call)
+	}
+
+	if !useAPI {
+		fake.Inject(&engine.Injection{
+			Args:   []string{"ls"},
+			Output: "ADDRESS MODE CHAIN\ngarbage\n",
+			Times:  1,
+		})
+		_, err = c.GetReplicaStates()
+		assert.NotNil(err)
+
+		fake.Inject(&engine.Injection{
+			Args:  []string{"ls"},
+			Delay: engine.CmdTimeout,
+			Times: 1,
+		})
+		_, err = c.GetReplicaStates()
+		assert.NotNil(err)
+	}
+
+	fake.ShutdownController(testCtrlAddr)
+	_, err = c.GetReplicaStates()
+	assert.NotNil(err)
+	assert.Equal("", c.Endpoint())
+}
+
+func TestExpand(t *testing.T) {
+	testExpand(t, false)
+	testExpand(t, true)
+}
+
+func testExpand(t *testing.T, useAPI bool) {
+	assert := require.New(t)
+
+	fake, c, cleanup := newFakeController(useAPI)
+	defer cleanup()
+
+	assert.Nil(c.Expand(2 * testVolumeSize))
+	assert.Equal(int64(2*testVolumeSize), fake.VolumeSize(testVolumeName))
+
+	// already expanded, e.g. retry after failing to record the new size
+	calls := len(fake.Calls())
+	assert.Nil(c.Expand(2 * testVolumeSize))
+	assert.Nil(c.Expand(testVolumeSize))
+	assert.Equal(int64(2*testVolumeSize), fake.VolumeSize(testVolumeName))
+	assert.Len(fake.Calls(), calls+2)
+
+	if !useAPI {
+		fake.Inject(&engine.Injection{
+			Args: []string{"expand"},
+			Err:  errors.New("injected"),
+		})
+		assert.NotNil(c.Expand(4 * testVolumeSize))
+	}
+}
+
+func TestExpandUnsupported(t *testing.T) {
+	testExpandUnsupported(t, false)
+	testExpandUnsupported(t, true)
+}
+
+func testExpandUnsupported(t *testing.T, useAPI bool) {
+	assert := require.New(t)
+
+	fake, c, cleanup := newFakeController(useAPI)
+	defer cleanup()
+	fake.DisableExpand()
+
+	err := c.Expand(2 * testVolumeSize)
+	assert.True(types.IsUnsupported(err))
+	assert.Equal(int64(testVolumeSize), fake.VolumeSize(testVolumeName))
+}
+
+func TestSnapshots(t *testing.T) {
+	testSnapshots(t, false)
+	testSnapshots(t, true)
+}
+
+func testSnapshots(t *testing.T, useAPI bool) {
+	assert := require.New(t)
+
+	fake, c, cleanup := newFakeController(useAPI)
+	defer cleanup()
+	ops := c.SnapshotOps()
+
+	name, err := ops.Create("snap1", map[string]string{"key": "value"})
+	assert.Nil(err)
+	assert.Equal("snap1", name)
+	_, err = ops.Create("snap2", nil)
+	assert.Nil(err)
+	_, err = ops.Create("snap1", nil)
+	assert.NotNil(err)
+
+	snapshots, err := ops.List()
+	assert.Nil(err)
+	assert.Len(snapshots, 2)
+
+	snap, err := ops.Get("snap1")
+	assert.Nil(err)
+	assert.Equal("value", snap.Labels["key"])
+	assert.Equal([]string{"snap2"}, snap.Children)
+	snap, err = ops.Get(VolumeHeadName)
+	assert.Nil(err)
+	assert.Nil(snap)
+
+	assert.Nil(ops.Revert("snap1"))
+	snap, err = ops.Get("snap1")
+	assert.Nil(err)
+	assert.Len(snap.Children, 2)
+
+	assert.Nil(ops.Delete("snap2"))
+	snap, err = ops.Get("snap2")
+	assert.Nil(err)
+	assert.True(snap.Removed)
+	assert.NotNil(ops.Revert("snap2"))
+
+	assert.Nil(ops.Purge())
+	snapshots, err = ops.List()
+	assert.Nil(err)
+	assert.Len(snapshots, 1)
+	assert.Equal("snap1", snapshots[0].Name)
+
+	fake.Inject(&engine.Injection{
+		Args:   []string{"snapshot", "info"},
+		Output: "{not json",
+		Times:  1,
+	})
+	_, err = ops.List()
+	assert.NotNil(err)
+
+	fake.Inject(&engine.Injection{
+		Args:  []string{"snapshot", "purge"},
+		Delay: purgeTimeout,
+		Times: 1,
+	})
+	assert.NotNil(ops.Purge())
+
+	fake.Inject(&engine.Injection{
+		Args: []string{"snapshot", "rm"},
+		Err:  errors.New("injected"),
+	})
+	assert.NotNil(ops.Delete("snap1"))
+}
+
+func TestRebuildStatus(t *testing.T) {
+	assert := require.New(t)
+
+	fake, c, cleanup := newFakeController(false)
+	defer cleanup()
+
+	ops := c.SnapshotOps()
+	for _, name := range []string{"snap1", "snap2"} {
+		_, err := ops.Create(name, nil)
+		assert.Nil(err)
+	}
+	assert.Nil(fake.SetSnapshotSize(testVolumeName, "snap1", 1024))
+	assert.Nil(fake.SetSnapshotSize(testVolumeName, "snap2", 3072))
+
+	rebuilding := "10.42.0.4"
+	status, err := c.RebuildStatus([]string{rebuilding})
+	assert.Nil(err)
+	assert.Equal(int64(0), status[rebuilding].SyncedBytes)
+	assert.Equal(int64(4096), status[rebuilding].TotalBytes)
+
+	fake.SetSyncedSnapshots(rebuilding, "snap1")
+	status, err = c.RebuildStatus([]string{rebuilding})
+	assert.Nil(err)
+	assert.Equal(int64(1024), status[rebuilding].SyncedBytes)
+	assert.Equal(int64(4096), status[rebuilding].TotalBytes)
+
+	// the file copied twice is counted once
+	fake.SetSyncedSnapshots(rebuilding, "snap1", "snap1")
+	status, err = c.RebuildStatus([]string{rebuilding})
+	assert.Nil(err)
+	assert.Equal(int64(1024), status[rebuilding].SyncedBytes)
+
+	// only the finished copies count
+	processes := []*engine.SyncProcess{}
+	for _, p := range []*engine.SyncProcess{
+		{ProcessType: "sync", ExitCode: 0},
+		{ProcessType: "sync", ExitCode: -1},
+		{ProcessType: "backup", ExitCode: 0},
+	} {
+		for _, name := range []string{"snap1", "snap2"} {
+			process := *p
+			process.SrcFile = "volume-snap-" + name + ".img"
+			process.DestFile = process.SrcFile
+			processes = append(processes, &process)
+		}
+	}
+	fake.SetSyncProcesses(rebuilding, processes[0], processes[3], processes[4], processes[5])
+	status, err = c.RebuildStatus([]string{rebuilding})
+	assert.Nil(err)
+	assert.Equal(int64(1024), status[rebuilding].SyncedBytes)
+	fake.SetSyncProcesses(rebuilding, processes...)
+	status, err = c.RebuildStatus([]string{rebuilding})
+	assert.Nil(err)
+	assert.Equal(int64(4096), status[rebuilding].SyncedBytes)
+	assert.Equal(int64(4096), status[rebuilding].TotalBytes)
+
+	assert.Nil(fake.SetReplicaMode(testCtrlAddr, testRep1Addr, types.ReplicaModeERR))
+	assert.Nil(fake.SetReplicaMode(testCtrlAddr, testRep2Addr, types.ReplicaModeERR))
+	_, err = c.RebuildStatus([]string{rebuilding})
+	assert.NotNil(err)
+}
+
+func TestBackups(t *testing.T) {
+	assert := require.New(t)
+
+	fake, c, cleanup := newFakeController(false)
+	defer cleanup()
+	target := "vfs:///var/lib/longhorn/backups/default"
+	env := []string{"AWS_ACCESS_KEY_ID=key", "AWS_SECRET_ACCESS_KEY=secret"}
+
+	_, err := c.SnapshotOps().Create("snap1", nil)
+	assert.Nil(err)
+
+	assert.Nil(c.BackupOps().StartBackup("snap1", target, env))
+	assert.NotNil(c.BackupOps().StartBackup("nonexistent", target, nil))
+	waitForBgTask(assert, c)
+	urls := fake.BackupURLs(target, testVolumeName)
+	assert.Len(urls, 1)
+	assert.Equal(env, backupEnv(fake, "create"))
+
+	assert.Nil(c.runBackup(&types.BackupBgTask{Snapshot: "snap1", BackupTarget: target}))
+	assert.Len(fake.BackupURLs(target, testVolumeName), 2)
+	assert.NotNil(c.runBackup(&types.BackupBgTask{Snapshot: "nonexistent", BackupTarget: target}))
+
+	url, err := c.BackupOps().Backup("snap1", target, env)
+	assert.Nil(err)
+	assert.Len(fake.BackupURLs(target, testVolumeName), 3)
+	assert.Contains(fake.BackupURLs(target, testVolumeName), url)
+	_, err = c.BackupOps().Backup("nonexistent", target, env)
+	assert.NotNil(err)
+
+	assert.Nil(c.BackupOps().Restore(urls[0], env))
+	assert.Nil(c.BackupOps().DeleteBackup(urls[0], env))
+	assert.Len(fake.BackupURLs(target, testVolumeName), 2)
+	assert.Equal(env, backupEnv(fake, "restore"))
+	assert.Equal(env, backupEnv(fake, "rm"))
+	assert.NotNil(c.BackupOps().DeleteBackup(urls[0], nil))
+}
+
+// backupEnv returns the environment variables of the first backup command
+func backupEnv(fake *engine.Fake, command string) []string {
+	envs := fake.Envs()
+	for i, call := range fake.Calls() {
+		if len(call) > 3 && call[2] == "backup" && call[3] == command {
+			return envs[i]
+		}
+	}
+	return nil
+}
+
+func waitForBgTask(assert *require.Assertions, c *controller) {
+	for i := 0; i < 50; i++ {
+		tasks := c.LatestBgTasks()
+		if len(tasks) == 1 && tasks[0].Finished != "" {
+			assert.Nil(tasks[0].Err)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Fail("background task is not finished")
+}
@@ -3,6 +3,7 @@ package controller
 import (
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
+	"sync"
 	"time"
 )
 
@@ -11,6 +12,11 @@ type taskQueue struct {
 
 	reqCh    chan interface{}
 	takeReqs []takeReq
+
+	// doneCh is closed by Close, reqCh is never closed so the requests
+	// racing with Close don't send to a closed channel
+	doneCh    chan struct{}
+	closeOnce sync.Once
 }
 
 type listReq chan []*types.BgTask
@@ -19,7 +25,16 @@ type takeReq chan *types.BgTask
 
 func (tq *taskQueue) runQueue() {
 	var i int64
-	for r := range tq.reqCh {
+	for {
+		var r interface{}
+		select {
+		case r = <-tq.reqCh:
+		case <-tq.doneCh:
+			for _, r := range tq.takeReqs {
+				close(r)
+			}
+			return
+		}
 		switch r := r.(type) {
 		case listReq:
 			r <- tq.queue
@@ -42,46 +57,48 @@ func (tq *taskQueue) runQueue() {
 			}
 		}
 	}
-	for _, r := range tq.takeReqs {
-		close(r)
-	}
 }
 
 func TaskQueue() types.TaskQueue {
-	tq := &taskQueue{queue: []*types.BgTask{}, reqCh: make(chan interface{}), takeReqs: []takeReq{}}
+	tq := &taskQueue{queue: []*types.BgTask{}, reqCh: make(chan interface{}), takeReqs: []takeReq{}, doneCh: make(chan struct{})}
 	go tq.runQueue()
 	return tq
 }
 
+// send passes req to runQueue, it returns false if the queue is closed
+func (tq *taskQueue) send(req interface{}) bool {
+	select {
+	case tq.reqCh <- req:
+		return true
+	case <-tq.doneCh:
+		return false
+	}
+}
+
 func (tq *taskQueue) List() []*types.BgTask {
-	defer func() {
-		recover()
-	}()
 	req := make(listReq)
-	tq.reqCh <- req
+	if !tq.send(req) {
+		return nil
+	}
 	return <-req
 }
 
 func (tq *taskQueue) Put(t *types.BgTask) {
-	defer func() {
-		recover()
-	}()
-	tq.reqCh <- putReq(t)
+	tq.send(putReq(t))
 }
 
+// Take waits for the next task, it returns nil once the queue is closed
 func (tq *taskQueue) Take() *types.BgTask {
-	defer func() {
-		recover()
-	}()
 	req := make(takeReq)
-	tq.reqCh <- req
+	if !tq.send(req) {
+		return nil
+	}
 	return <-req
 }
 
 func (tq *taskQueue) Close() error {
-	defer func() {
-		recover()
-	}()
-	close(tq.reqCh)
+	tq.closeOnce.Do(func() {
+		close(tq.doneCh)
+	})
 	return nil
 }
@@ -2,7 +2,6 @@ package controller
 
 import (
 	"encoding/json"
-	"os/exec"
 	"strings"
 	"time"
 
@@ -10,7 +9,6 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/rancher/longhorn-manager/types"
-	"github.com/rancher/longhorn-manager/util"
 )
 
 const (
@@ -23,13 +21,20 @@ func (c *controller) SnapshotOps() types.SnapshotOps {
 }
 
 func (c *controller) Create(name string, labels map[string]string) (string, error) {
+	if c.client != nil {
+		snapName, err := c.client.Snapshot(name, labels)
+		if err != nil {
+			return "", errors.Wrapf(err, "error creating snapshot '%s'", name)
+		}
+		return snapName, nil
+	}
 	args := []string{"--url", c.url, "snapshot", "create"}
 	for k, v := range labels {
 		args = append(args, "--label", k+"="+v)
 	}
 	args = append(args, name)
 
-	output, err := util.Execute("longhorn", args...)
+	output, err := c.engine.Execute(args...)
 	if err != nil {
 		return "", errors.Wrapf(err, "error creating snapshot '%s'", name)
 	}
@@ -37,22 +42,13 @@ func (c *controller) Create(name string, labels map[string]string) (string, erro
 }
 
 func (c *controller) list() (map[string]*types.SnapshotInfo, error) {
-	cmd := exec.Command("longhorn", "--url", c.url, "snapshot", "info")
-	stdout, err := cmd.StdoutPipe()
+	output, err := c.engine.Execute("--url", c.url, "snapshot", "info")
 	if err != nil {
-		return nil, errors.Wrapf(err, "error getting stdout from cmd '%v'", cmd)
+		return nil, errors.Wrapf(err, "error listing snapshots")
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Wrapf(err, "error starting cmd '%v'", cmd)
-	}
-	defer func() {
-		if err := cmd.Wait(); err != nil {
-			logrus.Errorf("%+v", errors.Wrapf(err, "error waiting for cmd '%v'", cmd))
-		}
-	}()
 	data := map[string]*types.SnapshotInfo{}
-	if err := json.NewDecoder(stdout).Decode(&data); err != nil {
-		return nil, errors.Wrapf(err, "error parsing data from cmd '%v'", cmd)
+	if err := json.Unmarshal([]byte(output), &data); err != nil {
+		return nil, errors.Wrapf(err, "error parsing snapshots: %v", output)
 	}
 	delete(data, VolumeHeadName)
 	return data, nil
@@ -79,7 +75,7 @@ func (c *controller) Get(name string) (*types.SnapshotInfo, error) {
 }
 
 func (c *controller) Delete(name string) error {
-	if _, err := util.Execute("longhorn", "--url", c.url,
+	if _, err := c.engine.Execute("--url", c.url,
 		"snapshot", "rm", name); err != nil {
 		return errors.Wrapf(err, "error deleting snapshot '%s'", name)
 	}
@@ -87,7 +83,13 @@ func (c *controller) Delete(name string) error {
 }
 
 func (c *controller) Revert(name string) error {
-	if _, err := util.Execute("longhorn", "--url", c.url,
+	if c.client != nil {
+		if err := c.client.Revert(name); err != nil {
+			return errors.Wrapf(err, "error reverting to snapshot '%s'", name)
+		}
+		return nil
+	}
+	if _, err := c.engine.Execute("--url", c.url,
 		"snapshot", "revert", name); err != nil {
 		return errors.Wrapf(err, "error reverting to snapshot '%s'", name)
 	}
@@ -107,7 +109,7 @@ func (c *controller) Purge() error {
 
 	c.Lock()
 	defer c.Unlock()
-	if _, err := util.ExecuteWithTimeout(purgeTimeout, "longhorn", "--url", c.url,
+	if _, err := c.engine.ExecuteWithTimeout(purgeTimeout, "--url", c.url,
 		"snapshot", "purge"); err != nil {
 		return errors.Wrapf(err, "error purging snapshots")
 	}
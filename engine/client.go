@@ -0,0 +1,268 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	// ClientTimeout limits every request to the engine REST API
+	ClientTimeout = 30 * time.Second
+
+	// transport is shared by all the clients, so the connections to the
+	// controllers are kept alive between the monitoring rounds
+	transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+)
+
+// Client talks to the REST API of the engine controller, usually at
+// http://<controller>:9501
+type Client struct {
+	url        string
+	httpClient *http.Client
+}
+
+type resource struct {
+	ID      string            `json:"id"`
+	Type    string            `json:"type"`
+	Links   map[string]string `json:"links,omitempty"`
+	Actions map[string]string `json:"actions,omitempty"`
+}
+
+type Replica struct {
+	resource
+	Address string `json:"address"`
+	Mode    string `json:"mode"`
+}
+
+type Volume struct {
+	resource
+	Name         string `json:"name"`
+	Size         string `json:"size"`
+	ReplicaCount int    `json:"replicaCount"`
+	Endpoint     string `json:"endpoint"`
+}
+
+type collection struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type snapshotInput struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type snapshotOutput struct {
+	ID string `json:"id"`
+}
+
+type expandInput struct {
+	Size int64 `json:"size"`
+}
+
+type replicaInput struct {
+	Address string `json:"address"`
+}
+
+// APIError is returned when the engine responds with an error status
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Code
+	}
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), msg)
+}
+
+// IsNotFound returns true if err is caused by an APIError with status 404
+func IsNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+func NewClient(controllerURL string) *Client {
+	return &Client{
+		url: strings.TrimSuffix(controllerURL, "/") + "/v1",
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   ClientTimeout,
+		},
+	}
+}
+
+func (c *Client) ListReplicas() ([]*Replica, error) {
+	replicas := []*Replica{}
+	if err := c.list("/replicas", &replicas); err != nil {
+		return nil, err
+	}
+	return replicas, nil
+}
+
+func (c *Client) CreateReplica(address string) (*Replica, error) {
+	replica := &Replica{}
+	if err := c.do("POST", c.url+"/replicas", &replicaInput{Address: address}, replica); err != nil {
+		return nil, err
+	}
+	return replica, nil
+}
+
+func (c *Client) DeleteReplica(address string) error {
+	replicas, err := c.ListReplicas()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		if r.Address == address {
+			return c.do("DELETE", c.resourceURL(&r.resource, "/replicas"), nil, nil)
+		}
+	}
+	return &APIError{
+		Method:     "DELETE",
+		URL:        c.url + "/replicas",
+		StatusCode: http.StatusNotFound,
+		Message:    fmt.Sprintf("cannot find replica %v", address),
+	}
+}
+
+// GetVolume returns the only volume served by the controller
+func (c *Client) GetVolume() (*Volume, error) {
+	volumes := []*Volume{}
+	if err := c.list("/volumes", &volumes); err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, errors.Errorf("no volume is served by controller %v", c.url)
+	}
+	return volumes[0], nil
+}
+
+// Snapshot creates a snapshot of the volume and returns its name
+func (c *Client) Snapshot(name string, labels map[string]string) (string, error) {
+	output := &snapshotOutput{}
+	if err := c.volumeAction("snapshot", &snapshotInput{Name: name, Labels: labels}, output); err != nil {
+		return "", err
+	}
+	return output.ID, nil
+}
+
+func (c *Client) Revert(name string) error {
+	return c.volumeAction("revert", &snapshotInput{Name: name}, nil)
+}
+
+// Expand grows the volume and all its replicas to size in bytes. It fails
+// with UnsupportedError if the engine doesn't offer the expand action.
+func (c *Client) Expand(size int64) error {
+	volume, err := c.GetVolume()
+	if err != nil {
+		return err
+	}
+	actionURL := volume.Actions["expand"]
+	if actionURL == "" {
+		return &types.UnsupportedError{Operation: "expand volumes"}
+	}
+	return c.do("POST", actionURL, &expandInput{Size: size}, nil)
+}
+
+func (c *Client) volumeAction(action string, input, output interface{}) error {
+	volume, err := c.GetVolume()
+	if err != nil {
+		return err
+	}
+	actionURL := volume.Actions[action]
+	if actionURL == "" {
+		actionURL = c.resourceURL(&volume.resource, "/volumes") + "?action=" + action
+	}
+	return c.do("POST", actionURL, input, output)
+}
+
+func (c *Client) resourceURL(r *resource, collectionPath string) string {
+	if self := r.Links["self"]; self != "" {
+		return self
+	}
+	return c.url + collectionPath + "/" + url.PathEscape(r.ID)
+}
+
+func (c *Client) list(path string, data interface{}) error {
+	coll := &collection{}
+	if err := c.do("GET", c.url+path, nil, coll); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(coll.Data, data); err != nil {
+		return errors.Wrapf(err, "fail to decode %v from %v", path, c.url)
+	}
+	return nil
+}
+
+func (c *Client) do(method, url string, input, output interface{}) error {
+	var body io.Reader
+	if input != nil {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	logrus.Debugf("%s %s", method, url)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if input != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "fail to %s %s", method, url)
+	}
+	defer func() {
+		// read the rest of the body, so the connection can be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &APIError{}
+		content, _ := ioutil.ReadAll(resp.Body)
+		if err := json.Unmarshal(content, apiErr); err != nil || apiErr.Message == "" && apiErr.Code == "" {
+			apiErr.Message = strings.TrimSpace(string(content))
+		}
+		apiErr.Method = method
+		apiErr.URL = url
+		apiErr.StatusCode = resp.StatusCode
+		return apiErr
+	}
+
+	if output == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(output); err != nil {
+		return errors.Wrapf(err, "fail to decode response of %s %s", method, url)
+	}
+	return nil
+}
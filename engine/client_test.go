@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	testVolumeName = "test-vol"
+	testCtrlAddr   = "10.42.0.1"
+)
+
+func TestClient(t *testing.T) {
+	assert := require.New(t)
+
+	fake := NewFake()
+	fake.LaunchController(testCtrlAddr, testVolumeName, 1024, []string{"tcp://10.42.0.2:9502"})
+	server := httptest.NewServer(fake.Handler(testCtrlAddr))
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	volume, err := client.GetVolume()
+	assert.Nil(err)
+	assert.Equal(testVolumeName, volume.Name)
+	assert.Equal(1, volume.ReplicaCount)
+	assert.Equal("/dev/longhorn/"+testVolumeName, volume.Endpoint)
+
+	replica, err := client.CreateReplica("tcp://10.42.0.3:9502")
+	assert.Nil(err)
+	assert.Equal("tcp://10.42.0.3:9502", replica.Address)
+	_, err = client.CreateReplica("tcp://10.42.0.3:9502")
+	assert.NotNil(err)
+	assert.Equal(http.StatusBadRequest, err.(*APIError).StatusCode)
+
+	assert.Nil(fake.SetReplicaMode(testCtrlAddr, "10.42.0.2", types.ReplicaModeERR))
+	replicas, err := client.ListReplicas()
+	assert.Nil(err)
+	assert.Len(replicas, 2)
+	assert.Equal("ERR", replicas[0].Mode)
+	assert.Equal("RW", replicas[1].Mode)
+
+	assert.Nil(client.DeleteReplica("tcp://10.42.0.2:9502"))
+	err = client.DeleteReplica("tcp://10.42.0.2:9502")
+	assert.True(IsNotFound(err))
+
+	name, err := client.Snapshot("snap1", map[string]string{"key": "value"})
+	assert.Nil(err)
+	assert.Equal("snap1", name)
+	name, err = client.Snapshot("", nil)
+	assert.Nil(err)
+	assert.NotEqual("", name)
+	assert.Nil(client.Revert("snap1"))
+	assert.NotNil(client.Revert("nonexistent"))
+
+	assert.Nil(client.Expand(2048))
+	volume, err = client.GetVolume()
+	assert.Nil(err)
+	assert.Equal("2048", volume.Size)
+	assert.Equal(int64(2048), fake.VolumeSize(testVolumeName))
+	assert.NotNil(client.Expand(1024))
+	fake.DisableExpand()
+	assert.True(types.IsUnsupported(client.Expand(4096)))
+	assert.Equal(int64(2048), fake.VolumeSize(testVolumeName))
+
+	// the snapshots created through the API are visible to the CLI
+	output, err := fake.Execute("--url", fakeControllerURL(testCtrlAddr), "snapshot", "info")
+	assert.Nil(err)
+	assert.Contains(output, `"key":"value"`)
+
+	fake.ShutdownController(testCtrlAddr)
+	_, err = client.ListReplicas()
+	assert.Equal(http.StatusServiceUnavailable, err.(*APIError).StatusCode)
+	assert.Contains(err.Error(), "controller is shut down")
+}
+
+func TestClientErrors(t *testing.T) {
+	assert := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/replicas":
+			w.Write([]byte(`{"type": "collection", "data": [{"id": `))
+		case "GET /v1/volumes":
+			time.Sleep(500 * time.Millisecond)
+		default:
+			http.Error(w, "page not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	timeout := ClientTimeout
+	ClientTimeout = 100 * time.Millisecond
+	defer func() { ClientTimeout = timeout }()
+	client := NewClient(server.URL)
+
+	_, err := client.ListReplicas()
+	assert.NotNil(err)
+
+	_, err = client.GetVolume()
+	assert.NotNil(err)
+	_, ok := err.(*APIError)
+	assert.False(ok)
+
+	_, err = client.CreateReplica("tcp://10.42.0.3:9502")
+	assert.True(IsNotFound(err))
+	assert.Contains(err.Error(), "page not found")
+
+	_, err = NewClient("http://127.0.0.1:1").ListReplicas()
+	assert.NotNil(err)
+}
+
+func TestReplicaClient(t *testing.T) {
+	assert := require.New(t)
+
+	// the replies of the replica and its sync agent while the rebuild
+	// is copying the second snapshot
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /replica/v1/replicas":
+			w.Write([]byte(`{"type": "collection", "data": [{"id": "1", "type": "replica", "state": "open",
+				"chain": ["volume-head-002.img", "volume-snap-s2.img", "volume-snap-s1.img"],
+				"disks": {"volume-snap-s1.img": {"name": "volume-snap-s1.img", "size": "4096"},
+					"volume-snap-s2.img": {"name": "volume-snap-s2.img", "size": "8192"}}}]}`))
+		case "GET /sync/v1/processes":
+			w.Write([]byte(`{"type": "collection", "data": [
+				{"id": "1", "type": "process", "processType": "sync", "srcFile": "volume-snap-s1.img", "destFile": "volume-snap-s1.img", "exitCode": 0},
+				{"id": "2", "type": "process", "processType": "sync", "srcFile": "volume-snap-s2.img", "destFile": "volume-snap-s2.img", "exitCode": -1}]}`))
+		default:
+			http.Error(w, "page not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := newReplicaClient(server.URL+"/replica", server.URL+"/sync")
+	replica, err := client.GetReplica()
+	assert.Nil(err)
+	assert.Equal([]string{"volume-head-002.img", "volume-snap-s2.img", "volume-snap-s1.img"}, replica.Chain)
+	assert.Equal("8192", replica.Disks["volume-snap-s2.img"].Size)
+
+	processes, err := client.ListSyncProcesses()
+	assert.Nil(err)
+	assert.Len(processes, 2)
+	assert.Equal("volume-snap-s1.img", processes[0].DestFile)
+	assert.Equal(0, processes[0].ExitCode)
+	assert.Equal(-1, processes[1].ExitCode)
+
+	_, err = newReplicaClient(server.URL, server.URL).GetReplica()
+	assert.True(IsNotFound(err))
+}
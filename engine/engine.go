@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	Binary = "longhorn"
+)
+
+var (
+	CmdTimeout = time.Minute
+)
+
+type longhornCLI struct {
+	env []string
+}
+
+// New returns the EngineCLI backed by the longhorn binary found in PATH
+func New() types.EngineCLI {
+	return &longhornCLI{}
+}
+
+func (l *longhornCLI) WithEnv(env []string) types.EngineCLI {
+	return &longhornCLI{env: append(append([]string{}, l.env...), env...)}
+}
+
+func (l *longhornCLI) Execute(args ...string) (string, error) {
+	return l.ExecuteWithTimeout(CmdTimeout, args...)
+}
+
+// ExecuteWithTimeout returns the stdout of the command even if it fails, the
+// stderr goes to the error
+func (l *longhornCLI) ExecuteWithTimeout(timeout time.Duration, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(Binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if len(l.env) > 0 {
+		cmd.Env = append(os.Environ(), l.env...)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", errors.Wrapf(err, "error starting cmd: %v %v", Binary, args)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return stdout.String(), errors.Wrapf(err, "failed to execute: %v %v, stderr: %s", Binary, args, &stderr)
+		}
+	case <-time.After(timeout):
+		if err := cmd.Process.Kill(); err != nil {
+			logrus.Warnf("Problem killing process pid=%v: %s", cmd.Process.Pid, err)
+		}
+		<-done
+		return stdout.String(), errors.Errorf("timeout executing: %v %v, stderr: %s", Binary, args, &stderr)
+	}
+	return stdout.String(), nil
+}
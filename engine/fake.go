@@ -0,0 +1,762 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	fakeHeadName = "volume-head"
+)
+
+// Injection scripts the reply of the fake engine to the commands starting
+// with Args, not counting the --url option.
+type Injection struct {
+	URL    string // only match the commands sent to this controller URL, any if empty
+	Args   []string
+	Output string
+	Err    error
+	Delay  time.Duration // if not shorter than the command timeout, the command times out
+	Times  int           // 0 means forever
+}
+
+// Fake is an in-memory stand-in for the longhorn engine CLI. It keeps track
+// of the controllers launched through it, their replicas, the snapshot chain
+// of every volume and the content of the backup targets.
+type Fake struct {
+	sync.Mutex
+
+	controllers map[string]*fakeController
+	volumes     map[string]*fakeVolume
+	targets     map[string]map[string]*fakeBackupVolume
+	// syncs are the processes of the sync agents, by replica URL
+	syncs map[string][]*SyncProcess
+
+	injections []*Injection
+	calls      [][]string
+	envs       [][]string
+
+	// noExpand makes the fake act like the engines without volume
+	// expansion, which neither report the size nor take the expand command
+	noExpand bool
+
+	clock time.Time
+}
+
+type fakeController struct {
+	volumeName string
+	replicas   []*fakeReplica
+}
+
+type fakeReplica struct {
+	url  string
+	mode types.ReplicaMode
+}
+
+type fakeVolume struct {
+	name      string
+	size      int64
+	snapshots map[string]*types.SnapshotInfo
+}
+
+type fakeBackupVolume struct {
+	Name           string
+	Size           string
+	Created        string
+	LastBackupName string
+	Backups        map[string]*fakeBackup `json:",omitempty"`
+}
+
+type fakeBackup struct {
+	Name            string
+	URL             string
+	SnapshotName    string
+	SnapshotCreated string
+	Created         string
+	Size            string
+}
+
+type fakeBackupInspect struct {
+	fakeBackup
+
+	VolumeName    string
+	VolumeSize    string
+	VolumeCreated string
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		controllers: map[string]*fakeController{},
+		volumes:     map[string]*fakeVolume{},
+		targets:     map[string]map[string]*fakeBackupVolume{},
+		syncs:       map[string][]*SyncProcess{},
+		clock:       time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func fakeControllerURL(address string) string {
+	return "http://" + address + ":9501"
+}
+
+func fakeReplicaURL(address string) string {
+	return "tcp://" + address + ":9502"
+}
+
+// now advances the clock by a second every time, so the timestamps are unique
+// and ordered even when the commands run in a tight loop
+func (f *Fake) now() string {
+	f.clock = f.clock.Add(time.Second)
+	return util.FormatTimeZ(f.clock)
+}
+
+// LaunchController starts a simulated controller listening at address, with
+// all the replicas in RW mode. The volume keeps its size and snapshots if it
+// has been launched before, like the replicas keep their data.
+func (f *Fake) LaunchController(address, volumeName string, volumeSize int64, replicaURLs []string) {
+	f.Lock()
+	defer f.Unlock()
+
+	c := &fakeController{volumeName: volumeName}
+	for _, url := range replicaURLs {
+		c.replicas = append(c.replicas, &fakeReplica{url: url, mode: types.ReplicaModeRW})
+	}
+	f.controllers[fakeControllerURL(address)] = c
+
+	v := f.volumes[volumeName]
+	if v == nil {
+		v = &fakeVolume{
+			name: volumeName,
+			size: volumeSize,
+			snapshots: map[string]*types.SnapshotInfo{
+				fakeHeadName: {Name: fakeHeadName, Children: []string{}, Size: "0"},
+			},
+		}
+		f.volumes[volumeName] = v
+	}
+}
+
+// ShutdownController makes the simulated controller at address unreachable
+func (f *Fake) ShutdownController(address string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.controllers, fakeControllerURL(address))
+}
+
+// SetReplicaMode changes the mode of a replica known to the controller at
+// controllerAddress, e.g. to simulate a replica failure
+func (f *Fake) SetReplicaMode(controllerAddress, replicaAddress string, mode types.ReplicaMode) error {
+	f.Lock()
+	defer f.Unlock()
+
+	c := f.controllers[fakeControllerURL(controllerAddress)]
+	if c == nil {
+		return errors.Errorf("cannot find controller %v", controllerAddress)
+	}
+	for _, r := range c.replicas {
+		if r.url == fakeReplicaURL(replicaAddress) {
+			r.mode = mode
+			return nil
+		}
+	}
+	return errors.Errorf("cannot find replica %v of controller %v", replicaAddress, controllerAddress)
+}
+
+// SetSnapshotSize changes the size of the snapshot file as seen by the
+// replicas of the volume
+func (f *Fake) SetSnapshotSize(volumeName, snapshot string, size int64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	v := f.volumes[volumeName]
+	if v == nil || v.snapshots[snapshot] == nil {
+		return errors.Errorf("cannot find snapshot %v of volume %v", snapshot, volumeName)
+	}
+	v.snapshots[snapshot].Size = strconv.FormatInt(size, 10)
+	return nil
+}
+
+// SetSyncedSnapshots simulates the progress of the rebuild of the replica at
+// replicaAddress, its sync agent has copied the files of the snapshots
+func (f *Fake) SetSyncedSnapshots(replicaAddress string, snapshots ...string) {
+	processes := []*SyncProcess{}
+	for _, name := range snapshots {
+		file := fakeDiskFile(name)
+		processes = append(processes, &SyncProcess{ProcessType: "sync", SrcFile: file, DestFile: file})
+	}
+	f.SetSyncProcesses(replicaAddress, processes...)
+}
+
+// SetSyncProcesses sets the processes the sync agent of the replica at
+// replicaAddress lists
+func (f *Fake) SetSyncProcesses(replicaAddress string, processes ...*SyncProcess) {
+	f.Lock()
+	defer f.Unlock()
+	f.syncs[fakeReplicaURL(replicaAddress)] = processes
+}
+
+// DisableExpand makes the fake act like the engines without volume expansion,
+// e.g. the engine pinned in scripts/common.sh
+func (f *Fake) DisableExpand() {
+	f.Lock()
+	defer f.Unlock()
+	f.noExpand = true
+}
+
+func (f *Fake) Inject(i *Injection) {
+	f.Lock()
+	defer f.Unlock()
+	f.injections = append(f.injections, i)
+}
+
+func (f *Fake) ClearInjections() {
+	f.Lock()
+	defer f.Unlock()
+	f.injections = nil
+}
+
+// Calls returns all the command lines executed so far
+func (f *Fake) Calls() [][]string {
+	f.Lock()
+	defer f.Unlock()
+	calls := make([][]string, len(f.calls))
+	copy(calls, f.calls)
+	return calls
+}
+
+// Envs returns the extra environment variables of the command lines executed
+// so far, in the same order as Calls
+func (f *Fake) Envs() [][]string {
+	f.Lock()
+	defer f.Unlock()
+	envs := make([][]string, len(f.envs))
+	copy(envs, f.envs)
+	return envs
+}
+
+func (f *Fake) Execute(args ...string) (string, error) {
+	return f.ExecuteWithTimeout(CmdTimeout, args...)
+}
+
+func (f *Fake) ExecuteWithTimeout(timeout time.Duration, args ...string) (string, error) {
+	return f.execute(nil, timeout, args)
+}
+
+func (f *Fake) WithEnv(env []string) types.EngineCLI {
+	return &fakeEnvCLI{fake: f, env: env}
+}
+
+type fakeEnvCLI struct {
+	fake *Fake
+	env  []string
+}
+
+func (e *fakeEnvCLI) Execute(args ...string) (string, error) {
+	return e.ExecuteWithTimeout(CmdTimeout, args...)
+}
+
+func (e *fakeEnvCLI) ExecuteWithTimeout(timeout time.Duration, args ...string) (string, error) {
+	return e.fake.execute(e.env, timeout, args)
+}
+
+func (e *fakeEnvCLI) WithEnv(env []string) types.EngineCLI {
+	return &fakeEnvCLI{fake: e.fake, env: append(append([]string{}, e.env...), env...)}
+}
+
+func (f *Fake) execute(env []string, timeout time.Duration, args []string) (string, error) {
+	url, cmd := splitURL(args)
+
+	f.Lock()
+	f.calls = append(f.calls, args)
+	f.envs = append(f.envs, env)
+	i := f.takeInjection(url, cmd)
+	f.Unlock()
+
+	if i != nil {
+		if i.Delay >= timeout {
+			return "", errors.Errorf("timeout executing: %v %v", Binary, args)
+		}
+		time.Sleep(i.Delay)
+		return i.Output, i.Err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	output, err := f.run(url, cmd)
+	if err != nil {
+		return output, errors.Wrapf(err, "failed to execute: %v %v", Binary, args)
+	}
+	return output, nil
+}
+
+func splitURL(args []string) (string, []string) {
+	if len(args) >= 2 && args[0] == "--url" {
+		return args[1], args[2:]
+	}
+	return "", args
+}
+
+func hasPrefix(args, prefix []string) bool {
+	if len(prefix) > len(args) {
+		return false
+	}
+	for i := range prefix {
+		if args[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Fake) takeInjection(url string, args []string) *Injection {
+	for k, i := range f.injections {
+		if (i.URL == "" || i.URL == url) && hasPrefix(args, i.Args) {
+			if i.Times > 0 {
+				if i.Times--; i.Times == 0 {
+					f.injections = append(f.injections[:k], f.injections[k+1:]...)
+				}
+			}
+			return i
+		}
+	}
+	return nil
+}
+
+func (f *Fake) run(url string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("no command")
+	}
+	if args[0] == "backup" && len(args) > 1 && args[1] != "create" && args[1] != "restore" {
+		return f.runBackupStore(args[1:])
+	}
+
+	c := f.controllers[url]
+	if c == nil {
+		return "", errors.Errorf("cannot connect to controller at '%s'", url)
+	}
+	switch args[0] {
+	case "ls":
+		return f.ls(c), nil
+	case "info":
+		return f.info(c)
+	case "add":
+		if len(args) != 2 {
+			return "", errors.New("replica address required")
+		}
+		for _, r := range c.replicas {
+			if r.url == args[1] {
+				return "", errors.Errorf("replica %v is already added", args[1])
+			}
+		}
+		c.replicas = append(c.replicas, &fakeReplica{url: args[1], mode: types.ReplicaModeRW})
+		return "", nil
+	case "rm":
+		if len(args) != 2 {
+			return "", errors.New("replica address required")
+		}
+		for k, r := range c.replicas {
+			if r.url == args[1] {
+				c.replicas = append(c.replicas[:k], c.replicas[k+1:]...)
+				return "", nil
+			}
+		}
+		return "", errors.Errorf("cannot find replica %v", args[1])
+	case "expand":
+		if f.noExpand {
+			break
+		}
+		if len(args) != 3 || args[1] != "--size" {
+			return "", errors.New("size required")
+		}
+		size, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid size %v", args[2])
+		}
+		return "", f.expand(f.volumes[c.volumeName], size)
+	case "snapshot":
+		return f.runSnapshot(f.volumes[c.volumeName], args[1:])
+	case "backup":
+		return f.runBackup(f.volumes[c.volumeName], args[1:])
+	}
+	return "", errors.Errorf("unknown command %v", args)
+}
+
+func (f *Fake) ls(c *fakeController) string {
+	lines := []string{"ADDRESS                              MODE CHAIN"}
+	chain := "[" + strings.Join(f.volumes[c.volumeName].chain(), " ") + "]"
+	for _, r := range c.replicas {
+		lines = append(lines, fmt.Sprintf("%s %s %s", r.url, r.mode, chain))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (f *Fake) info(c *fakeController) (string, error) {
+	info := map[string]interface{}{
+		"name":         c.volumeName,
+		"replicaCount": len(c.replicas),
+		"endpoint":     "/dev/longhorn/" + c.volumeName,
+	}
+	if !f.noExpand {
+		info["size"] = strconv.FormatInt(f.volumes[c.volumeName].size, 10)
+	}
+	b, err := json.Marshal(info)
+	return string(b), err
+}
+
+func (f *Fake) expand(v *fakeVolume, size int64) error {
+	if size < v.size {
+		return errors.Errorf("cannot shrink volume %v from %v to %v", v.name, v.size, size)
+	}
+	v.size = size
+	return nil
+}
+
+// VolumeSize returns the size of the volume as seen by its controllers
+func (f *Fake) VolumeSize(volumeName string) int64 {
+	f.Lock()
+	defer f.Unlock()
+	if v := f.volumes[volumeName]; v != nil {
+		return v.size
+	}
+	return 0
+}
+
+// ReplicaAPI returns the stand-in for the REST API and the sync agent of the
+// replica at address
+func (f *Fake) ReplicaAPI(address string) ReplicaAPI {
+	return &fakeReplicaAPI{fake: f, url: fakeReplicaURL(address)}
+}
+
+type fakeReplicaAPI struct {
+	fake *Fake
+	url  string
+}
+
+func fakeDiskFile(name string) string {
+	if name == fakeHeadName {
+		return "volume-head-000.img"
+	}
+	return "volume-snap-" + name + ".img"
+}
+
+func (a *fakeReplicaAPI) GetReplica() (*ReplicaState, error) {
+	a.fake.Lock()
+	defer a.fake.Unlock()
+
+	for _, c := range a.fake.controllers {
+		for _, r := range c.replicas {
+			if r.url != a.url {
+				continue
+			}
+			v := a.fake.volumes[c.volumeName]
+			replica := &ReplicaState{State: "open", Disks: map[string]*ReplicaDisk{}}
+			for _, name := range v.chain() {
+				file := fakeDiskFile(name)
+				replica.Chain = append(replica.Chain, file)
+				replica.Disks[file] = &ReplicaDisk{Name: file, Size: v.snapshots[name].Size}
+			}
+			return replica, nil
+		}
+	}
+	return nil, errors.Errorf("cannot connect to replica at '%s'", a.url)
+}
+
+func (a *fakeReplicaAPI) ListSyncProcesses() ([]*SyncProcess, error) {
+	a.fake.Lock()
+	defer a.fake.Unlock()
+
+	processes := []*SyncProcess{}
+	for _, p := range a.fake.syncs[a.url] {
+		process := *p
+		processes = append(processes, &process)
+	}
+	return processes, nil
+}
+
+func (v *fakeVolume) chain() []string {
+	chain := []string{}
+	for name := fakeHeadName; name != ""; name = v.snapshots[name].Parent {
+		chain = append(chain, name)
+	}
+	return chain
+}
+
+func removeString(l []string, s string) []string {
+	r := []string{}
+	for _, v := range l {
+		if v != s {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+func (f *Fake) runSnapshot(v *fakeVolume, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("snapshot command required")
+	}
+	switch args[0] {
+	case "create":
+		labels := map[string]string{}
+		name := ""
+		for i := 1; i < len(args); i++ {
+			if args[i] == "--label" && i+1 < len(args) {
+				i++
+				kv := strings.SplitN(args[i], "=", 2)
+				if len(kv) != 2 {
+					return "", errors.Errorf("invalid label %v", args[i])
+				}
+				labels[kv[0]] = kv[1]
+				continue
+			}
+			name = args[i]
+		}
+		if name == "" {
+			name = util.UUID()
+		}
+		if v.snapshots[name] != nil {
+			return "", errors.Errorf("snapshot %v already exists", name)
+		}
+		head := v.snapshots[fakeHeadName]
+		snap := &types.SnapshotInfo{
+			Name:        name,
+			Parent:      head.Parent,
+			Children:    []string{fakeHeadName},
+			UserCreated: true,
+			Created:     f.now(),
+			Size:        "0",
+			Labels:      labels,
+		}
+		if parent := v.snapshots[head.Parent]; parent != nil {
+			parent.Children = append(removeString(parent.Children, fakeHeadName), name)
+		}
+		head.Parent = name
+		v.snapshots[name] = snap
+		return name + "\n", nil
+	case "info":
+		b, err := json.Marshal(v.snapshots)
+		return string(b), err
+	case "rm":
+		if len(args) != 2 {
+			return "", errors.New("snapshot name required")
+		}
+		snap := v.snapshots[args[1]]
+		if snap == nil || args[1] == fakeHeadName {
+			return "", errors.Errorf("cannot find snapshot %v", args[1])
+		}
+		snap.Removed = true
+		return "", nil
+	case "revert":
+		if len(args) != 2 {
+			return "", errors.New("snapshot name required")
+		}
+		snap := v.snapshots[args[1]]
+		if snap == nil || snap.Removed || args[1] == fakeHeadName {
+			return "", errors.Errorf("cannot find snapshot %v", args[1])
+		}
+		head := v.snapshots[fakeHeadName]
+		if parent := v.snapshots[head.Parent]; parent != nil {
+			parent.Children = removeString(parent.Children, fakeHeadName)
+		}
+		snap.Children = append(snap.Children, fakeHeadName)
+		head.Parent = snap.Name
+		return "", nil
+	case "purge":
+		for name, snap := range v.snapshots {
+			if !snap.Removed {
+				continue
+			}
+			parent := v.snapshots[snap.Parent]
+			if parent != nil {
+				parent.Children = removeString(parent.Children, name)
+				parent.Children = append(parent.Children, snap.Children...)
+			}
+			for _, child := range snap.Children {
+				v.snapshots[child].Parent = snap.Parent
+			}
+			delete(v.snapshots, name)
+		}
+		return "", nil
+	}
+	return "", errors.Errorf("unknown snapshot command %v", args)
+}
+
+func (f *Fake) runBackup(v *fakeVolume, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("backup command required")
+	}
+	switch args[0] {
+	case "create":
+		target, snapName := "", ""
+		for i := 1; i < len(args); i++ {
+			if args[i] == "--dest" && i+1 < len(args) {
+				i++
+				target = args[i]
+				continue
+			}
+			snapName = args[i]
+		}
+		if target == "" {
+			return "", errors.New("backup target required")
+		}
+		snap := v.snapshots[snapName]
+		if snap == nil || snap.Removed || snapName == fakeHeadName {
+			return "", errors.Errorf("cannot find snapshot %v", snapName)
+		}
+		if f.targets[target] == nil {
+			f.targets[target] = map[string]*fakeBackupVolume{}
+		}
+		bv := f.targets[target][v.name]
+		if bv == nil {
+			bv = &fakeBackupVolume{
+				Name:    v.name,
+				Size:    strconv.FormatInt(v.size, 10),
+				Created: f.now(),
+				Backups: map[string]*fakeBackup{},
+			}
+			f.targets[target][v.name] = bv
+		}
+		name := "backup-" + util.RandomID()
+		b := &fakeBackup{
+			Name:            name,
+			URL:             fmt.Sprintf("%s?backup=%s&volume=%s", target, name, v.name),
+			SnapshotName:    snap.Name,
+			SnapshotCreated: snap.Created,
+			Created:         f.now(),
+			Size:            "0",
+		}
+		bv.Backups[b.URL] = b
+		bv.LastBackupName = name
+		return b.URL + "\n", nil
+	case "restore":
+		if len(args) != 2 {
+			return "", errors.New("backup URL required")
+		}
+		bv, _, err := f.findBackup(args[1])
+		if err != nil {
+			return "", err
+		}
+		size, err := strconv.ParseInt(bv.Size, 10, 64)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid backup volume size %v", bv.Size)
+		}
+		if size > v.size {
+			return "", errors.Errorf("backup volume size %v doesn't fit volume size %v", bv.Size, v.size)
+		}
+		return "", nil
+	}
+	return "", errors.Errorf("unknown backup command %v", args)
+}
+
+// runBackupStore handles the backup commands which don't need a controller
+func (f *Fake) runBackupStore(args []string) (string, error) {
+	switch args[0] {
+	case "ls":
+		target, volumeName, volumeOnly := "", "", false
+		for i := 1; i < len(args); i++ {
+			switch {
+			case args[i] == "--volume" && i+1 < len(args):
+				i++
+				volumeName = args[i]
+			case args[i] == "--volume-only":
+				volumeOnly = true
+			default:
+				target = args[i]
+			}
+		}
+		volumes := map[string]*fakeBackupVolume{}
+		for name, bv := range f.targets[target] {
+			if volumeName != "" && name != volumeName {
+				continue
+			}
+			v := *bv
+			if volumeOnly {
+				v.Backups = nil
+			}
+			volumes[name] = &v
+		}
+		if volumeName != "" && len(volumes) == 0 {
+			out := fmt.Sprintf("cannot find %v in backupstore\n", volumeName)
+			return out, errors.New(out)
+		}
+		b, err := json.Marshal(volumes)
+		return string(b), err
+	case "inspect":
+		if len(args) != 2 {
+			return "", errors.New("backup URL required")
+		}
+		bv, b, err := f.findBackup(args[1])
+		if err != nil {
+			return err.Error() + "\n", err
+		}
+		out, err := json.Marshal(&fakeBackupInspect{
+			fakeBackup:    *b,
+			VolumeName:    bv.Name,
+			VolumeSize:    bv.Size,
+			VolumeCreated: bv.Created,
+		})
+		return string(out), err
+	case "rm":
+		if len(args) != 2 {
+			return "", errors.New("backup URL required")
+		}
+		bv, b, err := f.findBackup(args[1])
+		if err != nil {
+			return err.Error() + "\n", err
+		}
+		delete(bv.Backups, b.URL)
+		return "", nil
+	}
+	return "", errors.Errorf("unknown backup command %v", args)
+}
+
+func (f *Fake) findBackup(backupURL string) (*fakeBackupVolume, *fakeBackup, error) {
+	parts := strings.SplitN(backupURL, "?", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.Errorf("invalid backup URL %v", backupURL)
+	}
+	query, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid backup URL %v", backupURL)
+	}
+	bv := f.targets[parts[0]][query.Get("volume")]
+	if bv == nil {
+		return nil, nil, errors.Errorf("cannot find %v in backupstore", query.Get("volume"))
+	}
+	for _, b := range bv.Backups {
+		if b.Name == query.Get("backup") {
+			return bv, b, nil
+		}
+	}
+	return nil, nil, errors.Errorf("cannot find backup %v", query.Get("backup"))
+}
+
+// BackupURLs returns the URLs of all the backups of the volume in the target,
+// in the order of creation
+func (f *Fake) BackupURLs(target, volumeName string) []string {
+	f.Lock()
+	defer f.Unlock()
+
+	backups := []*fakeBackup{}
+	if bv := f.targets[target][volumeName]; bv != nil {
+		for _, b := range bv.Backups {
+			backups = append(backups, b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Created < backups[j].Created })
+	urls := []string{}
+	for _, b := range backups {
+		urls = append(urls, b.URL)
+	}
+	return urls
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const fakeVolumeID = "1"
+
+type fakeAPIError struct {
+	Type    string `json:"type"`
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Handler serves the REST API of the simulated controller at address, e.g.
+// for an httptest.Server. The state is shared with the CLI commands.
+func (f *Fake) Handler(address string) http.Handler {
+	return &fakeAPI{fake: f, ctrlURL: fakeControllerURL(address)}
+}
+
+type fakeAPI struct {
+	fake    *Fake
+	ctrlURL string
+}
+
+func fakeEncodeID(address string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(address))
+}
+
+func writeFakeAPIError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&fakeAPIError{
+		Type:    "error",
+		Status:  status,
+		Code:    http.StatusText(status),
+		Message: err.Error(),
+	})
+}
+
+func writeFakeAPIResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.fake.Lock()
+	defer a.fake.Unlock()
+
+	a.fake.calls = append(a.fake.calls, []string{r.Method, r.URL.String()})
+	a.fake.envs = append(a.fake.envs, nil)
+
+	c := a.fake.controllers[a.ctrlURL]
+	if c == nil {
+		writeFakeAPIError(w, http.StatusServiceUnavailable, errors.New("controller is shut down"))
+		return
+	}
+	base := "http://" + r.Host + "/v1"
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+
+	switch {
+	case path == "/replicas" && r.Method == "GET":
+		replicas := []*Replica{}
+		for _, rep := range c.replicas {
+			replicas = append(replicas, a.replica(base, rep))
+		}
+		writeFakeAPIResponse(w, map[string]interface{}{"type": "collection", "data": replicas})
+	case path == "/replicas" && r.Method == "POST":
+		input := &replicaInput{}
+		if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, err := a.fake.run(a.ctrlURL, []string{"add", input.Address}); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeFakeAPIResponse(w, a.replica(base, c.replicas[len(c.replicas)-1]))
+	case strings.HasPrefix(path, "/replicas/") && r.Method == "DELETE":
+		id := strings.TrimPrefix(path, "/replicas/")
+		for _, rep := range c.replicas {
+			if fakeEncodeID(rep.url) == id {
+				a.fake.run(a.ctrlURL, []string{"rm", rep.url})
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeFakeAPIError(w, http.StatusNotFound, errors.Errorf("cannot find replica %v", id))
+	case path == "/volumes" && r.Method == "GET":
+		volume := &Volume{
+			resource: resource{
+				ID:   fakeVolumeID,
+				Type: "volume",
+				Links: map[string]string{
+					"self": base + "/volumes/" + fakeVolumeID,
+				},
+				Actions: map[string]string{
+					"snapshot": base + "/volumes/" + fakeVolumeID + "?action=snapshot",
+					"revert":   base + "/volumes/" + fakeVolumeID + "?action=revert",
+				},
+			},
+			Name:         c.volumeName,
+			ReplicaCount: len(c.replicas),
+			Endpoint:     "/dev/longhorn/" + c.volumeName,
+		}
+		if !a.fake.noExpand {
+			volume.Actions["expand"] = base + "/volumes/" + fakeVolumeID + "?action=expand"
+			volume.Size = strconv.FormatInt(a.fake.volumes[c.volumeName].size, 10)
+		}
+		writeFakeAPIResponse(w, map[string]interface{}{"type": "collection", "data": []*Volume{volume}})
+	case path == "/volumes/"+fakeVolumeID && r.Method == "POST":
+		a.volumeAction(w, r, c)
+	default:
+		writeFakeAPIError(w, http.StatusNotFound, errors.Errorf("unknown request %v %v", r.Method, r.URL))
+	}
+}
+
+func (a *fakeAPI) replica(base string, rep *fakeReplica) *Replica {
+	return &Replica{
+		resource: resource{
+			ID:   fakeEncodeID(rep.url),
+			Type: "replica",
+			Links: map[string]string{
+				"self": base + "/replicas/" + fakeEncodeID(rep.url),
+			},
+		},
+		Address: rep.url,
+		Mode:    string(rep.mode),
+	}
+}
+
+func (a *fakeAPI) volumeAction(w http.ResponseWriter, r *http.Request, c *fakeController) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeFakeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	input := &snapshotInput{}
+	if err := json.Unmarshal(body, input); err != nil {
+		writeFakeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	v := a.fake.volumes[c.volumeName]
+	switch action := r.URL.Query().Get("action"); action {
+	case "snapshot":
+		args := []string{"create"}
+		for k, v := range input.Labels {
+			args = append(args, "--label", fmt.Sprintf("%s=%s", k, v))
+		}
+		if input.Name != "" {
+			args = append(args, input.Name)
+		}
+		name, err := a.fake.runSnapshot(v, args)
+		if err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeFakeAPIResponse(w, &snapshotOutput{ID: strings.TrimSpace(name)})
+	case "revert":
+		if _, err := a.fake.runSnapshot(v, []string{"revert", input.Name}); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeFakeAPIResponse(w, map[string]string{})
+	case "expand":
+		if a.fake.noExpand {
+			writeFakeAPIError(w, http.StatusNotFound, errors.Errorf("unknown action %v", action))
+			return
+		}
+		input := &expandInput{}
+		if err := json.Unmarshal(body, input); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := a.fake.expand(v, input.Size); err != nil {
+			writeFakeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeFakeAPIResponse(w, map[string]string{})
+	default:
+		writeFakeAPIError(w, http.StatusNotFound, errors.Errorf("unknown action %v", action))
+	}
+}
@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ReplicaAPI is the part of the REST API of a replica and of its sync agent
+// used to follow the rebuild of the replica. The sync agent copies the
+// snapshot files from a healthy replica while the replica is rebuilt.
+type ReplicaAPI interface {
+	GetReplica() (*ReplicaState, error)
+	ListSyncProcesses() ([]*SyncProcess, error)
+}
+
+// ReplicaState is the replica as reported by its own REST API. Chain lists
+// the disk files from the volume head to the oldest snapshot.
+type ReplicaState struct {
+	resource
+	State string                  `json:"state"`
+	Chain []string                `json:"chain"`
+	Disks map[string]*ReplicaDisk `json:"disks"`
+}
+
+type ReplicaDisk struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+}
+
+// SyncProcess is a file copy run by the sync agent, ExitCode is -1 while it's
+// running
+type SyncProcess struct {
+	resource
+	ProcessType string `json:"processType"`
+	SrcFile     string `json:"srcFile"`
+	DestFile    string `json:"destFile"`
+	ExitCode    int    `json:"exitCode"`
+}
+
+type replicaClient struct {
+	replica   *Client
+	syncAgent *Client
+}
+
+// NewReplicaAPI connects to the REST API of the replica at
+// http://<address>:9502 and to its sync agent at http://<address>:9504
+func NewReplicaAPI(address string) ReplicaAPI {
+	return newReplicaClient("http://"+address+":9502", "http://"+address+":9504")
+}
+
+func newReplicaClient(replicaURL, syncAgentURL string) *replicaClient {
+	return &replicaClient{
+		replica:   NewClient(replicaURL),
+		syncAgent: NewClient(syncAgentURL),
+	}
+}
+
+// GetReplica returns the only replica served by the replica server
+func (c *replicaClient) GetReplica() (*ReplicaState, error) {
+	replicas := []*ReplicaState{}
+	if err := c.replica.list("/replicas", &replicas); err != nil {
+		return nil, err
+	}
+	if len(replicas) == 0 {
+		return nil, errors.Errorf("no replica is served by %v", c.replica.url)
+	}
+	return replicas[0], nil
+}
+
+func (c *replicaClient) ListSyncProcesses() ([]*SyncProcess, error) {
+	processes := []*SyncProcess{}
+	if err := c.syncAgent.list("/processes", &processes); err != nil {
+		return nil, err
+	}
+	return processes, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"os"
 
@@ -10,9 +11,13 @@ import (
 	"github.com/rancher/longhorn-manager/api"
 	"github.com/rancher/longhorn-manager/backups"
 	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/engine"
 	"github.com/rancher/longhorn-manager/manager"
 	"github.com/rancher/longhorn-manager/orch"
 	"github.com/rancher/longhorn-manager/orch/docker"
+	"github.com/rancher/longhorn-manager/orch/kubernetes"
+	"github.com/rancher/longhorn-manager/orch/memory"
+	"github.com/rancher/longhorn-manager/store"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util/daemon"
 	"github.com/rancher/longhorn-manager/util/server"
@@ -38,32 +43,93 @@ func main() {
 			Usage:  "enable debug logging level",
 			EnvVar: "RANCHER_DEBUG",
 		},
+		cli.StringFlag{
+			Name:  "debug-vars-listen",
+			Usage: "serve the counters of the manager at /debug/vars on `address`, e.g. 127.0.0.1:9510. It has no authentication, keep it off the public network. Disabled by default",
+		},
 		cli.StringFlag{
 			Name:  "orchestrator",
-			Usage: "Choose orchestrator: docker",
+			Usage: "Choose orchestrator: docker, kubernetes, memory",
 			Value: "docker",
 		},
 
+		cli.BoolFlag{
+			Name:  "engine-cli",
+			Usage: "run the longhorn CLI for all the engine operations, instead of using the engine REST API",
+		},
 		cli.StringFlag{
 			Name:   orch.EngineImageParam,
 			EnvVar: "LONGHORN_ENGINE_IMAGE",
 			Usage:  "Specify Longhorn engine image",
 		},
+		cli.StringSliceFlag{
+			Name:  orch.HostLabelParam,
+			Usage: "label of the current host, e.g. `zone=us-east-1a`, for docker and memory orchestrators. Kubernetes uses the labels of the node",
+		},
+		cli.StringFlag{
+			Name:  orch.StoragePathParam,
+			Usage: "path of the filesystem keeping the replica data on the current host, for reporting the storage capacity. Defaults to the data path of the orchestrator",
+		},
+		cli.StringFlag{
+			Name:  orch.StorageReservedParam,
+			Usage: "storage of the current host not to be used by the replicas, e.g. `10G`",
+		},
+		cli.StringFlag{
+			Name:  orch.CredentialKeyFileParam,
+			Usage: "file of the key encrypting the backup target credentials, must be the same on all the hosts. The key can also be set by " + orch.CredentialKeyEnv,
+		},
 
 		// Docker
+		cli.StringFlag{
+			Name:  "store",
+			Usage: "Choose metadata store: etcd (v2 API), etcd3, bolt, memory",
+			Value: "etcd",
+		},
 		cli.StringSliceFlag{
 			Name:  "etcd-servers",
 			Usage: "etcd server ip and port, in format `http://etcd1:2379,http://etcd2:2379`",
 		},
+		cli.BoolFlag{
+			Name:  "etcd3-migrate",
+			Usage: "with etcd3 store, copy the metadata kept through the etcd v2 API on start, the keys already in etcd v3 are kept",
+		},
 		cli.StringFlag{
 			Name:  "etcd-prefix",
-			Usage: "the prefix using with etcd server",
+			Usage: "the prefix of the keys in the metadata store",
 			Value: "/longhorn",
 		},
+		cli.StringFlag{
+			Name:  "bolt-path",
+			Usage: "path of the database file for bolt store",
+			Value: store.DefaultBoltPath,
+		},
 		cli.StringFlag{
 			Name:  "docker-network",
 			Usage: "use specified docker network, can be omitted for auto detection",
 		},
+
+		// Kubernetes
+		cli.StringFlag{
+			Name:   "kubernetes-namespace",
+			EnvVar: "POD_NAMESPACE",
+			Usage:  "namespace of the longhorn pods, can be omitted when running in the cluster",
+		},
+		cli.StringFlag{
+			Name:  "kubernetes-server",
+			Usage: "address of the Kubernetes API server, e.g. `http://localhost:8001` for kubectl proxy, can be omitted when running in the cluster",
+		},
+		cli.StringFlag{
+			Name:  "kubernetes-manager-selector",
+			Usage: "label selector of the longhorn-manager pods",
+			Value: kubernetes.DefaultManagerSelector,
+		},
+
+		// Memory
+		cli.IntFlag{
+			Name:  "memory-hosts",
+			Usage: "number of simulated hosts",
+			Value: memory.DefaultHosts,
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -76,6 +142,10 @@ func RunManager(c *cli.Context) error {
 	var (
 		orc types.Orchestrator
 		err error
+
+		engineCLI     types.EngineCLI = engine.New()
+		newReplicaAPI                 = engine.NewReplicaAPI
+		useEngineAPI                  = !c.Bool("engine-cli")
 	)
 
 	if c.Bool("debug") {
@@ -85,28 +155,68 @@ func RunManager(c *cli.Context) error {
 	if c.String(orch.EngineImageParam) == "" {
 		return fmt.Errorf("Must specify %v", orch.EngineImageParam)
 	}
+	if err := orch.LoadCredentialKey(c); err != nil {
+		return err
+	}
 
 	orcName := c.String("orchestrator")
-	if orcName == "docker" {
+	switch orcName {
+	case "docker":
 		orc, err = docker.New(c)
-	} else {
+	case "kubernetes":
+		orc, err = kubernetes.New(c)
+	case "memory":
+		// the fake engine stands in for the engine containers
+		fake := engine.NewFake()
+		engineCLI = fake
+		newReplicaAPI = fake.ReplicaAPI
+		useEngineAPI = false
+		orc, err = memory.New(c, fake)
+	default:
 		err = fmt.Errorf("Invalid orchestrator %v", orcName)
 	}
 	if err != nil {
 		return err
 	}
 
-	man := manager.New(orc, manager.Monitor(controller.Get), controller.Get, backups.New)
-	if err := man.Start(); err != nil {
-		return err
+	orcs := []types.Orchestrator{orc}
+	addresses := []string{fmt.Sprintf(":%v", api.DefaultPort)}
+	if orcName == "memory" {
+		// the simulated hosts forward the requests to each other like the
+		// real ones
+		orcs = memory.Hosts(orc)
+		addresses = []string{}
+		for _, o := range orcs {
+			address, err := o.GetAddress(o.GetCurrentHostID())
+			if err != nil {
+				return err
+			}
+			addresses = append(addresses, address)
+		}
 	}
 
+	stopCh := make(chan struct{})
 	proxy := api.Proxy()
+	for i, o := range orcs {
+		ctrls := controller.NewControllers(engineCLI, newReplicaAPI, useEngineAPI)
+		man := manager.New(o, manager.Monitor(ctrls, manager.MonitoringPeriod), ctrls.Get, backups.New(engineCLI))
+		if err := man.Start(stopCh); err != nil {
+			return err
+		}
+
+		s := api.NewServer(man, o, proxy)
+
+		if i == 0 {
+			go server.NewUnixServer(sockFile).Serve(api.Handler(s))
+		}
+		go server.NewTCPServer(addresses[i]).Serve(api.Handler(s))
+	}
 
-	s := api.NewServer(man, orc, proxy)
-
-	go server.NewUnixServer(sockFile).Serve(api.Handler(s))
-	go server.NewTCPServer(fmt.Sprintf(":%v", api.DefaultPort)).Serve(api.Handler(s))
+	if address := c.String("debug-vars-listen"); address != "" {
+		go server.NewTCPServer(address).Serve(expvar.Handler())
+	}
 
-	return daemon.WaitForExit()
+	err = daemon.WaitForExit()
+	close(stopCh)
+	return err
 }
@@ -0,0 +1,147 @@
+package manager
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// BackupTargetCheckPeriod is how often the backup targets are checked
+var BackupTargetCheckPeriod = time.Minute
+
+// validateBackupTargetURL checks the URL is in one of the forms the engine
+// supports: nfs://server:/path, s3://bucket@region/path or vfs:///path
+func validateBackupTargetURL(backupTarget string) error {
+	u, err := url.Parse(backupTarget)
+	if err != nil {
+		return errors.Wrapf(err, "invalid backup target URL '%s'", backupTarget)
+	}
+	switch u.Scheme {
+	case "nfs", "s3":
+		if u.Host == "" {
+			return errors.Errorf("invalid backup target URL '%s', missing %v server", backupTarget, u.Scheme)
+		}
+	case "vfs":
+		if u.Path == "" {
+			return errors.Errorf("invalid backup target URL '%s', missing path", backupTarget)
+		}
+	default:
+		return errors.Errorf("invalid backup target URL '%s', scheme should be nfs, s3 or vfs", backupTarget)
+	}
+	return nil
+}
+
+// CheckBackupTarget validates the URL of the backup target and makes sure it
+// can be reached with its credential. The result is recorded as the status of
+// the target.
+func (man *volumeManager) CheckBackupTarget(target *types.BackupTarget) error {
+	err := man.checkBackupTarget(target)
+	man.setBackupTargetStatus(target, err)
+	return err
+}
+
+func (man *volumeManager) checkBackupTarget(target *types.BackupTarget) error {
+	if err := validateBackupTargetURL(target.URL); err != nil {
+		return err
+	}
+	backups, err := man.ManagerBackupOps(target)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(backups.Check(), "backup target '%s' is not available", target.Name)
+}
+
+func (man *volumeManager) setBackupTargetStatus(target *types.BackupTarget, err error) {
+	status := &types.BackupTargetStatus{
+		Name:        target.Name,
+		URL:         target.URL,
+		Available:   err == nil,
+		LastChecked: util.Now(),
+	}
+	if err != nil {
+		status.Message = err.Error()
+	}
+
+	man.Lock()
+	defer man.Unlock()
+	last := man.backupTargetStatus[target.Name]
+	switch {
+	case err != nil && (last == nil || last.Available):
+		logrus.Warnf("%v", err)
+	case err == nil && last != nil && !last.Available:
+		logrus.Infof("backup target '%s' is available again", target.Name)
+	}
+	man.backupTargetStatus[target.Name] = status
+}
+
+// watchBackupTargets checks the backup targets every
+// BackupTargetCheckPeriod until stopCh is closed
+func (man *volumeManager) watchBackupTargets(stopCh <-chan struct{}) {
+	for {
+		if err := man.checkBackupTargets(); err != nil {
+			logrus.Errorf("%+v", errors.Wrap(err, "failed to check backup targets"))
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(BackupTargetCheckPeriod):
+		}
+	}
+}
+
+func (man *volumeManager) checkBackupTargets() error {
+	settings, err := man.settings.GetSettings()
+	if err != nil {
+		return errors.Wrap(err, "unable to get settings")
+	}
+	for _, target := range settings.ListBackupTargets() {
+		man.CheckBackupTarget(target)
+	}
+	return nil
+}
+
+// ListBackupTargetStatus returns the status of all the backup targets, the
+// targets which haven't been checked since they're set are shown unavailable
+func (man *volumeManager) ListBackupTargetStatus() ([]*types.BackupTargetStatus, error) {
+	settings, err := man.settings.GetSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get settings")
+	}
+	statuses := []*types.BackupTargetStatus{}
+	for _, target := range settings.ListBackupTargets() {
+		statuses = append(statuses, man.backupTargetStatusOf(target))
+	}
+	return statuses, nil
+}
+
+func (man *volumeManager) GetBackupTargetStatus(name string) (*types.BackupTargetStatus, error) {
+	settings, err := man.settings.GetSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get settings")
+	}
+	target, err := settings.GetBackupTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	return man.backupTargetStatusOf(target), nil
+}
+
+func (man *volumeManager) backupTargetStatusOf(target *types.BackupTarget) *types.BackupTargetStatus {
+	man.Lock()
+	defer man.Unlock()
+	status := man.backupTargetStatus[target.Name]
+	if status == nil || status.URL != target.URL {
+		return &types.BackupTargetStatus{
+			Name:    target.Name,
+			URL:     target.URL,
+			Message: "not checked yet",
+		}
+	}
+	s := *status
+	return &s
+}
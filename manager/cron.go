@@ -3,7 +3,6 @@ package manager
 import (
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
-	"github.com/rancher/longhorn-manager/backups"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 	"github.com/robfig/cron"
@@ -27,14 +26,22 @@ var tasks = map[string]taskCons{
 	types.BackupTaskName:   BackupTask,
 }
 
+// BackupTargets gives the recurring backups access to the backup targets,
+// implemented by the VolumeManager
+type BackupTargets interface {
+	BackupTargetEnv(target *types.BackupTarget) ([]string, error)
+	ManagerBackupOps(target *types.BackupTarget) (types.ManagerBackupOps, error)
+}
+
 type jobRunner struct {
 	volume   *types.VolumeInfo
 	ctrl     types.Controller
 	settings types.Settings
+	targets  BackupTargets
 }
 
-func newJobRunner(volume *types.VolumeInfo, ctrl types.Controller, settings types.Settings) *jobRunner {
-	return &jobRunner{volume: volume, ctrl: ctrl, settings: settings}
+func newJobRunner(volume *types.VolumeInfo, ctrl types.Controller, settings types.Settings, targets BackupTargets) *jobRunner {
+	return &jobRunner{volume: volume, ctrl: ctrl, settings: settings, targets: targets}
 }
 
 type cronUpdate []*types.RecurringJob
@@ -43,8 +50,8 @@ func CronUpdate(jobs []*types.RecurringJob) types.Event {
 	return cronUpdate(jobs)
 }
 
-func RunJobs(volume *types.VolumeInfo, ctrl types.Controller, settings types.Settings, ch chan types.Event) {
-	runner := newJobRunner(volume, ctrl, settings)
+func RunJobs(volume *types.VolumeInfo, ctrl types.Controller, settings types.Settings, targets BackupTargets, ch chan types.Event) {
+	runner := newJobRunner(volume, ctrl, settings, targets)
 
 	c := runner.setJobs(volume.RecurringJobs)
 	if c == nil {
@@ -198,13 +205,21 @@ func (st *snapshotTask) cleanup() error {
 }
 
 func BackupTask(runner *jobRunner, job *types.RecurringJob, si *types.SettingsInfo) Task {
-	return &backupTask{runner: runner, job: job, backupTarget: si.BackupTarget}
+	bt := &backupTask{runner: runner, job: job}
+	target, err := si.GetBackupTarget(job.BackupTarget)
+	if err != nil {
+		bt.targetErr = errors.Wrapf(err, "invalid backup target of recurring job '%s'", job.Name)
+		return bt
+	}
+	bt.backupTarget = target
+	return bt
 }
 
 type backupTask struct {
 	sync.Mutex
 
-	backupTarget string
+	backupTarget *types.BackupTarget
+	targetErr    error
 
 	runner *jobRunner
 	job    *types.RecurringJob
@@ -217,13 +232,21 @@ type backupTask struct {
 }
 
 func (bt *backupTask) Run() error {
+	if bt.targetErr != nil {
+		return bt.targetErr
+	}
+	env, err := bt.runner.targets.BackupTargetEnv(bt.backupTarget)
+	if err != nil {
+		return errors.Wrapf(err, "error running recurring backup '%s', volume '%s'", bt.job.Name, bt.runner.volume.Name)
+	}
 	name := snapName(bt.job.Name)
 	if _, err := bt.runner.ctrl.SnapshotOps().Create(name, map[string]string{JobName: bt.job.Name, BackupJob: bt.job.Name}); err != nil {
 		return errors.Wrapf(err, "error creating snapshot for recurring backup '%s', volume '%s'", name, bt.runner.volume.Name)
 	}
-	bt.runner.ctrl.BgTaskQueue().Put(&types.BgTask{Task: types.BackupBgTask{
+	bt.runner.ctrl.BgTaskQueue().Put(&types.BgTask{Task: &types.BackupBgTask{
 		Snapshot:     name,
-		BackupTarget: bt.backupTarget,
+		BackupTarget: bt.backupTarget.URL,
+		Env:          env,
 		CleanupHook:  bt.cleanup,
 	}})
 	return nil
@@ -260,7 +283,10 @@ func (bt *backupTask) listSnapshots() ([]*types.SnapshotInfo, error) {
 }
 
 func (bt *backupTask) listBackups() ([]*types.BackupInfo, error) {
-	backupOps := backups.New(bt.backupTarget)
+	backupOps, err := bt.runner.targets.ManagerBackupOps(bt.backupTarget)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing backups, volume '%s'", bt.runner.volume.Name)
+	}
 	bs, err := backupOps.List(bt.runner.volume.Name)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error listing backups, volume '%s'", bt.runner.volume.Name)
@@ -295,10 +321,14 @@ func (bt *backupTask) cleanupBackups() error {
 			bt.cached = bs
 			bt.count = len(bs)
 		}
+		env, err := bt.runner.targets.BackupTargetEnv(bt.backupTarget)
+		if err != nil {
+			return errors.Wrapf(err, "error cleaning up backups, recurring job '%s', volume '%s'", bt.job.Name, bt.runner.volume.Name)
+		}
 		for bt.count > bt.job.Retain && len(bt.cached) > 0 {
 			toRm := bt.cached[0]
 			logrus.Infof("recurring job cleanup: backup '%s', volume '%s'", toRm.URL, bt.runner.volume.Name)
-			if err := bt.runner.ctrl.BackupOps().DeleteBackup(toRm.URL); err != nil {
+			if err := bt.runner.ctrl.BackupOps().DeleteBackup(toRm.URL, env); err != nil {
 				return errors.Wrapf(err, "deleting backup '%s', volume '%s'", toRm.Name, bt.runner.volume.Name)
 			}
 			bt.cached = bt.cached[1:]
@@ -0,0 +1,202 @@
+package manager
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rancher/longhorn-manager/backups"
+	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/engine"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+const testBackupTarget = "vfs:///var/lib/longhorn/backups/default"
+
+type testSettings struct {
+	settings types.SettingsInfo
+}
+
+func (s *testSettings) GetSettings() (*types.SettingsInfo, error) {
+	settings := s.settings
+	return &settings, nil
+}
+
+func (s *testSettings) SetSettings(settings *types.SettingsInfo) error {
+	s.settings = *settings
+	return nil
+}
+
+// testBackupTargets passes the values of the credentials as they are to the
+// backup commands run with cli
+type testBackupTargets struct {
+	cli         types.EngineCLI
+	credentials map[string][]string
+}
+
+func (t *testBackupTargets) BackupTargetEnv(target *types.BackupTarget) ([]string, error) {
+	if target.Credential == "" {
+		return nil, nil
+	}
+	env, ok := t.credentials[target.Credential]
+	if !ok {
+		return nil, errors.Errorf("cannot find credential '%s'", target.Credential)
+	}
+	return env, nil
+}
+
+func (t *testBackupTargets) ManagerBackupOps(target *types.BackupTarget) (types.ManagerBackupOps, error) {
+	env, err := t.BackupTargetEnv(target)
+	if err != nil {
+		return nil, err
+	}
+	return backups.New(t.cli)(target.URL, env), nil
+}
+
+func newTestJobRunner(assert *require.Assertions, volumeName string) (*engine.Fake, *jobRunner) {
+	fake := engine.NewFake()
+	fake.LaunchController("10.42.0.1", volumeName, 1024, []string{"tcp://10.42.0.2:9502"})
+	volume := &types.VolumeInfo{
+		Name: volumeName,
+		Controller: &types.ControllerInfo{
+			InstanceInfo: types.InstanceInfo{Running: true, Address: "10.42.0.1"},
+		},
+	}
+	ctrl := controller.NewControllers(fake, fake.ReplicaAPI, false).Get(volume)
+	assert.NotNil(ctrl)
+	settings := &testSettings{types.SettingsInfo{BackupTarget: testBackupTarget}}
+	return fake, newJobRunner(volume, ctrl, settings, &testBackupTargets{cli: fake, credentials: map[string][]string{}})
+}
+
+func countCalls(fake *engine.Fake, args ...string) int {
+	count := 0
+	for _, call := range fake.Calls() {
+		if len(call) >= 2+len(args) {
+			match := true
+			for i, arg := range args {
+				if call[2+i] != arg {
+					match = false
+				}
+			}
+			if match {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// waitForBackupTask waits for the background task of the backup number count
+// of the runner to finish, along with its cleanup hook
+func waitForBackupTask(assert *require.Assertions, fake *engine.Fake, runner *jobRunner, count int) {
+	done := func() bool {
+		tasks := runner.ctrl.LatestBgTasks()
+		return countCalls(fake, "backup", "create") == count && len(tasks) == 1 && tasks[0].Finished != ""
+	}
+	for i := 0; i < 50 && !done(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(done(), "timeout waiting for the backup task of volume "+runner.volume.Name)
+}
+
+func TestSnapshotTask(t *testing.T) {
+	assert := require.New(t)
+
+	_, runner := newTestJobRunner(assert, "test-snapshot-task")
+	defer runner.ctrl.BgTaskQueue().Close()
+
+	job := &types.RecurringJob{Name: "snap", Task: types.SnapshotTaskName, Retain: 2}
+	si, err := runner.settings.GetSettings()
+	assert.Nil(err)
+	task := SnapshotTask(runner, job, si)
+	for i := 0; i < 3; i++ {
+		assert.Nil(task.Run())
+	}
+
+	snapshots, err := runner.ctrl.SnapshotOps().List()
+	assert.Nil(err)
+	assert.Len(snapshots, 2)
+	for _, s := range snapshots {
+		assert.Equal(job.Name, s.Labels[JobName])
+	}
+}
+
+func TestBackupTask(t *testing.T) {
+	assert := require.New(t)
+
+	fake, runner := newTestJobRunner(assert, "test-backup-task")
+	defer runner.ctrl.BgTaskQueue().Close()
+
+	job := &types.RecurringJob{Name: "backup", Task: types.BackupTaskName, Retain: 2}
+	si, err := runner.settings.GetSettings()
+	assert.Nil(err)
+	task := BackupTask(runner, job, si)
+	for i := 0; i < 3; i++ {
+		assert.Nil(task.Run())
+		waitForBackupTask(assert, fake, runner, i+1)
+	}
+
+	assert.Len(fake.BackupURLs(testBackupTarget, runner.volume.Name), 2)
+	snapshots, err := runner.ctrl.SnapshotOps().List()
+	assert.Nil(err)
+	count := 0
+	for _, s := range snapshots {
+		if !s.Removed {
+			count++
+		}
+	}
+	assert.Equal(retainBackupSnapshots, count)
+}
+
+func TestBackupTaskTarget(t *testing.T) {
+	assert := require.New(t)
+
+	fake, runner := newTestJobRunner(assert, "test-backup-task-target")
+	defer runner.ctrl.BgTaskQueue().Close()
+
+	offsite := "vfs:///var/lib/longhorn/backups/offsite"
+	si, err := runner.settings.GetSettings()
+	assert.Nil(err)
+	si.BackupTargets = []*types.BackupTarget{{Name: "offsite", URL: offsite}}
+	assert.Nil(runner.settings.SetSettings(si))
+
+	task := BackupTask(runner, &types.RecurringJob{Name: "missing", Task: types.BackupTaskName, BackupTarget: "missing"}, si)
+	assert.NotNil(task.Run())
+
+	task = BackupTask(runner, &types.RecurringJob{Name: "offsite", Task: types.BackupTaskName, BackupTarget: "offsite"}, si)
+	assert.Nil(task.Run())
+	waitForBackupTask(assert, fake, runner, 1)
+	assert.Len(fake.BackupURLs(offsite, runner.volume.Name), 1)
+	assert.Len(fake.BackupURLs(testBackupTarget, runner.volume.Name), 0)
+}
+
+func TestBackupTaskCredential(t *testing.T) {
+	assert := require.New(t)
+
+	fake, runner := newTestJobRunner(assert, "test-backup-task-credential")
+	defer runner.ctrl.BgTaskQueue().Close()
+
+	env := []string{"AWS_ACCESS_KEY_ID=key", "AWS_SECRET_ACCESS_KEY=secret"}
+	runner.targets = &testBackupTargets{cli: fake, credentials: map[string][]string{"s3": env}}
+	si, err := runner.settings.GetSettings()
+	assert.Nil(err)
+	si.BackupTargetCredential = "missing"
+	task := BackupTask(runner, &types.RecurringJob{Name: "missing", Task: types.BackupTaskName}, si)
+	assert.NotNil(task.Run())
+
+	si.BackupTargetCredential = "s3"
+	task = BackupTask(runner, &types.RecurringJob{Name: "s3", Task: types.BackupTaskName}, si)
+	assert.Nil(task.Run())
+	waitForBackupTask(assert, fake, runner, 1)
+	assert.Len(fake.BackupURLs(testBackupTarget, runner.volume.Name), 1)
+
+	envs := fake.Envs()
+	found := false
+	for i, call := range fake.Calls() {
+		if len(call) > 3 && call[2] == "backup" && call[3] == "create" {
+			assert.Equal(env, envs[i])
+			found = true
+		}
+	}
+	assert.True(found)
+}
@@ -0,0 +1,242 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	// EvictReplicaTimeout is how long to wait for a replica to be replaced
+	EvictReplicaTimeout = 30 * time.Minute
+	EvictCheckPeriod    = 5 * time.Second
+)
+
+// evictedReplica is a replica on the host being evicted
+type evictedReplica struct {
+	volumeName  string
+	replicaName string
+}
+
+func isEvicting(host *types.HostInfo) bool {
+	return host.Eviction != nil && host.Eviction.State == types.EvictionStateEvicting
+}
+
+func (man *volumeManager) UpdateHostMaintenance(id string, maintenance bool) (*types.HostInfo, error) {
+	host, err := man.orc.UpdateHostMaintenance(id, maintenance, func(host *types.HostInfo) error {
+		if !maintenance && isEvicting(host) {
+			return errors.Errorf("host %v is being evicted", id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if maintenance {
+		logrus.Infof("host %v(%v) is in maintenance", host.UUID, host.Name)
+	} else {
+		logrus.Infof("host %v(%v) is out of maintenance", host.UUID, host.Name)
+	}
+	return host, nil
+}
+
+// EvictHost moves the good replicas off the host in maintenance, one at a
+// time in the background. Each replica is marked evicting, so the monitor of
+// the volume adds a new replica on another host and removes the evicting one
+// once the new one is RW. The detached volumes are attached to the current
+// host during the move. The eviction state stored with the host keeps the
+// managers from evicting the same host at once.
+func (man *volumeManager) EvictHost(id string) error {
+	host, err := man.orc.GetHost(id)
+	if err != nil {
+		return err
+	}
+	if !host.Maintenance {
+		return errors.Errorf("host %v must be in maintenance to be evicted", id)
+	}
+	replicas, err := man.replicasOnHost(id)
+	if err != nil {
+		return err
+	}
+
+	eviction := &types.EvictionInfo{
+		State:   types.EvictionStateEvicting,
+		HostID:  man.orc.GetCurrentHostID(),
+		Total:   len(replicas),
+		Started: util.Now(),
+	}
+	if err := man.orc.UpdateHostEviction(id, eviction, func(host *types.HostInfo) error {
+		if !host.Maintenance {
+			return errors.Errorf("host %v must be in maintenance to be evicted", id)
+		}
+		if isEvicting(host) {
+			return errors.Errorf("host %v is being evicted by the manager on host %v", id, host.Eviction.HostID)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	logrus.Infof("evicting %v replicas from host %v(%v)", len(replicas), host.UUID, host.Name)
+	man.background(func() { man.evict(id, eviction, replicas) })
+	return nil
+}
+
+func (man *volumeManager) evict(id string, eviction *types.EvictionInfo, replicas []evictedReplica) {
+	for _, r := range replicas {
+		eviction.Current = r.replicaName
+		man.recordEviction(id, eviction)
+		if err := man.evictReplica(id, eviction, r); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to evict host %v", id))
+			eviction.State = types.EvictionStateFailed
+			eviction.Error = err.Error()
+			break
+		}
+		eviction.Evicted++
+		logrus.Infof("evicted replica '%s' of volume '%s' from host %v", r.replicaName, r.volumeName, id)
+	}
+	if eviction.State == types.EvictionStateEvicting {
+		eviction.State = types.EvictionStateCompleted
+	}
+	eviction.Current = ""
+	eviction.Finished = util.Now()
+	if err := man.orc.UpdateHostEviction(id, eviction, nil); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to record eviction status of host %v", id))
+	}
+}
+
+func (man *volumeManager) recordEviction(id string, eviction *types.EvictionInfo) {
+	if err := man.orc.UpdateHostEviction(id, eviction, nil); err != nil {
+		logrus.Warnf("%v", errors.Wrapf(err, "failed to record eviction progress of host %v", id))
+	}
+}
+
+// evictReplica moves the replica off the host being evicted, recording the
+// detached volume attached for the move in the eviction
+func (man *volumeManager) evictReplica(id string, eviction *types.EvictionInfo, r evictedReplica) (err error) {
+	volumeName, replicaName := r.volumeName, r.replicaName
+	volume, err := man.Get(volumeName)
+	if err != nil {
+		return err
+	}
+	if volume == nil || volume.Replicas[replicaName] == nil {
+		return nil
+	}
+	if volume.Controller == nil {
+		if err := man.doAttach(volume); err != nil {
+			return errors.Wrapf(err, "failed to attach volume '%s' for eviction", volumeName)
+		}
+		eviction.Attached = volumeName
+		man.recordEviction(id, eviction)
+		defer func() {
+			if detachErr := man.Detach(volumeName); detachErr != nil && err == nil {
+				err = errors.Wrapf(detachErr, "failed to detach volume '%s' after eviction", volumeName)
+			}
+			eviction.Attached = ""
+		}()
+	}
+	return man.replaceReplica(volumeName, replicaName)
+}
+
+// replaceReplica marks the replica of the attached volume evicting and waits
+// for the controller checks to replace it with a new one
+func (man *volumeManager) replaceReplica(volumeName, replicaName string) error {
+	if err := man.setEvicting(volumeName, replicaName, true); err != nil {
+		return errors.Wrapf(err, "failed to mark replica '%s' of volume '%s' evicting", replicaName, volumeName)
+	}
+	deadline := time.Now().Add(EvictReplicaTimeout)
+	for time.Now().Before(deadline) {
+		volume, err := man.orc.GetVolume(volumeName)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", volumeName)
+		}
+		if volume == nil || volume.Replicas[replicaName] == nil {
+			return nil
+		}
+		if volume.Controller == nil {
+			break
+		}
+		time.Sleep(EvictCheckPeriod)
+	}
+	if err := man.setEvicting(volumeName, replicaName, false); err != nil {
+		logrus.Warnf("%v", errors.Wrapf(err, "failed to clear evicting replica '%s' of volume '%s'", replicaName, volumeName))
+	}
+	return errors.Errorf("replica '%s' of volume '%s' is not replaced", replicaName, volumeName)
+}
+
+func (man *volumeManager) setEvicting(volumeName, replicaName string, evicting bool) error {
+	return man.updateReplica(volumeName, replicaName, func(r *types.ReplicaInfo) bool {
+		if r.Evicting == evicting {
+			return false
+		}
+		r.Evicting = evicting
+		return true
+	})
+}
+
+// replicasOnHost returns the good replicas on the host, the bad ones are left
+// to be cleaned up
+func (man *volumeManager) replicasOnHost(id string) ([]evictedReplica, error) {
+	volumes, err := man.orc.ListVolumes()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list volumes")
+	}
+	replicas := []evictedReplica{}
+	for _, volume := range volumes {
+		for _, replica := range volume.Replicas {
+			if replica.HostID == id && replica.BadTimestamp.IsZero() {
+				replicas = append(replicas, evictedReplica{volume.Name, replica.Name})
+			}
+		}
+	}
+	return replicas, nil
+}
+
+// failInterruptedEvictions fails the evictions the manager on the current
+// host was running before the restart. The replicas left evicting on the
+// evicted host are cleared, and the volume attached for the eviction detached.
+func (man *volumeManager) failInterruptedEvictions(volumes []*types.VolumeInfo) {
+	hosts, err := man.orc.ListHosts()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrap(err, "failed to list the hosts for the interrupted evictions"))
+		return
+	}
+	hostID := man.orc.GetCurrentHostID()
+	for id, host := range hosts {
+		if !isEvicting(host) || host.Eviction.HostID != hostID {
+			continue
+		}
+		logrus.Warnf("eviction of host %v was interrupted by the manager restart", id)
+		eviction := host.Eviction
+		for _, volume := range volumes {
+			// the engine upgrade of the volume replaces its replicas itself
+			if isUpgrading(volume) {
+				continue
+			}
+			for _, replica := range volume.Replicas {
+				if replica.HostID != id || !replica.Evicting {
+					continue
+				}
+				if err := man.setEvicting(volume.Name, replica.Name, false); err != nil {
+					logrus.Errorf("%+v", errors.Wrapf(err, "failed to clear evicting replica '%s' of volume '%s'", replica.Name, volume.Name))
+				}
+			}
+			if volume.Name == eviction.Attached && volume.Controller != nil {
+				if err := man.Detach(volume.Name); err != nil {
+					logrus.Errorf("%+v", errors.Wrapf(err, "failed to detach volume '%s' after the interrupted eviction", volume.Name))
+				}
+			}
+		}
+		eviction.State = types.EvictionStateFailed
+		eviction.Error = "interrupted by the manager restart"
+		eviction.Current = ""
+		eviction.Attached = ""
+		eviction.Finished = util.Now()
+		if err := man.orc.UpdateHostEviction(id, eviction, nil); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to record eviction status of host %v", id))
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	// VolumeLeaseTTL is how long the manager monitoring an attached volume
+	// owns it without renewing the lease
+	VolumeLeaseTTL         = 60 * time.Second
+	VolumeLeaseRenewPeriod = 10 * time.Second
+)
+
+func validateFailoverPolicy(policy types.FailoverPolicy) error {
+	switch policy {
+	case "", types.FailoverPolicyDetach, types.FailoverPolicyReattach:
+		return nil
+	}
+	return errors.Errorf("invalid failover policy '%v', should be %v or %v", policy,
+		types.FailoverPolicyDetach, types.FailoverPolicyReattach)
+}
+
+func failoverPolicy(volume *types.VolumeInfo) types.FailoverPolicy {
+	if volume.FailoverPolicy == "" {
+		return types.FailoverPolicyDetach
+	}
+	return volume.FailoverPolicy
+}
+
+// observedLease is the lease of a volume as last read by the current
+// manager, and when it was seen to change on the clock of the current host
+type observedLease struct {
+	lease    types.VolumeLease
+	observed time.Time
+}
+
+// leaseExpired tells if the lease hasn't been renewed for VolumeLeaseTTL.
+// Renewed is written on the clock of the owner, so it's only compared with
+// the one read before, and the renewals are timed on the clock of the
+// current host, like the heartbeats of the hosts. The first lease read counts
+// as a renewal.
+func (man *volumeManager) leaseExpired(name string, lease *types.VolumeLease, now time.Time) bool {
+	man.Lock()
+	defer man.Unlock()
+
+	seen := man.leases[name]
+	if seen == nil || seen.lease != *lease {
+		seen = &observedLease{lease: *lease, observed: now}
+		man.leases[name] = seen
+	}
+	return now.Sub(seen.observed) > VolumeLeaseTTL
+}
+
+// acquireLease makes the current host the owner of the volume just attached
+// to it, which clears the fault left by the last failover
+func (man *volumeManager) acquireLease(name string) error {
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		volume.Lease = &types.VolumeLease{HostID: man.orc.GetCurrentHostID(), Renewed: util.Now()}
+		if volume.Failover != nil {
+			volume.Failover.Faulted = false
+		}
+		return man.orc.UpdateVolume(volume)
+	})
+}
+
+// renewLease keeps the volume owned by the current host. It returns false if
+// another host has taken the volume over, in which case the current host
+// stops monitoring it and removes the stale controller.
+func (man *volumeManager) renewLease(volume, current *types.VolumeInfo) bool {
+	hostID := man.orc.GetCurrentHostID()
+	lease := current.Lease
+	if lease != nil && lease.HostID != hostID {
+		logrus.Errorf("volume '%s' has been taken over by host %v, stop monitoring it", volume.Name, lease.HostID)
+		man.stopMonitoring(volume)
+		if volume.Controller != nil && volume.Controller.HostID == hostID {
+			if _, err := man.orc.RemoveInstance(&volume.Controller.InstanceInfo); err != nil {
+				logrus.Warnf("%v", errors.Wrapf(err, "failed to remove stale controller of volume '%s'", volume.Name))
+			}
+		}
+		return false
+	}
+	if lease != nil {
+		renewed, err := util.ParseTimeZ(lease.Renewed)
+		if err == nil && time.Since(renewed) < VolumeLeaseRenewPeriod {
+			return true
+		}
+	}
+	// the lease is taken over with the same revision, so a conflict leaves
+	// the decision to the next check
+	current.Lease = &types.VolumeLease{HostID: hostID, Renewed: util.Now()}
+	if err := man.orc.UpdateVolume(current); err != nil {
+		logrus.Warnf("%v", errors.Wrapf(err, "failed to renew lease of volume '%s'", volume.Name))
+	}
+	return true
+}
+
+// checkControllers fails over the attached volumes whose controllers are
+// orphaned, i.e. on a host which is down, or whose lease isn't renewed
+func (man *volumeManager) checkControllers() error {
+	return man.checkControllersAt(time.Now())
+}
+
+func (man *volumeManager) checkControllersAt(now time.Time) error {
+	hosts, err := man.orc.ListHosts()
+	if err != nil {
+		return errors.Wrap(err, "unable to list hosts")
+	}
+	hostID := man.orc.GetCurrentHostID()
+	if current := hosts[hostID]; current != nil && !orch.IsHostUp(current) {
+		return nil
+	}
+	volumes, err := man.orc.ListVolumes()
+	if err != nil {
+		return errors.Wrap(err, "unable to list volumes")
+	}
+	errs := Errs{}
+	for _, volume := range volumes {
+		if volume.Controller == nil || volume.Controller.HostID == hostID || !man.orphaned(volume, hosts, now) {
+			continue
+		}
+		if err := man.failover(volume, hosts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (man *volumeManager) orphaned(volume *types.VolumeInfo, hosts map[string]*types.HostInfo, now time.Time) bool {
+	if host := hosts[volume.Controller.HostID]; host == nil || !orch.IsHostUp(host) {
+		return true
+	}
+	return volume.Lease != nil && man.leaseExpired(volume.Name, volume.Lease, now)
+}
+
+// failover takes the lease of the orphaned volume, then detaches it, and
+// attaches it to the current host if the policy says so. Only one manager
+// wins the lease, the others leave the volume alone.
+func (man *volumeManager) failover(volume *types.VolumeInfo, hosts map[string]*types.HostInfo) error {
+	hostID := man.orc.GetCurrentHostID()
+	from := volume.Controller.HostID
+	volume.Lease = &types.VolumeLease{HostID: hostID, Renewed: util.Now()}
+	if err := man.orc.UpdateVolume(volume); err != nil {
+		if types.IsConflict(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to take over volume '%s'", volume.Name)
+	}
+
+	policy := failoverPolicy(volume)
+	logrus.Warnf("controller of volume '%s' on host %v is orphaned, failing over to host %v with policy %v",
+		volume.Name, from, hostID, policy)
+	info := &types.FailoverInfo{
+		FromHostID: from,
+		Policy:     policy,
+		Started:    util.Now(),
+	}
+	err := man.doFailover(volume, hosts, policy)
+	if err == nil && policy == types.FailoverPolicyReattach {
+		info.ToHostID = hostID
+	}
+	info.Faulted = err != nil || policy == types.FailoverPolicyDetach
+	if err != nil {
+		info.Error = err.Error()
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to fail over volume '%s'", volume.Name))
+	}
+	info.Finished = util.Now()
+	if err := man.updateFailover(volume.Name, info); err != nil {
+		return errors.Wrapf(err, "failed to record failover of volume '%s'", volume.Name)
+	}
+	return nil
+}
+
+func (man *volumeManager) doFailover(volume *types.VolumeInfo, hosts map[string]*types.HostInfo, policy types.FailoverPolicy) error {
+	// the manager on the host is alive but stuck, the controller is
+	// removed so it cannot write to the replicas any more
+	if host := hosts[volume.Controller.HostID]; host != nil && orch.IsHostUp(host) {
+		if _, err := man.orc.RemoveInstance(&volume.Controller.InstanceInfo); err != nil {
+			logrus.Warnf("%v", errors.Wrapf(err, "failed to remove orphaned controller of volume '%s'", volume.Name))
+		}
+	}
+	name := volume.Name
+	if err := man.dropController(name, hosts); err != nil {
+		return err
+	}
+	volume, err := man.Get(name)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s'", name)
+	}
+	if policy == types.FailoverPolicyReattach {
+		return man.doAttach(volume)
+	}
+	errs := Errs{}
+	for _, replica := range volume.Replicas {
+		if !replica.Running {
+			continue
+		}
+		if _, err := man.orc.StopInstance(&replica.InstanceInfo); err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to stop replica '%s' for volume '%s'", replica.Name, name))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// dropController removes the orphaned controller from the volume, and marks
+// the replicas on the hosts which are down stopped, since the instances
+// cannot be reached any more. The restore running with the controller fails.
+func (man *volumeManager) dropController(name string, hosts map[string]*types.HostInfo) error {
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		volume.Controller = nil
+		if isRestoring(volume) {
+			volume.Restore.State = types.RestoreStateFailed
+			volume.Restore.Error = "interrupted by the failover"
+			volume.Restore.Finished = util.Now()
+		}
+		for _, replica := range volume.Replicas {
+			if host := hosts[replica.HostID]; host == nil || !orch.IsHostUp(host) {
+				replica.Running = false
+			}
+		}
+		return man.orc.UpdateVolume(volume)
+	})
+}
+
+func (man *volumeManager) updateFailover(name string, info *types.FailoverInfo) error {
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		volume.Failover = info
+		return man.orc.UpdateVolume(volume)
+	})
+}
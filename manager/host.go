@@ -0,0 +1,87 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+)
+
+// watchHosts looks for the dead hosts and the orphaned controllers every
+// orch.HeartbeatPeriod until stopCh is closed
+func (man *volumeManager) watchHosts(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(orch.HeartbeatPeriod):
+		}
+		if err := man.checkHosts(); err != nil {
+			logrus.Errorf("%+v", errors.Wrap(err, "failed to check hosts"))
+		}
+		if err := man.checkControllers(); err != nil {
+			logrus.Errorf("%+v", errors.Wrap(err, "failed to check controllers"))
+		}
+	}
+}
+
+// checkHosts marks the replicas on the dead hosts bad, so they're not used
+// on attach and get replaced in the attached volumes. Nothing is done if the
+// current host is down itself, since it cannot tell the others are dead.
+func (man *volumeManager) checkHosts() error {
+	hosts, err := man.orc.ListHosts()
+	if err != nil {
+		return errors.Wrap(err, "unable to list hosts")
+	}
+	if current := hosts[man.orc.GetCurrentHostID()]; current != nil && !orch.IsHostUp(current) {
+		logrus.Warnf("current host %v is down, skip checking other hosts", current.UUID)
+		return nil
+	}
+
+	down := map[string]bool{}
+	for id, host := range hosts {
+		if !orch.IsHostUp(host) {
+			down[id] = true
+		}
+	}
+	man.Lock()
+	for id := range down {
+		if !man.downHosts[id] {
+			logrus.Warnf("host %v(%v) is down, last seen at %v", id, hosts[id].Name, hosts[id].LastSeen)
+		}
+	}
+	for id := range man.downHosts {
+		if !down[id] && hosts[id] != nil {
+			logrus.Infof("host %v(%v) is up again", id, hosts[id].Name)
+		}
+	}
+	man.downHosts = down
+	man.Unlock()
+	if len(down) == 0 {
+		return nil
+	}
+
+	volumes, err := man.orc.ListVolumes()
+	if err != nil {
+		return errors.Wrap(err, "unable to list volumes")
+	}
+	errs := Errs{}
+	for _, volume := range volumes {
+		for _, replica := range volume.Replicas {
+			if !down[replica.HostID] || !replica.BadTimestamp.IsZero() {
+				continue
+			}
+			if err := man.orc.MarkBadReplica(volume.Name, replica); err != nil {
+				errs = append(errs, errors.Wrapf(err, "failed to mark replica '%s' of volume '%s' bad", replica.Name, volume.Name))
+				continue
+			}
+			logrus.Warnf("marked replica '%s' of volume '%s' bad, host %v is down", replica.Name, volume.Name, replica.HostID)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -2,17 +2,21 @@ package manager
 
 import (
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
+	"github.com/rancher/longhorn-manager/orch"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 )
 
 var (
+	// KeepBadReplicasPeriod is used for the volumes without their own
+	// StaleReplicaTimeout
 	KeepBadReplicasPeriod = time.Hour * 2
 )
 
@@ -22,6 +26,15 @@ type volumeManager struct {
 	monitors       map[string]types.Monitor
 	addingReplicas map[string]int
 
+	reusingReplicas map[string]bool
+	reuseFailed     map[string]time.Time
+
+	downHosts map[string]bool
+
+	leases map[string]*observedLease
+
+	backupTargetStatus map[string]*types.BackupTargetStatus
+
 	orc     types.Orchestrator
 	monitor types.BeginMonitoring
 
@@ -29,6 +42,20 @@ type volumeManager struct {
 	getBackups    types.GetManagerBackupOps
 
 	settings types.Settings
+
+	// running counts the goroutines the manager starts, stopped is set once
+	// the manager is stopped so no more monitors are started
+	running sync.WaitGroup
+	stopped bool
+}
+
+// background runs f in a goroutine counted in running
+func (man *volumeManager) background(f func()) {
+	man.running.Add(1)
+	go func() {
+		defer man.running.Done()
+		f()
+	}()
 }
 
 func (man *volumeManager) GetControllerName(volumeName string) string {
@@ -44,6 +71,15 @@ func New(orc types.Orchestrator, monitor types.BeginMonitoring, getController ty
 		monitors:       map[string]types.Monitor{},
 		addingReplicas: map[string]int{},
 
+		reusingReplicas: map[string]bool{},
+		reuseFailed:     map[string]time.Time{},
+
+		downHosts: map[string]bool{},
+
+		leases: map[string]*observedLease{},
+
+		backupTargetStatus: map[string]*types.BackupTargetStatus{},
+
 		orc:     orc,
 		monitor: monitor,
 
@@ -78,29 +114,87 @@ func (man *volumeManager) cleanupFailedCreate(vol *types.VolumeInfo) {
 	}
 }
 
-func (man *volumeManager) createFromBackup(volume *types.VolumeInfo, backup *types.BackupInfo) (*types.VolumeInfo, error) {
-	size, err := strconv.ParseInt(backup.VolumeSize, 10, 64)
+// createFromBackup creates the volume in the restoring state, and restores the
+// backup in the background
+func (man *volumeManager) createFromBackup(volume *types.VolumeInfo, backup *types.BackupInfo, restore *types.RestoreInfo, env []string) (*types.VolumeInfo, error) {
+	size, err := backupVolumeSize(backup)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing backup.VolumeSize, backup: %+v", backup)
+		return nil, err
 	}
 	volume.Size = size
+	volume.Restore = restore
 	vol, err := man.doCreate(volume)
 	if err != nil {
 		return nil, err
 	}
-	if err := man.doAttach(vol); err != nil {
-		defer man.cleanupFailedCreate(vol)
-		return nil, errors.Wrapf(err, "failed to attach to restore the backup, volume '%s', backup '%+v'", vol.Name, backup)
+	man.background(func() { man.restore(vol.Name, env) })
+	return vol, nil
+}
+
+// createFromSnapshot backs up FromSnapshot of the source volume to the default
+// backup target, then restores the backup into the new volume like
+// createFromBackup. The source volume is attached for the backup if it's
+// detached, and detached again once the backup is taken. The backup is
+// removed once the restore is done, or if the clone fails.
+func (man *volumeManager) createFromSnapshot(volume *types.VolumeInfo, target *types.BackupTarget) (vol *types.VolumeInfo, err error) {
+	source, err := man.Get(volume.FromVolume)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting volume (to clone volume) '%s'", volume.FromVolume)
 	}
-	if err := man.getController(vol).BackupOps().Restore(backup.URL); err != nil {
-		defer man.cleanupFailedCreate(vol)
-		return nil, errors.Wrapf(err, "failed to restore the backup, volume '%s', backup '%+v'", vol.Name, backup)
+	if source == nil {
+		return nil, errors.Errorf("cannot find volume (to clone volume) '%s'", volume.FromVolume)
 	}
-	if err := man.doDetach(vol); err != nil {
-		defer man.cleanupFailedCreate(vol)
-		return nil, errors.Wrapf(err, "failed to detach after restoring the backup, volume '%s', backup '%+v'", vol.Name, backup)
+	env, err := man.BackupTargetEnv(target)
+	if err != nil {
+		return nil, err
 	}
-	return vol, nil
+	if source.Controller == nil || !source.Controller.Running {
+		if err := man.doAttach(source); err != nil {
+			return nil, errors.Wrapf(err, "failed to attach volume '%s' to clone snapshot '%s'", source.Name, volume.FromSnapshot)
+		}
+		defer func() {
+			if err := man.doDetach(source); err != nil {
+				logrus.Errorf("%+v", errors.Wrapf(err, "failed to detach volume '%s' after cloning snapshot '%s'", source.Name, volume.FromSnapshot))
+			}
+		}()
+		if source, err = man.Get(source.Name); err != nil {
+			return nil, err
+		}
+		if source == nil {
+			return nil, errors.Errorf("cannot find volume (to clone volume) '%s'", volume.FromVolume)
+		}
+	}
+	ctrl := man.getController(source)
+	snapshot, err := ctrl.SnapshotOps().Get(volume.FromSnapshot)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting snapshot (to clone volume) '%s' of volume '%s'", volume.FromSnapshot, source.Name)
+	}
+	if snapshot == nil || snapshot.Removed {
+		return nil, errors.Errorf("cannot find snapshot (to clone volume) '%s' of volume '%s'", volume.FromSnapshot, source.Name)
+	}
+
+	backupURL, err := ctrl.BackupOps().Backup(volume.FromSnapshot, target.URL, env)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to back up snapshot '%s' of volume '%s' to clone it", volume.FromSnapshot, source.Name)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := man.getBackups(target.URL, env).Delete(backupURL); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to remove backup '%s' after failing to clone volume '%s'", backupURL, volume.Name))
+		}
+	}()
+	backup, err := man.getBackups(target.URL, env).Get(backupURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting backup (to clone volume) '%s'", backupURL)
+	}
+	if backup == nil {
+		return nil, errors.Errorf("cannot find backup (to clone volume) '%s'", backupURL)
+	}
+	restore := newRestoreInfo(man.orc.GetCurrentHostID(), backup.URL, target)
+	restore.RemoveBackup = true
+	return man.createFromBackup(volume, backup, restore, env)
 }
 
 func (man *volumeManager) Create(volume *types.VolumeInfo) (*types.VolumeInfo, error) {
@@ -121,21 +215,91 @@ func (man *volumeManager) Create(volume *types.VolumeInfo) (*types.VolumeInfo, e
 			return nil, errors.New("create volume fail: No EngineImage specified")
 		}
 	}
-	if volume.FromBackup != "" {
-		backupTarget := settings.BackupTarget
-		if backupTarget == "" {
-			return nil, errors.New("create volume fail: No BackupTarget specified")
+	if err := orch.ValidateSchedulePolicyBinding(volume.ReplicaSchedulePolicy); err != nil {
+		return nil, errors.Wrap(err, "create volume fail")
+	}
+	if err := validateFailoverPolicy(volume.FailoverPolicy); err != nil {
+		return nil, errors.Wrap(err, "create volume fail")
+	}
+	if err := orch.ValidateTags(volume.HostSelector); err != nil {
+		return nil, errors.Wrap(err, "create volume fail: invalid host selector")
+	}
+	if err := orch.ValidateTags(volume.DiskSelector); err != nil {
+		return nil, errors.Wrap(err, "create volume fail: invalid disk selector")
+	}
+	var cloneTarget *types.BackupTarget
+	if volume.FromVolume != "" || volume.FromSnapshot != "" {
+		if volume.FromVolume == "" || volume.FromSnapshot == "" {
+			return nil, errors.New("create volume fail: both FromVolume and FromSnapshot are required to clone a volume")
 		}
-
-		backup, err := man.getBackups(backupTarget).Get(volume.FromBackup)
+		if volume.FromBackup != "" {
+			return nil, errors.New("create volume fail: cannot clone a volume and restore a backup at the same time")
+		}
+		// the clone goes through the default backup target
+		if cloneTarget, err = settings.GetBackupTarget(types.DefaultBackupTargetName); err != nil {
+			return nil, errors.Wrap(err, "create volume fail: the default backup target is required to clone a volume")
+		}
+	}
+	if err := man.checkReplicaHosts(volume, volume.NumberOfReplicas, settings); err != nil {
+		return nil, errors.Wrap(err, "create volume fail")
+	}
+	if cloneTarget != nil {
+		return man.createFromSnapshot(volume, cloneTarget)
+	}
+	if volume.FromBackup != "" {
+		backup, target, env, err := man.getBackup(settings, volume.FromBackup)
 		if err != nil {
-			return nil, errors.Wrapf(err, "error getting backup (to create volume) '%s'", volume.FromBackup)
+			return nil, errors.Wrap(err, "create volume fail")
 		}
-		return man.createFromBackup(volume, backup)
+		return man.createFromBackup(volume, backup, newRestoreInfo(man.orc.GetCurrentHostID(), backup.URL, target), env)
 	}
 	return man.doCreate(volume)
 }
 
+// getBackup finds the backup in the backup target it's in, and returns it with
+// the target and the credential environment of the target
+func (man *volumeManager) getBackup(settings *types.SettingsInfo, backupURL string) (*types.BackupInfo, *types.BackupTarget, []string, error) {
+	target := backupTargetOf(settings, backupURL)
+	if target == nil {
+		return nil, nil, nil, errors.New("No BackupTarget specified")
+	}
+	env, err := man.BackupTargetEnv(target)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backup, err := man.getBackups(target.URL, env).Get(backupURL)
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "error getting backup '%s'", backupURL)
+	}
+	if backup == nil {
+		return nil, nil, nil, errors.Errorf("cannot find backup '%s'", backupURL)
+	}
+	return backup, target, env, nil
+}
+
+func backupVolumeSize(backup *types.BackupInfo) (int64, error) {
+	size, err := strconv.ParseInt(backup.VolumeSize, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error parsing backup.VolumeSize, backup: %+v", backup)
+	}
+	return size, nil
+}
+
+// backupTargetOf returns the backup target the backup is in, the default one
+// if the backup isn't in any of the named ones, or nil if it isn't set
+func backupTargetOf(settings *types.SettingsInfo, backupURL string) *types.BackupTarget {
+	for _, target := range settings.BackupTargets {
+		if strings.HasPrefix(backupURL, target.URL+"?") {
+			return target
+		}
+	}
+	target, err := settings.GetBackupTarget(types.DefaultBackupTargetName)
+	if err != nil {
+		return nil
+	}
+	return target
+}
+
 func (man *volumeManager) Delete(name string) error {
 	volume, err := man.Get(name)
 	if err != nil {
@@ -163,18 +327,39 @@ func volumeState(volume *types.VolumeInfo) types.VolumeState {
 		}
 	}
 	switch {
+	case isRestoring(volume):
+		return types.VolumeStateRestoring
+	case volume.Restore != nil && volume.Restore.State == types.RestoreStateFailed:
+		return types.VolumeStateFaulted
 	case goodReplicaCount == 0:
 		return types.VolumeStateFaulted
+	case volume.Controller == nil && volume.Failover != nil && volume.Failover.Faulted:
+		return types.VolumeStateFaulted
 	case volume.Controller == nil:
 		return types.VolumeStateDetached
-	case goodReplicaCount == volume.NumberOfReplicas:
+	case goodReplicaCount >= volume.NumberOfReplicas:
 		return types.VolumeStateHealthy
 	}
 	return types.VolumeStateDegraded
 }
 
+// staleReplicaTimeout is how long the bad replicas of the volume are kept
+// before they're removed
+func staleReplicaTimeout(volume *types.VolumeInfo) time.Duration {
+	if volume.StaleReplicaTimeout > 0 {
+		return volume.StaleReplicaTimeout
+	}
+	return KeepBadReplicasPeriod
+}
+
 func (man *volumeManager) completeVolumeState(vol *types.VolumeInfo) *types.VolumeInfo {
 	vol.State = volumeState(vol)
+	for _, replica := range vol.Replicas {
+		replica.StaleDeadline = time.Time{}
+		if !replica.BadTimestamp.IsZero() {
+			replica.StaleDeadline = replica.BadTimestamp.Add(staleReplicaTimeout(vol))
+		}
+	}
 
 	vol.Endpoint = ""
 	if vol.Controller != nil && vol.Controller.Running {
@@ -205,25 +390,40 @@ func (man *volumeManager) List() ([]*types.VolumeInfo, error) {
 	return volumes, nil
 }
 
-func (man *volumeManager) Start() error {
+func (man *volumeManager) Start(stopCh <-chan struct{}) error {
 	vs, err := man.List()
 	if err != nil {
 		return err
 	}
+	man.failInterruptedRestores(vs)
+	man.failInterruptedEngineUpgrades(vs)
+	man.failInterruptedEvictions(vs)
 	for _, v := range vs {
+		if isRestoring(v) {
+			continue
+		}
 		if v.Controller != nil && v.Controller.Running && v.Controller.HostID == man.orc.GetCurrentHostID() {
 			man.startMonitoring(v)
 		}
 	}
+	man.background(func() { man.watchHosts(stopCh) })
+	man.background(func() { man.watchBackupTargets(stopCh) })
+	man.background(func() {
+		<-stopCh
+		man.stopAllMonitoring()
+	})
 	return nil
 }
 
 func (man *volumeManager) startMonitoring(volume *types.VolumeInfo) {
 	man.Lock()
 	defer man.Unlock()
-	if man.monitors[volume.Name] == nil {
-		man.monitors[volume.Name] = man.monitor(volume, man)
+	if man.stopped || man.monitors[volume.Name] != nil {
+		return
 	}
+	monitor := man.monitor(volume, man)
+	man.monitors[volume.Name] = monitor
+	man.background(monitor.Wait)
 }
 
 func (man *volumeManager) updateCron(volume *types.VolumeInfo, jobs []*types.RecurringJob) {
@@ -239,6 +439,17 @@ func (man *volumeManager) updateCron(volume *types.VolumeInfo, jobs []*types.Rec
 	}
 }
 
+// stopAllMonitoring closes the monitors once the manager is stopped
+func (man *volumeManager) stopAllMonitoring() {
+	man.Lock()
+	defer man.Unlock()
+	man.stopped = true
+	for name, mon := range man.monitors {
+		mon.Close()
+		delete(man.monitors, name)
+	}
+}
+
 func (man *volumeManager) stopMonitoring(volume *types.VolumeInfo) {
 	man.Lock()
 	defer man.Unlock()
@@ -336,6 +547,14 @@ func (man *volumeManager) doAttach(volume *types.VolumeInfo) error {
 	}
 
 	volume.Controller = controller
+	if err := man.acquireLease(volume.Name); err != nil {
+		return errors.Wrapf(err, "failed to acquire lease of volume '%s'", volume.Name)
+	}
+	if volume.EngineUpgrade != nil && volume.EngineUpgrade.PendingController {
+		if err := man.clearPendingController(volume.Name); err != nil {
+			logrus.Warnf("%v", errors.Wrapf(err, "failed to record the controller upgrade of volume '%s'", volume.Name))
+		}
+	}
 	man.startMonitoring(volume)
 	return nil
 }
@@ -398,10 +617,11 @@ func (man *volumeManager) createAndAddReplicaToController(volumeName string, ctr
 	}
 	// Update replica.InstanceInfo to provide address for ctrl.AddReplica() call
 	replica.InstanceInfo = *instance
-	go func() {
-		man.addingReplicasCount(volumeName, 1)
+	// counted before returning, so the next check won't add another one
+	man.addingReplicasCount(volumeName, 1)
+	man.background(func() {
 		defer man.addingReplicasCount(volumeName, -1)
-		if err := ctrl.AddReplica(replica); err != nil {
+		if err := man.rebuildReplica(volumeName, replica, ctrl); err != nil {
 			logrus.Errorf("%+v", errors.Wrapf(err, "failed to add replica '%s' to volume '%s'", replica.Name, volumeName))
 			if _, err := man.orc.StopInstance(&replica.InstanceInfo); err != nil {
 				logrus.Errorf("%+v", errors.Wrapf(err, "failed to stop stale replica '%s' of volume '%s'", replica.Name, volumeName))
@@ -410,7 +630,7 @@ func (man *volumeManager) createAndAddReplicaToController(volumeName string, ctr
 				logrus.Errorf("%+v", errors.Wrapf(err, "failed to remove stale replica '%s' of volume '%s'", replica.Name, volumeName))
 			}
 		}
-	}()
+	})
 	return nil
 }
 
@@ -423,6 +643,18 @@ func (man *volumeManager) addingReplicasCount(name string, add int) int {
 }
 
 func (man *volumeManager) UpdateRecurring(name string, jobs []*types.RecurringJob) error {
+	settings, err := man.settings.GetSettings()
+	if err != nil || settings == nil {
+		return errors.Wrap(err, "unable to get settings")
+	}
+	for _, job := range jobs {
+		if job.Task != types.BackupTaskName {
+			continue
+		}
+		if _, err := settings.GetBackupTarget(job.BackupTarget); err != nil {
+			return errors.Wrapf(err, "invalid backup target of recurring job '%s'", job.Name)
+		}
+	}
 	volume, err := man.orc.GetVolume(name)
 	if err != nil {
 		return errors.Wrapf(err, "unable to get volume '%s'", name)
@@ -441,25 +673,156 @@ func (man *volumeManager) UpdateRecurring(name string, jobs []*types.RecurringJo
 	return nil
 }
 
+// UpdateReplicaCount changes the desired number of replicas of the volume.
+// The replicas are added or removed by the monitor of the attached volume.
+func (man *volumeManager) UpdateReplicaCount(name string, count int) error {
+	if count < 1 {
+		return errors.Errorf("invalid number of replicas %v for volume '%s'", count, name)
+	}
+	settings, err := man.settings.GetSettings()
+	if err != nil || settings == nil {
+		return errors.Errorf("unable to load settings to update volume '%s'", name)
+	}
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		if err := man.checkReplicaHosts(volume, count, settings); err != nil {
+			return err
+		}
+		volume.NumberOfReplicas = count
+		return errors.Wrapf(man.orc.UpdateVolume(volume), "unable to update volume '%s'", name)
+	})
+}
+
+// checkReplicaHosts makes sure there are enough hosts matching the selectors
+// of the volume for count replicas, which is count hosts if the replicas
+// cannot share a host. The hosts in maintenance or down don't count.
+func (man *volumeManager) checkReplicaHosts(volume *types.VolumeInfo, count int, settings *types.SettingsInfo) error {
+	hosts, err := man.orc.ListHosts()
+	if err != nil {
+		return errors.Wrap(err, "unable to list hosts")
+	}
+	matched := 0
+	for _, host := range hosts {
+		if !host.Maintenance && orch.IsHostUp(host) && orch.MatchHost(host, volume.HostSelector, volume.DiskSelector) {
+			matched++
+		}
+	}
+	binding := orch.ReplicaScheduleBinding(volume, settings)
+	if binding == types.SchedulePolicyBindingHardAntiAffinity && matched < count {
+		return errors.Errorf("volume '%s' needs %v hosts for %v replicas with %v, only %v matching hosts available",
+			volume.Name, count, count, binding, matched)
+	}
+	if matched == 0 {
+		return errors.Errorf("no host matches host selector %v and disk selector %v of volume '%s'",
+			volume.HostSelector, volume.DiskSelector, volume.Name)
+	}
+	return nil
+}
+
+// Expand grows the volume to size through its controller, which expands the
+// replicas too. A detached volume is attached for the expansion and detached
+// again afterwards. It fails with UnsupportedError if the engine of the volume
+// cannot expand volumes.
+func (man *volumeManager) Expand(name string, size int64) (err error) {
+	if size != util.RoundUpSize(size) {
+		return errors.Errorf("size %v of volume '%s' is not a multiple of 4096", size, name)
+	}
+	volume, err := man.orc.GetVolume(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get volume '%s'", name)
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s'", name)
+	}
+	if size <= volume.Size {
+		return errors.Errorf("new size %v of volume '%s' must be larger than current size %v", size, name, volume.Size)
+	}
+	if volume.Controller == nil {
+		if err := man.doAttach(volume); err != nil {
+			return errors.Wrapf(err, "failed to attach volume '%s' for expansion", name)
+		}
+		defer func() {
+			if detachErr := man.Detach(name); detachErr != nil && err == nil {
+				err = errors.Wrapf(detachErr, "failed to detach volume '%s' after expansion", name)
+			}
+		}()
+		if volume, err = man.Get(name); err != nil {
+			return err
+		}
+		if volume == nil || volume.Controller == nil {
+			return errors.Errorf("volume '%s' is not attached for expansion", name)
+		}
+	}
+	ctrl := man.getController(volume)
+	if err := ctrl.Expand(size); err != nil {
+		return errors.Wrapf(err, "failed to expand volume '%s'", name)
+	}
+	// the volume is expanded already, keep trying to record it
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		if volume.Size >= size {
+			return nil
+		}
+		volume.Size = size
+		return errors.Wrapf(man.orc.UpdateVolume(volume), "unable to update volume '%s'", name)
+	})
+}
+
 func (man *volumeManager) CheckController(ctrl types.Controller, volume *types.VolumeInfo) error {
 	replicas, err := ctrl.GetReplicaStates()
 	if err != nil {
 		return NewControllerError(err)
 	}
-	logrus.Debugf("checking '%s', NumberOfReplicas=%v: controller knows %v replicas", volume.Name, volume.NumberOfReplicas, len(volume.Replicas))
+	// the number of replicas can be changed while the volume is attached
+	current, err := man.orc.GetVolume(volume.Name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get volume '%s'", volume.Name)
+	}
+	if current == nil {
+		return errors.Errorf("cannot find volume '%s'", volume.Name)
+	}
+	if !man.renewLease(volume, current) {
+		return nil
+	}
+	numberOfReplicas := current.NumberOfReplicas
+	logrus.Debugf("checking '%s', NumberOfReplicas=%v: controller knows %v replicas", volume.Name, numberOfReplicas, len(replicas))
 	goodReplicas := []*types.ReplicaInfo{}
 	woReplicas := []*types.ReplicaInfo{}
+	// the evicting replicas are kept until the replacements are ready
+	evictingReplicas := []*types.ReplicaInfo{}
+	// the replicas marked bad meanwhile, e.g. their hosts are down
+	badReplicas := []*types.ReplicaInfo{}
 	errCh := make(chan error)
 	wg := &sync.WaitGroup{}
 	for _, replica := range replicas {
 		switch replica.Mode {
 		case types.ReplicaModeRW:
-			goodReplicas = append(goodReplicas, replica)
+			r := findReplicaByAddress(current, replica.Address)
+			switch {
+			case r != nil && !r.BadTimestamp.IsZero():
+				badReplicas = append(badReplicas, replica)
+			case r != nil && r.Evicting:
+				evictingReplicas = append(evictingReplicas, replica)
+			default:
+				goodReplicas = append(goodReplicas, replica)
+			}
 		case types.ReplicaModeWO:
 			woReplicas = append(woReplicas, replica)
 		case types.ReplicaModeERR:
 			wg.Add(1)
-			go func(replica *types.ReplicaInfo) {
+			go func(replica, r *types.ReplicaInfo) {
 				defer wg.Done()
 				logrus.Warnf("Marking bad replica '%s'", replica.Address)
 				wg.Add(2)
@@ -470,10 +833,22 @@ func (man *volumeManager) CheckController(ctrl types.Controller, volume *types.V
 				}()
 				go func() {
 					defer wg.Done()
-					err := man.orc.MarkBadReplica(volume.Name, replica)
-					errCh <- errors.Wrapf(err, "failed to mark replica '%s' bad for volume '%s'", replica.Address, volume.Name)
+					if r == nil {
+						logrus.Warnf("cannot find ERR replica '%s' of volume '%s'", replica.Address, volume.Name)
+						return
+					}
+					if err := man.orc.MarkBadReplica(volume.Name, r); err != nil {
+						errCh <- errors.Wrapf(err, "failed to mark replica '%s' bad for volume '%s'", replica.Address, volume.Name)
+						return
+					}
+					// stopped right away, the data is kept until the
+					// stale replica timeout in case the fault is transient
+					if r.Running {
+						_, err := man.orc.StopInstance(&r.InstanceInfo)
+						errCh <- errors.Wrapf(err, "failed to stop bad replica '%s' of volume '%s'", r.Name, volume.Name)
+					}
 				}()
-			}(replica)
+			}(replica, findReplicaByAddress(current, replica.Address))
 		}
 	}
 	go func() {
@@ -491,22 +866,91 @@ func (man *volumeManager) CheckController(ctrl types.Controller, volume *types.V
 	if len(errs) > 0 {
 		return errs
 	}
-	if len(goodReplicas) == 0 {
+	for _, replica := range badReplicas {
+		if err := ctrl.RemoveReplica(replica); err != nil {
+			return errors.Wrapf(err, "failed to remove bad replica '%s' from volume '%s'", replica.Address, volume.Name)
+		}
+		logrus.Warnf("removed bad replica '%s' from volume '%s'", replica.Address, volume.Name)
+	}
+	if len(goodReplicas)+len(evictingReplicas) == 0 {
 		logrus.Errorf("volume '%s' has no more good replicas, shutting it down", volume.Name)
 		return man.Detach(volume.Name)
 	}
 
 	addingReplicas := man.addingReplicasCount(volume.Name, 0)
-	logrus.Debugf("'%s' replicas by state: RW=%v, WO=%v, adding=%v", volume.Name, len(goodReplicas), len(woReplicas), addingReplicas)
-	if len(goodReplicas) < volume.NumberOfReplicas && len(woReplicas) == 0 && addingReplicas == 0 {
-		if err := man.createAndAddReplicaToController(volume.Name, ctrl); err != nil {
+	if err := man.updateRebuildProgress(current, ctrl); err != nil {
+		logrus.Warnf("%v", errors.Wrapf(err, "failed to get rebuild progress of volume '%s'", volume.Name))
+	}
+	logrus.Debugf("'%s' replicas by state: RW=%v, WO=%v, evicting=%v, adding=%v", volume.Name, len(goodReplicas), len(woReplicas), len(evictingReplicas), addingReplicas)
+	if len(goodReplicas) < numberOfReplicas && len(woReplicas) == 0 && addingReplicas == 0 {
+		if err := man.addReplicaToController(volume.Name, ctrl); err != nil {
+			return err
+		}
+	}
+	total := len(goodReplicas) + len(woReplicas) + len(evictingReplicas)
+	if total > numberOfReplicas && addingReplicas == 0 {
+		logrus.Infof("volume '%s' has more replicas than needed: has %v, needs %v", volume.Name, total, numberOfReplicas)
+		surplus := append(woReplicas, evictingReplicas...)
+		surplus = append(surplus, replicasToRemove(current, goodReplicas)...)
+		if err := man.removeReplicasFromController(current, ctrl, surplus[:total-numberOfReplicas]); err != nil {
 			return err
 		}
 	}
-	if len(goodReplicas)+len(woReplicas) > volume.NumberOfReplicas {
-		logrus.Warnf("volume '%s' has more replicas than needed: has %v, needs %v", volume.Name, len(goodReplicas), volume.NumberOfReplicas)
+
+	return nil
+}
+
+// replicasToRemove sorts the replicas in the order they should be removed
+// when there're more than needed. The replicas sharing a host with other
+// replicas of the volume go first.
+func replicasToRemove(volume *types.VolumeInfo, replicas []*types.ReplicaInfo) []*types.ReplicaInfo {
+	hostReplicas := map[string]int{}
+	for _, r := range volume.Replicas {
+		hostReplicas[r.HostID]++
+	}
+	shared := []*types.ReplicaInfo{}
+	others := []*types.ReplicaInfo{}
+	for _, replica := range replicas {
+		r := findReplicaByAddress(volume, replica.Address)
+		if r != nil && hostReplicas[r.HostID] > 1 {
+			hostReplicas[r.HostID]--
+			shared = append(shared, replica)
+		} else {
+			others = append(others, replica)
+		}
 	}
+	return append(shared, others...)
+}
 
+func findReplicaByAddress(volume *types.VolumeInfo, address string) *types.ReplicaInfo {
+	for _, r := range volume.Replicas {
+		if r.Address == address {
+			return r
+		}
+	}
+	return nil
+}
+
+// removeReplicasFromController removes the replicas from the controller, then
+// removes their instances
+func (man *volumeManager) removeReplicasFromController(volume *types.VolumeInfo, ctrl types.Controller, replicas []*types.ReplicaInfo) error {
+	for _, replica := range replicas {
+		if err := ctrl.RemoveReplica(replica); err != nil {
+			return errors.Wrapf(err, "failed to remove surplus replica '%s' from volume '%s'", replica.Address, volume.Name)
+		}
+		r := findReplicaByAddress(volume, replica.Address)
+		if r == nil {
+			logrus.Warnf("cannot find surplus replica '%s' of volume '%s'", replica.Address, volume.Name)
+			continue
+		}
+		logrus.Infof("removed surplus replica '%s' from volume '%s'", r.Name, volume.Name)
+		if _, err := man.orc.StopInstance(&r.InstanceInfo); err != nil {
+			return errors.Wrapf(err, "failed to stop surplus replica '%s' of volume '%s'", r.Name, volume.Name)
+		}
+		if _, err := man.orc.RemoveInstance(&r.InstanceInfo); err != nil {
+			return errors.Wrapf(err, "failed to remove surplus replica '%s' of volume '%s'", r.Name, volume.Name)
+		}
+	}
 	return nil
 }
 
@@ -517,10 +961,19 @@ func (man *volumeManager) Cleanup(v *types.VolumeInfo) error {
 	}
 	logrus.Infof("running cleanup, volume '%s'", volume.Name)
 	now := time.Now().UTC()
+	// the most recent bad replica is the last resort of a faulted volume
+	var lastResort *types.ReplicaInfo
+	if volumeState(volume) == types.VolumeStateFaulted {
+		for _, replica := range volume.Replicas {
+			if lastResort == nil || replica.BadTimestamp.After(lastResort.BadTimestamp) {
+				lastResort = replica
+			}
+		}
+	}
 	errCh := make(chan error)
 	wg := &sync.WaitGroup{}
 	for _, replica := range volume.Replicas {
-		if replica.BadTimestamp.IsZero() {
+		if replica.BadTimestamp.IsZero() || man.isReusing(replica.Name) {
 			continue
 		}
 		wg.Add(1)
@@ -534,7 +987,7 @@ func (man *volumeManager) Cleanup(v *types.VolumeInfo) error {
 					errCh <- errors.Wrapf(err, "error stopping bad replica '%s', volume '%s'", replica.Name, volume.Name)
 				}()
 			}
-			if replica.BadTimestamp.Add(KeepBadReplicasPeriod).Before(now) {
+			if replica != lastResort && replica.StaleDeadline.Before(now) {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
@@ -586,6 +1039,14 @@ func (man *volumeManager) GetHost(id string) (*types.HostInfo, error) {
 	return man.orc.GetHost(id)
 }
 
+func (man *volumeManager) UpdateHostLabels(id string, labels map[string]string) (*types.HostInfo, error) {
+	return man.orc.UpdateHostLabels(id, labels)
+}
+
+func (man *volumeManager) UpdateHostTags(id string, tags, diskTags []string) (*types.HostInfo, error) {
+	return man.orc.UpdateHostTags(id, tags, diskTags)
+}
+
 func (man *volumeManager) VolumeBackupOps(name string) (types.VolumeBackupOps, error) {
 	controller, err := man.Controller(name)
 	if err != nil {
@@ -598,8 +1059,26 @@ func (man *volumeManager) Settings() types.Settings {
 	return man.settings
 }
 
-func (man *volumeManager) ManagerBackupOps(backupTarget string) types.ManagerBackupOps {
-	return man.getBackups(backupTarget)
+func (man *volumeManager) Credentials() types.Credentials {
+	return man.orc
+}
+
+// BackupTargetEnv returns the environment variables carrying the credential
+// of the backup target for the backup commands
+func (man *volumeManager) BackupTargetEnv(target *types.BackupTarget) ([]string, error) {
+	env, err := orch.CredentialEnv(man.orc, target.Credential)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get the credential of backup target '%s'", target.Name)
+	}
+	return env, nil
+}
+
+func (man *volumeManager) ManagerBackupOps(target *types.BackupTarget) (types.ManagerBackupOps, error) {
+	env, err := man.BackupTargetEnv(target)
+	if err != nil {
+		return nil, err
+	}
+	return man.getBackups(target.URL, env), nil
 }
 
 func (man *volumeManager) ProcessSchedule(spec *types.ScheduleSpec, item *types.ScheduleItem) (*types.InstanceInfo, error) {
@@ -0,0 +1,1470 @@
+package manager
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/backups"
+	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/engine"
+	"github.com/rancher/longhorn-manager/orch/memory"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	testEngineImage = "rancher/longhorn-engine:test"
+	testVolumeSize  = 8 * 1024 * 1024
+)
+
+var (
+	// testStopCh stops testManager, the manager of the last test
+	testStopCh  chan struct{}
+	testManager *volumeManager
+)
+
+// newTestManager returns the manager of the first host of an in-memory
+// cluster, with the controllers running in the fake engine
+func newTestManager(assert *require.Assertions) (*engine.Fake, types.Orchestrator, types.VolumeManager) {
+	return newMonitoredTestManager(assert, MonitoringPeriod)
+}
+
+// newUnmonitoredTestManager returns the test manager for the tests running
+// the controller checks themselves
+func newUnmonitoredTestManager(assert *require.Assertions) (*engine.Fake, types.Orchestrator, types.VolumeManager) {
+	return newMonitoredTestManager(assert, time.Hour)
+}
+
+// newMonitoredTestManager stops the manager of the last test and waits for it
+// before returning the test manager checking the controllers every period
+func newMonitoredTestManager(assert *require.Assertions, period time.Duration) (*engine.Fake, types.Orchestrator, types.VolumeManager) {
+	if testStopCh != nil {
+		close(testStopCh)
+		testManager.running.Wait()
+	}
+	testStopCh = make(chan struct{})
+
+	fake := engine.NewFake()
+	orc, err := memory.NewWithConfig(&memory.Config{
+		Hosts:       3,
+		EngineImage: testEngineImage,
+		Engine:      fake,
+	})
+	assert.Nil(err)
+	ctrls := controller.NewControllers(fake, fake.ReplicaAPI, false)
+	testManager = New(orc, Monitor(ctrls, period), ctrls.Get, backups.New(fake)).(*volumeManager)
+	assert.Nil(testManager.Start(testStopCh))
+	return fake, orc, testManager
+}
+
+func createTestVolume(assert *require.Assertions, man types.VolumeManager, name string) *types.VolumeInfo {
+	volume, err := man.Create(&types.VolumeInfo{
+		Name:             name,
+		Size:             testVolumeSize,
+		NumberOfReplicas: 2,
+	})
+	assert.Nil(err)
+	assert.Len(volume.Replicas, 2)
+	return volume
+}
+
+func TestExpand(t *testing.T) {
+	assert := require.New(t)
+
+	fake, _, man := newTestManager(assert)
+	name := "test-expand"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+
+	assert.NotNil(man.Expand(name, testVolumeSize+1))
+	assert.NotNil(man.Expand(name, testVolumeSize))
+	assert.NotNil(man.Expand(name, testVolumeSize/2))
+	assert.NotNil(man.Expand("nonexistent", 2*testVolumeSize))
+
+	// a detached volume is attached for the expansion and detached again
+	assert.Nil(man.Expand(name, 2*testVolumeSize))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	assert.Equal(int64(2*testVolumeSize), volume.Size)
+	assert.Equal(types.VolumeStateDetached, volume.State)
+	assert.Nil(volume.Controller)
+
+	assert.Nil(man.Attach(name))
+	assert.Equal(int64(2*testVolumeSize), fake.VolumeSize(name))
+
+	assert.Nil(man.Expand(name, 4*testVolumeSize))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Equal(int64(4*testVolumeSize), volume.Size)
+	assert.Equal(types.VolumeStateHealthy, volume.State)
+	assert.Equal(int64(4*testVolumeSize), fake.VolumeSize(name))
+
+	fake.Inject(&engine.Injection{
+		Args: []string{"expand"},
+		Err:  errors.New("injected"),
+	})
+	assert.NotNil(man.Expand(name, 8*testVolumeSize))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Equal(int64(4*testVolumeSize), volume.Size)
+	fake.ClearInjections()
+
+	assert.Nil(man.Detach(name))
+}
+
+func TestExpandUnsupported(t *testing.T) {
+	assert := require.New(t)
+
+	fake, _, man := newTestManager(assert)
+	fake.DisableExpand()
+	name := "test-expand-unsupported"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+
+	// attaching doesn't depend on expansion
+	assert.Nil(man.Attach(name))
+	err := man.Expand(name, 2*testVolumeSize)
+	assert.True(types.IsUnsupported(err))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	assert.Equal(int64(testVolumeSize), volume.Size)
+	assert.Equal(types.VolumeStateHealthy, volume.State)
+	assert.Nil(man.Detach(name))
+}
+
+// checkReplicaCount runs the check of the monitor until the volume converges
+// to count replicas
+func checkReplicaCount(assert *require.Assertions, man types.VolumeManager, name string, count int) {
+	m := man.(*volumeManager)
+	for i := 0; i < 10; i++ {
+		volume, err := man.Get(name)
+		assert.Nil(err)
+		ctrl := m.getController(volume)
+		replicas, err := ctrl.GetReplicaStates()
+		assert.Nil(err)
+		if len(replicas) == count && len(volume.Replicas) == count && m.addingReplicasCount(name, 0) == 0 {
+			for _, replica := range replicas {
+				assert.Equal(types.ReplicaModeRW, replica.Mode)
+			}
+			assert.Equal(types.VolumeStateHealthy, volume.State)
+			return
+		}
+		assert.Nil(man.CheckController(ctrl, volume))
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.FailNow("volume doesn't converge", "volume %v expects %v replicas", name, count)
+}
+
+// racingOrc updates the volume behind the back of the manager before its
+// next update of the volume
+type racingOrc struct {
+	types.Orchestrator
+
+	update func(volume *types.VolumeInfo)
+}
+
+func (o *racingOrc) UpdateVolume(volume *types.VolumeInfo) error {
+	if update := o.update; update != nil {
+		o.update = nil
+		current, err := o.Orchestrator.GetVolume(volume.Name)
+		if err != nil {
+			return err
+		}
+		update(current)
+		if err := o.Orchestrator.UpdateVolume(current); err != nil {
+			return err
+		}
+	}
+	return o.Orchestrator.UpdateVolume(volume)
+}
+
+func TestUpdateReplicaCountConflict(t *testing.T) {
+	assert := require.New(t)
+
+	_, orc, man := newTestManager(assert)
+	name := "test-update-replica-count-conflict"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+
+	racing := &racingOrc{Orchestrator: orc, update: func(volume *types.VolumeInfo) {
+		volume.StaleReplicaTimeout = time.Hour
+	}}
+	assert.Nil(New(racing, testManager.monitor, testManager.getController, testManager.getBackups).UpdateReplicaCount(name, 3))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	assert.Equal(3, volume.NumberOfReplicas)
+	assert.Equal(time.Hour, volume.StaleReplicaTimeout)
+}
+
+func TestUpdateReplicaCount(t *testing.T) {
+	assert := require.New(t)
+
+	// the test runs the checks itself
+	_, _, man := newUnmonitoredTestManager(assert)
+	name := "test-update-replica-count"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+
+	assert.NotNil(man.UpdateReplicaCount(name, 0))
+	assert.NotNil(man.UpdateReplicaCount("nonexistent", 3))
+
+	assert.Nil(man.Attach(name))
+	checkReplicaCount(assert, man, name, 2)
+
+	assert.Nil(man.UpdateReplicaCount(name, 3))
+	checkReplicaCount(assert, man, name, 3)
+
+	assert.Nil(man.UpdateReplicaCount(name, 1))
+	checkReplicaCount(assert, man, name, 1)
+
+	// scaled up on the next attach
+	assert.Nil(man.Detach(name))
+	assert.Nil(man.UpdateReplicaCount(name, 2))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	assert.Equal(2, volume.NumberOfReplicas)
+	assert.Len(volume.Replicas, 1)
+	assert.Nil(man.Attach(name))
+	checkReplicaCount(assert, man, name, 2)
+
+	assert.Nil(man.Detach(name))
+}
+
+func TestReplicaAntiAffinity(t *testing.T) {
+	assert := require.New(t)
+
+	_, orc, man := newTestManager(assert)
+
+	// 3 hosts for 4 replicas
+	_, err := man.Create(&types.VolumeInfo{
+		Name:                  "test-hard-too-many",
+		Size:                  testVolumeSize,
+		NumberOfReplicas:      4,
+		ReplicaSchedulePolicy: types.SchedulePolicyBindingHardAntiAffinity,
+	})
+	assert.NotNil(err)
+	_, err = man.Create(&types.VolumeInfo{
+		Name:                  "test-invalid-policy",
+		Size:                  testVolumeSize,
+		NumberOfReplicas:      2,
+		ReplicaSchedulePolicy: "invalid",
+	})
+	assert.NotNil(err)
+
+	hard := "test-hard"
+	volume, err := man.Create(&types.VolumeInfo{
+		Name:                  hard,
+		Size:                  testVolumeSize,
+		NumberOfReplicas:      3,
+		ReplicaSchedulePolicy: types.SchedulePolicyBindingHardAntiAffinity,
+	})
+	assert.Nil(err)
+	defer man.Delete(hard)
+	hosts := map[string]struct{}{}
+	for _, replica := range volume.Replicas {
+		hosts[replica.HostID] = struct{}{}
+	}
+	assert.Len(hosts, 3)
+	_, err = orc.CreateReplica(hard, "test-hard-extra")
+	assert.NotNil(err)
+	assert.NotNil(man.UpdateReplicaCount(hard, 4))
+
+	soft := "test-soft"
+	volume, err = man.Create(&types.VolumeInfo{
+		Name:                  soft,
+		Size:                  testVolumeSize,
+		NumberOfReplicas:      4,
+		ReplicaSchedulePolicy: types.SchedulePolicyBindingSoftAntiAffinity,
+	})
+	assert.Nil(err)
+	defer man.Delete(soft)
+	assert.Len(volume.Replicas, 4)
+
+	// the volumes without a policy follow the settings
+	name := "test-default"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+	settings, err := man.Settings().GetSettings()
+	assert.Nil(err)
+	settings.ReplicaSchedulePolicy = types.SchedulePolicyBindingHardAntiAffinity
+	assert.Nil(man.Settings().SetSettings(settings))
+	assert.NotNil(man.UpdateReplicaCount(name, 4))
+	assert.Nil(man.UpdateReplicaCount(name, 3))
+	_, err = man.Create(&types.VolumeInfo{
+		Name:             "test-default-too-many",
+		Size:             testVolumeSize,
+		NumberOfReplicas: 4,
+	})
+	assert.NotNil(err)
+	assert.Nil(man.UpdateReplicaCount(soft, 5))
+}
+
+func TestHostSelector(t *testing.T) {
+	assert := require.New(t)
+
+	_, _, man := newTestManager(assert)
+
+	hosts, err := man.ListHosts()
+	assert.Nil(err)
+	ssd := map[string]bool{}
+	nvme := ""
+	for id := range hosts {
+		if len(ssd) == 2 {
+			break
+		}
+		tags := []string{"ssd"}
+		diskTags := []string{}
+		if nvme == "" {
+			nvme = id
+			diskTags = append(diskTags, "nvme")
+		}
+		host, err := man.UpdateHostTags(id, tags, diskTags)
+		assert.Nil(err)
+		assert.Equal(tags, host.Tags)
+		ssd[id] = true
+	}
+	for id := range hosts {
+		_, err = man.UpdateHostTags(id, []string{"invalid tag"}, nil)
+		assert.NotNil(err)
+		break
+	}
+
+	name := "test-host-selector"
+	volume, err := man.Create(&types.VolumeInfo{
+		Name:             name,
+		Size:             testVolumeSize,
+		NumberOfReplicas: 2,
+		HostSelector:     []string{"ssd"},
+	})
+	assert.Nil(err)
+	defer man.Delete(name)
+	for _, replica := range volume.Replicas {
+		assert.True(ssd[replica.HostID])
+	}
+
+	name = "test-disk-selector"
+	volume, err = man.Create(&types.VolumeInfo{
+		Name:             name,
+		Size:             testVolumeSize,
+		NumberOfReplicas: 2,
+		DiskSelector:     []string{"nvme"},
+	})
+	assert.Nil(err)
+	defer man.Delete(name)
+	for _, replica := range volume.Replicas {
+		assert.Equal(nvme, replica.HostID)
+	}
+
+	// 2 matching hosts for 3 replicas which cannot share a host
+	_, err = man.Create(&types.VolumeInfo{
+		Name:                  "test-selector-too-many",
+		Size:                  testVolumeSize,
+		NumberOfReplicas:      3,
+		HostSelector:          []string{"ssd"},
+		ReplicaSchedulePolicy: types.SchedulePolicyBindingHardAntiAffinity,
+	})
+	assert.NotNil(err)
+	_, err = man.Create(&types.VolumeInfo{
+		Name:             "test-selector-no-host",
+		Size:             testVolumeSize,
+		NumberOfReplicas: 1,
+		HostSelector:     []string{"ssd", "gpu"},
+	})
+	assert.NotNil(err)
+}
+
+func TestCreateFromSnapshot(t *testing.T) {
+	assert := require.New(t)
+
+	fake, _, man := newTestManager(assert)
+	source := "test-clone-source"
+	createTestVolume(assert, man, source)
+	defer man.Delete(source)
+
+	assert.Nil(man.Attach(source))
+	volume, err := man.Get(source)
+	assert.Nil(err)
+	ops := man.(*volumeManager).getController(volume).SnapshotOps()
+	_, err = ops.Create("snap1", nil)
+	assert.Nil(err)
+	_, err = ops.Create("snap2", nil)
+	assert.Nil(err)
+	assert.Nil(man.Detach(source))
+
+	// the clone goes through the backup target
+	_, err = man.Create(&types.VolumeInfo{Name: "test-clone-invalid", FromVolume: source, FromSnapshot: "snap1", NumberOfReplicas: 2})
+	assert.NotNil(err)
+	target := "vfs:///var/lib/longhorn/backups/default"
+	settings, err := man.Settings().GetSettings()
+	assert.Nil(err)
+	settings.BackupTarget = target
+	assert.Nil(man.Settings().SetSettings(settings))
+
+	_, err = man.Create(&types.VolumeInfo{Name: "test-clone-invalid", FromVolume: source, NumberOfReplicas: 2})
+	assert.NotNil(err)
+	_, err = man.Create(&types.VolumeInfo{Name: "test-clone-invalid", FromVolume: source, FromSnapshot: "nonexistent", NumberOfReplicas: 2})
+	assert.NotNil(err)
+	_, err = man.Create(&types.VolumeInfo{Name: "test-clone-invalid", FromVolume: "nonexistent", FromSnapshot: "snap1", NumberOfReplicas: 2})
+	assert.NotNil(err)
+	invalid, err := man.Get("test-clone-invalid")
+	assert.Nil(err)
+	assert.Nil(invalid)
+	assert.Len(fake.BackupURLs(target, source), 0)
+
+	// the detached source is attached for the backup only
+	name := "test-clone"
+	clone, err := man.Create(&types.VolumeInfo{
+		Name:             name,
+		FromVolume:       source,
+		FromSnapshot:     "snap1",
+		NumberOfReplicas: 2,
+	})
+	assert.Nil(err)
+	defer man.Delete(name)
+	assert.Equal(int64(testVolumeSize), clone.Size)
+	assert.Len(clone.Replicas, 2)
+	for _, replica := range clone.Replicas {
+		for _, r := range volume.Replicas {
+			assert.NotEqual(r.Name, replica.Name)
+		}
+	}
+	assert.Equal(types.VolumeStateRestoring, clone.State)
+	assert.True(clone.Restore.RemoveBackup)
+	volume, err = man.Get(source)
+	assert.Nil(err)
+	assert.Nil(volume.Controller)
+
+	clone = waitForRestore(assert, man, name)
+	assert.Equal(source, clone.FromVolume)
+	assert.Equal("snap1", clone.FromSnapshot)
+	assert.Equal(types.VolumeStateDetached, clone.State)
+	assert.Equal(types.RestoreStateCompleted, clone.Restore.State)
+
+	// the backup taken for the clone is removed once restored
+	waitForNoBackups(assert, fake, target, source)
+
+	// and if the restore fails
+	failed := "test-clone-failed"
+	fake.Inject(&engine.Injection{Args: []string{"backup", "restore"}, Err: errors.New("injected restore failure"), Times: 1})
+	_, err = man.Create(&types.VolumeInfo{Name: failed, FromVolume: source, FromSnapshot: "snap2", NumberOfReplicas: 2})
+	assert.Nil(err)
+	defer man.Delete(failed)
+	clone = waitForRestore(assert, man, failed)
+	assert.Equal(types.RestoreStateFailed, clone.Restore.State)
+	waitForNoBackups(assert, fake, target, source)
+	volume, err = man.Get(source)
+	assert.Nil(err)
+	assert.Nil(volume.Controller)
+}
+
+func waitForNoBackups(assert *require.Assertions, fake *engine.Fake, target, volumeName string) {
+	for i := 0; i < 50 && len(fake.BackupURLs(target, volumeName)) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Len(fake.BackupURLs(target, volumeName), 0)
+}
+
+// checkController runs the check of the monitor of the volume, if it's
+// attached, and waits for the replicas it adds. The controller can be
+// detached or swapped by the background tasks under the check.
+func checkController(assert *require.Assertions, man types.VolumeManager, volume *types.VolumeInfo) {
+	ctrl := man.(*volumeManager).getController(volume)
+	if ctrl == nil {
+		return
+	}
+	if err := man.CheckController(ctrl, volume); err != nil {
+		_, ok := err.(ControllerError)
+		assert.True(ok, "%v", err)
+	}
+	waitForAddingReplicas(assert, man, volume.Name)
+}
+
+// waitForEngineUpgrade runs the controller checks replacing the replicas
+// until the engine upgrade of the volume is done
+func waitForEngineUpgrade(assert *require.Assertions, man types.VolumeManager, name string) *types.VolumeInfo {
+	for i := 0; i < 100; i++ {
+		volume, err := man.Get(name)
+		assert.Nil(err)
+		if !isUpgrading(volume) {
+			return volume
+		}
+		checkController(assert, man, volume)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.FailNow("timeout waiting for engine upgrade of volume " + name)
+	return nil
+}
+
+func replicaNames(volume *types.VolumeInfo) map[string]bool {
+	names := map[string]bool{}
+	for name := range volume.Replicas {
+		names[name] = true
+	}
+	return names
+}
+
+// assertReplaced checks all the replicas of the volume are new
+func assertReplaced(assert *require.Assertions, old, volume *types.VolumeInfo) {
+	assert.Len(volume.Replicas, len(old.Replicas))
+	for name := range volume.Replicas {
+		assert.False(replicaNames(old)[name])
+	}
+	assert.Equal(len(old.Replicas), volume.EngineUpgrade.Replicas)
+	assert.Equal(len(old.Replicas), volume.EngineUpgrade.Replaced)
+}
+
+func TestEngineUpgrade(t *testing.T) {
+	assert := require.New(t)
+
+	waitForAPI := WaitForControllerAPI
+	frontendInUse := FrontendInUse
+	checkPeriod := EvictCheckPeriod
+	EvictCheckPeriod = 10 * time.Millisecond
+	defer func() {
+		WaitForControllerAPI = waitForAPI
+		FrontendInUse = frontendInUse
+		EvictCheckPeriod = checkPeriod
+	}()
+	inUse := false
+	FrontendInUse = func(endpoint string) (bool, error) {
+		return inUse, nil
+	}
+	failures := 0
+	WaitForControllerAPI = func(address string) error {
+		if failures > 0 {
+			failures--
+			return errors.New("injected")
+		}
+		return nil
+	}
+
+	_, orc, man := newUnmonitoredTestManager(assert)
+	name := "test-engine-upgrade"
+	volume := createTestVolume(assert, man, name)
+	defer man.Delete(name)
+
+	assert.NotNil(man.EngineUpgrade(name, ""))
+	assert.NotNil(man.EngineUpgrade(name, "Invalid Image"))
+	assert.NotNil(man.EngineUpgrade(name, testEngineImage))
+	assert.NotNil(man.EngineUpgrade("nonexistent", testEngineImage+"2"))
+
+	// the detached volume is attached for the upgrade
+	assert.Nil(man.EngineUpgrade(name, testEngineImage+"2"))
+	upgraded := waitForEngineUpgrade(assert, man, name)
+	assert.Equal(testEngineImage+"2", upgraded.EngineImage)
+	assert.Equal(testEngineImage, upgraded.EngineUpgrade.FromImage)
+	assert.Equal(types.EngineUpgradeStateCompleted, upgraded.EngineUpgrade.State)
+	assert.Equal(orc.GetCurrentHostID(), upgraded.EngineUpgrade.HostID)
+	assert.False(upgraded.EngineUpgrade.PendingController)
+	assertReplaced(assert, volume, upgraded)
+	assert.Nil(upgraded.Controller)
+
+	assert.Nil(man.Attach(name))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	controllerID := volume.Controller.ID
+
+	// the replicas are replaced under the volume in use, the controller
+	// follows on the next attach
+	inUse = true
+	assert.Nil(man.EngineUpgrade(name, testEngineImage+"3"))
+	upgraded = waitForEngineUpgrade(assert, man, name)
+	assert.Equal(testEngineImage+"3", upgraded.EngineImage)
+	assert.Equal(types.EngineUpgradeStateCompleted, upgraded.EngineUpgrade.State)
+	assert.True(upgraded.EngineUpgrade.PendingController)
+	assertReplaced(assert, volume, upgraded)
+	assert.Equal(controllerID, upgraded.Controller.ID)
+	assert.Equal(types.VolumeStateHealthy, upgraded.State)
+	assert.Nil(man.Detach(name))
+	assert.Nil(man.Attach(name))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.False(volume.EngineUpgrade.PendingController)
+	controllerID = volume.Controller.ID
+	inUse = false
+
+	// the controller is swapped too if the volume is not in use
+	assert.Nil(man.EngineUpgrade(name, testEngineImage+"4"))
+	assert.NotNil(man.EngineUpgrade(name, testEngineImage+"5"))
+	upgraded = waitForEngineUpgrade(assert, man, name)
+	assert.Equal(testEngineImage+"4", upgraded.EngineImage)
+	assert.Equal(testEngineImage+"3", upgraded.EngineUpgrade.FromImage)
+	assert.Equal(types.EngineUpgradeStateCompleted, upgraded.EngineUpgrade.State)
+	assert.False(upgraded.EngineUpgrade.PendingController)
+	assertReplaced(assert, volume, upgraded)
+	assert.NotEqual(controllerID, upgraded.Controller.ID)
+	assert.Equal(types.VolumeStateHealthy, upgraded.State)
+
+	failures = 1
+	assert.Nil(man.EngineUpgrade(name, testEngineImage+"5"))
+	volume = waitForEngineUpgrade(assert, man, name)
+	assert.Equal(testEngineImage+"4", volume.EngineImage)
+	assert.Equal(testEngineImage+"5", volume.EngineUpgrade.ToImage)
+	assert.Equal(types.EngineUpgradeStateRolledBack, volume.EngineUpgrade.State)
+	assert.NotEmpty(volume.EngineUpgrade.Error)
+	assert.Equal(types.VolumeStateHealthy, volume.State)
+
+	// the upgrade left by the last manager fails
+	volume.EngineUpgrade.State = types.EngineUpgradeStateUpgrading
+	volume.EngineUpgrade.Error = ""
+	volume.EngineImage = testEngineImage + "5"
+	assert.Nil(orc.UpdateVolume(volume))
+	assert.NotNil(man.EngineUpgrade(name, testEngineImage+"6"))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	man.(*volumeManager).failInterruptedEngineUpgrades([]*types.VolumeInfo{volume})
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Equal(testEngineImage+"4", volume.EngineImage)
+	assert.Equal(types.EngineUpgradeStateFailed, volume.EngineUpgrade.State)
+	assert.Contains(volume.EngineUpgrade.Error, "interrupted")
+
+	// the attached volumes are left alone
+	detached := "test-engine-upgrade-detached"
+	volume = createTestVolume(assert, man, detached)
+	defer man.Delete(detached)
+	assert.NotNil(man.EngineUpgradeDetached(""))
+	assert.Nil(man.EngineUpgradeDetached(testEngineImage + "6"))
+	upgraded = waitForEngineUpgrade(assert, man, detached)
+	assert.Equal(testEngineImage+"6", upgraded.EngineImage)
+	assert.Equal(types.EngineUpgradeStateCompleted, upgraded.EngineUpgrade.State)
+	assertReplaced(assert, volume, upgraded)
+	assert.Nil(upgraded.Controller)
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Equal(testEngineImage+"4", volume.EngineImage)
+
+	assert.Nil(man.Detach(name))
+}
+
+func waitForAddingReplicas(assert *require.Assertions, man types.VolumeManager, name string) {
+	m := man.(*volumeManager)
+	for i := 0; i < 10 && m.addingReplicasCount(name, 0) != 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(0, m.addingReplicasCount(name, 0))
+}
+
+func TestStaleReplicaTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	fake, orc, man := newUnmonitoredTestManager(assert)
+	name := "test-stale-replica"
+	_, err := man.Create(&types.VolumeInfo{
+		Name:                name,
+		Size:                testVolumeSize,
+		NumberOfReplicas:    2,
+		StaleReplicaTimeout: time.Minute,
+	})
+	assert.Nil(err)
+	defer man.Delete(name)
+
+	assert.Nil(man.Attach(name))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	var bad *types.ReplicaInfo
+	for _, r := range volume.Replicas {
+		bad = r
+		break
+	}
+	// the bad replica fails to be reused, and is replaced by a new one
+	fake.Inject(&engine.Injection{
+		Args:  []string{"add"},
+		Err:   errors.New("injected"),
+		Times: 1,
+	})
+	assert.Nil(fake.SetReplicaMode(volume.Controller.Address, bad.Address, types.ReplicaModeERR))
+	assert.Nil(man.CheckController(man.(*volumeManager).getController(volume), volume))
+	waitForAddingReplicas(assert, man, name)
+	assert.Nil(man.CheckController(man.(*volumeManager).getController(volume), volume))
+	waitForAddingReplicas(assert, man, name)
+
+	// stopped right away, and kept for the timeout
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Len(volume.Replicas, 3)
+	replica := volume.Replicas[bad.Name]
+	assert.False(replica.BadTimestamp.IsZero())
+	assert.False(replica.Running)
+	assert.Equal(replica.BadTimestamp.Add(time.Minute), replica.StaleDeadline)
+	assert.Nil(man.Cleanup(volume))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.NotNil(volume.Replicas[bad.Name])
+
+	v, err := orc.GetVolume(name)
+	assert.Nil(err)
+	v.Replicas[bad.Name].BadTimestamp = time.Now().UTC().Add(-2 * time.Minute)
+	assert.Nil(orc.UpdateVolume(v))
+	assert.Nil(man.Cleanup(volume))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Len(volume.Replicas, 2)
+	assert.Nil(volume.Replicas[bad.Name])
+
+	// the most recent bad replica of a faulted volume is kept
+	assert.Nil(man.Detach(name))
+	v, err = orc.GetVolume(name)
+	assert.Nil(err)
+	var recent string
+	offset := 2 * time.Minute
+	for replicaName, r := range v.Replicas {
+		r.BadTimestamp = time.Now().UTC().Add(-offset)
+		if recent == "" {
+			recent = replicaName
+		}
+		offset += time.Minute
+	}
+	assert.Nil(orc.UpdateVolume(v))
+	assert.Nil(man.Cleanup(volume))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Equal(types.VolumeStateFaulted, volume.State)
+	assert.Len(volume.Replicas, 1)
+	assert.NotNil(volume.Replicas[recent])
+}
+
+func replicaMetric(name string) int64 {
+	if v, ok := ReplicaMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestReuseBadReplica(t *testing.T) {
+	assert := require.New(t)
+
+	fake, _, man := newUnmonitoredTestManager(assert)
+	name := "test-reuse-replica"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+
+	assert.Nil(man.Attach(name))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	ctrl := man.(*volumeManager).getController(volume)
+	var bad *types.ReplicaInfo
+	for _, r := range volume.Replicas {
+		bad = r
+		break
+	}
+
+	succeeded := replicaMetric(MetricReplicaReuseSucceeded)
+	assert.Nil(fake.SetReplicaMode(volume.Controller.Address, bad.Address, types.ReplicaModeERR))
+	assert.Nil(man.CheckController(ctrl, volume))
+	waitForAddingReplicas(assert, man, name)
+	assert.Equal(succeeded+1, replicaMetric(MetricReplicaReuseSucceeded))
+
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Len(volume.Replicas, 2)
+	assert.True(volume.Replicas[bad.Name].BadTimestamp.IsZero())
+	assert.True(volume.Replicas[bad.Name].Running)
+	assert.Equal(types.VolumeStateHealthy, volume.State)
+	replicas, err := ctrl.GetReplicaStates()
+	assert.Nil(err)
+	assert.Len(replicas, 2)
+
+	// a failed reuse isn't retried, the replica is rebuilt instead
+	failed := replicaMetric(MetricReplicaReuseFailed)
+	rebuilds := replicaMetric(MetricReplicaRebuilds)
+	bad = volume.Replicas[bad.Name]
+	fake.Inject(&engine.Injection{
+		Args:  []string{"add"},
+		Err:   errors.New("injected"),
+		Times: 1,
+	})
+	assert.Nil(fake.SetReplicaMode(volume.Controller.Address, bad.Address, types.ReplicaModeERR))
+	assert.Nil(man.CheckController(ctrl, volume))
+	waitForAddingReplicas(assert, man, name)
+	assert.Equal(failed+1, replicaMetric(MetricReplicaReuseFailed))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.False(volume.Replicas[bad.Name].BadTimestamp.IsZero())
+	assert.False(volume.Replicas[bad.Name].Running)
+
+	assert.Nil(man.CheckController(ctrl, volume))
+	waitForAddingReplicas(assert, man, name)
+	assert.Equal(rebuilds+1, replicaMetric(MetricReplicaRebuilds))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Len(volume.Replicas, 3)
+	assert.Equal(types.VolumeStateHealthy, volume.State)
+
+	assert.Nil(man.Detach(name))
+}
+
+func TestRebuildETA(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2017, 6, 1, 0, 10, 0, 0, time.UTC)
+	started := "2017-06-01T00:00:00Z"
+	assert.Equal("2017-06-01T00:40:00Z", rebuildETA(started, &types.RebuildStatus{SyncedBytes: 1024, TotalBytes: 4096}, now))
+	assert.Equal("", rebuildETA(started, &types.RebuildStatus{SyncedBytes: 0, TotalBytes: 4096}, now))
+	assert.Equal("", rebuildETA("invalid", &types.RebuildStatus{SyncedBytes: 1024, TotalBytes: 4096}, now))
+}
+
+func TestRebuildProgress(t *testing.T) {
+	assert := require.New(t)
+
+	fake, _, man := newUnmonitoredTestManager(assert)
+	name := "test-rebuild-progress"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+
+	assert.Nil(man.Attach(name))
+	assert.Nil(man.UpdateReplicaCount(name, 3))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	ctrl := man.(*volumeManager).getController(volume)
+	for _, snap := range []string{"snap1", "snap2"} {
+		_, err = ctrl.SnapshotOps().Create(snap, nil)
+		assert.Nil(err)
+	}
+	assert.Nil(fake.SetSnapshotSize(name, "snap1", testVolumeSize/4))
+	assert.Nil(fake.SetSnapshotSize(name, "snap2", 3*testVolumeSize/4))
+
+	fake.Inject(&engine.Injection{
+		Args:  []string{"add"},
+		Delay: 500 * time.Millisecond,
+		Times: 1,
+	})
+	assert.Nil(man.CheckController(ctrl, volume))
+
+	var rebuilding *types.ReplicaInfo
+	for i := 0; i < 10 && rebuilding == nil; i++ {
+		volume, err = man.Get(name)
+		assert.Nil(err)
+		for _, r := range volume.Replicas {
+			if r.Rebuild != nil {
+				rebuilding = r
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(rebuilding)
+	assert.NotEmpty(rebuilding.Rebuild.Started)
+	assert.Equal(int64(0), rebuilding.Rebuild.SyncedBytes)
+
+	fake.SetSyncedSnapshots(rebuilding.Address, "snap1")
+	assert.Nil(man.CheckController(ctrl, volume))
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	rebuild := volume.Replicas[rebuilding.Name].Rebuild
+	assert.NotNil(rebuild)
+	assert.Equal(int64(testVolumeSize/4), rebuild.SyncedBytes)
+	assert.Equal(int64(testVolumeSize), rebuild.TotalBytes)
+	assert.NotEmpty(rebuild.ETA)
+
+	waitForAddingReplicas(assert, man, name)
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Nil(volume.Replicas[rebuilding.Name].Rebuild)
+
+	assert.Nil(man.Detach(name))
+}
+
+func TestEvictHost(t *testing.T) {
+	assert := require.New(t)
+
+	checkPeriod := EvictCheckPeriod
+	EvictCheckPeriod = 10 * time.Millisecond
+	defer func() {
+		EvictCheckPeriod = checkPeriod
+	}()
+
+	_, orc, man := newUnmonitoredTestManager(assert)
+	name := "test-evict"
+	volume := createTestVolume(assert, man, name)
+	defer man.Delete(name)
+	assert.Nil(man.Attach(name))
+	detached := "test-evict-detached"
+	_, err := man.Create(&types.VolumeInfo{
+		Name:             detached,
+		Size:             testVolumeSize,
+		NumberOfReplicas: 3,
+	})
+	assert.Nil(err)
+	defer man.Delete(detached)
+
+	var hostID string
+	for _, replica := range volume.Replicas {
+		hostID = replica.HostID
+		break
+	}
+	assert.NotNil(man.EvictHost(hostID))
+	host, err := man.UpdateHostMaintenance(hostID, true)
+	assert.Nil(err)
+	assert.True(host.Maintenance)
+
+	// nothing new goes to the host in maintenance
+	_, err = man.Create(&types.VolumeInfo{
+		Name:                  "test-evict-hard",
+		Size:                  testVolumeSize,
+		NumberOfReplicas:      3,
+		ReplicaSchedulePolicy: types.SchedulePolicyBindingHardAntiAffinity,
+	})
+	assert.NotNil(err)
+
+	// the eviction stored by the manager on another host guards the host
+	hosts, err := orc.ListHosts()
+	assert.Nil(err)
+	var otherID string
+	for id := range hosts {
+		if id != orc.GetCurrentHostID() {
+			otherID = id
+			break
+		}
+	}
+	assert.Nil(orc.UpdateHostEviction(hostID, &types.EvictionInfo{
+		State:  types.EvictionStateEvicting,
+		HostID: otherID,
+	}, nil))
+	assert.NotNil(man.EvictHost(hostID))
+	_, err = man.UpdateHostMaintenance(hostID, false)
+	assert.NotNil(err)
+	assert.Nil(orc.UpdateHostEviction(hostID, nil, nil))
+
+	assert.Nil(man.EvictHost(hostID))
+	for i := 0; i < 100; i++ {
+		host, err = orc.GetHost(hostID)
+		assert.Nil(err)
+		if host.Eviction.State != types.EvictionStateEvicting {
+			break
+		}
+		for _, n := range []string{name, detached} {
+			volume, err := man.Get(n)
+			assert.Nil(err)
+			checkController(assert, man, volume)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(types.EvictionStateCompleted, host.Eviction.State)
+	assert.Equal(orc.GetCurrentHostID(), host.Eviction.HostID)
+	assert.Equal(2, host.Eviction.Total)
+	assert.Equal(2, host.Eviction.Evicted)
+	assert.Empty(host.Eviction.Attached)
+
+	for n, count := range map[string]int{name: 2, detached: 3} {
+		volume, err := man.Get(n)
+		assert.Nil(err)
+		assert.Len(volume.Replicas, count)
+		for _, replica := range volume.Replicas {
+			assert.NotEqual(hostID, replica.HostID)
+			assert.False(replica.Evicting)
+		}
+	}
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.NotNil(volume.Controller)
+	volume, err = man.Get(detached)
+	assert.Nil(err)
+	assert.Nil(volume.Controller)
+
+	host, err = man.UpdateHostMaintenance(hostID, false)
+	assert.Nil(err)
+	assert.False(host.Maintenance)
+	assert.Nil(man.Detach(name))
+}
+
+func TestInterruptedEviction(t *testing.T) {
+	assert := require.New(t)
+
+	_, orc, man := newUnmonitoredTestManager(assert)
+	m := man.(*volumeManager)
+	name := "test-evict-interrupted"
+	volume := createTestVolume(assert, man, name)
+	defer man.Delete(name)
+
+	// the manager stopped moving the replica of the volume it attached
+	assert.Nil(man.Attach(name))
+	var replica *types.ReplicaInfo
+	for _, replica = range volume.Replicas {
+		break
+	}
+	assert.Nil(m.setEvicting(name, replica.Name, true))
+	assert.Nil(orc.UpdateHostEviction(replica.HostID, &types.EvictionInfo{
+		State:    types.EvictionStateEvicting,
+		HostID:   orc.GetCurrentHostID(),
+		Total:    1,
+		Current:  replica.Name,
+		Attached: name,
+	}, nil))
+
+	// the eviction run by the manager on another host is left alone
+	hosts, err := orc.ListHosts()
+	assert.Nil(err)
+	var otherID, runnerID string
+	for id := range hosts {
+		if id != replica.HostID {
+			otherID = id
+		}
+		if id != orc.GetCurrentHostID() {
+			runnerID = id
+		}
+	}
+	assert.Nil(orc.UpdateHostEviction(otherID, &types.EvictionInfo{
+		State:  types.EvictionStateEvicting,
+		HostID: runnerID,
+	}, nil))
+
+	volumes, err := man.List()
+	assert.Nil(err)
+	m.failInterruptedEvictions(volumes)
+
+	host, err := orc.GetHost(replica.HostID)
+	assert.Nil(err)
+	assert.Equal(types.EvictionStateFailed, host.Eviction.State)
+	assert.Contains(host.Eviction.Error, "interrupted")
+	assert.Empty(host.Eviction.Current)
+	assert.Empty(host.Eviction.Attached)
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Nil(volume.Controller)
+	assert.False(volume.Replicas[replica.Name].Evicting)
+	_, err = man.UpdateHostMaintenance(replica.HostID, false)
+	assert.Nil(err)
+
+	host, err = orc.GetHost(otherID)
+	assert.Nil(err)
+	assert.Equal(types.EvictionStateEvicting, host.Eviction.State)
+	_, err = man.UpdateHostMaintenance(otherID, false)
+	assert.NotNil(err)
+}
+
+func TestDeadHost(t *testing.T) {
+	assert := require.New(t)
+
+	_, orc, man := newUnmonitoredTestManager(assert)
+	m := man.(*volumeManager)
+	name := "test-dead-host"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+	assert.Nil(man.Attach(name))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+
+	var dead *types.ReplicaInfo
+	for _, replica := range volume.Replicas {
+		if replica.HostID != orc.GetCurrentHostID() && replica.HostID != volume.Controller.HostID {
+			dead = replica
+			break
+		}
+	}
+	assert.NotNil(dead)
+	hosts := orc.(interface {
+		SetHostDown(id string, down bool) error
+	})
+	assert.Nil(hosts.SetHostDown(dead.HostID, true))
+	host, err := orc.GetHost(dead.HostID)
+	assert.Nil(err)
+	assert.Equal(types.HostStatusDown, host.Status)
+
+	// nothing new goes to the dead host
+	_, err = man.Create(&types.VolumeInfo{
+		Name:                  "test-dead-host-hard",
+		Size:                  testVolumeSize,
+		NumberOfReplicas:      3,
+		ReplicaSchedulePolicy: types.SchedulePolicyBindingHardAntiAffinity,
+	})
+	assert.NotNil(err)
+
+	assert.Nil(m.checkHosts())
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.False(volume.Replicas[dead.Name].BadTimestamp.IsZero())
+	assert.Equal(types.VolumeStateDegraded, volume.State)
+
+	// the bad replica is replaced on another host
+	assert.Nil(man.CheckController(m.getController(volume), volume))
+	waitForAddingReplicas(assert, man, name)
+	volume, err = man.Get(name)
+	assert.Nil(err)
+	assert.Len(volume.Replicas, 3)
+	for _, replica := range volume.Replicas {
+		if replica.Name != dead.Name {
+			assert.True(replica.BadTimestamp.IsZero())
+			assert.NotEqual(dead.HostID, replica.HostID)
+		}
+	}
+	replicas, err := m.getController(volume).GetReplicaStates()
+	assert.Nil(err)
+	assert.Len(replicas, 2)
+	for _, replica := range replicas {
+		assert.NotEqual(dead.Address, replica.Address)
+	}
+
+	assert.Nil(hosts.SetHostDown(dead.HostID, false))
+	host, err = orc.GetHost(dead.HostID)
+	assert.Nil(err)
+	assert.Equal(types.HostStatusUp, host.Status)
+	assert.Nil(man.Detach(name))
+}
+
+func TestControllerFailover(t *testing.T) {
+	assert := require.New(t)
+
+	_, orc, man := newUnmonitoredTestManager(assert)
+	m := man.(*volumeManager)
+	cluster := orc.(interface {
+		SetHostDown(id string, down bool) error
+		GetHostOrchestrator(id string) (types.Orchestrator, error)
+	})
+	hosts, err := orc.ListHosts()
+	assert.Nil(err)
+	var other string
+	for id := range hosts {
+		if id != orc.GetCurrentHostID() {
+			other = id
+			break
+		}
+	}
+	otherOrc, err := cluster.GetHostOrchestrator(other)
+	assert.Nil(err)
+	otherMan := New(otherOrc, m.monitor, m.getController, m.getBackups)
+	om := otherMan.(*volumeManager)
+	defer func() {
+		om.stopAllMonitoring()
+		om.running.Wait()
+	}()
+
+	_, err = man.Create(&types.VolumeInfo{
+		Name:             "test-failover-invalid",
+		Size:             testVolumeSize,
+		NumberOfReplicas: 2,
+		FailoverPolicy:   "invalid",
+	})
+	assert.NotNil(err)
+
+	policies := map[string]types.FailoverPolicy{
+		"test-failover-detach":   "",
+		"test-failover-reattach": types.FailoverPolicyReattach,
+	}
+	stale := map[string]*types.VolumeInfo{}
+	for name, policy := range policies {
+		_, err := man.Create(&types.VolumeInfo{
+			Name:             name,
+			Size:             testVolumeSize,
+			NumberOfReplicas: 2,
+			FailoverPolicy:   policy,
+		})
+		assert.Nil(err)
+		defer man.Delete(name)
+		assert.Nil(otherMan.Attach(name))
+		volume, err := man.Get(name)
+		assert.Nil(err)
+		assert.Equal(other, volume.Controller.HostID)
+		assert.Equal(other, volume.Lease.HostID)
+		stale[name] = volume
+	}
+	// the controllers are owned by a live host
+	assert.Nil(m.checkControllers())
+	for name := range policies {
+		volume, err := man.Get(name)
+		assert.Nil(err)
+		assert.Equal(other, volume.Controller.HostID)
+		assert.Nil(volume.Failover)
+	}
+
+	assert.Nil(cluster.SetHostDown(other, true))
+	assert.Nil(m.checkHosts())
+	assert.Nil(m.checkControllers())
+
+	volume, err := man.Get("test-failover-detach")
+	assert.Nil(err)
+	assert.Nil(volume.Controller)
+	assert.Equal(types.VolumeStateFaulted, volume.State)
+	assert.Equal(orc.GetCurrentHostID(), volume.Lease.HostID)
+	assert.Equal(other, volume.Failover.FromHostID)
+	assert.Equal(types.FailoverPolicyDetach, volume.Failover.Policy)
+	assert.True(volume.Failover.Faulted)
+	for _, replica := range volume.Replicas {
+		assert.False(replica.Running)
+	}
+
+	volume, err = man.Get("test-failover-reattach")
+	assert.Nil(err)
+	assert.NotNil(volume.Controller)
+	assert.Equal(orc.GetCurrentHostID(), volume.Controller.HostID)
+	assert.Equal(orc.GetCurrentHostID(), volume.Failover.ToHostID)
+	assert.False(volume.Failover.Faulted)
+	assert.Empty(volume.Failover.Error)
+
+	// the manager coming back stops monitoring the volume taken over
+	assert.Nil(cluster.SetHostDown(other, false))
+	reattached := stale["test-failover-reattach"]
+	assert.Nil(otherMan.CheckController(om.getController(reattached), reattached))
+	volume, err = man.Get("test-failover-reattach")
+	assert.Nil(err)
+	assert.Equal(orc.GetCurrentHostID(), volume.Controller.HostID)
+
+	// the fault is cleared once the volume is attached again
+	assert.Nil(man.Attach("test-failover-detach"))
+	volume, err = man.Get("test-failover-detach")
+	assert.Nil(err)
+	assert.NotNil(volume.Controller)
+	assert.False(volume.Failover.Faulted)
+	assert.NotEqual(types.VolumeStateFaulted, volume.State)
+
+	// the lease renewed on a clock an hour behind is still alive
+	assert.Nil(man.Detach("test-failover-detach"))
+	assert.Nil(otherMan.Attach("test-failover-detach"))
+	skewed := time.Now().Add(-time.Hour)
+	renew := func(renewed time.Time) {
+		volume, err := man.Get("test-failover-detach")
+		assert.Nil(err)
+		volume.Lease.Renewed = renewed.UTC().Format(time.RFC3339)
+		assert.Nil(orc.UpdateVolume(volume))
+	}
+	renew(skewed)
+	now := time.Now()
+	assert.Nil(m.checkControllersAt(now))
+	renew(skewed.Add(VolumeLeaseRenewPeriod))
+	assert.Nil(m.checkControllersAt(now.Add(VolumeLeaseTTL)))
+	volume, err = man.Get("test-failover-detach")
+	assert.Nil(err)
+	assert.NotNil(volume.Controller)
+	assert.Equal(other, volume.Controller.HostID)
+
+	// a live manager not renewing the lease loses the volume as well
+	assert.Nil(m.checkControllersAt(now.Add(2*VolumeLeaseTTL + time.Second)))
+	volume, err = man.Get("test-failover-detach")
+	assert.Nil(err)
+	assert.Nil(volume.Controller)
+	assert.True(volume.Failover.Faulted)
+
+	assert.Nil(man.Detach("test-failover-reattach"))
+}
+
+func TestBackupTargetStatus(t *testing.T) {
+	assert := require.New(t)
+
+	for _, target := range []string{
+		"nfs://10.42.0.1:/opt/backupstore",
+		"s3://backups@us-east-1/longhorn",
+		"vfs:///var/lib/longhorn/backups",
+	} {
+		assert.Nil(validateBackupTargetURL(target))
+	}
+	for _, target := range []string{"", "/var/lib/longhorn/backups", "http://10.42.0.1/backups", "nfs:///opt/backupstore", "vfs://"} {
+		assert.NotNil(validateBackupTargetURL(target), target)
+	}
+
+	fake, _, man := newTestManager(assert)
+	settings, err := man.Settings().GetSettings()
+	assert.Nil(err)
+	settings.BackupTarget = "vfs:///var/lib/longhorn/backups/default"
+	settings.BackupTargets = []*types.BackupTarget{
+		{Name: "offsite", URL: "vfs:///var/lib/longhorn/backups/offsite", Credential: "missing"},
+	}
+	assert.Nil(man.Settings().SetSettings(settings))
+
+	assert.Nil(man.(*volumeManager).checkBackupTargets())
+	statuses, err := man.ListBackupTargetStatus()
+	assert.Nil(err)
+	assert.Len(statuses, 2)
+	assert.True(statuses[0].Available)
+	assert.NotEqual("", statuses[0].LastChecked)
+	assert.False(statuses[1].Available)
+	assert.Contains(statuses[1].Message, "missing")
+
+	fake.Inject(&engine.Injection{Args: []string{"backup", "ls"}, Output: "cannot find backupstore", Err: errors.New("exit status 1")})
+	defaultTarget, err := settings.GetBackupTarget("")
+	assert.Nil(err)
+	assert.NotNil(man.CheckBackupTarget(defaultTarget))
+	status, err := man.GetBackupTargetStatus(types.DefaultBackupTargetName)
+	assert.Nil(err)
+	assert.False(status.Available)
+	assert.Contains(status.Message, "cannot find backupstore")
+
+	fake.ClearInjections()
+	assert.Nil(man.CheckBackupTarget(defaultTarget))
+	status, err = man.GetBackupTargetStatus("")
+	assert.Nil(err)
+	assert.True(status.Available)
+	assert.Equal("", status.Message)
+
+	// a changed target isn't checked yet
+	settings.BackupTarget = "vfs:///var/lib/longhorn/backups/other"
+	assert.Nil(man.Settings().SetSettings(settings))
+	status, err = man.GetBackupTargetStatus("")
+	assert.Nil(err)
+	assert.False(status.Available)
+	assert.Equal("", status.LastChecked)
+
+	_, err = man.GetBackupTargetStatus("nonexistent")
+	assert.NotNil(err)
+}
+
+func waitForRestore(assert *require.Assertions, man types.VolumeManager, name string) *types.VolumeInfo {
+	for i := 0; i < 50; i++ {
+		volume, err := man.Get(name)
+		assert.Nil(err)
+		if volume.State != types.VolumeStateRestoring {
+			return volume
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.FailNow("timeout waiting for restore of volume " + name)
+	return nil
+}
+
+// createTestBackup backs up the volume to target, and returns the backup URL
+func createTestBackup(assert *require.Assertions, fake *engine.Fake, man types.VolumeManager, name, target string) string {
+	assert.Nil(man.Attach(name))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	ctrl := man.(*volumeManager).getController(volume)
+	_, err = ctrl.SnapshotOps().Create("", nil)
+	assert.Nil(err)
+	snapshots, err := ctrl.SnapshotOps().List()
+	assert.Nil(err)
+	count := len(fake.BackupURLs(target, name))
+	for _, snapshot := range snapshots {
+		if snapshot.UserCreated {
+			assert.Nil(ctrl.BackupOps().StartBackup(snapshot.Name, target, nil))
+			break
+		}
+	}
+	for i := 0; i < 50 && len(fake.BackupURLs(target, name)) == count; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	urls := fake.BackupURLs(target, name)
+	assert.Len(urls, count+1)
+	assert.Nil(man.Detach(name))
+	return urls[len(urls)-1]
+}
+
+func TestRestore(t *testing.T) {
+	assert := require.New(t)
+
+	fake, orc, man := newTestManager(assert)
+	target := "vfs:///var/lib/longhorn/backups/default"
+	settings, err := man.Settings().GetSettings()
+	assert.Nil(err)
+	settings.BackupTarget = target
+	assert.Nil(man.Settings().SetSettings(settings))
+
+	source := "test-restore-source"
+	createTestVolume(assert, man, source)
+	defer man.Delete(source)
+	urls := []string{createTestBackup(assert, fake, man, source, target)}
+	var volume *types.VolumeInfo
+
+	// the volume is returned in the restoring state right away
+	fake.Inject(&engine.Injection{Args: []string{"backup", "restore"}, Delay: 500 * time.Millisecond, Times: 1})
+	name := "test-restore"
+	volume, err = man.Create(&types.VolumeInfo{Name: name, FromBackup: urls[0], NumberOfReplicas: 2})
+	assert.Nil(err)
+	defer man.Delete(name)
+	assert.Equal(types.VolumeStateRestoring, volume.State)
+	assert.Equal(types.RestoreStateRestoring, volume.Restore.State)
+	assert.Equal(urls[0], volume.Restore.BackupURL)
+	assert.Equal(types.DefaultBackupTargetName, volume.Restore.BackupTarget)
+	volume = waitForRestore(assert, man, name)
+	assert.Equal(types.VolumeStateDetached, volume.State)
+	assert.Equal(types.RestoreStateCompleted, volume.Restore.State)
+	assert.Equal(100, volume.Restore.Progress)
+	assert.Equal("", volume.Restore.Error)
+	assert.NotEqual("", volume.Restore.Finished)
+	assert.Equal(int64(testVolumeSize), volume.Size)
+
+	// the failed restore keeps the volume with the error
+	fake.Inject(&engine.Injection{Args: []string{"backup", "restore"}, Err: errors.New("injected restore failure"), Times: 1})
+	failed := "test-restore-failed"
+	_, err = man.Create(&types.VolumeInfo{Name: failed, FromBackup: urls[0], NumberOfReplicas: 2})
+	assert.Nil(err)
+	defer man.Delete(failed)
+	volume = waitForRestore(assert, man, failed)
+	assert.Equal(types.VolumeStateFaulted, volume.State)
+	assert.Equal(types.RestoreStateFailed, volume.Restore.State)
+	assert.Contains(volume.Restore.Error, "injected restore failure")
+	assert.Nil(volume.Controller)
+
+	// the restore left by the last manager fails
+	volume.Restore.State = types.RestoreStateRestoring
+	volume.Restore.Error = ""
+	assert.Nil(orc.UpdateVolume(volume))
+	volume, err = man.Get(failed)
+	assert.Nil(err)
+	assert.Equal(types.VolumeStateRestoring, volume.State)
+	man.(*volumeManager).failInterruptedRestores([]*types.VolumeInfo{volume})
+	volume, err = man.Get(failed)
+	assert.Nil(err)
+	assert.Equal(types.RestoreStateFailed, volume.Restore.State)
+	assert.Contains(volume.Restore.Error, "interrupted")
+
+	_, err = man.Create(&types.VolumeInfo{Name: "test-restore-invalid", FromBackup: target + "?backup=nonexistent&volume=" + source, NumberOfReplicas: 2})
+	assert.NotNil(err)
+}
+
+func TestRestoreBackup(t *testing.T) {
+	assert := require.New(t)
+
+	fake, _, man := newTestManager(assert)
+	target := "vfs:///var/lib/longhorn/backups/default"
+	settings, err := man.Settings().GetSettings()
+	assert.Nil(err)
+	settings.BackupTarget = target
+	assert.Nil(man.Settings().SetSettings(settings))
+
+	name := "test-restore-backup"
+	createTestVolume(assert, man, name)
+	defer man.Delete(name)
+	backupURL := createTestBackup(assert, fake, man, name, target)
+
+	assert.NotNil(man.RestoreBackup(name, ""))
+	assert.NotNil(man.RestoreBackup(name, target+"?backup=nonexistent&volume="+name))
+	assert.NotNil(man.RestoreBackup("nonexistent", backupURL))
+
+	// the volume must be detached
+	assert.Nil(man.Attach(name))
+	assert.NotNil(man.RestoreBackup(name, backupURL))
+	assert.Nil(man.Detach(name))
+
+	// the backup must fit the volume
+	small := "test-restore-backup-small"
+	_, err = man.Create(&types.VolumeInfo{Name: small, Size: testVolumeSize / 2, NumberOfReplicas: 2})
+	assert.Nil(err)
+	defer man.Delete(small)
+	assert.NotNil(man.RestoreBackup(small, backupURL))
+
+	fake.Inject(&engine.Injection{Args: []string{"backup", "restore"}, Delay: 500 * time.Millisecond, Times: 1})
+	assert.Nil(man.RestoreBackup(name, backupURL))
+	volume, err := man.Get(name)
+	assert.Nil(err)
+	assert.Equal(types.VolumeStateRestoring, volume.State)
+	assert.True(volume.Restore.InPlace)
+	assert.NotNil(man.RestoreBackup(name, backupURL))
+	volume = waitForRestore(assert, man, name)
+	assert.Equal(types.VolumeStateDetached, volume.State)
+	assert.Equal(types.RestoreStateCompleted, volume.Restore.State)
+	assert.Equal(backupURL, volume.Restore.BackupURL)
+	assert.Equal(100, volume.Restore.Progress)
+	assert.Equal(int64(testVolumeSize), volume.Size)
+	assert.NotEqual("", volume.Restore.Snapshot)
+
+	// the snapshot taken before the restore is kept
+	assert.Nil(man.Attach(name))
+	attached, err := man.Get(name)
+	assert.Nil(err)
+	snapshot, err := man.(*volumeManager).getController(attached).SnapshotOps().Get(volume.Restore.Snapshot)
+	assert.Nil(err)
+	assert.NotNil(snapshot)
+	assert.Nil(man.Detach(name))
+
+	// the restore which failed can be tried again
+	fake.Inject(&engine.Injection{Args: []string{"backup", "restore"}, Err: errors.New("injected restore failure"), Times: 1})
+	assert.Nil(man.RestoreBackup(name, backupURL))
+	volume = waitForRestore(assert, man, name)
+	assert.Equal(types.VolumeStateFaulted, volume.State)
+	assert.Equal(types.RestoreStateFailed, volume.Restore.State)
+	assert.Nil(volume.Controller)
+	assert.Nil(man.RestoreBackup(name, backupURL))
+	volume = waitForRestore(assert, man, name)
+	assert.Equal(types.VolumeStateDetached, volume.State)
+	assert.Equal(types.RestoreStateCompleted, volume.Restore.State)
+}
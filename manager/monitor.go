@@ -5,6 +5,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rancher/longhorn-manager/controller"
 	"github.com/rancher/longhorn-manager/types"
+	"sync"
 	"time"
 )
 
@@ -16,16 +17,19 @@ var (
 
 type monitorChan struct {
 	volume    *types.VolumeInfo
+	ctrls     *controller.Controllers
 	cronCh    chan<- types.Event
 	monitorCh chan<- types.Event
 	cleanupCh chan<- types.Event
+
+	running sync.WaitGroup
 }
 
 func (mc *monitorChan) Close() error {
 	defer func() {
 		recover()
 	}()
-	defer controller.Cleanup(mc.volume)
+	defer mc.ctrls.Cleanup(mc.volume)
 	defer close(mc.cronCh)
 	defer close(mc.monitorCh)
 	defer close(mc.cleanupCh)
@@ -36,20 +40,37 @@ func (mc *monitorChan) CronCh() chan<- types.Event {
 	return mc.cronCh
 }
 
-func Monitor(getController types.GetController) types.BeginMonitoring {
+// Wait waits for the goroutines of the monitor to exit after it's closed
+func (mc *monitorChan) Wait() {
+	mc.running.Wait()
+}
+
+func (mc *monitorChan) run(f func()) {
+	mc.running.Add(1)
+	go func() {
+		defer mc.running.Done()
+		f()
+	}()
+}
+
+// Monitor returns the BeginMonitoring checking the controllers of ctrls every
+// period
+func Monitor(ctrls *controller.Controllers, period time.Duration) types.BeginMonitoring {
 	return func(volume *types.VolumeInfo, man types.VolumeManager) types.Monitor {
 		monitorCh := make(chan types.Event)
-		go monitor(getController(volume), volume, man, monitorCh)
 		cleanupCh := make(chan types.Event)
-		go cleanup(volume, man, cleanupCh)
 		cronCh := make(chan types.Event)
-		go RunJobs(volume, getController(volume), man.Settings(), cronCh)
-		return &monitorChan{volume: volume, cronCh: cronCh, monitorCh: monitorCh, cleanupCh: cleanupCh}
+		mc := &monitorChan{volume: volume, ctrls: ctrls, cronCh: cronCh, monitorCh: monitorCh, cleanupCh: cleanupCh}
+		ctrl := ctrls.Get(volume)
+		mc.run(func() { monitor(ctrl, period, volume, man, monitorCh) })
+		mc.run(func() { cleanup(volume, man, cleanupCh) })
+		mc.run(func() { RunJobs(volume, ctrl, man.Settings(), man, cronCh) })
+		return mc
 	}
 }
 
-func monitor(ctrl types.Controller, volume *types.VolumeInfo, man types.VolumeManager, ch chan types.Event) {
-	ticker := NewTicker(MonitoringPeriod, ch)
+func monitor(ctrl types.Controller, period time.Duration, volume *types.VolumeInfo, man types.VolumeManager, ch chan types.Event) {
+	ticker := NewTicker(period, ch)
 	defer ticker.Start().Stop()
 	<-ch
 	failedAttempts := 0
@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// rebuildReplica adds the replica to the controller, recording the rebuild
+// in the metadata of the replica while the controller syncs it
+func (man *volumeManager) rebuildReplica(volumeName string, replica *types.ReplicaInfo, ctrl types.Controller) error {
+	err := man.updateReplica(volumeName, replica.Name, func(r *types.ReplicaInfo) bool {
+		r.Rebuild = &types.RebuildInfo{Started: util.Now()}
+		return true
+	})
+	if err != nil {
+		logrus.Warnf("%v", errors.Wrapf(err, "failed to record rebuild of replica '%s' of volume '%s'", replica.Name, volumeName))
+	}
+	addErr := ctrl.AddReplica(replica)
+	err = man.updateReplica(volumeName, replica.Name, func(r *types.ReplicaInfo) bool {
+		if r.Rebuild == nil {
+			return false
+		}
+		r.Rebuild = nil
+		return true
+	})
+	if err != nil {
+		logrus.Warnf("%v", errors.Wrapf(err, "failed to clear rebuild of replica '%s' of volume '%s'", replica.Name, volumeName))
+	}
+	return addErr
+}
+
+// updateReplica updates the metadata of the replica if update returns true
+func (man *volumeManager) updateReplica(volumeName, replicaName string, update func(r *types.ReplicaInfo) bool) error {
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(volumeName)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", volumeName)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", volumeName)
+		}
+		replica := volume.Replicas[replicaName]
+		if replica == nil {
+			return errors.Errorf("cannot find replica '%s' of volume '%s'", replicaName, volumeName)
+		}
+		if !update(replica) {
+			return nil
+		}
+		return man.orc.UpdateVolume(volume)
+	})
+}
+
+// updateRebuildProgress records the progress of the replicas being rebuilt,
+// as reported by the controller
+func (man *volumeManager) updateRebuildProgress(volume *types.VolumeInfo, ctrl types.Controller) error {
+	addresses := []string{}
+	for _, replica := range volume.Replicas {
+		if replica.Rebuild != nil && replica.Address != "" {
+			addresses = append(addresses, replica.Address)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	status, err := ctrl.RebuildStatus(addresses)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, replica := range volume.Replicas {
+		s := status[replica.Address]
+		if replica.Rebuild == nil || s == nil {
+			continue
+		}
+		progress := &types.RebuildInfo{
+			Started:     replica.Rebuild.Started,
+			SyncedBytes: s.SyncedBytes,
+			TotalBytes:  s.TotalBytes,
+			ETA:         rebuildETA(replica.Rebuild.Started, s, now),
+			Updated:     util.FormatTimeZ(now),
+		}
+		err := man.updateReplica(volume.Name, replica.Name, func(r *types.ReplicaInfo) bool {
+			if r.Rebuild == nil {
+				return false
+			}
+			r.Rebuild = progress
+			return true
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to update rebuild progress of replica '%s' of volume '%s'", replica.Name, volume.Name)
+		}
+	}
+	return nil
+}
+
+// rebuildETA estimates when the rebuild finishes from the average speed so
+// far, it's empty if nothing has been synced yet
+func rebuildETA(started string, s *types.RebuildStatus, now time.Time) string {
+	start, err := time.Parse(time.RFC3339, started)
+	if err != nil || s.SyncedBytes <= 0 || s.TotalBytes <= s.SyncedBytes {
+		return ""
+	}
+	elapsed := now.Sub(start)
+	remaining := time.Duration(float64(elapsed) * float64(s.TotalBytes-s.SyncedBytes) / float64(s.SyncedBytes))
+	return util.FormatTimeZ(now.Add(remaining))
+}
@@ -0,0 +1,241 @@
+package manager
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// The engine restores the backup in one go, so the progress only moves on
+// as the restore goes through its steps
+const (
+	restoreProgressAttached = 10
+	restoreProgressRestored = 90
+	restoreProgressDetached = 100
+)
+
+func isRestoring(volume *types.VolumeInfo) bool {
+	return volume.Restore != nil && volume.Restore.State == types.RestoreStateRestoring
+}
+
+func newRestoreInfo(hostID, backupURL string, target *types.BackupTarget) *types.RestoreInfo {
+	return &types.RestoreInfo{
+		BackupURL:    backupURL,
+		BackupTarget: target.Name,
+		HostID:       hostID,
+		State:        types.RestoreStateRestoring,
+		Started:      util.Now(),
+	}
+}
+
+// RestoreBackup restores the backup into the existing volume, which must be
+// detached and large enough for the backup. A snapshot of the current data is
+// taken before the restore, so it can be reverted to. The restore runs in the
+// background like the one of a new volume.
+func (man *volumeManager) RestoreBackup(name, backupURL string) error {
+	if backupURL == "" {
+		return errors.Errorf("backup URL required to restore volume '%s'", name)
+	}
+	volume, err := man.orc.GetVolume(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get volume '%s'", name)
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s'", name)
+	}
+	settings, err := man.settings.GetSettings()
+	if err != nil || settings == nil {
+		return errors.New("restore backup fail: fail to load settings")
+	}
+	backup, target, env, err := man.getBackup(settings, backupURL)
+	if err != nil {
+		return errors.Wrapf(err, "unable to restore volume '%s'", name)
+	}
+	size, err := backupVolumeSize(backup)
+	if err != nil {
+		return err
+	}
+	if size > volume.Size {
+		return errors.Errorf("backup '%s' of size %v doesn't fit volume '%s' of size %v", backupURL, size, name, volume.Size)
+	}
+
+	if err := orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		if isRestoring(volume) {
+			return errors.Errorf("volume '%s' is being restored already", name)
+		}
+		if volume.Controller != nil {
+			return errors.Errorf("volume '%s' must be detached to restore backup '%s'", name, backupURL)
+		}
+		volume.Restore = newRestoreInfo(man.orc.GetCurrentHostID(), backup.URL, target)
+		volume.Restore.InPlace = true
+		return man.orc.UpdateVolume(volume)
+	}); err != nil {
+		return err
+	}
+	man.background(func() { man.restore(name, env) })
+	return nil
+}
+
+// restore attaches the volume to the current host, restores the backup and
+// detaches the volume. It runs in the background, the volume is kept on
+// failure with the error recorded. The backup taken to clone a volume is
+// removed whether the restore succeeds or not.
+func (man *volumeManager) restore(name string, env []string) {
+	err := man.doRestore(name, env)
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to restore volume '%s'", name))
+	}
+	var restored *types.RestoreInfo
+	if err := man.updateRestore(name, func(restore *types.RestoreInfo) {
+		restored = restore
+		restore.Finished = util.Now()
+		if err != nil {
+			restore.State = types.RestoreStateFailed
+			restore.Error = err.Error()
+			return
+		}
+		restore.State = types.RestoreStateCompleted
+		restore.Progress = restoreProgressDetached
+	}); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to record the restore status of volume '%s'", name))
+	}
+	if restored != nil && restored.RemoveBackup {
+		man.removeRestoredBackup(name, restored)
+	}
+}
+
+// removeRestoredBackup removes the backup taken to clone the volume, the
+// volume has to be cloned again if the restore failed
+func (man *volumeManager) removeRestoredBackup(name string, restore *types.RestoreInfo) {
+	settings, err := man.settings.GetSettings()
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "unable to get settings to remove backup '%s' of volume '%s'", restore.BackupURL, name))
+		return
+	}
+	target, err := settings.GetBackupTarget(restore.BackupTarget)
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "unable to remove backup '%s' of volume '%s'", restore.BackupURL, name))
+		return
+	}
+	backups, err := man.ManagerBackupOps(target)
+	if err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "unable to remove backup '%s' of volume '%s'", restore.BackupURL, name))
+		return
+	}
+	if err := backups.Delete(restore.BackupURL); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to remove backup '%s' of volume '%s'", restore.BackupURL, name))
+	}
+}
+
+func (man *volumeManager) doRestore(name string, env []string) error {
+	volume, err := man.Get(name)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s'", name)
+	}
+	backupURL := volume.Restore.BackupURL
+	if err := man.doAttach(volume); err != nil {
+		return errors.Wrapf(err, "failed to attach to restore the backup, volume '%s', backup '%s'", name, backupURL)
+	}
+	if err := man.updateRestoreProgress(name, restoreProgressAttached); err != nil {
+		logrus.Warnf("%v", err)
+	}
+	if volume, err = man.Get(name); err != nil {
+		return err
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s'", name)
+	}
+	if volume.Restore.InPlace {
+		if err := man.takeRestoreSnapshot(volume); err != nil {
+			if err := man.doDetach(volume); err != nil {
+				logrus.Errorf("%+v", errors.Wrapf(err, "failed to detach after failing to snapshot volume '%s'", name))
+			}
+			return err
+		}
+	}
+	if err := man.getController(volume).BackupOps().Restore(backupURL, env); err != nil {
+		if err := man.doDetach(volume); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to detach after failing to restore volume '%s'", name))
+		}
+		return errors.Wrapf(err, "failed to restore the backup, volume '%s', backup '%s'", name, backupURL)
+	}
+	if err := man.updateRestoreProgress(name, restoreProgressRestored); err != nil {
+		logrus.Warnf("%v", err)
+	}
+	if err := man.doDetach(volume); err != nil {
+		return errors.Wrapf(err, "failed to detach after restoring the backup, volume '%s', backup '%s'", name, backupURL)
+	}
+	return nil
+}
+
+// takeRestoreSnapshot keeps the data of the volume before it's overwritten by
+// the restore
+func (man *volumeManager) takeRestoreSnapshot(volume *types.VolumeInfo) error {
+	snapshot, err := man.getController(volume).SnapshotOps().Create("", nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to snapshot volume '%s' before the restore", volume.Name)
+	}
+	logrus.Infof("snapshot '%s' of volume '%s' taken before restoring backup '%s'", snapshot, volume.Name, volume.Restore.BackupURL)
+	return errors.Wrapf(man.updateRestore(volume.Name, func(restore *types.RestoreInfo) {
+		restore.Snapshot = snapshot
+	}), "failed to record the snapshot of volume '%s' taken before the restore", volume.Name)
+}
+
+func (man *volumeManager) updateRestoreProgress(name string, progress int) error {
+	return errors.Wrapf(man.updateRestore(name, func(restore *types.RestoreInfo) {
+		restore.Progress = progress
+	}), "failed to record the restore progress of volume '%s'", name)
+}
+
+func (man *volumeManager) updateRestore(name string, update func(restore *types.RestoreInfo)) error {
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		if volume.Restore == nil {
+			return errors.Errorf("volume '%s' isn't restored", name)
+		}
+		update(volume.Restore)
+		return man.orc.UpdateVolume(volume)
+	})
+}
+
+// failInterruptedRestores marks the restores the current host was running
+// failed and detaches the volumes, since the restores are gone with the last
+// manager
+func (man *volumeManager) failInterruptedRestores(volumes []*types.VolumeInfo) {
+	hostID := man.orc.GetCurrentHostID()
+	for _, volume := range volumes {
+		if !isRestoring(volume) || volume.Restore.HostID != hostID {
+			continue
+		}
+		logrus.Warnf("restore of volume '%s' was interrupted by the manager restart", volume.Name)
+		if err := man.updateRestore(volume.Name, func(restore *types.RestoreInfo) {
+			restore.State = types.RestoreStateFailed
+			restore.Error = "interrupted by the manager restart"
+			restore.Finished = util.Now()
+		}); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to record the restore status of volume '%s'", volume.Name))
+		}
+		if err := man.doDetach(volume); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to detach volume '%s' after the interrupted restore", volume.Name))
+		}
+	}
+}
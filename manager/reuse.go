@@ -0,0 +1,149 @@
+package manager
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	MetricReplicaReuseSucceeded = "reuseSucceeded"
+	MetricReplicaReuseFailed    = "reuseFailed"
+	MetricReplicaRebuilds       = "rebuilds"
+)
+
+// ReplicaMetrics counts how the missing replicas are replaced, published as
+// "replicas" in /debug/vars on the address of --debug-vars-listen
+var ReplicaMetrics = expvar.NewMap("replicas")
+
+// addReplicaToController tries to reuse the most recent bad replica of the
+// volume before it expires, so the engine only needs to sync the delta.
+// Otherwise, a new replica is created and rebuilt from scratch.
+func (man *volumeManager) addReplicaToController(volumeName string, ctrl types.Controller) error {
+	volume, err := man.Get(volumeName)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get volume '%s'", volumeName)
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s'", volumeName)
+	}
+	hosts, err := man.orc.ListHosts()
+	if err != nil {
+		return errors.Wrap(err, "unable to list hosts")
+	}
+	if replica := man.reusableReplica(volume, hosts); replica != nil {
+		err := man.reuseReplica(volumeName, replica, ctrl)
+		if err == nil {
+			return nil
+		}
+		logrus.Errorf("%+v", err)
+	}
+	ReplicaMetrics.Add(MetricReplicaRebuilds, 1)
+	return man.createAndAddReplicaToController(volumeName, ctrl)
+}
+
+// reusableReplica skips the bad replicas on the hosts in maintenance or down,
+// and all of them during an engine upgrade, since they run the old image
+func (man *volumeManager) reusableReplica(volume *types.VolumeInfo, hosts map[string]*types.HostInfo) *types.ReplicaInfo {
+	if isUpgrading(volume) {
+		return nil
+	}
+
+	man.Lock()
+	defer man.Unlock()
+
+	now := time.Now().UTC()
+	var reusable *types.ReplicaInfo
+	for _, replica := range volume.Replicas {
+		if replica.BadTimestamp.IsZero() || !replica.StaleDeadline.After(now) {
+			continue
+		}
+		if host := hosts[replica.HostID]; host == nil || host.Maintenance || !orch.IsHostUp(host) {
+			continue
+		}
+		if man.reuseFailed[replica.Name].Equal(replica.BadTimestamp) {
+			continue
+		}
+		if reusable == nil || replica.BadTimestamp.After(reusable.BadTimestamp) {
+			reusable = replica
+		}
+	}
+	return reusable
+}
+
+func (man *volumeManager) reuseReplica(volumeName string, replica *types.ReplicaInfo, ctrl types.Controller) error {
+	man.setReusing(replica, true)
+	instance, err := man.orc.StartInstance(&replica.InstanceInfo)
+	if err != nil {
+		man.setReusing(replica, false)
+		return errors.Wrapf(err, "failed to start bad replica %v for volume '%s'", replica.Name, volumeName)
+	}
+	replica.InstanceInfo = *instance
+	logrus.Infof("reusing bad replica '%s' of volume '%s'", replica.Name, volumeName)
+	man.addingReplicasCount(volumeName, 1)
+	man.background(func() {
+		defer man.addingReplicasCount(volumeName, -1)
+		defer man.setReusing(replica, false)
+		if err := man.rebuildReplica(volumeName, replica, ctrl); err != nil {
+			ReplicaMetrics.Add(MetricReplicaReuseFailed, 1)
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to reuse bad replica '%s' of volume '%s'", replica.Name, volumeName))
+			if _, err := man.orc.StopInstance(&replica.InstanceInfo); err != nil {
+				logrus.Errorf("%+v", errors.Wrapf(err, "failed to stop bad replica '%s' of volume '%s'", replica.Name, volumeName))
+			}
+			return
+		}
+		ReplicaMetrics.Add(MetricReplicaReuseSucceeded, 1)
+		if err := man.clearBadReplica(volumeName, replica.Name); err != nil {
+			logrus.Errorf("%+v", errors.Wrapf(err, "failed to clear bad replica '%s' of volume '%s'", replica.Name, volumeName))
+		}
+	})
+	return nil
+}
+
+// setReusing tracks the bad replicas being reused, so they're left alone by
+// Cleanup. A failed reuse isn't retried until the replica goes bad again.
+func (man *volumeManager) setReusing(replica *types.ReplicaInfo, reusing bool) {
+	man.Lock()
+	defer man.Unlock()
+	if reusing {
+		man.reusingReplicas[replica.Name] = true
+		man.reuseFailed[replica.Name] = replica.BadTimestamp
+		return
+	}
+	delete(man.reusingReplicas, replica.Name)
+}
+
+func (man *volumeManager) isReusing(replicaName string) bool {
+	man.Lock()
+	defer man.Unlock()
+	return man.reusingReplicas[replicaName]
+}
+
+func (man *volumeManager) clearBadReplica(volumeName, replicaName string) error {
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(volumeName)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", volumeName)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", volumeName)
+		}
+		replica := volume.Replicas[replicaName]
+		if replica == nil {
+			return errors.Errorf("cannot find replica '%s' of volume '%s'", replicaName, volumeName)
+		}
+		replica.BadTimestamp = time.Time{}
+		if err := man.orc.UpdateVolume(volume); err != nil {
+			return err
+		}
+		man.Lock()
+		delete(man.reuseFailed, replicaName)
+		man.Unlock()
+		return nil
+	})
+}
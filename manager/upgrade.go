@@ -0,0 +1,338 @@
+package manager
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	EngineUpgradeAPITimeout = 30 // seconds
+
+	// WaitForControllerAPI waits for the API of the controller started
+	// with the new engine image
+	WaitForControllerAPI = func(address string) error {
+		return util.WaitForAPI("http://"+address+":9501/v1", EngineUpgradeAPITimeout)
+	}
+
+	// FrontendInUse tells if the block device of the volume is mounted or
+	// opened exclusively on the current host
+	FrontendInUse = util.IsDeviceBusy
+)
+
+func validateEngineImage(image string) error {
+	if image == "" {
+		return errors.New("engine image required")
+	}
+	if _, err := reference.ParseNamed(image); err != nil {
+		return errors.Wrapf(err, "invalid engine image '%s'", image)
+	}
+	return nil
+}
+
+func isUpgrading(volume *types.VolumeInfo) bool {
+	return volume.EngineUpgrade != nil && volume.EngineUpgrade.State == types.EngineUpgradeStateUpgrading
+}
+
+// updateEngineUpgrade records the engine image of the volume along with the
+// status of the upgrade
+func (man *volumeManager) updateEngineUpgrade(name, image string, upgrade *types.EngineUpgradeInfo) error {
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		volume.EngineImage = image
+		volume.EngineUpgrade = upgrade
+		return man.orc.UpdateVolume(volume)
+	})
+}
+
+func (man *volumeManager) finishEngineUpgrade(name, image string, upgrade *types.EngineUpgradeInfo, state types.EngineUpgradeState, cause error) {
+	upgrade.State = state
+	upgrade.Finished = util.Now()
+	if cause != nil {
+		upgrade.Error = cause.Error()
+	}
+	if err := man.updateEngineUpgrade(name, image, upgrade); err != nil {
+		logrus.Errorf("%+v", errors.Wrapf(err, "failed to record the engine upgrade status of volume '%s'", name))
+	}
+}
+
+// startEngineUpgrade records the engine image of the volume and the upgrade
+// in progress, refusing to start another upgrade while one is running. It
+// returns the good replicas to replace.
+func (man *volumeManager) startEngineUpgrade(name, image string) (*types.EngineUpgradeInfo, []string, error) {
+	var (
+		upgrade  *types.EngineUpgradeInfo
+		replicas []string
+	)
+	err := orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil {
+			return errors.Errorf("cannot find volume '%s'", name)
+		}
+		if volume.EngineImage == image {
+			return errors.Errorf("volume '%s' already uses engine image '%s'", name, image)
+		}
+		if isUpgrading(volume) {
+			return errors.Errorf("volume '%s' is being upgraded to engine image '%s'", name, volume.EngineUpgrade.ToImage)
+		}
+		if isRestoring(volume) {
+			return errors.Errorf("volume '%s' is being restored", name)
+		}
+		if volume.Controller != nil && volume.Controller.HostID != man.orc.GetCurrentHostID() {
+			return errors.Errorf("volume '%s' is attached to host %v, cannot upgrade it on host %v",
+				name, volume.Controller.HostID, man.orc.GetCurrentHostID())
+		}
+		replicas = []string{}
+		for _, replica := range volume.Replicas {
+			if replica.BadTimestamp.IsZero() {
+				replicas = append(replicas, replica.Name)
+			}
+		}
+		upgrade = &types.EngineUpgradeInfo{
+			FromImage: volume.EngineImage,
+			ToImage:   image,
+			HostID:    man.orc.GetCurrentHostID(),
+			State:     types.EngineUpgradeStateUpgrading,
+			Replicas:  len(replicas),
+			Started:   util.Now(),
+		}
+		volume.EngineImage = image
+		volume.EngineUpgrade = upgrade
+		return man.orc.UpdateVolume(volume)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return upgrade, replicas, nil
+}
+
+// EngineUpgrade moves the volume to the engine image in the background, the
+// status is recorded in the EngineUpgrade of the volume. The replicas are
+// replaced one at a time by new ones with the engine image, the way the
+// replicas of an evicted host are, so an attached volume keeps serving I/O.
+// A detached volume is attached on the current host with a controller of the
+// new engine image for the upgrade, and detached again afterwards.
+//
+// The controller of an attached volume cannot be swapped without taking the
+// block device away. It's swapped at the end of the upgrade if the device is
+// not in use, otherwise it keeps the old engine image until the volume is
+// attached again and PendingController is set. A new controller failing to
+// come up is rolled back to the old engine image.
+func (man *volumeManager) EngineUpgrade(name, image string) error {
+	if err := validateEngineImage(image); err != nil {
+		return err
+	}
+	upgrade, replicas, err := man.startEngineUpgrade(name, image)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("upgrading volume '%s' from engine image '%s' to '%s'", name, upgrade.FromImage, image)
+	man.background(func() { man.upgradeEngine(name, upgrade, replicas) })
+	return nil
+}
+
+func (man *volumeManager) upgradeEngine(name string, upgrade *types.EngineUpgradeInfo, replicas []string) {
+	state, err := man.doUpgradeEngine(name, upgrade, replicas)
+	image := upgrade.ToImage
+	if state != types.EngineUpgradeStateCompleted {
+		image = upgrade.FromImage
+		logrus.Errorf("%+v", errors.Wrapf(err, "engine upgrade of volume '%s' to '%s' is %s", name, upgrade.ToImage, state))
+	} else {
+		logrus.Infof("upgraded volume '%s' to engine image '%s'", name, upgrade.ToImage)
+	}
+	man.finishEngineUpgrade(name, image, upgrade, state, err)
+}
+
+// doUpgradeEngine returns the state the upgrade ends in, with the error if
+// it's not completed
+func (man *volumeManager) doUpgradeEngine(name string, upgrade *types.EngineUpgradeInfo, replicas []string) (state types.EngineUpgradeState, err error) {
+	volume, err := man.Get(name)
+	if err != nil {
+		return types.EngineUpgradeStateFailed, err
+	}
+	if volume == nil {
+		return types.EngineUpgradeStateFailed, errors.Errorf("cannot find volume '%s'", name)
+	}
+	attached := volume.Controller != nil
+	if !attached {
+		if err := man.reattach(name); err != nil {
+			if detachErr := man.Detach(name); detachErr != nil {
+				return types.EngineUpgradeStateFailed, errors.Wrapf(detachErr, "failed to detach volume '%s' after %v", name, err)
+			}
+			return types.EngineUpgradeStateRolledBack, err
+		}
+		defer func() {
+			if detachErr := man.Detach(name); detachErr != nil && err == nil {
+				state = types.EngineUpgradeStateFailed
+				err = errors.Wrapf(detachErr, "failed to detach volume '%s' after engine upgrade", name)
+			}
+		}()
+	}
+
+	for _, replica := range replicas {
+		if err := man.replaceReplica(name, replica); err != nil {
+			return types.EngineUpgradeStateFailed, errors.Wrapf(err, "failed to replace replica '%s' of volume '%s'", replica, name)
+		}
+		upgrade.Replaced++
+		if err := man.updateEngineUpgrade(name, upgrade.ToImage, upgrade); err != nil {
+			logrus.Warnf("%v", errors.Wrapf(err, "failed to record engine upgrade progress of volume '%s'", name))
+		}
+	}
+	if !attached {
+		return types.EngineUpgradeStateCompleted, nil
+	}
+
+	volume, err = man.Get(name)
+	if err != nil {
+		return types.EngineUpgradeStateFailed, err
+	}
+	if volume == nil || volume.Controller == nil {
+		return types.EngineUpgradeStateFailed, errors.Errorf("volume '%s' is detached during engine upgrade", name)
+	}
+	if volume.Endpoint != "" {
+		inUse, err := FrontendInUse(volume.Endpoint)
+		if err != nil {
+			return types.EngineUpgradeStateFailed, errors.Wrapf(err, "unable to check if volume '%s' is in use", name)
+		}
+		if inUse {
+			logrus.Infof("volume '%s' is in use at %v, its controller is upgraded on the next attach", name, volume.Endpoint)
+			upgrade.PendingController = true
+			return types.EngineUpgradeStateCompleted, nil
+		}
+	}
+	return man.swapController(volume, upgrade)
+}
+
+// swapController restarts the controller of the attached volume with the
+// engine image of the upgrade, going back to the old engine image if the new
+// controller fails to come up
+func (man *volumeManager) swapController(volume *types.VolumeInfo, upgrade *types.EngineUpgradeInfo) (types.EngineUpgradeState, error) {
+	name := volume.Name
+	if err := man.doDetach(volume); err != nil {
+		return types.EngineUpgradeStateFailed, errors.Wrapf(err, "failed to detach volume '%s' to swap the controller", name)
+	}
+	upgradeErr := man.reattach(name)
+	if upgradeErr == nil {
+		return types.EngineUpgradeStateCompleted, nil
+	}
+
+	logrus.Errorf("%+v", errors.Wrapf(upgradeErr, "controller of volume '%s' failed, rolling back to '%s'", name, upgrade.FromImage))
+	if err := man.Detach(name); err != nil {
+		return types.EngineUpgradeStateFailed, errors.Wrapf(err, "failed to detach volume '%s' to roll back engine upgrade: %v", name, upgradeErr)
+	}
+	if err := man.updateEngineUpgrade(name, upgrade.FromImage, upgrade); err != nil {
+		return types.EngineUpgradeStateFailed, errors.Wrapf(err, "failed to roll back engine upgrade of volume '%s': %v", name, upgradeErr)
+	}
+	if err := man.reattach(name); err != nil {
+		return types.EngineUpgradeStateFailed, errors.Wrapf(err, "failed to reattach volume '%s' to roll back engine upgrade: %v", name, upgradeErr)
+	}
+	return types.EngineUpgradeStateRolledBack, upgradeErr
+}
+
+// reattach attaches the volume with the engine image in the metadata, and
+// waits for the API of the new controller
+func (man *volumeManager) reattach(name string) error {
+	volume, err := man.Get(name)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		return errors.Errorf("cannot find volume '%s'", name)
+	}
+	if err := man.doAttach(volume); err != nil {
+		return err
+	}
+	if err := WaitForControllerAPI(volume.Controller.Address); err != nil {
+		return errors.Wrapf(err, "controller of volume '%s' is not ready", name)
+	}
+	return nil
+}
+
+// clearPendingController records that the controller of the volume runs the
+// engine image of the volume, after it's attached again
+func (man *volumeManager) clearPendingController(name string) error {
+	return orch.RetryOnConflict(func() error {
+		volume, err := man.orc.GetVolume(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get volume '%s'", name)
+		}
+		if volume == nil || volume.EngineUpgrade == nil || !volume.EngineUpgrade.PendingController {
+			return nil
+		}
+		volume.EngineUpgrade.PendingController = false
+		return man.orc.UpdateVolume(volume)
+	})
+}
+
+// EngineUpgradeDetached moves all the detached volumes to the engine image.
+// The volumes are upgraded one by one in the background, each is attached
+// for it like in EngineUpgrade.
+func (man *volumeManager) EngineUpgradeDetached(image string) error {
+	if err := validateEngineImage(image); err != nil {
+		return err
+	}
+	volumes, err := man.List()
+	if err != nil {
+		return err
+	}
+	type detachedUpgrade struct {
+		name     string
+		upgrade  *types.EngineUpgradeInfo
+		replicas []string
+	}
+	upgrades := []detachedUpgrade{}
+	errs := Errs{}
+	for _, volume := range volumes {
+		if volume.Controller != nil || volume.EngineImage == image || isUpgrading(volume) || isRestoring(volume) {
+			continue
+		}
+		upgrade, replicas, err := man.startEngineUpgrade(volume.Name, image)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to upgrade volume '%s' to engine image '%s'", volume.Name, image))
+			continue
+		}
+		logrus.Infof("upgrading detached volume '%s' from engine image '%s' to '%s'", volume.Name, upgrade.FromImage, image)
+		upgrades = append(upgrades, detachedUpgrade{name: volume.Name, upgrade: upgrade, replicas: replicas})
+	}
+	if len(upgrades) > 0 {
+		man.background(func() {
+			for _, u := range upgrades {
+				man.upgradeEngine(u.name, u.upgrade, u.replicas)
+			}
+		})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// failInterruptedEngineUpgrades marks the upgrades the manager was running
+// before the restart failed, so the volumes can be upgraded again. The
+// replicas marked evicting for the upgrade are replaced by the controller
+// checks anyway.
+func (man *volumeManager) failInterruptedEngineUpgrades(volumes []*types.VolumeInfo) {
+	hostID := man.orc.GetCurrentHostID()
+	for _, volume := range volumes {
+		if !isUpgrading(volume) || volume.EngineUpgrade.HostID != hostID {
+			continue
+		}
+		logrus.Warnf("engine upgrade of volume '%s' was interrupted by the manager restart", volume.Name)
+		upgrade := volume.EngineUpgrade
+		man.finishEngineUpgrade(volume.Name, upgrade.FromImage, upgrade, types.EngineUpgradeStateFailed,
+			errors.New("interrupted by the manager restart"))
+	}
+}
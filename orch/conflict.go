@@ -0,0 +1,31 @@
+package orch
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	ConflictRetries  = 10
+	ConflictInterval = 100 * time.Millisecond
+)
+
+// RetryOnConflict runs the read-modify-write f again if the metadata has been
+// modified by someone else in the meantime, with a short random wait in
+// between to let the other writer finish
+func RetryOnConflict(f func() error) error {
+	var err error
+	for i := 0; i < ConflictRetries; i++ {
+		if err = f(); err == nil || !types.IsConflict(err) {
+			return err
+		}
+		logrus.Debugf("Retry on %v", err)
+		time.Sleep(time.Duration(rand.Int63n(int64(ConflictInterval) + 1)))
+	}
+	return errors.Wrapf(err, "fail after %v retries", ConflictRetries)
+}
@@ -2,4 +2,5 @@ package orch
 
 const (
 	EngineImageParam = "engine-image"
+	HostLabelParam   = "host-label"
 )
@@ -0,0 +1,172 @@
+package orch
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	CredentialKeyFileParam = "credential-key-file"
+	// CredentialKeyEnv is the environment variable of the key, used if the
+	// key file isn't specified
+	CredentialKeyEnv = "LONGHORN_CREDENTIAL_KEY"
+)
+
+var (
+	// CredentialKey encrypts the values of the credentials in the metadata
+	// store, it must be the same on all the hosts
+	CredentialKey []byte
+
+	credentialKeyRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+)
+
+// LoadCredentialKey reads the key from the key file, or from the environment
+// variable. The credentials cannot be used without the key.
+func LoadCredentialKey(c *cli.Context) error {
+	key := os.Getenv(CredentialKeyEnv)
+	if file := c.String(CredentialKeyFileParam); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read %v %v", CredentialKeyFileParam, file)
+		}
+		key = string(data)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		logrus.Warnf("credential key isn't specified by %v or %v, backup target credentials are disabled",
+			CredentialKeyFileParam, CredentialKeyEnv)
+		CredentialKey = nil
+		return nil
+	}
+	CredentialKey = []byte(key)
+	return nil
+}
+
+func credentialCipher() (cipher.AEAD, error) {
+	if len(CredentialKey) == 0 {
+		return nil, errors.New("credential key not set")
+	}
+	key := sha256.Sum256(CredentialKey)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ValidateCredential checks the keys of the credential can be the names of
+// environment variables
+func ValidateCredential(credential *types.CredentialInfo) error {
+	if len(credential.Values) == 0 {
+		return errors.Errorf("credential '%s' has no values", credential.Name)
+	}
+	for key := range credential.Values {
+		if !credentialKeyRegexp.MatchString(key) {
+			return errors.Errorf("invalid key '%s' of credential '%s', should be an environment variable name", key, credential.Name)
+		}
+	}
+	return nil
+}
+
+// EncryptCredential returns the credential with the values encrypted, to be
+// kept in the metadata store
+func EncryptCredential(credential *types.CredentialInfo) (*types.CredentialInfo, error) {
+	aead, err := credentialCipher()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to encrypt credential '%s'", credential.Name)
+	}
+	encrypted := &types.CredentialInfo{Name: credential.Name, Values: map[string]string{}}
+	for key, value := range credential.Values {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, errors.Wrapf(err, "unable to encrypt credential '%s'", credential.Name)
+		}
+		sealed := aead.Seal(nonce, nonce, []byte(value), []byte(key))
+		encrypted.Values[key] = base64.StdEncoding.EncodeToString(sealed)
+	}
+	return encrypted, nil
+}
+
+// DecryptCredential reverses EncryptCredential
+func DecryptCredential(credential *types.CredentialInfo) (*types.CredentialInfo, error) {
+	aead, err := credentialCipher()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decrypt credential '%s'", credential.Name)
+	}
+	decrypted := &types.CredentialInfo{Name: credential.Name, Values: map[string]string{}}
+	for key, value := range credential.Values {
+		sealed, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return nil, errors.Errorf("unable to decrypt key '%s' of credential '%s': invalid value", key, credential.Name)
+		}
+		nonce := sealed[:aead.NonceSize()]
+		plain, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decrypt key '%s' of credential '%s', wrong credential key?", key, credential.Name)
+		}
+		decrypted.Values[key] = string(plain)
+	}
+	return decrypted, nil
+}
+
+// CredentialEnv returns the values of the credential as environment
+// variables, nil if name is empty
+func CredentialEnv(credentials types.Credentials, name string) ([]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+	credential, err := credentials.GetCredential(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get credential '%s'", name)
+	}
+	if credential == nil {
+		return nil, errors.Errorf("cannot find credential '%s'", name)
+	}
+	credential, err = DecryptCredential(credential)
+	if err != nil {
+		return nil, err
+	}
+	env := []string{}
+	for key, value := range credential.Values {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// EngineEnv returns the environment variables of the engine containers, which
+// carry the credential of the default backup target. The replicas read and
+// write the backup target themselves, so the engine needs the credential
+// decrypted in its environment, where anyone allowed to inspect the
+// containers or read the pod specs can see it. Leave the credential of the
+// default backup target unset to keep it out of the engine, e.g. if the
+// hosts have access to the target on their own. A broken credential doesn't
+// stop the engine from starting.
+func EngineEnv(orc types.Orchestrator) []string {
+	settings, err := orc.GetSettings()
+	if err != nil {
+		logrus.Warnf("%v", errors.Wrap(err, "unable to get the credential of the default backup target"))
+		return nil
+	}
+	env, err := CredentialEnv(orc, settings.BackupTargetCredential)
+	if err != nil {
+		logrus.Warnf("%v", errors.Wrap(err, "unable to get the credential of the default backup target"))
+		return nil
+	}
+	return env
+}
@@ -12,14 +12,13 @@ import (
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
 
-	eCli "github.com/coreos/etcd/client"
-
 	dTypes "github.com/docker/docker/api/types"
 	dCli "github.com/docker/docker/client"
 
 	"github.com/rancher/longhorn-manager/api"
 	"github.com/rancher/longhorn-manager/orch"
 	"github.com/rancher/longhorn-manager/scheduler"
+	"github.com/rancher/longhorn-manager/store"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 )
@@ -27,19 +26,23 @@ import (
 const (
 	cfgDirectory = "/var/lib/rancher/longhorn/"
 	hostUUIDFile = cfgDirectory + ".physical_host_uuid"
+
+	// the replicas keep the data in the docker volumes
+	defaultStoragePath = "/var/lib/docker/volumes"
 )
 
 type dockerOrc struct {
-	Servers     []string //etcd servers
-	Prefix      string   //prefix in k/v store
+	Prefix      string //prefix in k/v store
 	EngineImage string
 	Network     string
 	IP          string
 
 	currentHost *types.HostInfo
+	storage     *orch.StorageConfig
 
-	kapi eCli.KeysAPI
-	cli  *dCli.Client
+	store      types.MetadataStore
+	cli        *dCli.Client
+	heartbeats *orch.HeartbeatMonitor
 
 	scheduler types.Scheduler
 }
@@ -49,42 +52,100 @@ type dockerOrcConfig struct {
 	prefix  string
 	image   string
 	network string
+	labels  map[string]string
+	storage *orch.StorageConfig
+
+	// store is used instead of etcd servers if specified
+	store types.MetadataStore
 }
 
 func New(c *cli.Context) (types.Orchestrator, error) {
-	servers := c.StringSlice("etcd-servers")
-	if len(servers) == 0 {
-		return nil, fmt.Errorf("Unspecified etcd servers")
+	metadataStore, err := newStore(c)
+	if err != nil {
+		return nil, err
 	}
 	prefix := c.String("etcd-prefix")
 	image := c.String(orch.EngineImageParam)
 	network := c.String("docker-network")
+	labels, err := orch.ParseHostLabels(c.StringSlice(orch.HostLabelParam))
+	if err != nil {
+		return nil, err
+	}
+	storage, err := orch.ParseStorageConfig(c, defaultStoragePath)
+	if err != nil {
+		return nil, err
+	}
 	return newDocker(&dockerOrcConfig{
-		servers: servers,
 		prefix:  prefix,
 		image:   image,
 		network: network,
+		labels:  labels,
+		storage: storage,
+		store:   metadataStore,
 	})
 }
 
-func newDocker(cfg *dockerOrcConfig) (types.Orchestrator, error) {
-	eCfg := eCli.Config{
-		Endpoints:               cfg.servers,
-		Transport:               eCli.DefaultTransport,
-		HeaderTimeoutPerRequest: time.Second,
+// newStore creates the metadata store chosen by --store option
+func newStore(c *cli.Context) (types.MetadataStore, error) {
+	storeType := c.String("store")
+	switch storeType {
+	case "etcd", "etcd3":
+		servers := c.StringSlice("etcd-servers")
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("Unspecified etcd servers")
+		}
+		if storeType == "etcd3" {
+			return newEtcd3Store(servers, c.String("etcd-prefix"), c.Bool("etcd3-migrate"))
+		}
+		return newEtcdStore(servers)
+	case "bolt":
+		return store.NewBoltStore(c.String("bolt-path"))
+	case "memory":
+		logrus.Warn("Metadata is kept in memory, and will be lost after restart")
+		return store.NewMemoryStore(), nil
 	}
+	return nil, fmt.Errorf("Invalid metadata store %v", storeType)
+}
 
-	etcdc, err := eCli.New(eCfg)
+// newEtcd3Store connects to etcd through the v3 API. The metadata kept
+// through the v2 API isn't visible there, it's copied over if migrate is set.
+func newEtcd3Store(servers []string, prefix string, migrate bool) (types.MetadataStore, error) {
+	s, err := store.NewEtcd3Store(servers)
 	if err != nil {
 		return nil, err
 	}
+	if !migrate {
+		return s, nil
+	}
+	v2, err := newEtcdStore(servers)
+	if err != nil {
+		return nil, err
+	}
+	copied, err := store.Copy(v2, s, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to migrate the metadata from etcd v2 API")
+	}
+	logrus.Infof("Migrated %v keys under %v from etcd v2 API", copied, prefix)
+	return s, nil
+}
+
+func newDocker(cfg *dockerOrcConfig) (types.Orchestrator, error) {
+	var err error
+
+	metadataStore := cfg.store
+	if metadataStore == nil {
+		if metadataStore, err = newEtcdStore(cfg.servers); err != nil {
+			return nil, err
+		}
+	}
 
 	docker := &dockerOrc{
-		Servers:     cfg.servers,
 		Prefix:      cfg.prefix,
 		EngineImage: cfg.image,
 
-		kapi: eCli.NewKeysAPI(etcdc),
+		storage:    cfg.storage,
+		store:      metadataStore,
+		heartbeats: orch.NewHeartbeatMonitor(),
 	}
 	docker.scheduler = scheduler.NewOrcScheduler(docker)
 
@@ -108,9 +169,13 @@ func newDocker(cfg *dockerOrcConfig) (types.Orchestrator, error) {
 	address := docker.IP + ":" + strconv.Itoa(api.DefaultPort)
 	logrus.Info("Local address is: ", address)
 
-	if err := docker.Register(address); err != nil {
+	if err := docker.Register(address, cfg.labels); err != nil {
 		return nil, err
 	}
+	go docker.heartbeat()
+	if docker.storage != nil {
+		go docker.reportStorage()
+	}
 	logrus.Info("Docker orchestrator is ready")
 	return docker, nil
 }
@@ -176,19 +241,78 @@ func (d *dockerOrc) updateNetwork(userSpecifiedNetwork string) error {
 	return nil
 }
 
-func (d *dockerOrc) Register(address string) error {
+// Register adds the current host, the labels are applied on top of the ones
+// kept from the last run, and the rest of the host is kept
+func (d *dockerOrc) Register(address string, labels map[string]string) error {
 	currentHost, err := getCurrentHost(address)
 	if err != nil {
 		return err
 	}
+	pair, err := d.store.Get(d.hostKey(currentHost.UUID))
+	if err != nil {
+		return errors.Wrap(err, "unable to get host")
+	}
+	if pair != nil {
+		registered, err := pair2Host(pair)
+		if err != nil {
+			return err
+		}
+		registered.Name = currentHost.Name
+		registered.Address = currentHost.Address
+		currentHost = registered
+	}
+	currentHost.Labels = orch.MergeHostLabels(currentHost.Labels, labels)
+	currentHost.LastSeen = util.Now()
 
 	if err := d.setHost(currentHost); err != nil {
 		return err
 	}
+	logrus.Infof("Add host %v name %v longhorn-manager address %v", currentHost.UUID, currentHost.Name, currentHost.Address)
 	d.currentHost = currentHost
 	return nil
 }
 
+// heartbeat renews the lease of the current host, the host is down once
+// it isn't renewed for orch.HostTTL
+func (d *dockerOrc) heartbeat() {
+	for {
+		time.Sleep(orch.HeartbeatPeriod)
+		_, err := d.updateHost(d.currentHost.UUID, func(host *types.HostInfo) error {
+			host.LastSeen = util.Now()
+			return nil
+		})
+		if err != nil {
+			logrus.Warnf("%v", errors.Wrapf(err, "fail to send heartbeat of host %v", d.currentHost.UUID))
+		}
+	}
+}
+
+// reportStorage keeps the storage of the current host up to date
+func (d *dockerOrc) reportStorage() {
+	for {
+		if err := d.updateStorage(); err != nil {
+			logrus.Warnf("%v", errors.Wrapf(err, "fail to report storage of host %v", d.currentHost.UUID))
+		}
+		time.Sleep(orch.StorageReportPeriod)
+	}
+}
+
+func (d *dockerOrc) updateStorage() error {
+	volumes, err := d.ListVolumes()
+	if err != nil {
+		return errors.Wrap(err, "unable to list volumes")
+	}
+	storage, err := orch.GetHostStorage(d.storage, d.currentHost.UUID, volumes)
+	if err != nil {
+		return err
+	}
+	_, err = d.updateHost(d.currentHost.UUID, func(host *types.HostInfo) error {
+		host.Storage = storage
+		return nil
+	})
+	return err
+}
+
 func (d *dockerOrc) GetHost(id string) (*types.HostInfo, error) {
 	return d.getHost(id)
 }
@@ -197,6 +321,67 @@ func (d *dockerOrc) ListHosts() (map[string]*types.HostInfo, error) {
 	return d.listHosts()
 }
 
+func (d *dockerOrc) UpdateHostLabels(id string, labels map[string]string) (*types.HostInfo, error) {
+	if err := orch.ValidateHostLabels(labels); err != nil {
+		return nil, err
+	}
+	host, err := d.updateHost(id, func(host *types.HostInfo) error {
+		host.Labels = orch.MergeHostLabels(nil, labels)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to update labels of host %v", id)
+	}
+	return host, nil
+}
+
+func (d *dockerOrc) UpdateHostTags(id string, tags, diskTags []string) (*types.HostInfo, error) {
+	if err := orch.ValidateTags(tags); err != nil {
+		return nil, err
+	}
+	if err := orch.ValidateTags(diskTags); err != nil {
+		return nil, err
+	}
+	host, err := d.updateHost(id, func(host *types.HostInfo) error {
+		host.Tags = tags
+		host.DiskTags = diskTags
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to update tags of host %v", id)
+	}
+	return host, nil
+}
+
+func (d *dockerOrc) UpdateHostMaintenance(id string, maintenance bool, check func(host *types.HostInfo) error) (*types.HostInfo, error) {
+	host, err := d.updateHost(id, func(host *types.HostInfo) error {
+		if check != nil {
+			if err := check(host); err != nil {
+				return err
+			}
+		}
+		host.Maintenance = maintenance
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to update maintenance of host %v", id)
+	}
+	return host, nil
+}
+
+func (d *dockerOrc) UpdateHostEviction(id string, eviction *types.EvictionInfo, check func(host *types.HostInfo) error) error {
+	_, err := d.updateHost(id, func(host *types.HostInfo) error {
+		if check != nil {
+			if err := check(host); err != nil {
+				return err
+			}
+		}
+		host.Eviction = eviction
+		return nil
+	})
+	return errors.Wrapf(err, "unable to update eviction of host %v", id)
+}
+
 func (d *dockerOrc) GetCurrentHostID() string {
 	return d.currentHost.UUID
 }
@@ -217,6 +402,7 @@ func (d *dockerOrc) CreateVolume(volume *types.VolumeInfo) (*types.VolumeInfo, e
 	if err == nil && v != nil {
 		return nil, errors.Errorf("volume %v already exists %+v", volume.Name, v)
 	}
+	volume.Revision = 0
 	if err := d.setVolume(volume); err != nil {
 		return nil, errors.Wrap(err, "fail to create new volume metadata")
 	}
@@ -233,7 +419,7 @@ func (d *dockerOrc) GetVolume(volumeName string) (*types.VolumeInfo, error) {
 
 func (d *dockerOrc) UpdateVolume(volume *types.VolumeInfo) error {
 	v, err := d.getVolume(volume.Name)
-	if err != nil {
+	if err != nil || v == nil {
 		return errors.Errorf("cannot update volume %v because it doesn't exists %+v", volume.Name, v)
 	}
 	return d.setVolume(volume)
@@ -244,21 +430,23 @@ func (d *dockerOrc) ListVolumes() ([]*types.VolumeInfo, error) {
 }
 
 func (d *dockerOrc) MarkBadReplica(volumeName string, replica *types.ReplicaInfo) error {
-	v, err := d.getVolume(volumeName)
-	if err != nil {
-		return errors.Wrap(err, "fail to mark bad replica, cannot get volume")
-	}
-	for k, r := range v.Replicas {
-		if r.Name == replica.Name {
-			r.BadTimestamp = time.Now().UTC()
-			v.Replicas[k] = r
-			break
+	return orch.RetryOnConflict(func() error {
+		v, err := d.getVolume(volumeName)
+		if err != nil || v == nil {
+			return errors.Errorf("fail to mark bad replica, cannot get volume %v", volumeName)
 		}
-	}
-	if err := d.UpdateVolume(v); err != nil {
-		return errors.Wrap(err, "fail to mark bad replica, cannot update volume")
-	}
-	return nil
+		for k, r := range v.Replicas {
+			if r.Name == replica.Name {
+				r.BadTimestamp = time.Now().UTC()
+				v.Replicas[k] = r
+				break
+			}
+		}
+		if err := d.UpdateVolume(v); err != nil {
+			return errors.Wrap(err, "fail to mark bad replica, cannot update volume")
+		}
+		return nil
+	})
 }
 
 func (d *dockerOrc) GetSettings() (*types.SettingsInfo, error) {
@@ -279,6 +467,22 @@ func (d *dockerOrc) SetSettings(settings *types.SettingsInfo) error {
 	return d.setSettings(settings)
 }
 
+func (d *dockerOrc) ListCredentials() (map[string]*types.CredentialInfo, error) {
+	return d.listCredentials()
+}
+
+func (d *dockerOrc) GetCredential(name string) (*types.CredentialInfo, error) {
+	return d.getCredential(name)
+}
+
+func (d *dockerOrc) SetCredential(credential *types.CredentialInfo) error {
+	return d.setCredential(credential)
+}
+
+func (d *dockerOrc) DeleteCredential(name string) error {
+	return d.rmCredential(name)
+}
+
 func (d *dockerOrc) Scheduler() types.Scheduler {
 	return d.scheduler
 }
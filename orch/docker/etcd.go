@@ -0,0 +1,120 @@
+package docker
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	eCli "github.com/coreos/etcd/client"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// etcdStore is the MetadataStore on top of etcd v2 API, the revision is the
+// modified index of the key
+type etcdStore struct {
+	kapi eCli.KeysAPI
+}
+
+func newEtcdStore(servers []string) (types.MetadataStore, error) {
+	eCfg := eCli.Config{
+		Endpoints:               servers,
+		Transport:               eCli.DefaultTransport,
+		HeaderTimeoutPerRequest: time.Second,
+	}
+
+	etcdc, err := eCli.New(eCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdStore{
+		kapi: eCli.NewKeysAPI(etcdc),
+	}, nil
+}
+
+func node2Pair(node *eCli.Node) *types.KVPair {
+	return &types.KVPair{
+		Key:      node.Key,
+		Value:    []byte(node.Value),
+		Revision: int64(node.ModifiedIndex),
+	}
+}
+
+func (s *etcdStore) Get(key string) (*types.KVPair, error) {
+	resp, err := s.kapi.Get(context.Background(), key, nil)
+	if err != nil {
+		if eCli.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if resp.Node.Dir {
+		return nil, errors.Errorf("Invalid node %v is a directory", resp.Node.Key)
+	}
+	return node2Pair(resp.Node), nil
+}
+
+func (s *etcdStore) Set(key string, value []byte) (int64, error) {
+	resp, err := s.kapi.Set(context.Background(), key, string(value), nil)
+	if err != nil {
+		return 0, err
+	}
+	return int64(resp.Node.ModifiedIndex), nil
+}
+
+func (s *etcdStore) CompareAndSet(key string, value []byte, revision int64) (int64, error) {
+	opts := &eCli.SetOptions{PrevIndex: uint64(revision)}
+	if revision == 0 {
+		opts = &eCli.SetOptions{PrevExist: eCli.PrevNoExist}
+	}
+	resp, err := s.kapi.Set(context.Background(), key, string(value), opts)
+	if err != nil {
+		if e, ok := err.(eCli.Error); ok &&
+			(e.Code == eCli.ErrorCodeTestFailed || e.Code == eCli.ErrorCodeNodeExist || e.Code == eCli.ErrorCodeKeyNotFound) {
+			return 0, &types.ConflictError{Key: key}
+		}
+		return 0, err
+	}
+	return int64(resp.Node.ModifiedIndex), nil
+}
+
+func (s *etcdStore) Delete(key string) error {
+	_, err := s.kapi.Delete(context.Background(), key, &eCli.DeleteOptions{Recursive: true})
+	if err != nil && !eCli.IsKeyNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *etcdStore) List(dir string) ([]*types.KVPair, error) {
+	resp, err := s.kapi.Get(context.Background(), dir, &eCli.GetOptions{Recursive: true, Sort: true})
+	if err != nil {
+		if eCli.IsKeyNotFound(err) {
+			return []*types.KVPair{}, nil
+		}
+		return nil, err
+	}
+	if !resp.Node.Dir {
+		return nil, errors.Errorf("Invalid node %v is not a directory", resp.Node.Key)
+	}
+	pairs := []*types.KVPair{}
+	var walk func(nodes eCli.Nodes)
+	walk = func(nodes eCli.Nodes) {
+		for _, node := range nodes {
+			if node.Dir {
+				walk(node.Nodes)
+				continue
+			}
+			pairs = append(pairs, node2Pair(node))
+		}
+	}
+	walk(resp.Node.Nodes)
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
+
+func (s *etcdStore) Close() error {
+	return nil
+}
@@ -16,6 +16,7 @@ import (
 	dContainer "github.com/docker/docker/api/types/container"
 	dNat "github.com/docker/go-connections/nat"
 
+	"github.com/rancher/longhorn-manager/orch"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 )
@@ -79,11 +80,14 @@ func (d *dockerOrc) ProcessSchedule(item *types.ScheduleItem) (*types.InstanceIn
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to process schedule")
 	}
-	if item.Action == types.ScheduleActionDeleteInstance {
-		err = d.removeInstanceMetadata(instance)
-	} else {
-		err = d.updateInstanceMetadata(instance)
-	}
+	// the metadata of other instances of the volume can be updated at
+	// the same time on the other hosts
+	err = orch.RetryOnConflict(func() error {
+		if item.Action == types.ScheduleActionDeleteInstance {
+			return d.removeInstanceMetadata(instance)
+		}
+		return d.updateInstanceMetadata(instance)
+	})
 	if err != nil {
 		if item.Action == types.ScheduleActionCreateController ||
 			item.Action == types.ScheduleActionCreateReplica {
@@ -175,6 +179,7 @@ func (d *dockerOrc) createController(data *dockerScheduleData) (instance *types.
 		&dContainer.Config{
 			Image: data.EngineImage,
 			Cmd:   cmd,
+			Env:   orch.EngineEnv(d),
 		},
 		&dContainer.HostConfig{
 			Binds: []string{
@@ -249,7 +254,11 @@ func (d *dockerOrc) CreateReplica(volumeName, replicaName string) (*types.Replic
 		Data: *data,
 	}
 
-	policy := d.prepareCreateReplicaPolicy(volume)
+	settings, err := d.GetSettings()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create replica for %v", volumeName)
+	}
+	policy := orch.ReplicaSchedulePolicy(volume, settings)
 
 	instance, err := d.scheduler.Schedule(schedule, policy)
 	if err != nil {
@@ -260,19 +269,6 @@ func (d *dockerOrc) CreateReplica(volumeName, replicaName string) (*types.Replic
 	}, nil
 }
 
-func (d *dockerOrc) prepareCreateReplicaPolicy(volume *types.VolumeInfo) *types.SchedulePolicy {
-	policy := &types.SchedulePolicy{
-		Binding:   types.SchedulePolicyBindingSoftAntiAffinity,
-		HostIDMap: map[string]struct{}{},
-	}
-	for _, replica := range volume.Replicas {
-		if replica.BadTimestamp.IsZero() {
-			policy.HostIDMap[replica.HostID] = struct{}{}
-		}
-	}
-	return policy
-}
-
 func (d *dockerOrc) prepareCreateReplica(volume *types.VolumeInfo, replicaName string) (*types.ScheduleData, error) {
 	if volume.Size == 0 {
 		return nil, errors.Errorf("invalid volume size 0")
@@ -310,6 +306,7 @@ func (d *dockerOrc) createReplica(data *dockerScheduleData) (*types.InstanceInfo
 				"/volume": {},
 			},
 			Cmd: cmd,
+			Env: orch.EngineEnv(d),
 		},
 		&dContainer.HostConfig{
 			Privileged:  true,
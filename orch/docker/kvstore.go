@@ -3,20 +3,19 @@ package docker
 import (
 	"encoding/json"
 	"path/filepath"
+	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
-	"golang.org/x/net/context"
-
-	eCli "github.com/coreos/etcd/client"
 
+	"github.com/rancher/longhorn-manager/orch"
 	"github.com/rancher/longhorn-manager/types"
 )
 
 const (
-	keyHosts    = "hosts"
-	keyVolumes  = "volumes"
-	keySettings = "settings"
+	keyHosts       = "hosts"
+	keyVolumes     = "volumes"
+	keySettings    = "settings"
+	keyCredentials = "credentials"
 )
 
 func (d *dockerOrc) key(key string) string {
@@ -28,56 +27,93 @@ func (d *dockerOrc) hostKey(id string) string {
 	return filepath.Join(d.key(keyHosts), id)
 }
 
+// pair2Host and setHost deal with the stored host, the status isn't stored
+// but worked out from the last heartbeat when the host is read
 func (d *dockerOrc) setHost(host *types.HostInfo) error {
-	value, err := json.Marshal(host)
+	stored := *host
+	stored.Status = ""
+	value, err := json.Marshal(&stored)
 	if err != nil {
 		return err
 	}
-	if _, err := d.kapi.Set(context.Background(), d.hostKey(host.UUID), string(value), nil); err != nil {
+	if _, err := d.store.Set(d.hostKey(host.UUID), value); err != nil {
 		return err
 	}
-	logrus.Infof("Add host %v name %v longhorn-manager address %v", host.UUID, host.Name, host.Address)
 	return nil
 }
 
+// updateHost applies update to the host, as long as the host in the store
+// isn't changed meanwhile. The host is left alone if update fails.
+func (d *dockerOrc) updateHost(id string, update func(host *types.HostInfo) error) (*types.HostInfo, error) {
+	var host *types.HostInfo
+	err := orch.RetryOnConflict(func() error {
+		pair, err := d.store.Get(d.hostKey(id))
+		if err != nil {
+			return errors.Wrap(err, "unable to get host")
+		}
+		if pair == nil {
+			return errors.Errorf("unable to get host %v", id)
+		}
+		if host, err = pair2Host(pair); err != nil {
+			return err
+		}
+		if err := update(host); err != nil {
+			return err
+		}
+		host.Status = ""
+		value, err := json.Marshal(host)
+		if err != nil {
+			return err
+		}
+		_, err = d.store.CompareAndSet(d.hostKey(id), value, pair.Revision)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.heartbeats.SetHostStatus(host, time.Now())
+	return host, nil
+}
+
 func (d *dockerOrc) getHost(id string) (*types.HostInfo, error) {
-	resp, err := d.kapi.Get(context.Background(), d.hostKey(id), nil)
+	pair, err := d.store.Get(d.hostKey(id))
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to get host")
 	}
-	return node2Host(resp.Node)
+	if pair == nil {
+		return nil, errors.Errorf("unable to get host %v", id)
+	}
+	host, err := pair2Host(pair)
+	if err != nil {
+		return nil, err
+	}
+	d.heartbeats.SetHostStatus(host, time.Now())
+	return host, nil
 }
 
 func (d *dockerOrc) listHosts() (map[string]*types.HostInfo, error) {
-	resp, err := d.kapi.Get(context.Background(), d.key(keyHosts), nil)
+	pairs, err := d.store.List(d.key(keyHosts))
 	if err != nil {
 		return nil, err
 	}
 
-	if !resp.Node.Dir {
-		return nil, errors.Errorf("Invalid node %v is not a directory",
-			resp.Node.Key)
-	}
-
+	now := time.Now()
 	hosts := make(map[string]*types.HostInfo)
-	for _, node := range resp.Node.Nodes {
-		host, err := node2Host(node)
+	for _, pair := range pairs {
+		host, err := pair2Host(pair)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Invalid node %v:%v, %v",
-				node.Key, node.Value, err)
+			return nil, errors.Wrapf(err, "Invalid node %v:%s, %v",
+				pair.Key, pair.Value, err)
 		}
+		d.heartbeats.SetHostStatus(host, now)
 		hosts[host.UUID] = host
 	}
 	return hosts, nil
 }
 
-func node2Host(node *eCli.Node) (*types.HostInfo, error) {
+func pair2Host(pair *types.KVPair) (*types.HostInfo, error) {
 	host := &types.HostInfo{}
-	if node.Dir {
-		return nil, errors.Errorf("Invalid node %v is a directory",
-			node.Key)
-	}
-	if err := json.Unmarshal([]byte(node.Value), host); err != nil {
+	if err := json.Unmarshal(pair.Value, host); err != nil {
 		return nil, errors.Wrap(err, "fail to unmarshall json for host")
 	}
 	return host, nil
@@ -87,71 +123,63 @@ func (d *dockerOrc) volumeKey(id string) string {
 	return filepath.Join(d.key(keyVolumes), id)
 }
 
+// setVolume only succeeds if the volume in the store is still at
+// volume.Revision, or doesn't exist yet for revision 0
 func (d *dockerOrc) setVolume(volume *types.VolumeInfo) error {
 	value, err := json.Marshal(volume)
 	if err != nil {
 		return err
 	}
-	if _, err := d.kapi.Set(context.Background(), d.volumeKey(volume.Name), string(value), nil); err != nil {
+	revision, err := d.store.CompareAndSet(d.volumeKey(volume.Name), value, volume.Revision)
+	if err != nil {
 		return err
 	}
+	volume.Revision = revision
 	return nil
 }
 
 func (d *dockerOrc) getVolume(id string) (*types.VolumeInfo, error) {
-	resp, err := d.kapi.Get(context.Background(), d.volumeKey(id), nil)
+	pair, err := d.store.Get(d.volumeKey(id))
 	if err != nil {
-		if eCli.IsKeyNotFound(err) {
-			return nil, nil
-		}
 		return nil, errors.Wrap(err, "unable to get volume")
 	}
-	return node2Volume(resp.Node)
+	if pair == nil {
+		return nil, nil
+	}
+	return pair2Volume(pair)
 }
 
 func (d *dockerOrc) rmVolume(id string) error {
-	_, err := d.kapi.Delete(context.Background(), d.volumeKey(id), &eCli.DeleteOptions{Recursive: true})
-	if err != nil {
+	if err := d.store.Delete(d.volumeKey(id)); err != nil {
 		return errors.Wrap(err, "unable to remove volume")
 	}
 	return nil
 }
 
 func (d *dockerOrc) listVolumes() ([]*types.VolumeInfo, error) {
-	resp, err := d.kapi.Get(context.Background(), d.key(keyVolumes), nil)
+	pairs, err := d.store.List(d.key(keyVolumes))
 	if err != nil {
-		if eCli.IsKeyNotFound(err) {
-			return nil, nil
-		}
 		return nil, err
 	}
 
-	if !resp.Node.Dir {
-		return nil, errors.Errorf("Invalid node %v is not a directory",
-			resp.Node.Key)
-	}
-
 	volumes := []*types.VolumeInfo{}
-	for _, node := range resp.Node.Nodes {
-		volume, err := node2Volume(node)
+	for _, pair := range pairs {
+		volume, err := pair2Volume(pair)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Invalid node %v:%v, %v",
-				node.Key, node.Value, err)
+			return nil, errors.Wrapf(err, "Invalid node %v:%s, %v",
+				pair.Key, pair.Value, err)
 		}
 		volumes = append(volumes, volume)
 	}
 	return volumes, nil
 }
 
-func node2Volume(node *eCli.Node) (*types.VolumeInfo, error) {
+func pair2Volume(pair *types.KVPair) (*types.VolumeInfo, error) {
 	volume := &types.VolumeInfo{}
-	if node.Dir {
-		return nil, errors.Errorf("Invalid node %v is a directory",
-			node.Key)
-	}
-	if err := json.Unmarshal([]byte(node.Value), volume); err != nil {
+	if err := json.Unmarshal(pair.Value, volume); err != nil {
 		return nil, errors.Wrap(err, "fail to unmarshall json for volume")
 	}
+	volume.Revision = pair.Revision
 	return volume, nil
 }
 
@@ -164,29 +192,82 @@ func (d *dockerOrc) setSettings(settings *types.SettingsInfo) error {
 	if err != nil {
 		return err
 	}
-	if _, err := d.kapi.Set(context.Background(), d.settingsKey(), string(value), nil); err != nil {
+	if _, err := d.store.Set(d.settingsKey(), value); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (d *dockerOrc) getSettings() (*types.SettingsInfo, error) {
-	resp, err := d.kapi.Get(context.Background(), d.settingsKey(), nil)
+	pair, err := d.store.Get(d.settingsKey())
 	if err != nil {
-		if eCli.IsKeyNotFound(err) {
-			return nil, nil
-		}
 		return nil, errors.Wrap(err, "unable to get settings")
 	}
+	if pair == nil {
+		return nil, nil
+	}
 
 	settings := &types.SettingsInfo{}
-	node := resp.Node
-	if node.Dir {
-		return nil, errors.Errorf("Invalid node %v is a directory",
-			node.Key)
-	}
-	if err := json.Unmarshal([]byte(node.Value), settings); err != nil {
+	if err := json.Unmarshal(pair.Value, settings); err != nil {
 		return nil, errors.Wrap(err, "fail to unmarshall json for settings")
 	}
 	return settings, nil
 }
+
+func (d *dockerOrc) credentialKey(name string) string {
+	return filepath.Join(d.key(keyCredentials), name)
+}
+
+func (d *dockerOrc) setCredential(credential *types.CredentialInfo) error {
+	value, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	if _, err := d.store.Set(d.credentialKey(credential.Name), value); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *dockerOrc) getCredential(name string) (*types.CredentialInfo, error) {
+	pair, err := d.store.Get(d.credentialKey(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get credential")
+	}
+	if pair == nil {
+		return nil, nil
+	}
+	return pair2Credential(pair)
+}
+
+func (d *dockerOrc) rmCredential(name string) error {
+	if err := d.store.Delete(d.credentialKey(name)); err != nil {
+		return errors.Wrap(err, "unable to remove credential")
+	}
+	return nil
+}
+
+func (d *dockerOrc) listCredentials() (map[string]*types.CredentialInfo, error) {
+	pairs, err := d.store.List(d.key(keyCredentials))
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := map[string]*types.CredentialInfo{}
+	for _, pair := range pairs {
+		credential, err := pair2Credential(pair)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid node %v", pair.Key)
+		}
+		credentials[credential.Name] = credential
+	}
+	return credentials, nil
+}
+
+func pair2Credential(pair *types.KVPair) (*types.CredentialInfo, error) {
+	credential := &types.CredentialInfo{}
+	if err := json.Unmarshal(pair.Value, credential); err != nil {
+		return nil, errors.Wrap(err, "fail to unmarshall json for credential")
+	}
+	return credential, nil
+}
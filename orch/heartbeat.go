@@ -0,0 +1,60 @@
+package orch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	// HeartbeatPeriod is how often the managers report they're alive
+	HeartbeatPeriod = 10 * time.Second
+	// HostTTL is how long a host stays up after its last heartbeat, as a
+	// lease held by the manager on the host
+	HostTTL = 60 * time.Second
+)
+
+// HeartbeatMonitor works out the status of the hosts from their heartbeats.
+// The LastSeen written by the manager of the host is only compared with the
+// one read before, and its changes are timed on the clock of the current
+// host, so the clocks of the hosts don't have to agree.
+type HeartbeatMonitor struct {
+	sync.Mutex
+
+	heartbeats map[string]*heartbeat
+}
+
+type heartbeat struct {
+	lastSeen string
+	observed time.Time
+}
+
+func NewHeartbeatMonitor() *HeartbeatMonitor {
+	return &HeartbeatMonitor{heartbeats: map[string]*heartbeat{}}
+}
+
+// SetHostStatus sets the host up if its LastSeen changed within HostTTL
+// before now. The first LastSeen read counts as a change, so a host that
+// went down before the current manager started is down after HostTTL.
+func (m *HeartbeatMonitor) SetHostStatus(host *types.HostInfo, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	host.Status = types.HostStatusDown
+	if host.LastSeen == "" {
+		return
+	}
+	hb := m.heartbeats[host.UUID]
+	if hb == nil || hb.lastSeen != host.LastSeen {
+		hb = &heartbeat{lastSeen: host.LastSeen, observed: now}
+		m.heartbeats[host.UUID] = hb
+	}
+	if now.Sub(hb.observed) < HostTTL {
+		host.Status = types.HostStatusUp
+	}
+}
+
+func IsHostUp(host *types.HostInfo) bool {
+	return host.Status == types.HostStatusUp
+}
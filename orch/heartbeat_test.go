@@ -0,0 +1,35 @@
+package orch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+func TestHeartbeatMonitor(t *testing.T) {
+	assert := require.New(t)
+
+	m := NewHeartbeatMonitor()
+	now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// the clock of the host is an hour behind
+	host := &types.HostInfo{UUID: "host1", LastSeen: "2017-05-31T23:00:00Z"}
+	m.SetHostStatus(host, now)
+	assert.Equal(types.HostStatusUp, host.Status)
+	m.SetHostStatus(host, now.Add(HostTTL-time.Second))
+	assert.Equal(types.HostStatusUp, host.Status)
+	m.SetHostStatus(host, now.Add(HostTTL))
+	assert.Equal(types.HostStatusDown, host.Status)
+
+	host.LastSeen = "2017-05-31T23:01:00Z"
+	m.SetHostStatus(host, now.Add(HostTTL+time.Second))
+	assert.Equal(types.HostStatusUp, host.Status)
+
+	// never sent a heartbeat
+	other := &types.HostInfo{UUID: "host2"}
+	m.SetHostStatus(other, now)
+	assert.Equal(types.HostStatusDown, other.Status)
+}
@@ -0,0 +1,78 @@
+package orch
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// ParseHostLabels parses the labels in format key=value
+func ParseHostLabels(pairs []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid host label '%s', should be in format key=value", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	if err := ValidateHostLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func ValidateHostLabels(labels map[string]string) error {
+	for key := range labels {
+		if strings.TrimSpace(key) == "" {
+			return errors.New("empty host label key")
+		}
+	}
+	return nil
+}
+
+// MergeHostLabels returns the labels with the updates applied on top
+func MergeHostLabels(labels, updates map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range updates {
+		merged[k] = v
+	}
+	return merged
+}
+
+// ValidateTags accepts the tags without spaces or commas
+func ValidateTags(tags []string) error {
+	for _, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, " \t\n,") {
+			return errors.Errorf("invalid tag '%s'", tag)
+		}
+	}
+	return nil
+}
+
+// MatchTags returns true if tags has all the tags in selector
+func MatchTags(tags, selector []string) bool {
+	for _, s := range selector {
+		found := false
+		for _, tag := range tags {
+			if tag == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchHost returns true if the host and its disk have all the tags selected
+func MatchHost(host *types.HostInfo, hostSelector, diskSelector []string) bool {
+	return MatchTags(host.Tags, hostSelector) && MatchTags(host.DiskTags, diskSelector)
+}
@@ -0,0 +1,276 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+)
+
+var (
+	RequestTimeout = 30 * time.Second
+)
+
+// Client is the part of the Kubernetes API used by the orchestrator. All the
+// namespaced objects live in the namespace of the client.
+type Client interface {
+	ListNodes() ([]*Node, error)
+	GetNode(name string) (*Node, error)
+
+	ListPods(labelSelector string) ([]*Pod, error)
+	GetPod(name string) (*Pod, error)
+	CreatePod(pod *Pod) (*Pod, error)
+	DeletePod(name string) error
+
+	ListConfigMaps(labelSelector string) ([]*ConfigMap, error)
+	GetConfigMap(name string) (*ConfigMap, error)
+	// CreateConfigMap fails with types.ConflictError if the config map
+	// exists already
+	CreateConfigMap(cm *ConfigMap) (*ConfigMap, error)
+	// UpdateConfigMap fails with types.ConflictError if the resource
+	// version of cm is not the latest one
+	UpdateConfigMap(cm *ConfigMap) (*ConfigMap, error)
+	DeleteConfigMap(name string) error
+}
+
+func statusCode(err error) int {
+	if s, ok := errors.Cause(err).(*Status); ok {
+		return s.Code
+	}
+	return 0
+}
+
+func IsNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound
+}
+
+// conflictError turns the 409 replies to the writes of the config map name,
+// AlreadyExists or Conflict, into types.ConflictError, so they're retried by
+// orch.RetryOnConflict like the conflicts of the other metadata stores
+func conflictError(name string, err error) error {
+	if statusCode(err) == http.StatusConflict {
+		return errors.Wrap(&types.ConflictError{Key: name}, err.Error())
+	}
+	return err
+}
+
+type restClient struct {
+	server     string
+	namespace  string
+	token      string
+	httpClient *http.Client
+}
+
+// NewInClusterClient connects to the API server using the service account of
+// the pod. If server is specified, e.g. for kubectl proxy, it's used instead
+// of the in-cluster address.
+func NewInClusterClient(server, namespace string) (Client, error) {
+	c := &restClient{
+		server:     server,
+		namespace:  namespace,
+		httpClient: &http.Client{Timeout: RequestTimeout},
+	}
+	if c.namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "namespace")
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to detect namespace, use --kubernetes-namespace option to specify")
+		}
+		c.namespace = strings.TrimSpace(string(ns))
+	}
+	if c.server != "" {
+		return c, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("unable to find the API server, may not be running inside Kubernetes, use --kubernetes-server option to specify")
+	}
+	c.server = "https://" + host + ":" + port
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "token")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read service account token")
+	}
+	c.token = strings.TrimSpace(string(token))
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "ca.crt")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read service account CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account CA")
+	}
+	c.httpClient.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return c, nil
+}
+
+func (c *restClient) nsPath(resource string) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/%s", c.namespace, resource)
+}
+
+func selectorQuery(labelSelector string) string {
+	if labelSelector == "" {
+		return ""
+	}
+	return "?labelSelector=" + url.QueryEscape(labelSelector)
+}
+
+func (c *restClient) ListNodes() ([]*Node, error) {
+	list := &struct {
+		Items []*Node `json:"items"`
+	}{}
+	if err := c.do("GET", "/api/v1/nodes", nil, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *restClient) GetNode(name string) (*Node, error) {
+	node := &Node{}
+	if err := c.do("GET", "/api/v1/nodes/"+name, nil, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (c *restClient) ListPods(labelSelector string) ([]*Pod, error) {
+	list := &struct {
+		Items []*Pod `json:"items"`
+	}{}
+	if err := c.do("GET", c.nsPath("pods")+selectorQuery(labelSelector), nil, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *restClient) GetPod(name string) (*Pod, error) {
+	pod := &Pod{}
+	if err := c.do("GET", c.nsPath("pods/")+name, nil, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+func (c *restClient) CreatePod(pod *Pod) (*Pod, error) {
+	pod.APIVersion, pod.Kind = "v1", "Pod"
+	created := &Pod{}
+	if err := c.do("POST", c.nsPath("pods"), pod, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *restClient) DeletePod(name string) error {
+	return c.do("DELETE", c.nsPath("pods/")+name, nil, nil)
+}
+
+func (c *restClient) ListConfigMaps(labelSelector string) ([]*ConfigMap, error) {
+	list := &struct {
+		Items []*ConfigMap `json:"items"`
+	}{}
+	if err := c.do("GET", c.nsPath("configmaps")+selectorQuery(labelSelector), nil, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *restClient) GetConfigMap(name string) (*ConfigMap, error) {
+	cm := &ConfigMap{}
+	if err := c.do("GET", c.nsPath("configmaps/")+name, nil, cm); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+func (c *restClient) CreateConfigMap(cm *ConfigMap) (*ConfigMap, error) {
+	cm.APIVersion, cm.Kind = "v1", "ConfigMap"
+	created := &ConfigMap{}
+	if err := c.do("POST", c.nsPath("configmaps"), cm, created); err != nil {
+		return nil, conflictError(cm.Metadata.Name, err)
+	}
+	return created, nil
+}
+
+func (c *restClient) UpdateConfigMap(cm *ConfigMap) (*ConfigMap, error) {
+	cm.APIVersion, cm.Kind = "v1", "ConfigMap"
+	updated := &ConfigMap{}
+	if err := c.do("PUT", c.nsPath("configmaps/")+cm.Metadata.Name, cm, updated); err != nil {
+		return nil, conflictError(cm.Metadata.Name, err)
+	}
+	return updated, nil
+}
+
+func (c *restClient) DeleteConfigMap(name string) error {
+	return c.do("DELETE", c.nsPath("configmaps/")+name, nil, nil)
+}
+
+func (c *restClient) do(method, path string, input, output interface{}) error {
+	var body io.Reader
+	if input != nil {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	url := c.server + path
+	logrus.Debugf("%s %s", method, url)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if input != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "fail to %s %s", method, url)
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "fail to read response of %s %s", method, url)
+	}
+	if resp.StatusCode >= 300 {
+		status := &Status{}
+		if err := json.Unmarshal(content, status); err != nil || status.Kind != "Status" {
+			status.Message = strings.TrimSpace(string(content))
+		}
+		status.Code = resp.StatusCode
+		return errors.Wrapf(status, "fail to %s %s", method, url)
+	}
+	if output == nil {
+		return nil
+	}
+	if err := json.Unmarshal(content, output); err != nil {
+		return errors.Wrapf(err, "fail to decode response of %s %s", method, url)
+	}
+	return nil
+}
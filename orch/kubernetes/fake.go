@@ -0,0 +1,369 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// FakeClient is an in-memory Client for testing. The pods are scheduled and
+// running as soon as they're created, on the node selected by their affinity.
+type FakeClient struct {
+	sync.Mutex
+
+	nodes      map[string]*Node
+	pods       map[string]*Pod
+	configMaps map[string]*ConfigMap
+
+	// conflicts is the number of the next updates of every config map
+	// failing as if it was changed by someone else meanwhile
+	conflicts map[string]int
+
+	resourceVersion int
+	lastIP          int
+}
+
+func NewFakeClient() *FakeClient {
+	return &FakeClient{
+		nodes:      map[string]*Node{},
+		pods:       map[string]*Pod{},
+		configMaps: map[string]*ConfigMap{},
+		conflicts:  map[string]int{},
+	}
+}
+
+func notFound(kind, name string) error {
+	return &Status{
+		Kind:    "Status",
+		Status:  "Failure",
+		Message: fmt.Sprintf("%s %q not found", kind, name),
+		Reason:  "NotFound",
+		Code:    http.StatusNotFound,
+	}
+}
+
+func alreadyExists(kind, name string) error {
+	return &Status{
+		Kind:    "Status",
+		Status:  "Failure",
+		Message: fmt.Sprintf("%s %q already exists", kind, name),
+		Reason:  "AlreadyExists",
+		Code:    http.StatusConflict,
+	}
+}
+
+func conflict(kind, name string) error {
+	return &Status{
+		Kind:    "Status",
+		Status:  "Failure",
+		Message: fmt.Sprintf("Operation cannot be fulfilled on %s %q: the object has been modified", kind, name),
+		Reason:  "Conflict",
+		Code:    http.StatusConflict,
+	}
+}
+
+// copyObject deep copies in to out, so nobody can change stored objects by
+// accident
+func copyObject(in, out interface{}) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		panic(err)
+	}
+}
+
+func matchLabels(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	for _, req := range strings.Split(selector, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		value, ok := labels[kv[0]]
+		if !ok || len(kv) == 2 && value != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FakeClient) nextResourceVersion() string {
+	f.resourceVersion++
+	return strconv.Itoa(f.resourceVersion)
+}
+
+// AddNode adds a ready node to the fake cluster and returns it
+func (f *FakeClient) AddNode(name string) *Node {
+	f.Lock()
+	defer f.Unlock()
+
+	f.lastIP++
+	node := &Node{
+		Metadata: ObjectMeta{
+			Name:            name,
+			UID:             util.UUID(),
+			ResourceVersion: f.nextResourceVersion(),
+			Labels:          map[string]string{LabelHostname: name},
+		},
+		Status: NodeStatus{
+			Addresses: []NodeAddress{{Type: NodeInternalIP, Address: fmt.Sprintf("192.168.0.%d", f.lastIP)}},
+		},
+	}
+	f.nodes[name] = node
+	n := &Node{}
+	copyObject(node, n)
+	return n
+}
+
+func (f *FakeClient) ListNodes() ([]*Node, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	names := []string{}
+	for name := range f.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nodes := []*Node{}
+	for _, name := range names {
+		n := &Node{}
+		copyObject(f.nodes[name], n)
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func (f *FakeClient) GetNode(name string) (*Node, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	node := f.nodes[name]
+	if node == nil {
+		return nil, notFound("nodes", name)
+	}
+	n := &Node{}
+	copyObject(node, n)
+	return n, nil
+}
+
+func (f *FakeClient) ListPods(labelSelector string) ([]*Pod, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	names := []string{}
+	for name, pod := range f.pods {
+		if matchLabels(pod.Metadata.Labels, labelSelector) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	pods := []*Pod{}
+	for _, name := range names {
+		p := &Pod{}
+		copyObject(f.pods[name], p)
+		pods = append(pods, p)
+	}
+	return pods, nil
+}
+
+func (f *FakeClient) GetPod(name string) (*Pod, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	pod := f.pods[name]
+	if pod == nil {
+		return nil, notFound("pods", name)
+	}
+	p := &Pod{}
+	copyObject(pod, p)
+	return p, nil
+}
+
+// scheduleNode finds the node required by the affinity of the pod
+func (f *FakeClient) scheduleNode(pod *Pod) string {
+	if pod.Spec.NodeName != "" {
+		return pod.Spec.NodeName
+	}
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil ||
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return ""
+	}
+	for _, term := range pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for name, node := range f.nodes {
+			match := true
+			for _, req := range term.MatchExpressions {
+				if req.Operator != "In" {
+					match = false
+					continue
+				}
+				found := false
+				for _, v := range req.Values {
+					if node.Metadata.Labels[req.Key] == v {
+						found = true
+					}
+				}
+				match = match && found
+			}
+			if match {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func (f *FakeClient) CreatePod(pod *Pod) (*Pod, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	name := pod.Metadata.Name
+	if f.pods[name] != nil {
+		return nil, alreadyExists("pods", name)
+	}
+	p := &Pod{}
+	copyObject(pod, p)
+	p.Metadata.UID = util.UUID()
+	p.Metadata.ResourceVersion = f.nextResourceVersion()
+	p.Spec.NodeName = f.scheduleNode(p)
+	p.Status.Phase = PodPending
+	if p.Spec.NodeName != "" {
+		f.lastIP++
+		p.Status.Phase = PodRunning
+		p.Status.PodIP = fmt.Sprintf("10.42.%d.%d", f.lastIP/250, f.lastIP%250+1)
+	}
+	f.pods[name] = p
+
+	created := &Pod{}
+	copyObject(p, created)
+	return created, nil
+}
+
+func (f *FakeClient) DeletePod(name string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.pods[name] == nil {
+		return notFound("pods", name)
+	}
+	delete(f.pods, name)
+	return nil
+}
+
+// SetPodPhase simulates the failure or the completion of a pod
+func (f *FakeClient) SetPodPhase(name, phase string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	pod := f.pods[name]
+	if pod == nil {
+		return notFound("pods", name)
+	}
+	pod.Status.Phase = phase
+	pod.Metadata.ResourceVersion = f.nextResourceVersion()
+	return nil
+}
+
+func (f *FakeClient) ListConfigMaps(labelSelector string) ([]*ConfigMap, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	names := []string{}
+	for name, cm := range f.configMaps {
+		if matchLabels(cm.Metadata.Labels, labelSelector) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	cms := []*ConfigMap{}
+	for _, name := range names {
+		cm := &ConfigMap{}
+		copyObject(f.configMaps[name], cm)
+		cms = append(cms, cm)
+	}
+	return cms, nil
+}
+
+func (f *FakeClient) GetConfigMap(name string) (*ConfigMap, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	cm := f.configMaps[name]
+	if cm == nil {
+		return nil, notFound("configmaps", name)
+	}
+	c := &ConfigMap{}
+	copyObject(cm, c)
+	return c, nil
+}
+
+func (f *FakeClient) CreateConfigMap(cm *ConfigMap) (*ConfigMap, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	name := cm.Metadata.Name
+	if f.configMaps[name] != nil {
+		return nil, conflictError(name, alreadyExists("configmaps", name))
+	}
+	c := &ConfigMap{}
+	copyObject(cm, c)
+	c.Metadata.UID = util.UUID()
+	c.Metadata.ResourceVersion = f.nextResourceVersion()
+	f.configMaps[name] = c
+
+	created := &ConfigMap{}
+	copyObject(c, created)
+	return created, nil
+}
+
+func (f *FakeClient) UpdateConfigMap(cm *ConfigMap) (*ConfigMap, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	name := cm.Metadata.Name
+	old := f.configMaps[name]
+	if old == nil {
+		return nil, notFound("configmaps", name)
+	}
+	if f.conflicts[name] > 0 {
+		f.conflicts[name]--
+		old.Metadata.ResourceVersion = f.nextResourceVersion()
+	}
+	if cm.Metadata.ResourceVersion != "" && cm.Metadata.ResourceVersion != old.Metadata.ResourceVersion {
+		return nil, conflictError(name, conflict("configmaps", name))
+	}
+	c := &ConfigMap{}
+	copyObject(cm, c)
+	c.Metadata.UID = old.Metadata.UID
+	c.Metadata.ResourceVersion = f.nextResourceVersion()
+	f.configMaps[name] = c
+
+	updated := &ConfigMap{}
+	copyObject(c, updated)
+	return updated, nil
+}
+
+// InjectConflicts makes the next times updates of the config map fail with a
+// conflict, as if someone else changed it after it was read
+func (f *FakeClient) InjectConflicts(name string, times int) {
+	f.Lock()
+	defer f.Unlock()
+	f.conflicts[name] = times
+}
+
+func (f *FakeClient) DeleteConfigMap(name string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.configMaps[name] == nil {
+		return notFound("configmaps", name)
+	}
+	delete(f.configMaps, name)
+	return nil
+}
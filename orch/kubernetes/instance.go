@@ -0,0 +1,606 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	OrcName = "kubernetes"
+)
+
+var (
+	// ReplicaDataDir is where the replica data is kept on the hosts, the
+	// manager must have it mounted at the same path
+	ReplicaDataDir = "/var/lib/rancher/longhorn/replicas/"
+
+	WaitPodTimeout    = 60 * time.Second
+	WaitDeviceTimeout = 30 //seconds
+	WaitAPITimeout    = 30 //seconds
+
+	// waitForController blocks until the controller API and the block
+	// device are ready
+	waitForController = func(address, volumeName string) error {
+		url := "http://" + address + ":9501/v1"
+		if err := util.WaitForAPI(url, WaitAPITimeout); err != nil {
+			return errors.Wrapf(err, "fail to wait for api endpoint at %v", url)
+		}
+		return util.WaitForDevice(filepath.Join("/dev/longhorn/", volumeName), WaitDeviceTimeout)
+	}
+)
+
+type kubernetesScheduleData struct {
+	InstanceName string
+	VolumeName   string
+	VolumeSize   string
+	EngineImage  string
+	ReplicaURLs  []string
+}
+
+func (k *kubernetesOrc) ProcessSchedule(item *types.ScheduleItem) (*types.InstanceInfo, error) {
+	var (
+		data     kubernetesScheduleData
+		instance *types.InstanceInfo
+		err      error
+	)
+
+	if item.Data.Orchestrator != OrcName {
+		return nil, errors.Errorf("received request for the wrong orchestrator %v", item.Data.Orchestrator)
+	}
+	if len(item.Data.Data) != 0 {
+		if err := json.Unmarshal(item.Data.Data, &data); err != nil {
+			return nil, errors.Wrap(err, "fail to parse schedule data")
+		}
+	}
+	if item.Instance.ID == "" {
+		return nil, errors.Errorf("empty instance ID")
+	}
+	input := &types.InstanceInfo{
+		ID:         item.Instance.ID,
+		HostID:     item.Instance.HostID,
+		Type:       item.Instance.Type,
+		VolumeName: item.Instance.VolumeName,
+	}
+	switch item.Action {
+	case types.ScheduleActionCreateController:
+		instance, err = k.createController(&data)
+	case types.ScheduleActionCreateReplica:
+		instance, err = k.createReplica(&data)
+	case types.ScheduleActionStartInstance:
+		instance, err = k.startInstance(input)
+	case types.ScheduleActionStopInstance:
+		instance, err = k.stopInstance(input)
+	case types.ScheduleActionDeleteInstance:
+		instance, err = k.removeInstance(input)
+	default:
+		return nil, errors.Errorf("cannot find specified action %v", item.Action)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to process schedule")
+	}
+	// the metadata of other instances of the volume can be updated at
+	// the same time on the other hosts
+	err = orch.RetryOnConflict(func() error {
+		if item.Action == types.ScheduleActionDeleteInstance {
+			return k.removeInstanceMetadata(instance)
+		}
+		return k.updateInstanceMetadata(instance)
+	})
+	if err != nil {
+		if item.Action == types.ScheduleActionCreateController ||
+			item.Action == types.ScheduleActionCreateReplica {
+			logrus.Warnf("failed to update instance metadata for %+v, cleaning up", instance)
+			k.removeInstance(instance)
+		}
+
+		return nil, errors.Wrapf(err, "failed to update instance metadata for %+v", instance)
+	}
+	return instance, nil
+}
+
+func (k *kubernetesOrc) CreateController(volumeName, controllerName string, replicas map[string]*types.ReplicaInfo) (*types.ControllerInfo, error) {
+	volume, err := k.getVolume(volumeName)
+	if err != nil || volume == nil {
+		return nil, errors.Errorf("unable to find volume %v", volumeName)
+	}
+
+	data := &kubernetesScheduleData{
+		InstanceName: controllerName,
+		VolumeName:   volumeName,
+		EngineImage:  volume.EngineImage,
+		ReplicaURLs:  []string{},
+	}
+	for name := range replicas {
+		replica := volume.Replicas[name]
+		if replica == nil {
+			return nil, errors.Errorf("cannot find replica %v", name)
+		}
+		if replica.Address == "" {
+			return nil, errors.Errorf("invalid empty address of replica %v", name)
+		}
+		data.ReplicaURLs = append(data.ReplicaURLs, "tcp://"+replica.Address+":9502")
+	}
+	scheduleData, err := toScheduleData(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create controller for %v", volumeName)
+	}
+
+	schedule := &types.ScheduleItem{
+		Action: types.ScheduleActionCreateController,
+		Instance: types.ScheduleInstance{
+			ID:         controllerName,
+			HostID:     k.GetCurrentHostID(),
+			Type:       types.InstanceTypeController,
+			VolumeName: volumeName,
+		},
+		Data: *scheduleData,
+	}
+	instance, err := k.scheduler.Schedule(schedule, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create controller for %v", volumeName)
+	}
+	return &types.ControllerInfo{
+		InstanceInfo: *instance,
+	}, nil
+}
+
+func (k *kubernetesOrc) CreateReplica(volumeName, replicaName string) (*types.ReplicaInfo, error) {
+	volume, err := k.getVolume(volumeName)
+	if err != nil || volume == nil {
+		return nil, errors.Errorf("unable to find volume %v", volumeName)
+	}
+	if volume.Size == 0 {
+		return nil, errors.Errorf("invalid volume size 0")
+	}
+
+	scheduleData, err := toScheduleData(&kubernetesScheduleData{
+		VolumeName:   volume.Name,
+		VolumeSize:   strconv.FormatInt(volume.Size, 10),
+		InstanceName: replicaName,
+		EngineImage:  volume.EngineImage,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create replica for %v", volumeName)
+	}
+
+	schedule := &types.ScheduleItem{
+		Action: types.ScheduleActionCreateReplica,
+		Instance: types.ScheduleInstance{
+			ID:         replicaName,
+			Type:       types.InstanceTypeReplica,
+			VolumeName: volumeName,
+		},
+		Data: *scheduleData,
+	}
+
+	settings, err := k.GetSettings()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create replica for %v", volumeName)
+	}
+	policy := orch.ReplicaSchedulePolicy(volume, settings)
+
+	instance, err := k.scheduler.Schedule(schedule, policy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create replica for %v", volumeName)
+	}
+	return &types.ReplicaInfo{
+		InstanceInfo: *instance,
+	}, nil
+}
+
+func toScheduleData(data *kubernetesScheduleData) (*types.ScheduleData, error) {
+	bData, err := json.Marshal(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to marshall %+v", data)
+	}
+	return &types.ScheduleData{
+		Orchestrator: OrcName,
+		Data:         bData,
+	}, nil
+}
+
+// newPod returns a pod pinned to the current node by node affinity
+func (k *kubernetesOrc) newPod(name, volumeName string, instanceType types.InstanceType) *Pod {
+	return &Pod{
+		Metadata: ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				labelVolume:   volumeName,
+				labelInstance: string(instanceType),
+			},
+		},
+		Spec: PodSpec{
+			Affinity: &Affinity{
+				NodeAffinity: &NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &NodeSelector{
+						NodeSelectorTerms: []NodeSelectorTerm{{
+							MatchExpressions: []NodeSelectorRequirement{{
+								Key:      LabelHostname,
+								Operator: "In",
+								Values:   []string{nodeHostname(k.currentNode)},
+							}},
+						}},
+					},
+				},
+			},
+			// the manager takes care of the failed instances
+			RestartPolicy: "Never",
+		},
+	}
+}
+
+func (k *kubernetesOrc) engineEnv() []EnvVar {
+	env := []EnvVar{}
+	for _, kv := range orch.EngineEnv(k) {
+		parts := strings.SplitN(kv, "=", 2)
+		env = append(env, EnvVar{Name: parts[0], Value: parts[1]})
+	}
+	return env
+}
+
+func hostPathVolume(name, path, pathType string) Volume {
+	return Volume{
+		Name:     name,
+		HostPath: &HostPathVolumeSource{Path: path, Type: pathType},
+	}
+}
+
+func (k *kubernetesOrc) createController(data *kubernetesScheduleData) (instance *types.InstanceInfo, err error) {
+	args := []string{
+		"launch", "controller",
+		"--listen", "0.0.0.0:9501",
+		"--frontend", "tgt",
+	}
+	for _, url := range data.ReplicaURLs {
+		args = append(args, "--replica", url)
+	}
+	args = append(args, data.VolumeName)
+
+	privileged := true
+	pod := k.newPod(data.InstanceName, data.VolumeName, types.InstanceTypeController)
+	pod.Spec.Containers = []Container{{
+		Name:  "controller",
+		Image: data.EngineImage,
+		Args:  args,
+		Env:   k.engineEnv(),
+		Ports: []ContainerPort{{ContainerPort: 9501}},
+		VolumeMounts: []VolumeMount{
+			{Name: "dev", MountPath: "/host/dev"},
+			{Name: "proc", MountPath: "/host/proc"},
+		},
+		SecurityContext: &SecurityContext{Privileged: &privileged},
+	}}
+	pod.Spec.Volumes = []Volume{
+		hostPathVolume("dev", "/dev", ""),
+		hostPathVolume("proc", "/proc", ""),
+	}
+
+	input := &types.InstanceInfo{
+		ID:         data.InstanceName,
+		Type:       types.InstanceTypeController,
+		Name:       data.InstanceName,
+		HostID:     k.GetCurrentHostID(),
+		VolumeName: data.VolumeName,
+	}
+	defer func() {
+		if err != nil {
+			logrus.Errorf("fail to start controller %v of %v, cleaning up: %v",
+				data.InstanceName, data.VolumeName, err)
+			k.removeInstance(input)
+			instance = nil
+		}
+	}()
+
+	instance, err = k.runPod(pod, input)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to start controller pod")
+	}
+	if err := waitForController(instance.Address, data.VolumeName); err != nil {
+		return nil, errors.Wrapf(err, "fail to create controller for %v", instance.VolumeName)
+	}
+	return instance, nil
+}
+
+// createReplica only records the replica on the current host, the pod is
+// created when the replica is started
+func (k *kubernetesOrc) createReplica(data *kubernetesScheduleData) (*types.InstanceInfo, error) {
+	return &types.InstanceInfo{
+		ID:         data.InstanceName,
+		Type:       types.InstanceTypeReplica,
+		Name:       data.InstanceName,
+		HostID:     k.GetCurrentHostID(),
+		VolumeName: data.VolumeName,
+	}, nil
+}
+
+func (k *kubernetesOrc) replicaPod(name string, volume *types.VolumeInfo) *Pod {
+	privileged := true
+	pod := k.newPod(name, volume.Name, types.InstanceTypeReplica)
+	pod.Spec.Containers = []Container{{
+		Name:  "replica",
+		Image: volume.EngineImage,
+		Args: []string{
+			"launch", "replica",
+			"--listen", "0.0.0.0:9502",
+			"--size", strconv.FormatInt(volume.Size, 10),
+			"/volume",
+		},
+		Env: k.engineEnv(),
+		Ports: []ContainerPort{
+			{ContainerPort: 9502},
+			{ContainerPort: 9503},
+			{ContainerPort: 9504},
+		},
+		VolumeMounts: []VolumeMount{
+			{Name: "volume", MountPath: "/volume"},
+		},
+		SecurityContext: &SecurityContext{Privileged: &privileged},
+	}}
+	// the data must survive the pod, which is deleted when the replica stops
+	pod.Spec.Volumes = []Volume{
+		hostPathVolume("volume", filepath.Join(ReplicaDataDir, name), "DirectoryOrCreate"),
+	}
+	return pod
+}
+
+// runPod creates the pod and waits for it to be running
+func (k *kubernetesOrc) runPod(pod *Pod, instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	if _, err := k.client.CreatePod(pod); err != nil {
+		return nil, errors.Wrapf(err, "fail to create pod %v", pod.Metadata.Name)
+	}
+	var info *types.InstanceInfo
+	err := util.Backoff(WaitPodTimeout, "timeout waiting for pod "+pod.Metadata.Name, func() (bool, error) {
+		var err error
+		info, err = k.refreshInstanceInfo(instance)
+		if err != nil {
+			return false, err
+		}
+		return info.Running, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (k *kubernetesOrc) refreshInstanceInfo(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	info := &types.InstanceInfo{
+		ID:         instance.ID,
+		Type:       instance.Type,
+		Name:       instance.ID,
+		HostID:     k.GetCurrentHostID(),
+		VolumeName: instance.VolumeName,
+	}
+	pod, err := k.client.GetPod(instance.ID)
+	if err != nil {
+		if IsNotFound(err) {
+			return info, nil
+		}
+		return nil, errors.Wrapf(err, "fail to get %v instance %v", instance.Type, instance.ID)
+	}
+	switch pod.Status.Phase {
+	case PodFailed, PodSucceeded:
+		return nil, errors.Errorf("%v instance %v exited, phase %v", instance.Type, instance.ID, pod.Status.Phase)
+	case PodRunning:
+		info.Running = pod.Metadata.DeletionTimestamp == ""
+		info.Address = pod.Status.PodIP
+	}
+	if info.Running && info.Address == "" {
+		return nil, errors.Errorf("BUG: Cannot find IP address of %v", instance.ID)
+	}
+	return info, nil
+}
+
+// deletePod deletes the pod if it exists and waits for it to be gone
+func (k *kubernetesOrc) deletePod(name string) error {
+	if err := k.client.DeletePod(name); err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "fail to delete pod %v", name)
+	}
+	return util.Backoff(WaitPodTimeout, "timeout waiting for deletion of pod "+name, func() (bool, error) {
+		_, err := k.client.GetPod(name)
+		if IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}
+
+func getScheduleInstanceFromInstance(instance *types.InstanceInfo) (*types.ScheduleInstance, error) {
+	if instance.ID == "" || instance.HostID == "" ||
+		instance.Type == types.InstanceTypeNone ||
+		instance.VolumeName == "" {
+		return nil, errors.Errorf("Invalid instance info for schedule %+v", instance)
+	}
+
+	return &types.ScheduleInstance{
+		ID:         instance.ID,
+		Type:       instance.Type,
+		HostID:     instance.HostID,
+		VolumeName: instance.VolumeName,
+	}, nil
+}
+
+func (k *kubernetesOrc) scheduleInstance(action string, instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	si, err := getScheduleInstanceFromInstance(instance)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to %v instance", action)
+	}
+	schedule := &types.ScheduleItem{
+		Action:   action,
+		Instance: *si,
+		Data: types.ScheduleData{
+			Orchestrator: OrcName,
+		},
+	}
+	ret, err := k.scheduler.Schedule(schedule, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to %v instance %v", action, instance.ID)
+	}
+	return ret, nil
+}
+
+func (k *kubernetesOrc) StartInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	return k.scheduleInstance(types.ScheduleActionStartInstance, instance)
+}
+
+func (k *kubernetesOrc) startInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	info, err := k.refreshInstanceInfo(instance)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to start instance '%v' type %v", instance.ID, instance.Type)
+	}
+	if info.Running {
+		return info, nil
+	}
+	if instance.Type != types.InstanceTypeReplica {
+		return nil, errors.Errorf("cannot start %v instance %v, it must be created again", instance.Type, instance.ID)
+	}
+	volume, err := k.getVolume(instance.VolumeName)
+	if err != nil || volume == nil {
+		return nil, errors.Errorf("unable to find volume %v", instance.VolumeName)
+	}
+	info, err = k.runPod(k.replicaPod(instance.ID, volume), instance)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to start instance '%v' type %v", instance.ID, instance.Type)
+	}
+	return info, nil
+}
+
+func (k *kubernetesOrc) StopInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	return k.scheduleInstance(types.ScheduleActionStopInstance, instance)
+}
+
+func (k *kubernetesOrc) stopInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	if err := k.deletePod(instance.ID); err != nil {
+		return nil, errors.Wrapf(err, "fail to stop instance '%v'", instance.ID)
+	}
+	return k.refreshInstanceInfo(instance)
+}
+
+func (k *kubernetesOrc) RemoveInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	return k.scheduleInstance(types.ScheduleActionDeleteInstance, instance)
+}
+
+func (k *kubernetesOrc) removeInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	if err := k.deletePod(instance.ID); err != nil {
+		return nil, errors.Wrapf(err, "Fail to remove instance %v", instance.ID)
+	}
+	if instance.Type == types.InstanceTypeReplica {
+		if err := os.RemoveAll(filepath.Join(ReplicaDataDir, instance.ID)); err != nil {
+			return nil, errors.Wrapf(err, "Fail to remove data of instance %v", instance.ID)
+		}
+	}
+	ret := &types.InstanceInfo{
+		ID:         instance.ID,
+		Name:       instance.ID,
+		HostID:     instance.HostID,
+		Type:       instance.Type,
+		VolumeName: instance.VolumeName,
+	}
+	return ret, nil
+}
+
+func (k *kubernetesOrc) updateInstanceMetadata(instance *types.InstanceInfo) error {
+	if instance.ID == "" ||
+		instance.Name == "" ||
+		instance.HostID == "" ||
+		instance.Type == types.InstanceTypeNone ||
+		instance.VolumeName == "" {
+		return errors.Errorf("invalid instance to update metadata: %+v", instance)
+	}
+
+	volume, err := k.getVolume(instance.VolumeName)
+	if err != nil {
+		return errors.Wrapf(err, "fail to update instance metadata: %+v", instance)
+	}
+	if volume == nil {
+		return errors.Errorf("fail to find volume %v", instance.VolumeName)
+	}
+
+	if instance.Type == types.InstanceTypeController {
+		controller := volume.Controller
+		if controller != nil && (controller.ID != instance.ID || controller.HostID != instance.HostID) {
+			return errors.Errorf("unable to update instance metadata: metadata conflict: %+v %+v",
+				controller, instance)
+		}
+		volume.Controller = &types.ControllerInfo{InstanceInfo: *instance}
+	} else if instance.Type == types.InstanceTypeReplica {
+		replica := volume.Replicas[instance.Name]
+		if replica != nil {
+			if replica.ID != instance.ID || replica.HostID != instance.HostID {
+				return errors.Errorf("unable to update instance metadata: replica %v metadata conflict: %+v %+v",
+					instance.Name, replica, instance)
+			}
+			replica.InstanceInfo = *instance
+		} else {
+			replica = &types.ReplicaInfo{InstanceInfo: *instance}
+		}
+		if volume.Replicas == nil {
+			volume.Replicas = make(map[string]*types.ReplicaInfo)
+		}
+		volume.Replicas[instance.Name] = replica
+	}
+	if err := k.setVolume(volume); err != nil {
+		return errors.Wrap(err, "fail to update instance metadata")
+	}
+	return nil
+}
+
+func (k *kubernetesOrc) removeInstanceMetadata(instance *types.InstanceInfo) error {
+	if instance.ID == "" ||
+		instance.HostID == "" ||
+		instance.Type == types.InstanceTypeNone ||
+		instance.VolumeName == "" {
+		return errors.Errorf("invalid instance to update metadata for %+v", instance)
+	}
+
+	volume, err := k.getVolume(instance.VolumeName)
+	if err != nil {
+		return errors.Wrapf(err, "fail to update instance metadata for %+v", instance)
+	}
+	if volume == nil {
+		return errors.Errorf("fail to find volume %v", instance.VolumeName)
+	}
+
+	if instance.Type == types.InstanceTypeController {
+		controller := volume.Controller
+		if controller == nil {
+			return errors.Errorf("unable to remove instance metadata: unable to find controller for volume %v",
+				instance.VolumeName)
+		}
+		if controller.ID != instance.ID || controller.HostID != instance.HostID {
+			return errors.Errorf("unable to remove instance metadata: metadata conflict: %+v %+v",
+				controller, instance)
+		}
+		volume.Controller = nil
+	} else if instance.Type == types.InstanceTypeReplica {
+		replica := volume.Replicas[instance.Name]
+		if replica == nil {
+			return errors.Errorf("unable to remove instance metadata: unable to find replica as %+v",
+				instance)
+		}
+		if replica.ID != instance.ID || replica.HostID != instance.HostID {
+			return errors.Errorf("unable to remove instance metadata: metadata conflict: %+v %+v",
+				replica, instance)
+		}
+		delete(volume.Replicas, replica.Name)
+	}
+
+	if err := k.setVolume(volume); err != nil {
+		return errors.Wrap(err, "fail to remove instance metadata")
+	}
+	return nil
+}
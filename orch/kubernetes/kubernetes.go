@@ -0,0 +1,647 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	"github.com/rancher/longhorn-manager/api"
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/scheduler"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	DefaultManagerSelector = "app=longhorn-manager"
+
+	volumeConfigMapPrefix = "longhorn-volume-"
+	hostConfigMapPrefix   = "longhorn-host-"
+	settingsConfigMap     = "longhorn-settings"
+	credentialsConfigMap  = "longhorn-credentials"
+
+	labelVolume   = "longhorn-manager/volume"
+	labelInstance = "longhorn-manager/instance"
+	labelHost     = "longhorn-manager/host"
+
+	keyVolume      = "volume"
+	keySettings    = "settings"
+	keyStorage     = "storage"
+	keyTags        = "tags"
+	keyDiskTags    = "diskTags"
+	keyMaintenance = "maintenance"
+	keyEviction    = "eviction"
+	keyLastSeen    = "lastSeen"
+)
+
+type kubernetesOrc struct {
+	EngineImage     string
+	ManagerSelector string
+
+	currentHost *types.HostInfo
+	currentNode *Node
+
+	client     Client
+	storage    *orch.StorageConfig
+	heartbeats *orch.HeartbeatMonitor
+
+	scheduler types.Scheduler
+}
+
+// Config of the Kubernetes orchestrator. PodName is the name of the pod of
+// the current manager, which runs on every node, e.g. as a DaemonSet.
+type Config struct {
+	EngineImage     string
+	ManagerSelector string
+	PodName         string
+	Client          Client
+	// Storage is reported for the current host if specified
+	Storage *orch.StorageConfig
+
+	// remote replaces the API calls to the managers on the other nodes,
+	// for testing
+	remote scheduler.RemoteSchedule
+}
+
+func New(c *cli.Context) (types.Orchestrator, error) {
+	client, err := NewInClusterClient(c.String("kubernetes-server"), c.String("kubernetes-namespace"))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to Kubernetes")
+	}
+	podName := os.Getenv("POD_NAME")
+	if podName == "" {
+		podName = os.Getenv("HOSTNAME")
+	}
+	storage, err := orch.ParseStorageConfig(c, ReplicaDataDir)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithConfig(&Config{
+		EngineImage:     c.String(orch.EngineImageParam),
+		ManagerSelector: c.String("kubernetes-manager-selector"),
+		PodName:         podName,
+		Client:          client,
+		Storage:         storage,
+	})
+}
+
+func NewWithConfig(cfg *Config) (types.Orchestrator, error) {
+	if cfg.PodName == "" {
+		return nil, errors.New("unable to find the name of the manager pod")
+	}
+	k := &kubernetesOrc{
+		EngineImage:     cfg.EngineImage,
+		ManagerSelector: cfg.ManagerSelector,
+		client:          cfg.Client,
+		storage:         cfg.Storage,
+		heartbeats:      orch.NewHeartbeatMonitor(),
+	}
+	if k.ManagerSelector == "" {
+		k.ManagerSelector = DefaultManagerSelector
+	}
+	if cfg.remote != nil {
+		k.scheduler = scheduler.NewOrcSchedulerWithRemote(k, cfg.remote)
+	} else {
+		k.scheduler = scheduler.NewOrcScheduler(k)
+	}
+
+	pod, err := k.client.GetPod(cfg.PodName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot find manager pod %v", cfg.PodName)
+	}
+	if pod.Spec.NodeName == "" || pod.Status.PodIP == "" {
+		return nil, errors.Errorf("manager pod %v is not running on a node", cfg.PodName)
+	}
+	node, err := k.client.GetNode(pod.Spec.NodeName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot find node %v", pod.Spec.NodeName)
+	}
+	k.currentNode = node
+	k.currentHost = node2Host(node, pod)
+	logrus.Infof("Current host %v name %v longhorn-manager address %v",
+		k.currentHost.UUID, k.currentHost.Name, k.currentHost.Address)
+
+	if err := k.sendHeartbeat(); err != nil {
+		return nil, err
+	}
+	go k.heartbeat()
+	if k.storage != nil {
+		go k.reportStorage()
+	}
+	logrus.Info("Kubernetes orchestrator is ready")
+	return k, nil
+}
+
+// node2Host uses the UID of the node as the host ID, and the address of the
+// manager pod running on it as the host address. The labels of the host are
+// the ones of the node, with the zone taken from the well-known zone label
+// if the node doesn't have a zone label.
+func node2Host(node *Node, managerPod *Pod) *types.HostInfo {
+	labels := orch.MergeHostLabels(nil, node.Metadata.Labels)
+	if zone, ok := labels[LabelZone]; ok && labels[types.HostLabelZone] == "" {
+		labels[types.HostLabelZone] = zone
+	}
+	return &types.HostInfo{
+		UUID:    node.Metadata.UID,
+		Name:    node.Metadata.Name,
+		Address: managerPod.Status.PodIP + ":" + strconv.Itoa(api.DefaultPort),
+		Labels:  labels,
+	}
+}
+
+// ListHosts returns the nodes with a running manager, the ones whose manager
+// stops sending heartbeats are down
+func (k *kubernetesOrc) ListHosts() (map[string]*types.HostInfo, error) {
+	nodes, err := k.client.ListNodes()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list nodes")
+	}
+	pods, err := k.client.ListPods(k.ManagerSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list manager pods")
+	}
+	managers := map[string]*Pod{}
+	for _, pod := range pods {
+		if pod.Status.Phase == PodRunning && pod.Status.PodIP != "" && pod.Metadata.DeletionTimestamp == "" {
+			managers[pod.Spec.NodeName] = pod
+		}
+	}
+
+	cms, err := k.listHostConfigMaps()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	hosts := make(map[string]*types.HostInfo)
+	for _, node := range nodes {
+		if pod := managers[node.Metadata.Name]; pod != nil {
+			host := node2Host(node, pod)
+			if cm := cms[host.UUID]; cm != nil {
+				if err := configMap2Host(cm, host); err != nil {
+					return nil, err
+				}
+			}
+			k.heartbeats.SetHostStatus(host, now)
+			hosts[host.UUID] = host
+		}
+	}
+	return hosts, nil
+}
+
+func hostConfigMapName(hostID string) string {
+	return hostConfigMapPrefix + hostID
+}
+
+// listHostConfigMaps returns the config maps keeping the storage and the
+// tags of the hosts, by host ID
+func (k *kubernetesOrc) listHostConfigMaps() (map[string]*ConfigMap, error) {
+	cms, err := k.client.ListConfigMaps(labelHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list hosts")
+	}
+	hostCMs := map[string]*ConfigMap{}
+	for _, cm := range cms {
+		hostCMs[cm.Metadata.Labels[labelHost]] = cm
+	}
+	return hostCMs, nil
+}
+
+func configMap2Host(cm *ConfigMap, host *types.HostInfo) error {
+	if value, ok := cm.Data[keyStorage]; ok {
+		host.Storage = &types.HostStorage{}
+		if err := json.Unmarshal([]byte(value), host.Storage); err != nil {
+			return errors.Wrapf(err, "fail to unmarshall json for storage of host %v", host.UUID)
+		}
+	}
+	if value, ok := cm.Data[keyTags]; ok {
+		if err := json.Unmarshal([]byte(value), &host.Tags); err != nil {
+			return errors.Wrapf(err, "fail to unmarshall json for tags of host %v", host.UUID)
+		}
+	}
+	if value, ok := cm.Data[keyDiskTags]; ok {
+		if err := json.Unmarshal([]byte(value), &host.DiskTags); err != nil {
+			return errors.Wrapf(err, "fail to unmarshall json for disk tags of host %v", host.UUID)
+		}
+	}
+	if value, ok := cm.Data[keyMaintenance]; ok {
+		if err := json.Unmarshal([]byte(value), &host.Maintenance); err != nil {
+			return errors.Wrapf(err, "fail to unmarshall json for maintenance of host %v", host.UUID)
+		}
+	}
+	if value, ok := cm.Data[keyEviction]; ok {
+		if err := json.Unmarshal([]byte(value), &host.Eviction); err != nil {
+			return errors.Wrapf(err, "fail to unmarshall json for eviction of host %v", host.UUID)
+		}
+	}
+	if value, ok := cm.Data[keyLastSeen]; ok {
+		if err := json.Unmarshal([]byte(value), &host.LastSeen); err != nil {
+			return errors.Wrapf(err, "fail to unmarshall json for last seen of host %v", host.UUID)
+		}
+	}
+	return nil
+}
+
+// updateHostConfigMap sets the values in the config map of the host, if
+// check, when given, passes on the host config kept in the map
+func (k *kubernetesOrc) updateHostConfigMap(hostID string, values map[string]interface{}, check func(host *types.HostInfo) error) error {
+	data := map[string]string{}
+	for key, v := range values {
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data[key] = string(value)
+	}
+	name := hostConfigMapName(hostID)
+	return orch.RetryOnConflict(func() error {
+		cm, err := k.client.GetConfigMap(name)
+		if err != nil {
+			if !IsNotFound(err) {
+				return errors.Wrapf(err, "unable to get host %v", hostID)
+			}
+			cm = nil
+		}
+		if check != nil {
+			host := &types.HostInfo{UUID: hostID}
+			if cm != nil {
+				if err := configMap2Host(cm, host); err != nil {
+					return err
+				}
+			}
+			if err := check(host); err != nil {
+				return err
+			}
+		}
+		if cm == nil {
+			_, err = k.client.CreateConfigMap(&ConfigMap{
+				Metadata: ObjectMeta{
+					Name:   name,
+					Labels: map[string]string{labelHost: hostID},
+				},
+				Data: data,
+			})
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		for key, value := range data {
+			cm.Data[key] = value
+		}
+		_, err = k.client.UpdateConfigMap(cm)
+		return err
+	})
+}
+
+// heartbeat renews the lease of the current host, the host is down once
+// it isn't renewed for orch.HostTTL
+func (k *kubernetesOrc) heartbeat() {
+	for {
+		time.Sleep(orch.HeartbeatPeriod)
+		if err := k.sendHeartbeat(); err != nil {
+			logrus.Warnf("%v", err)
+		}
+	}
+}
+
+func (k *kubernetesOrc) sendHeartbeat() error {
+	return errors.Wrapf(k.updateHostConfigMap(k.currentHost.UUID, map[string]interface{}{keyLastSeen: util.Now()}, nil),
+		"fail to send heartbeat of host %v", k.currentHost.UUID)
+}
+
+// reportStorage keeps the storage of the current host up to date
+func (k *kubernetesOrc) reportStorage() {
+	for {
+		if err := k.updateStorage(); err != nil {
+			logrus.Warnf("%v", errors.Wrapf(err, "fail to report storage of host %v", k.currentHost.UUID))
+		}
+		time.Sleep(orch.StorageReportPeriod)
+	}
+}
+
+func (k *kubernetesOrc) updateStorage() error {
+	volumes, err := k.ListVolumes()
+	if err != nil {
+		return err
+	}
+	storage, err := orch.GetHostStorage(k.storage, k.currentHost.UUID, volumes)
+	if err != nil {
+		return err
+	}
+	return k.updateHostConfigMap(k.currentHost.UUID, map[string]interface{}{keyStorage: storage}, nil)
+}
+
+func (k *kubernetesOrc) UpdateHostTags(id string, tags, diskTags []string) (*types.HostInfo, error) {
+	if err := orch.ValidateTags(tags); err != nil {
+		return nil, err
+	}
+	if err := orch.ValidateTags(diskTags); err != nil {
+		return nil, err
+	}
+	if _, err := k.GetHost(id); err != nil {
+		return nil, err
+	}
+	if err := k.updateHostConfigMap(id, map[string]interface{}{keyTags: tags, keyDiskTags: diskTags}, nil); err != nil {
+		return nil, errors.Wrapf(err, "unable to update tags of host %v", id)
+	}
+	return k.GetHost(id)
+}
+
+func (k *kubernetesOrc) UpdateHostMaintenance(id string, maintenance bool, check func(host *types.HostInfo) error) (*types.HostInfo, error) {
+	if _, err := k.GetHost(id); err != nil {
+		return nil, err
+	}
+	if err := k.updateHostConfigMap(id, map[string]interface{}{keyMaintenance: maintenance}, check); err != nil {
+		return nil, errors.Wrapf(err, "unable to update maintenance of host %v", id)
+	}
+	return k.GetHost(id)
+}
+
+func (k *kubernetesOrc) UpdateHostEviction(id string, eviction *types.EvictionInfo, check func(host *types.HostInfo) error) error {
+	return errors.Wrapf(k.updateHostConfigMap(id, map[string]interface{}{keyEviction: eviction}, check),
+		"unable to update eviction of host %v", id)
+}
+
+func (k *kubernetesOrc) GetHost(id string) (*types.HostInfo, error) {
+	hosts, err := k.ListHosts()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get host")
+	}
+	host := hosts[id]
+	if host == nil {
+		return nil, errors.Errorf("unable to get host %v", id)
+	}
+	return host, nil
+}
+
+// UpdateHostLabels is not supported, the labels come from the node
+func (k *kubernetesOrc) UpdateHostLabels(id string, labels map[string]string) (*types.HostInfo, error) {
+	return nil, errors.Errorf("cannot update labels of host %v, label the Kubernetes node instead", id)
+}
+
+func (k *kubernetesOrc) GetCurrentHostID() string {
+	return k.currentHost.UUID
+}
+
+func (k *kubernetesOrc) GetAddress(hostID string) (string, error) {
+	if hostID == k.currentHost.UUID {
+		return k.currentHost.Address, nil
+	}
+	host, err := k.GetHost(hostID)
+	if err != nil {
+		return "", err
+	}
+	return host.Address, nil
+}
+
+func volumeConfigMapName(volumeName string) string {
+	return volumeConfigMapPrefix + volumeName
+}
+
+func configMap2Volume(cm *ConfigMap) (*types.VolumeInfo, error) {
+	volume := &types.VolumeInfo{}
+	if err := json.Unmarshal([]byte(cm.Data[keyVolume]), volume); err != nil {
+		return nil, errors.Wrapf(err, "fail to unmarshall json for volume in configmap %v", cm.Metadata.Name)
+	}
+	revision, err := strconv.ParseInt(cm.Metadata.ResourceVersion, 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid resource version of configmap %v", cm.Metadata.Name)
+	}
+	volume.Revision = revision
+	return volume, nil
+}
+
+func (k *kubernetesOrc) getVolume(name string) (*types.VolumeInfo, error) {
+	cm, err := k.client.GetConfigMap(volumeConfigMapName(name))
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "unable to get volume")
+	}
+	return configMap2Volume(cm)
+}
+
+// setVolume creates the configmap for revision 0, otherwise updates it with
+// the revision as the resource version, so the API server would reject the
+// update if someone else has changed it
+func (k *kubernetesOrc) setVolume(volume *types.VolumeInfo) error {
+	value, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+	name := volumeConfigMapName(volume.Name)
+	cm := &ConfigMap{
+		Metadata: ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{labelVolume: volume.Name},
+		},
+		Data: map[string]string{keyVolume: string(value)},
+	}
+	if volume.Revision == 0 {
+		cm, err = k.client.CreateConfigMap(cm)
+	} else {
+		cm.Metadata.ResourceVersion = strconv.FormatInt(volume.Revision, 10)
+		cm, err = k.client.UpdateConfigMap(cm)
+	}
+	if err != nil {
+		if volume.Revision != 0 && IsNotFound(err) {
+			return errors.Wrap(&types.ConflictError{Key: name}, err.Error())
+		}
+		return err
+	}
+	updated, err := configMap2Volume(cm)
+	if err != nil {
+		return err
+	}
+	volume.Revision = updated.Revision
+	return nil
+}
+
+func (k *kubernetesOrc) CreateVolume(volume *types.VolumeInfo) (*types.VolumeInfo, error) {
+	v, err := k.getVolume(volume.Name)
+	if err == nil && v != nil {
+		return nil, errors.Errorf("volume %v already exists %+v", volume.Name, v)
+	}
+	volume.Revision = 0
+	if err := k.setVolume(volume); err != nil {
+		return nil, errors.Wrap(err, "fail to create new volume metadata")
+	}
+	return volume, nil
+}
+
+func (k *kubernetesOrc) DeleteVolume(volumeName string) error {
+	if err := k.client.DeleteConfigMap(volumeConfigMapName(volumeName)); err != nil && !IsNotFound(err) {
+		return errors.Wrap(err, "unable to remove volume")
+	}
+	return nil
+}
+
+func (k *kubernetesOrc) GetVolume(volumeName string) (*types.VolumeInfo, error) {
+	return k.getVolume(volumeName)
+}
+
+func (k *kubernetesOrc) UpdateVolume(volume *types.VolumeInfo) error {
+	v, err := k.getVolume(volume.Name)
+	if err != nil || v == nil {
+		return errors.Errorf("cannot update volume %v because it doesn't exists %+v", volume.Name, v)
+	}
+	return k.setVolume(volume)
+}
+
+func (k *kubernetesOrc) ListVolumes() ([]*types.VolumeInfo, error) {
+	cms, err := k.client.ListConfigMaps(labelVolume)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list volumes")
+	}
+	volumes := []*types.VolumeInfo{}
+	for _, cm := range cms {
+		volume, err := configMap2Volume(cm)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+func (k *kubernetesOrc) MarkBadReplica(volumeName string, replica *types.ReplicaInfo) error {
+	return orch.RetryOnConflict(func() error {
+		v, err := k.getVolume(volumeName)
+		if err != nil || v == nil {
+			return errors.Errorf("fail to mark bad replica, cannot get volume %v", volumeName)
+		}
+		for key, r := range v.Replicas {
+			if r.Name == replica.Name {
+				r.BadTimestamp = time.Now().UTC()
+				v.Replicas[key] = r
+				break
+			}
+		}
+		if err := k.UpdateVolume(v); err != nil {
+			return errors.Wrap(err, "fail to mark bad replica, cannot update volume")
+		}
+		return nil
+	})
+}
+
+func (k *kubernetesOrc) GetSettings() (*types.SettingsInfo, error) {
+	cm, err := k.client.GetConfigMap(settingsConfigMap)
+	if err != nil {
+		if IsNotFound(err) {
+			return &types.SettingsInfo{
+				BackupTarget: "",
+				EngineImage:  k.EngineImage,
+			}, nil
+		}
+		return nil, errors.Wrap(err, "unable to get settings")
+	}
+	settings := &types.SettingsInfo{}
+	if err := json.Unmarshal([]byte(cm.Data[keySettings]), settings); err != nil {
+		return nil, errors.Wrap(err, "fail to unmarshall json for settings")
+	}
+	return settings, nil
+}
+
+func (k *kubernetesOrc) SetSettings(settings *types.SettingsInfo) error {
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	// the settings are replaced as a whole, the last writer wins
+	return orch.RetryOnConflict(func() error {
+		cm, err := k.client.GetConfigMap(settingsConfigMap)
+		if err != nil {
+			if !IsNotFound(err) {
+				return errors.Wrap(err, "unable to get settings")
+			}
+			_, err = k.client.CreateConfigMap(&ConfigMap{
+				Metadata: ObjectMeta{Name: settingsConfigMap},
+				Data:     map[string]string{keySettings: string(value)},
+			})
+			return err
+		}
+		cm.Data = map[string]string{keySettings: string(value)}
+		_, err = k.client.UpdateConfigMap(cm)
+		return err
+	})
+}
+
+// the credentials are kept in one config map by name, the values are already
+// encrypted by the manager
+func (k *kubernetesOrc) ListCredentials() (map[string]*types.CredentialInfo, error) {
+	cm, err := k.client.GetConfigMap(credentialsConfigMap)
+	if err != nil {
+		if IsNotFound(err) {
+			return map[string]*types.CredentialInfo{}, nil
+		}
+		return nil, errors.Wrap(err, "unable to get credentials")
+	}
+	credentials := map[string]*types.CredentialInfo{}
+	for name, value := range cm.Data {
+		credential := &types.CredentialInfo{}
+		if err := json.Unmarshal([]byte(value), credential); err != nil {
+			return nil, errors.Wrapf(err, "fail to unmarshall json for credential %v", name)
+		}
+		credentials[name] = credential
+	}
+	return credentials, nil
+}
+
+func (k *kubernetesOrc) GetCredential(name string) (*types.CredentialInfo, error) {
+	credentials, err := k.ListCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return credentials[name], nil
+}
+
+func (k *kubernetesOrc) SetCredential(credential *types.CredentialInfo) error {
+	value, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	return k.updateCredentials(func(data map[string]string) {
+		data[credential.Name] = string(value)
+	})
+}
+
+func (k *kubernetesOrc) DeleteCredential(name string) error {
+	return k.updateCredentials(func(data map[string]string) {
+		delete(data, name)
+	})
+}
+
+func (k *kubernetesOrc) updateCredentials(update func(data map[string]string)) error {
+	return orch.RetryOnConflict(func() error {
+		cm, err := k.client.GetConfigMap(credentialsConfigMap)
+		if err != nil {
+			if !IsNotFound(err) {
+				return errors.Wrap(err, "unable to get credentials")
+			}
+			data := map[string]string{}
+			update(data)
+			_, err = k.client.CreateConfigMap(&ConfigMap{
+				Metadata: ObjectMeta{Name: credentialsConfigMap},
+				Data:     data,
+			})
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		update(cm.Data)
+		_, err = k.client.UpdateConfigMap(cm)
+		return err
+	})
+}
+
+func (k *kubernetesOrc) Scheduler() types.Scheduler {
+	return k.scheduler
+}
@@ -0,0 +1,593 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+
+	. "gopkg.in/check.v1"
+)
+
+const (
+	// EnvAPIServer is the address of a real API server, e.g.
+	// http://localhost:8001 for kubectl proxy, for APIServerSuite
+	EnvAPIServer = "LONGHORN_MANAGER_TEST_KUBERNETES_SERVER"
+	// EnvNamespace is the namespace APIServerSuite creates objects in,
+	// default if not set
+	EnvNamespace = "LONGHORN_MANAGER_TEST_KUBERNETES_NAMESPACE"
+
+	TestPrefix      = "longhorn-manager-test"
+	TestEngineImage = "rancher/longhorn-engine:test"
+	TestNodes       = 3
+)
+
+var (
+	VolumeName     = TestPrefix + "-vol"
+	ControllerName = VolumeName + "-controller"
+	Replica1Name   = VolumeName + "-replica1"
+	Replica2Name   = VolumeName + "-replica2"
+	Replica3Name   = VolumeName + "-replica3"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	client *FakeClient
+	// the orchestrator of the manager on every node, by host ID
+	orcs map[string]*kubernetesOrc
+	k    *kubernetesOrc
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(c *C) {
+	waitForController = func(address, volumeName string) error {
+		return nil
+	}
+	WaitPodTimeout = time.Second
+}
+
+func (s *TestSuite) SetUpTest(c *C) {
+	ReplicaDataDir = c.MkDir()
+
+	s.client = NewFakeClient()
+	s.orcs = map[string]*kubernetesOrc{}
+	remote := func(host *types.HostInfo, item *types.ScheduleItem) (*types.InstanceInfo, error) {
+		k := s.orcs[host.UUID]
+		if k == nil {
+			return nil, errors.Errorf("cannot find host %v", host.UUID)
+		}
+		return k.scheduler.Process(&types.ScheduleSpec{HostID: host.UUID}, item)
+	}
+
+	for i := 0; i < TestNodes; i++ {
+		node := s.client.AddNode(fmt.Sprintf("node-%d", i+1))
+		podName := "longhorn-manager-" + node.Metadata.Name
+		_, err := s.client.CreatePod(&Pod{
+			Metadata: ObjectMeta{
+				Name:   podName,
+				Labels: map[string]string{"app": "longhorn-manager"},
+			},
+			Spec: PodSpec{NodeName: node.Metadata.Name},
+		})
+		c.Assert(err, IsNil)
+
+		orc, err := NewWithConfig(&Config{
+			EngineImage: TestEngineImage,
+			PodName:     podName,
+			Client:      s.client,
+			remote:      remote,
+		})
+		c.Assert(err, IsNil)
+		k := orc.(*kubernetesOrc)
+		c.Assert(k.GetCurrentHostID(), Equals, node.Metadata.UID)
+		s.orcs[node.Metadata.UID] = k
+		if i == 0 {
+			s.k = k
+		}
+	}
+}
+
+func (s *TestSuite) TestHosts(c *C) {
+	hosts, err := s.k.ListHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts, HasLen, TestNodes)
+
+	host, err := s.k.GetHost(s.k.GetCurrentHostID())
+	c.Assert(err, IsNil)
+	c.Assert(hosts[host.UUID], DeepEquals, host)
+	c.Assert(host.Name, Equals, "node-1")
+	c.Assert(host.Status, Equals, types.HostStatusUp)
+
+	// the host is down once the heartbeats stop for orch.HostTTL on the
+	// clock of the reader, whatever the clock of the host says
+	s.k.heartbeats.SetHostStatus(host, time.Now().Add(orch.HostTTL))
+	c.Assert(host.Status, Equals, types.HostStatusDown)
+	lastSeen := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	c.Assert(s.k.updateHostConfigMap(host.UUID, map[string]interface{}{keyLastSeen: lastSeen}, nil), IsNil)
+	host, err = s.k.GetHost(host.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(host.Status, Equals, types.HostStatusUp)
+
+	address, err := s.k.GetAddress(host.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(address, Equals, host.Address)
+
+	// a node without a running manager is not a host
+	s.client.AddNode("node-without-manager")
+	c.Assert(s.client.SetPodPhase("longhorn-manager-node-2", PodFailed), IsNil)
+	hosts, err = s.k.ListHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts, HasLen, TestNodes-1)
+
+	_, err = s.k.GetHost("nonexistent")
+	c.Assert(err, NotNil)
+
+	_, err = NewWithConfig(&Config{PodName: "nonexistent", Client: s.client})
+	c.Assert(err, NotNil)
+
+	// the zone of the host comes from the well-known label of the node
+	host = node2Host(&Node{Metadata: ObjectMeta{
+		UID:    "node-uid",
+		Name:   "node-with-zone",
+		Labels: map[string]string{LabelZone: "us-east-1a"},
+	}}, &Pod{})
+	c.Assert(host.Labels[types.HostLabelZone], Equals, "us-east-1a")
+	_, err = s.k.UpdateHostLabels(host.UUID, map[string]string{types.HostLabelZone: "us-east-1b"})
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestHostStorage(c *C) {
+	s.k.storage = &orch.StorageConfig{Path: c.MkDir(), Reserved: 1024}
+	c.Assert(s.k.updateStorage(), IsNil)
+	// updated in place
+	c.Assert(s.k.updateStorage(), IsNil)
+
+	hosts, err := s.k.ListHosts()
+	c.Assert(err, IsNil)
+	for id, host := range hosts {
+		if id != s.k.GetCurrentHostID() {
+			c.Assert(host.Storage, IsNil)
+			continue
+		}
+		c.Assert(host.Storage, NotNil)
+		c.Assert(host.Storage.Total > 0, Equals, true)
+		c.Assert(host.Storage.Reserved, Equals, int64(1024))
+	}
+}
+
+func (s *TestSuite) TestSettings(c *C) {
+	settings, err := s.k.GetSettings()
+	c.Assert(err, IsNil)
+	c.Assert(settings.EngineImage, Equals, TestEngineImage)
+	c.Assert(settings.BackupTarget, Equals, "")
+
+	settings.BackupTarget = "vfs:///var/lib/longhorn/backups"
+	err = s.k.SetSettings(settings)
+	c.Assert(err, IsNil)
+
+	for _, k := range s.orcs {
+		settings, err = k.GetSettings()
+		c.Assert(err, IsNil)
+		c.Assert(settings.BackupTarget, Equals, "vfs:///var/lib/longhorn/backups")
+	}
+
+	settings.BackupTarget = ""
+	s.client.InjectConflicts(settingsConfigMap, 2)
+	err = s.k.SetSettings(settings)
+	c.Assert(err, IsNil)
+	settings, err = s.k.GetSettings()
+	c.Assert(err, IsNil)
+	c.Assert(settings.BackupTarget, Equals, "")
+}
+
+func (s *TestSuite) TestCredentials(c *C) {
+	credentials, err := s.k.ListCredentials()
+	c.Assert(err, IsNil)
+	c.Assert(credentials, HasLen, 0)
+
+	for _, name := range []string{"s3", "nfs"} {
+		err = s.k.SetCredential(&types.CredentialInfo{Name: name, Values: map[string]string{"KEY": name}})
+		c.Assert(err, IsNil)
+	}
+	for _, k := range s.orcs {
+		credentials, err = k.ListCredentials()
+		c.Assert(err, IsNil)
+		c.Assert(credentials, HasLen, 2)
+		c.Assert(credentials["s3"].Values["KEY"], Equals, "s3")
+	}
+
+	// e.g. the credentials updated through the managers on two hosts
+	s.client.InjectConflicts(credentialsConfigMap, 2)
+	c.Assert(s.k.DeleteCredential("s3"), IsNil)
+	credential, err := s.k.GetCredential("s3")
+	c.Assert(err, IsNil)
+	c.Assert(credential, IsNil)
+	credential, err = s.k.GetCredential("nfs")
+	c.Assert(err, IsNil)
+	c.Assert(credential.Values["KEY"], Equals, "nfs")
+}
+
+func (s *TestSuite) TestUpdateVolumeConflict(c *C) {
+	volume := &types.VolumeInfo{
+		Name:             VolumeName,
+		Size:             8 * 1024 * 1024, // 8M
+		NumberOfReplicas: 3,
+		EngineImage:      TestEngineImage,
+	}
+	_, err := s.k.CreateVolume(volume)
+	c.Assert(err, IsNil)
+
+	v1, err := s.k.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	v2, err := s.k.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(v1.Revision, Equals, volume.Revision)
+
+	v1.NumberOfReplicas = 2
+	c.Assert(s.k.UpdateVolume(v1), IsNil)
+	c.Assert(v1.Revision > v2.Revision, Equals, true)
+	v2.NumberOfReplicas = 1
+	err = s.k.UpdateVolume(v2)
+	c.Assert(types.IsConflict(err), Equals, true)
+
+	volume, err = s.k.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume.NumberOfReplicas, Equals, 2)
+	c.Assert(volume.Revision, Equals, v1.Revision)
+}
+
+func (s *TestSuite) TestCreateVolume(c *C) {
+	volume := &types.VolumeInfo{
+		Name:             VolumeName,
+		Size:             8 * 1024 * 1024, // 8M
+		NumberOfReplicas: 3,
+		EngineImage:      TestEngineImage,
+	}
+	_, err := s.k.CreateVolume(volume)
+	c.Assert(err, IsNil)
+	_, err = s.k.CreateVolume(volume)
+	c.Assert(err, NotNil)
+
+	hostIDs := map[string]struct{}{}
+	replicas := map[string]*types.ReplicaInfo{}
+	for _, name := range []string{Replica1Name, Replica2Name, Replica3Name} {
+		replica, err := s.k.CreateReplica(VolumeName, name)
+		c.Assert(err, IsNil)
+		c.Assert(replica.Name, Equals, name)
+		c.Assert(replica.Running, Equals, false)
+		hostIDs[replica.HostID] = struct{}{}
+
+		instance, err := s.k.StartInstance(&replica.InstanceInfo)
+		c.Assert(err, IsNil)
+		c.Assert(instance.ID, Equals, replica.ID)
+		c.Assert(instance.Running, Equals, true)
+		c.Assert(instance.Address, Not(Equals), "")
+		replicas[name] = &types.ReplicaInfo{InstanceInfo: *instance}
+
+		// the replica pod is pinned to the host of the replica
+		pod, err := s.client.GetPod(name)
+		c.Assert(err, IsNil)
+		host, err := s.k.GetHost(replica.HostID)
+		c.Assert(err, IsNil)
+		c.Assert(pod.Spec.NodeName, Equals, host.Name)
+		c.Assert(pod.Spec.Volumes[0].HostPath.Path, Equals, filepath.Join(ReplicaDataDir, name))
+	}
+	// soft anti-affinity should spread replicas over all the hosts
+	c.Assert(hostIDs, HasLen, TestNodes)
+
+	controller, err := s.k.CreateController(VolumeName, ControllerName, replicas)
+	c.Assert(err, IsNil)
+	c.Assert(controller.HostID, Equals, s.k.GetCurrentHostID())
+	c.Assert(controller.Running, Equals, true)
+	c.Assert(controller.Address, Not(Equals), "")
+	pod, err := s.client.GetPod(ControllerName)
+	c.Assert(err, IsNil)
+	c.Assert(pod.Spec.NodeName, Equals, "node-1")
+	c.Assert(pod.Spec.Containers[0].Args, HasLen, 13)
+
+	volume, err = s.k.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Controller, NotNil)
+	c.Assert(volume.Controller.ID, Equals, controller.ID)
+	c.Assert(volume.Replicas, HasLen, 3)
+	for name, replica := range volume.Replicas {
+		c.Assert(replica.Running, Equals, true)
+		c.Assert(replica.ID, Equals, replicas[name].ID)
+	}
+
+	err = s.k.MarkBadReplica(VolumeName, replicas[Replica1Name])
+	c.Assert(err, IsNil)
+	volume, err = s.k.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Replicas[Replica1Name].BadTimestamp.IsZero(), Equals, false)
+	c.Assert(volume.Replicas[Replica2Name].BadTimestamp.IsZero(), Equals, true)
+
+	instance, err := s.k.StopInstance(&volume.Controller.InstanceInfo)
+	c.Assert(err, IsNil)
+	c.Assert(instance.Running, Equals, false)
+	_, err = s.k.StartInstance(&volume.Controller.InstanceInfo)
+	c.Assert(err, NotNil)
+	_, err = s.k.RemoveInstance(&volume.Controller.InstanceInfo)
+	c.Assert(err, IsNil)
+
+	// the data of the replicas stays on the host until they're removed
+	replica := volume.Replicas[Replica2Name]
+	dataDir := filepath.Join(ReplicaDataDir, Replica2Name)
+	c.Assert(os.MkdirAll(dataDir, 0700), IsNil)
+	instance, err = s.k.StopInstance(&replica.InstanceInfo)
+	c.Assert(err, IsNil)
+	c.Assert(instance.Running, Equals, false)
+	_, err = s.client.GetPod(Replica2Name)
+	c.Assert(IsNotFound(err), Equals, true)
+	_, err = os.Stat(dataDir)
+	c.Assert(err, IsNil)
+	instance, err = s.k.StartInstance(&replica.InstanceInfo)
+	c.Assert(err, IsNil)
+	c.Assert(instance.Running, Equals, true)
+
+	for _, replica := range volume.Replicas {
+		instance, err := s.k.StopInstance(&replica.InstanceInfo)
+		c.Assert(err, IsNil)
+		c.Assert(instance.Running, Equals, false)
+		_, err = s.k.RemoveInstance(&replica.InstanceInfo)
+		c.Assert(err, IsNil)
+	}
+	_, err = os.Stat(dataDir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = s.k.RemoveInstance(&volume.Controller.InstanceInfo)
+	c.Assert(err, NotNil)
+
+	pods, err := s.client.ListPods(labelVolume)
+	c.Assert(err, IsNil)
+	c.Assert(pods, HasLen, 0)
+
+	volume, err = s.k.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Controller, IsNil)
+	c.Assert(volume.Replicas, HasLen, 0)
+
+	volumes, err := s.k.ListVolumes()
+	c.Assert(err, IsNil)
+	c.Assert(volumes, HasLen, 1)
+
+	err = s.k.DeleteVolume(VolumeName)
+	c.Assert(err, IsNil)
+	volume, err = s.k.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume, IsNil)
+	volumes, err = s.k.ListVolumes()
+	c.Assert(err, IsNil)
+	c.Assert(volumes, HasLen, 0)
+}
+
+func (s *TestSuite) TestFailedPod(c *C) {
+	volume := &types.VolumeInfo{
+		Name:             VolumeName,
+		Size:             8 * 1024 * 1024,
+		NumberOfReplicas: 1,
+		EngineImage:      TestEngineImage,
+	}
+	_, err := s.k.CreateVolume(volume)
+	c.Assert(err, IsNil)
+	replica, err := s.k.CreateReplica(VolumeName, Replica1Name)
+	c.Assert(err, IsNil)
+	instance, err := s.k.StartInstance(&replica.InstanceInfo)
+	c.Assert(err, IsNil)
+	c.Assert(instance.Running, Equals, true)
+
+	c.Assert(s.client.SetPodPhase(Replica1Name, PodFailed), IsNil)
+	_, err = s.k.StartInstance(&replica.InstanceInfo)
+	c.Assert(err, NotNil)
+
+	// the failed pod can still be removed
+	_, err = s.k.RemoveInstance(&replica.InstanceInfo)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestRESTClient(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status *Status
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/namespaces/longhorn/configmaps":
+			c.Check(r.URL.Query().Get("labelSelector"), Equals, labelVolume)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"items": []*ConfigMap{{Metadata: ObjectMeta{Name: "cm"}}},
+			})
+			return
+		case "GET /api/v1/namespaces/longhorn/configmaps/missing":
+			status = notFound("configmaps", "missing").(*Status)
+		case "PUT /api/v1/namespaces/longhorn/configmaps/cm":
+			status = conflict("configmaps", "cm").(*Status)
+		case "POST /api/v1/namespaces/longhorn/configmaps":
+			status = alreadyExists("configmaps", "cm").(*Status)
+		default:
+			http.Error(w, "unexpected request", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(status.Code)
+		json.NewEncoder(w).Encode(status)
+	}))
+	defer server.Close()
+
+	client, err := NewInClusterClient(server.URL, "longhorn")
+	c.Assert(err, IsNil)
+
+	cms, err := client.ListConfigMaps(labelVolume)
+	c.Assert(err, IsNil)
+	c.Assert(cms, HasLen, 1)
+	c.Assert(cms[0].Metadata.Name, Equals, "cm")
+
+	_, err = client.GetConfigMap("missing")
+	c.Assert(IsNotFound(err), Equals, true)
+	_, err = client.UpdateConfigMap(cms[0])
+	c.Assert(types.IsConflict(err), Equals, true)
+	_, err = client.CreateConfigMap(cms[0])
+	c.Assert(types.IsConflict(err), Equals, true)
+	_, err = client.ListNodes()
+	c.Assert(err, ErrorMatches, ".*unexpected request.*")
+}
+
+// APIServerSuite runs the REST client against a real API server, to check
+// the requests and the objects are what the API server expects
+type APIServerSuite struct {
+	client Client
+}
+
+var _ = Suite(&APIServerSuite{})
+
+func (s *APIServerSuite) SetUpSuite(c *C) {
+	server := os.Getenv(EnvAPIServer)
+	if server == "" {
+		c.Skip(EnvAPIServer + " not set")
+	}
+	namespace := os.Getenv(EnvNamespace)
+	if namespace == "" {
+		namespace = "default"
+	}
+	client, err := NewInClusterClient(server, namespace)
+	c.Assert(err, IsNil)
+	s.client = client
+}
+
+func (s *APIServerSuite) TestNodes(c *C) {
+	nodes, err := s.client.ListNodes()
+	c.Assert(err, IsNil)
+	c.Assert(len(nodes) > 0, Equals, true)
+	node, err := s.client.GetNode(nodes[0].Metadata.Name)
+	c.Assert(err, IsNil)
+	c.Assert(node.Metadata.UID, Not(Equals), "")
+	c.Assert(node.Metadata.UID, Equals, nodes[0].Metadata.UID)
+	c.Assert(node.Status.Addresses, Not(HasLen), 0)
+
+	_, err = s.client.GetNode(TestPrefix + "-nonexistent")
+	c.Assert(IsNotFound(err), Equals, true)
+}
+
+func (s *APIServerSuite) TestConfigMaps(c *C) {
+	name := TestPrefix + "-cm"
+	labels := map[string]string{labelVolume: VolumeName}
+	s.client.DeleteConfigMap(name)
+
+	cm, err := s.client.CreateConfigMap(&ConfigMap{
+		Metadata: ObjectMeta{Name: name, Labels: labels},
+		Data:     map[string]string{"key": "value"},
+	})
+	c.Assert(err, IsNil)
+	defer s.client.DeleteConfigMap(name)
+	c.Assert(cm.Metadata.ResourceVersion, Not(Equals), "")
+	_, err = s.client.CreateConfigMap(&ConfigMap{Metadata: ObjectMeta{Name: name}})
+	c.Assert(types.IsConflict(err), Equals, true)
+
+	cms, err := s.client.ListConfigMaps(labelVolume + "=" + VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(cms, HasLen, 1)
+	c.Assert(cms[0].Data, DeepEquals, map[string]string{"key": "value"})
+
+	stale := *cm
+	cm.Data["key"] = "updated"
+	updated, err := s.client.UpdateConfigMap(cm)
+	c.Assert(err, IsNil)
+	c.Assert(updated.Metadata.ResourceVersion, Not(Equals), stale.Metadata.ResourceVersion)
+	stale.Data = map[string]string{"key": "stale"}
+	_, err = s.client.UpdateConfigMap(&stale)
+	c.Assert(types.IsConflict(err), Equals, true)
+
+	cm, err = s.client.GetConfigMap(name)
+	c.Assert(err, IsNil)
+	c.Assert(cm.Data["key"], Equals, "updated")
+	c.Assert(cm.Metadata.Labels, DeepEquals, labels)
+
+	c.Assert(s.client.DeleteConfigMap(name), IsNil)
+	_, err = s.client.GetConfigMap(name)
+	c.Assert(IsNotFound(err), Equals, true)
+}
+
+func (s *APIServerSuite) TestPods(c *C) {
+	name := TestPrefix + "-pod"
+	labels := map[string]string{labelVolume: VolumeName}
+	s.client.DeletePod(name)
+
+	privileged := true
+	pod, err := s.client.CreatePod(&Pod{
+		Metadata: ObjectMeta{Name: name, Labels: labels},
+		Spec: PodSpec{
+			Containers: []Container{{
+				Name:            "pause",
+				Image:           "busybox",
+				Args:            []string{"sleep", "3600"},
+				Env:             []EnvVar{{Name: "KEY", Value: "value"}},
+				Ports:           []ContainerPort{{ContainerPort: 9501}},
+				VolumeMounts:    []VolumeMount{{Name: "dev", MountPath: "/host/dev"}},
+				SecurityContext: &SecurityContext{Privileged: &privileged},
+			}},
+			Volumes:       []Volume{hostPathVolume("dev", "/dev", "")},
+			RestartPolicy: "Never",
+		},
+	})
+	c.Assert(err, IsNil)
+	defer s.client.DeletePod(name)
+	c.Assert(pod.Metadata.UID, Not(Equals), "")
+	c.Assert(pod.Status.Phase, Equals, PodPending)
+
+	pods, err := s.client.ListPods(labelVolume + "=" + VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(pods, HasLen, 1)
+	c.Assert(pods[0].Spec.Containers[0].Args, DeepEquals, []string{"sleep", "3600"})
+
+	c.Assert(s.client.DeletePod(name), IsNil)
+	pod, err = s.client.GetPod(name)
+	if err == nil {
+		// terminating
+		c.Assert(pod.Metadata.DeletionTimestamp, Not(Equals), "")
+	} else {
+		c.Assert(IsNotFound(err), Equals, true)
+	}
+}
+
+func (s *TestSuite) TestHostConfigMapConflict(c *C) {
+	id := s.k.GetCurrentHostID()
+	name := hostConfigMapName(id)
+	c.Assert(s.k.sendHeartbeat(), IsNil)
+
+	// e.g. the heartbeat and the tags written at the same time
+	s.client.InjectConflicts(name, 2)
+	host, err := s.k.UpdateHostTags(id, []string{"ssd"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(host.Tags, DeepEquals, []string{"ssd"})
+	s.client.InjectConflicts(name, 2)
+	c.Assert(s.k.sendHeartbeat(), IsNil)
+
+	s.client.InjectConflicts(name, orch.ConflictRetries)
+	err = s.k.sendHeartbeat()
+	c.Assert(types.IsConflict(err), Equals, true)
+	s.client.InjectConflicts(name, 0)
+}
+
+func (s *TestSuite) TestHostTags(c *C) {
+	s.k.storage = &orch.StorageConfig{Path: c.MkDir()}
+	c.Assert(s.k.updateStorage(), IsNil)
+
+	id := s.k.GetCurrentHostID()
+	host, err := s.k.UpdateHostTags(id, []string{"ssd"}, []string{"nvme"})
+	c.Assert(err, IsNil)
+	c.Assert(host.Tags, DeepEquals, []string{"ssd"})
+	c.Assert(host.DiskTags, DeepEquals, []string{"nvme"})
+	// the storage is kept
+	c.Assert(host.Storage, NotNil)
+
+	_, err = s.k.UpdateHostTags(id, []string{"invalid,tag"}, nil)
+	c.Assert(err, NotNil)
+	_, err = s.k.UpdateHostTags("nonexistent", []string{"ssd"}, nil)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,152 @@
+package kubernetes
+
+// The subset of the Kubernetes API objects used by the orchestrator, with the
+// same JSON representation as the core/v1 API. Only the fields read or set by
+// the orchestrator are here, the others are dropped when an object is read.
+// Only the config maps are written back after a read, they're created by the
+// orchestrator and have no other fields. The JSON is checked against a real
+// API server by APIServerSuite.
+
+const (
+	PodPending   = "Pending"
+	PodRunning   = "Running"
+	PodSucceeded = "Succeeded"
+	PodFailed    = "Failed"
+
+	NodeInternalIP = "InternalIP"
+
+	LabelHostname = "kubernetes.io/hostname"
+	LabelZone     = "failure-domain.beta.kubernetes.io/zone"
+)
+
+type ObjectMeta struct {
+	Name              string            `json:"name,omitempty"`
+	UID               string            `json:"uid,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	DeletionTimestamp string            `json:"deletionTimestamp,omitempty"`
+}
+
+type Node struct {
+	APIVersion string     `json:"apiVersion,omitempty"`
+	Kind       string     `json:"kind,omitempty"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Status     NodeStatus `json:"status,omitempty"`
+}
+
+type NodeStatus struct {
+	Addresses []NodeAddress `json:"addresses,omitempty"`
+}
+
+type NodeAddress struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+type Pod struct {
+	APIVersion string     `json:"apiVersion,omitempty"`
+	Kind       string     `json:"kind,omitempty"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       PodSpec    `json:"spec"`
+	Status     PodStatus  `json:"status,omitempty"`
+}
+
+type PodSpec struct {
+	NodeName      string      `json:"nodeName,omitempty"`
+	Affinity      *Affinity   `json:"affinity,omitempty"`
+	Containers    []Container `json:"containers"`
+	Volumes       []Volume    `json:"volumes,omitempty"`
+	RestartPolicy string      `json:"restartPolicy,omitempty"`
+}
+
+type Affinity struct {
+	NodeAffinity *NodeAffinity `json:"nodeAffinity,omitempty"`
+}
+
+type NodeAffinity struct {
+	RequiredDuringSchedulingIgnoredDuringExecution *NodeSelector `json:"requiredDuringSchedulingIgnoredDuringExecution,omitempty"`
+}
+
+type NodeSelector struct {
+	NodeSelectorTerms []NodeSelectorTerm `json:"nodeSelectorTerms"`
+}
+
+type NodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement `json:"matchExpressions,omitempty"`
+}
+
+type NodeSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+}
+
+type Container struct {
+	Name            string           `json:"name"`
+	Image           string           `json:"image"`
+	Args            []string         `json:"args,omitempty"`
+	Env             []EnvVar         `json:"env,omitempty"`
+	Ports           []ContainerPort  `json:"ports,omitempty"`
+	VolumeMounts    []VolumeMount    `json:"volumeMounts,omitempty"`
+	SecurityContext *SecurityContext `json:"securityContext,omitempty"`
+}
+
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type ContainerPort struct {
+	ContainerPort int `json:"containerPort"`
+}
+
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+}
+
+type SecurityContext struct {
+	Privileged *bool `json:"privileged,omitempty"`
+}
+
+type Volume struct {
+	Name     string                `json:"name"`
+	HostPath *HostPathVolumeSource `json:"hostPath,omitempty"`
+}
+
+type HostPathVolumeSource struct {
+	Path string `json:"path"`
+	Type string `json:"type,omitempty"`
+}
+
+type PodStatus struct {
+	Phase string `json:"phase,omitempty"`
+	PodIP string `json:"podIP,omitempty"`
+}
+
+type ConfigMap struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+// Status is returned by the API server on failure
+type Status struct {
+	Kind    string `json:"kind,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+func (s *Status) Error() string {
+	return s.Message
+}
+
+func nodeHostname(node *Node) string {
+	if hostname := node.Metadata.Labels[LabelHostname]; hostname != "" {
+		return hostname
+	}
+	return node.Metadata.Name
+}
@@ -0,0 +1,422 @@
+package memory
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	OrcName = "memory"
+)
+
+type memoryScheduleData struct {
+	InstanceName string
+	VolumeName   string
+	VolumeSize   string
+	EngineImage  string
+	ReplicaURLs  []string
+}
+
+func (m *memoryOrc) ProcessSchedule(item *types.ScheduleItem) (*types.InstanceInfo, error) {
+	var (
+		data     memoryScheduleData
+		instance *types.InstanceInfo
+		err      error
+	)
+
+	if item.Data.Orchestrator != OrcName {
+		return nil, errors.Errorf("received request for the wrong orchestrator %v", item.Data.Orchestrator)
+	}
+	if len(item.Data.Data) != 0 {
+		if err := json.Unmarshal(item.Data.Data, &data); err != nil {
+			return nil, errors.Wrap(err, "fail to parse schedule data")
+		}
+	}
+	if item.Instance.ID == "" {
+		return nil, errors.Errorf("empty instance ID")
+	}
+	input := &types.InstanceInfo{
+		ID:         item.Instance.ID,
+		HostID:     item.Instance.HostID,
+		Type:       item.Instance.Type,
+		VolumeName: item.Instance.VolumeName,
+	}
+	switch item.Action {
+	case types.ScheduleActionCreateController:
+		instance, err = m.createController(&data)
+	case types.ScheduleActionCreateReplica:
+		instance, err = m.createReplica(&data)
+	case types.ScheduleActionStartInstance:
+		instance, err = m.startInstance(input)
+	case types.ScheduleActionStopInstance:
+		instance, err = m.stopInstance(input)
+	case types.ScheduleActionDeleteInstance:
+		instance, err = m.removeInstance(input)
+	default:
+		return nil, errors.Errorf("cannot find specified action %v", item.Action)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to process schedule")
+	}
+	// the metadata of other instances of the volume can be updated at
+	// the same time on the other hosts
+	err = orch.RetryOnConflict(func() error {
+		if item.Action == types.ScheduleActionDeleteInstance {
+			return m.removeInstanceMetadata(instance)
+		}
+		return m.updateInstanceMetadata(instance)
+	})
+	if err != nil {
+		if item.Action == types.ScheduleActionCreateController ||
+			item.Action == types.ScheduleActionCreateReplica {
+			logrus.Warnf("failed to update instance metadata for %+v, cleaning up", instance)
+			m.removeInstance(instance)
+		}
+
+		return nil, errors.Wrapf(err, "failed to update instance metadata for %+v", instance)
+	}
+	return instance, nil
+}
+
+func (m *memoryOrc) CreateController(volumeName, controllerName string, replicas map[string]*types.ReplicaInfo) (*types.ControllerInfo, error) {
+	volume, err := m.getVolume(volumeName)
+	if err != nil || volume == nil {
+		return nil, errors.Errorf("unable to find volume %v", volumeName)
+	}
+
+	data := &memoryScheduleData{
+		InstanceName: controllerName,
+		VolumeName:   volumeName,
+		VolumeSize:   strconv.FormatInt(volume.Size, 10),
+		EngineImage:  volume.EngineImage,
+		ReplicaURLs:  []string{},
+	}
+	for name := range replicas {
+		replica := volume.Replicas[name]
+		if replica == nil {
+			return nil, errors.Errorf("cannot find replica %v", name)
+		}
+		if replica.Address == "" {
+			return nil, errors.Errorf("invalid empty address of replica %v", name)
+		}
+		data.ReplicaURLs = append(data.ReplicaURLs, "tcp://"+replica.Address+":9502")
+	}
+	scheduleData, err := toScheduleData(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create controller for %v", volumeName)
+	}
+
+	schedule := &types.ScheduleItem{
+		Action: types.ScheduleActionCreateController,
+		Instance: types.ScheduleInstance{
+			ID:         controllerName,
+			HostID:     m.GetCurrentHostID(),
+			Type:       types.InstanceTypeController,
+			VolumeName: volumeName,
+		},
+		Data: *scheduleData,
+	}
+	instance, err := m.scheduler.Schedule(schedule, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create controller for %v", volumeName)
+	}
+	return &types.ControllerInfo{
+		InstanceInfo: *instance,
+	}, nil
+}
+
+func (m *memoryOrc) CreateReplica(volumeName, replicaName string) (*types.ReplicaInfo, error) {
+	volume, err := m.getVolume(volumeName)
+	if err != nil || volume == nil {
+		return nil, errors.Errorf("unable to find volume %v", volumeName)
+	}
+	if volume.Size == 0 {
+		return nil, errors.Errorf("invalid volume size 0")
+	}
+
+	scheduleData, err := toScheduleData(&memoryScheduleData{
+		VolumeName:   volume.Name,
+		VolumeSize:   strconv.FormatInt(volume.Size, 10),
+		InstanceName: replicaName,
+		EngineImage:  volume.EngineImage,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create replica for %v", volumeName)
+	}
+
+	schedule := &types.ScheduleItem{
+		Action: types.ScheduleActionCreateReplica,
+		Instance: types.ScheduleInstance{
+			ID:         replicaName,
+			Type:       types.InstanceTypeReplica,
+			VolumeName: volumeName,
+		},
+		Data: *scheduleData,
+	}
+
+	settings, err := m.GetSettings()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create replica for %v", volumeName)
+	}
+	policy := orch.ReplicaSchedulePolicy(volume, settings)
+
+	instance, err := m.scheduler.Schedule(schedule, policy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create replica for %v", volumeName)
+	}
+	return &types.ReplicaInfo{
+		InstanceInfo: *instance,
+	}, nil
+}
+
+func toScheduleData(data *memoryScheduleData) (*types.ScheduleData, error) {
+	bData, err := json.Marshal(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to marshall %+v", data)
+	}
+	return &types.ScheduleData{
+		Orchestrator: OrcName,
+		Data:         bData,
+	}, nil
+}
+
+func (m *memoryOrc) createController(data *memoryScheduleData) (*types.InstanceInfo, error) {
+	instance := &types.InstanceInfo{
+		ID:         util.UUID(),
+		Type:       types.InstanceTypeController,
+		Name:       data.InstanceName,
+		HostID:     m.GetCurrentHostID(),
+		Address:    m.cluster.newAddress(),
+		Running:    true,
+		VolumeName: data.VolumeName,
+	}
+	if m.engine != nil {
+		size, err := strconv.ParseInt(data.VolumeSize, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid volume size %v", data.VolumeSize)
+		}
+		m.engine.LaunchController(instance.Address, data.VolumeName, size, data.ReplicaURLs)
+	}
+	m.setInstance(instance)
+	return m.getInstance(instance.ID)
+}
+
+func (m *memoryOrc) createReplica(data *memoryScheduleData) (*types.InstanceInfo, error) {
+	instance := &types.InstanceInfo{
+		ID:         util.UUID(),
+		Type:       types.InstanceTypeReplica,
+		Name:       data.InstanceName,
+		HostID:     m.GetCurrentHostID(),
+		Address:    m.cluster.newAddress(),
+		VolumeName: data.VolumeName,
+	}
+	m.setInstance(instance)
+	return m.getInstance(instance.ID)
+}
+
+func (m *memoryOrc) setInstance(instance *types.InstanceInfo) {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	i := *instance
+	m.cluster.instances[instance.ID] = &i
+}
+
+func (m *memoryOrc) getInstance(id string) (*types.InstanceInfo, error) {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	instance := m.cluster.instances[id]
+	if instance == nil || instance.HostID != m.GetCurrentHostID() {
+		return nil, errors.Errorf("cannot find instance %v on host %v", id, m.GetCurrentHostID())
+	}
+	i := *instance
+	return &i, nil
+}
+
+func (m *memoryOrc) setRunning(instance *types.InstanceInfo, running bool) (*types.InstanceInfo, error) {
+	i, err := m.getInstance(instance.ID)
+	if err != nil {
+		return nil, err
+	}
+	i.Running = running
+	m.setInstance(i)
+	return i, nil
+}
+
+func getScheduleInstanceFromInstance(instance *types.InstanceInfo) (*types.ScheduleInstance, error) {
+	if instance.ID == "" || instance.HostID == "" ||
+		instance.Type == types.InstanceTypeNone ||
+		instance.VolumeName == "" {
+		return nil, errors.Errorf("Invalid instance info for schedule %+v", instance)
+	}
+
+	return &types.ScheduleInstance{
+		ID:         instance.ID,
+		Type:       instance.Type,
+		HostID:     instance.HostID,
+		VolumeName: instance.VolumeName,
+	}, nil
+}
+
+func (m *memoryOrc) scheduleInstance(action string, instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	si, err := getScheduleInstanceFromInstance(instance)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to %v instance", action)
+	}
+	schedule := &types.ScheduleItem{
+		Action:   action,
+		Instance: *si,
+		Data: types.ScheduleData{
+			Orchestrator: OrcName,
+		},
+	}
+	ret, err := m.scheduler.Schedule(schedule, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to %v instance %v", action, instance.ID)
+	}
+	return ret, nil
+}
+
+func (m *memoryOrc) StartInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	return m.scheduleInstance(types.ScheduleActionStartInstance, instance)
+}
+
+func (m *memoryOrc) startInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	return m.setRunning(instance, true)
+}
+
+func (m *memoryOrc) StopInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	return m.scheduleInstance(types.ScheduleActionStopInstance, instance)
+}
+
+func (m *memoryOrc) stopInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	i, err := m.setRunning(instance, false)
+	if err != nil {
+		return nil, err
+	}
+	m.shutdownController(i)
+	return i, nil
+}
+
+func (m *memoryOrc) shutdownController(instance *types.InstanceInfo) {
+	if m.engine != nil && instance.Type == types.InstanceTypeController {
+		m.engine.ShutdownController(instance.Address)
+	}
+}
+
+func (m *memoryOrc) RemoveInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	return m.scheduleInstance(types.ScheduleActionDeleteInstance, instance)
+}
+
+func (m *memoryOrc) removeInstance(instance *types.InstanceInfo) (*types.InstanceInfo, error) {
+	i, err := m.getInstance(instance.ID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to remove instance %v", instance.ID)
+	}
+	m.cluster.Lock()
+	delete(m.cluster.instances, instance.ID)
+	m.cluster.Unlock()
+	m.shutdownController(i)
+
+	i.Running = false
+	i.Address = ""
+	return i, nil
+}
+
+func (m *memoryOrc) updateInstanceMetadata(instance *types.InstanceInfo) error {
+	if instance.ID == "" ||
+		instance.Name == "" ||
+		instance.HostID == "" ||
+		instance.Type == types.InstanceTypeNone ||
+		instance.VolumeName == "" {
+		return errors.Errorf("invalid instance to update metadata: %+v", instance)
+	}
+
+	volume, err := m.getVolume(instance.VolumeName)
+	if err != nil {
+		return errors.Wrapf(err, "fail to update instance metadata: %+v", instance)
+	}
+	if volume == nil {
+		return errors.Errorf("fail to find volume %v", instance.VolumeName)
+	}
+
+	if instance.Type == types.InstanceTypeController {
+		controller := volume.Controller
+		if controller != nil && (controller.ID != instance.ID || controller.HostID != instance.HostID) {
+			return errors.Errorf("unable to update instance metadata: metadata conflict: %+v %+v",
+				controller, instance)
+		}
+		volume.Controller = &types.ControllerInfo{InstanceInfo: *instance}
+	} else if instance.Type == types.InstanceTypeReplica {
+		replica := volume.Replicas[instance.Name]
+		if replica != nil {
+			if replica.ID != instance.ID || replica.HostID != instance.HostID {
+				return errors.Errorf("unable to update instance metadata: replica %v metadata conflict: %+v %+v",
+					instance.Name, replica, instance)
+			}
+			replica.InstanceInfo = *instance
+		} else {
+			replica = &types.ReplicaInfo{InstanceInfo: *instance}
+		}
+		if volume.Replicas == nil {
+			volume.Replicas = make(map[string]*types.ReplicaInfo)
+		}
+		volume.Replicas[instance.Name] = replica
+	}
+	if err := m.setVolume(volume); err != nil {
+		return errors.Wrap(err, "fail to update instance metadata")
+	}
+	return nil
+}
+
+func (m *memoryOrc) removeInstanceMetadata(instance *types.InstanceInfo) error {
+	if instance.ID == "" ||
+		instance.HostID == "" ||
+		instance.Type == types.InstanceTypeNone ||
+		instance.VolumeName == "" {
+		return errors.Errorf("invalid instance to update metadata for %+v", instance)
+	}
+
+	volume, err := m.getVolume(instance.VolumeName)
+	if err != nil {
+		return errors.Wrapf(err, "fail to update instance metadata for %+v", instance)
+	}
+	if volume == nil {
+		return errors.Errorf("fail to find volume %v", instance.VolumeName)
+	}
+
+	if instance.Type == types.InstanceTypeController {
+		controller := volume.Controller
+		if controller == nil {
+			return errors.Errorf("unable to remove instance metadata: unable to find controller for volume %v",
+				instance.VolumeName)
+		}
+		if controller.ID != instance.ID || controller.HostID != instance.HostID {
+			return errors.Errorf("unable to remove instance metadata: metadata conflict: %+v %+v",
+				controller, instance)
+		}
+		volume.Controller = nil
+	} else if instance.Type == types.InstanceTypeReplica {
+		replica := volume.Replicas[instance.Name]
+		if replica == nil {
+			return errors.Errorf("unable to remove instance metadata: unable to find replica as %+v",
+				instance)
+		}
+		if replica.ID != instance.ID || replica.HostID != instance.HostID {
+			return errors.Errorf("unable to remove instance metadata: metadata conflict: %+v %+v",
+				replica, instance)
+		}
+		delete(volume.Replicas, replica.Name)
+	}
+
+	if err := m.setVolume(volume); err != nil {
+		return errors.Wrap(err, "fail to remove instance metadata")
+	}
+	return nil
+}
@@ -0,0 +1,502 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	"github.com/rancher/longhorn-manager/api"
+	"github.com/rancher/longhorn-manager/engine"
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/scheduler"
+	"github.com/rancher/longhorn-manager/store"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	DefaultHosts = 3
+
+	volumesDir = "/volumes"
+)
+
+// Config of the in-memory cluster. The orchestrator returned by NewWithConfig
+// acts as the manager of the first simulated host. If Engine is set, the
+// controllers are launched in the fake engine.
+type Config struct {
+	Hosts       int
+	EngineImage string
+	Engine      *engine.Fake
+	// Port of the API of the first simulated host on 127.0.0.1, the other
+	// hosts use the next ports. api.DefaultPort if 0.
+	Port int
+
+	// HostLabels are the initial labels of all the simulated hosts
+	HostLabels map[string]string
+	// HostStorage is the simulated storage of every host, the replicas
+	// scheduled are added up from the volumes. It's unknown if nil.
+	HostStorage *types.HostStorage
+}
+
+// cluster is the state shared by the managers of all simulated hosts
+type cluster struct {
+	sync.Mutex
+
+	hosts     map[string]*types.HostInfo
+	orcs      map[string]*memoryOrc
+	ordered   []types.Orchestrator
+	volumes   types.MetadataStore
+	instances map[string]*types.InstanceInfo
+	settings  *types.SettingsInfo
+	// the credentials as given, encrypted by the manager
+	credentials map[string]*types.CredentialInfo
+	// the simulated hosts stopped sending heartbeats
+	down map[string]bool
+
+	lastAddress int
+}
+
+type memoryOrc struct {
+	EngineImage string
+	engine      *engine.Fake
+
+	currentHost *types.HostInfo
+	cluster     *cluster
+
+	scheduler types.Scheduler
+}
+
+// Hosts returns the orchestrators of all the simulated hosts, starting with
+// orc. Every simulated host needs its own manager and API server listening
+// on the address of the host, for the requests to be forwarded to the host
+// of the volume.
+func Hosts(orc types.Orchestrator) []types.Orchestrator {
+	m := orc.(*memoryOrc)
+	hosts := []types.Orchestrator{m}
+	for _, o := range m.cluster.ordered {
+		if o != orc {
+			hosts = append(hosts, o)
+		}
+	}
+	return hosts
+}
+
+func New(c *cli.Context, e *engine.Fake) (types.Orchestrator, error) {
+	labels, err := orch.ParseHostLabels(c.StringSlice(orch.HostLabelParam))
+	if err != nil {
+		return nil, err
+	}
+	return NewWithConfig(&Config{
+		Hosts:       c.Int("memory-hosts"),
+		EngineImage: c.String(orch.EngineImageParam),
+		Engine:      e,
+		HostLabels:  labels,
+	})
+}
+
+func NewWithConfig(cfg *Config) (types.Orchestrator, error) {
+	if cfg.Hosts <= 0 {
+		return nil, errors.Errorf("invalid number of simulated hosts %v", cfg.Hosts)
+	}
+	c := &cluster{
+		hosts:       map[string]*types.HostInfo{},
+		orcs:        map[string]*memoryOrc{},
+		volumes:     store.NewMemoryStore(),
+		instances:   map[string]*types.InstanceInfo{},
+		credentials: map[string]*types.CredentialInfo{},
+		down:        map[string]bool{},
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = api.DefaultPort
+	}
+
+	var first *memoryOrc
+	for i := 0; i < cfg.Hosts; i++ {
+		host := &types.HostInfo{
+			UUID:    util.UUID(),
+			Name:    fmt.Sprintf("memory-host-%d", i+1),
+			Address: fmt.Sprintf("127.0.0.1:%d", port+i),
+			Labels:  orch.MergeHostLabels(nil, cfg.HostLabels),
+		}
+		if cfg.HostStorage != nil {
+			storage := *cfg.HostStorage
+			host.Storage = &storage
+		}
+		m := &memoryOrc{
+			EngineImage: cfg.EngineImage,
+			engine:      cfg.Engine,
+			currentHost: host,
+			cluster:     c,
+		}
+		m.scheduler = scheduler.NewOrcSchedulerWithRemote(m, c.remoteSchedule)
+		c.hosts[host.UUID] = host
+		c.orcs[host.UUID] = m
+		c.ordered = append(c.ordered, m)
+		logrus.Infof("Add simulated host %v name %v", host.UUID, host.Name)
+		if first == nil {
+			first = m
+		}
+	}
+	logrus.Info("Memory orchestrator is ready")
+	return first, nil
+}
+
+// remoteSchedule delivers the item directly to the scheduler of another
+// simulated host, the same way the API would do for a real one
+func (c *cluster) remoteSchedule(host *types.HostInfo, item *types.ScheduleItem) (*types.InstanceInfo, error) {
+	c.Lock()
+	m := c.orcs[host.UUID]
+	c.Unlock()
+	if m == nil {
+		return nil, errors.Errorf("cannot find simulated host %v", host.UUID)
+	}
+	return m.scheduler.Process(&types.ScheduleSpec{HostID: host.UUID}, item)
+}
+
+func (c *cluster) newAddress() string {
+	c.Lock()
+	defer c.Unlock()
+	c.lastAddress++
+	return fmt.Sprintf("10.42.%d.%d", c.lastAddress/250, c.lastAddress%250+1)
+}
+
+func (m *memoryOrc) GetHost(id string) (*types.HostInfo, error) {
+	hosts, err := m.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	host := hosts[id]
+	if host == nil {
+		return nil, errors.Errorf("unable to get host %v", id)
+	}
+	return host, nil
+}
+
+func (m *memoryOrc) ListHosts() (map[string]*types.HostInfo, error) {
+	volumes, err := m.ListVolumes()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list volumes")
+	}
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	hosts := make(map[string]*types.HostInfo)
+	for id, host := range m.cluster.hosts {
+		h := *host
+		m.cluster.heartbeat(&h)
+		if host.Storage != nil {
+			storage := *host.Storage
+			storage.Scheduled = orch.ScheduledStorage(id, volumes)
+			storage.Updated = util.Now()
+			h.Storage = &storage
+		}
+		hosts[id] = &h
+	}
+	return hosts, nil
+}
+
+func (m *memoryOrc) UpdateHostLabels(id string, labels map[string]string) (*types.HostInfo, error) {
+	if err := orch.ValidateHostLabels(labels); err != nil {
+		return nil, err
+	}
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	host := m.cluster.hosts[id]
+	if host == nil {
+		return nil, errors.Errorf("unable to get host %v", id)
+	}
+	h := *host
+	h.Labels = orch.MergeHostLabels(nil, labels)
+	m.cluster.hosts[id] = &h
+	updated := h
+	m.cluster.heartbeat(&updated)
+	return &updated, nil
+}
+
+func (m *memoryOrc) UpdateHostTags(id string, tags, diskTags []string) (*types.HostInfo, error) {
+	if err := orch.ValidateTags(tags); err != nil {
+		return nil, err
+	}
+	if err := orch.ValidateTags(diskTags); err != nil {
+		return nil, err
+	}
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	host := m.cluster.hosts[id]
+	if host == nil {
+		return nil, errors.Errorf("unable to get host %v", id)
+	}
+	h := *host
+	h.Tags = tags
+	h.DiskTags = diskTags
+	m.cluster.hosts[id] = &h
+	updated := h
+	m.cluster.heartbeat(&updated)
+	return &updated, nil
+}
+
+func (m *memoryOrc) UpdateHostMaintenance(id string, maintenance bool, check func(host *types.HostInfo) error) (*types.HostInfo, error) {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	host := m.cluster.hosts[id]
+	if host == nil {
+		return nil, errors.Errorf("unable to get host %v", id)
+	}
+	if check != nil {
+		if err := check(host); err != nil {
+			return nil, err
+		}
+	}
+	h := *host
+	h.Maintenance = maintenance
+	m.cluster.hosts[id] = &h
+	updated := h
+	m.cluster.heartbeat(&updated)
+	return &updated, nil
+}
+
+func (m *memoryOrc) UpdateHostEviction(id string, eviction *types.EvictionInfo, check func(host *types.HostInfo) error) error {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	host := m.cluster.hosts[id]
+	if host == nil {
+		return errors.Errorf("unable to get host %v", id)
+	}
+	if check != nil {
+		if err := check(host); err != nil {
+			return err
+		}
+	}
+	h := *host
+	h.Eviction = nil
+	if eviction != nil {
+		e := *eviction
+		h.Eviction = &e
+	}
+	m.cluster.hosts[id] = &h
+	return nil
+}
+
+// heartbeat simulates the last heartbeat of the host, the up hosts have
+// just sent one. The simulated hosts share the same clock, so the status
+// follows SetHostDown right away.
+func (c *cluster) heartbeat(host *types.HostInfo) {
+	now := time.Now()
+	if c.down[host.UUID] {
+		host.LastSeen = now.Add(-orch.HostTTL).UTC().Format(time.RFC3339)
+		host.Status = types.HostStatusDown
+	} else {
+		host.LastSeen = now.UTC().Format(time.RFC3339)
+		host.Status = types.HostStatusUp
+	}
+}
+
+// SetHostDown stops or resumes the heartbeats of the simulated host, for
+// testing
+func (m *memoryOrc) SetHostDown(id string, down bool) error {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	if m.cluster.hosts[id] == nil {
+		return errors.Errorf("unable to get host %v", id)
+	}
+	m.cluster.down[id] = down
+	return nil
+}
+
+// GetHostOrchestrator returns the orchestrator of another simulated host,
+// for testing the managers running on multiple hosts
+func (m *memoryOrc) GetHostOrchestrator(id string) (types.Orchestrator, error) {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	orc := m.cluster.orcs[id]
+	if orc == nil {
+		return nil, errors.Errorf("cannot find simulated host %v", id)
+	}
+	return orc, nil
+}
+
+func (m *memoryOrc) GetCurrentHostID() string {
+	return m.currentHost.UUID
+}
+
+func (m *memoryOrc) GetAddress(hostID string) (string, error) {
+	if hostID == m.currentHost.UUID {
+		return m.currentHost.Address, nil
+	}
+	host, err := m.GetHost(hostID)
+	if err != nil {
+		return "", err
+	}
+	return host.Address, nil
+}
+
+func (m *memoryOrc) CreateVolume(volume *types.VolumeInfo) (*types.VolumeInfo, error) {
+	v, err := m.getVolume(volume.Name)
+	if err == nil && v != nil {
+		return nil, errors.Errorf("volume %v already exists %+v", volume.Name, v)
+	}
+	volume.Revision = 0
+	if err := m.setVolume(volume); err != nil {
+		return nil, errors.Wrap(err, "fail to create new volume metadata")
+	}
+	return volume, nil
+}
+
+func (m *memoryOrc) DeleteVolume(volumeName string) error {
+	return m.cluster.volumes.Delete(volumeKey(volumeName))
+}
+
+func (m *memoryOrc) GetVolume(volumeName string) (*types.VolumeInfo, error) {
+	return m.getVolume(volumeName)
+}
+
+func (m *memoryOrc) UpdateVolume(volume *types.VolumeInfo) error {
+	v, err := m.getVolume(volume.Name)
+	if err != nil || v == nil {
+		return errors.Errorf("cannot update volume %v because it doesn't exists %+v", volume.Name, v)
+	}
+	return m.setVolume(volume)
+}
+
+func (m *memoryOrc) ListVolumes() ([]*types.VolumeInfo, error) {
+	pairs, err := m.cluster.volumes.List(volumesDir)
+	if err != nil {
+		return nil, err
+	}
+	volumes := []*types.VolumeInfo{}
+	for _, pair := range pairs {
+		volume, err := pair2Volume(pair)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+func (m *memoryOrc) MarkBadReplica(volumeName string, replica *types.ReplicaInfo) error {
+	return orch.RetryOnConflict(func() error {
+		v, err := m.getVolume(volumeName)
+		if err != nil || v == nil {
+			return errors.Errorf("fail to mark bad replica, cannot get volume %v", volumeName)
+		}
+		for k, r := range v.Replicas {
+			if r.Name == replica.Name {
+				r.BadTimestamp = time.Now().UTC()
+				v.Replicas[k] = r
+				break
+			}
+		}
+		if err := m.UpdateVolume(v); err != nil {
+			return errors.Wrap(err, "fail to mark bad replica, cannot update volume")
+		}
+		return nil
+	})
+}
+
+func volumeKey(name string) string {
+	return volumesDir + "/" + name
+}
+
+func pair2Volume(pair *types.KVPair) (*types.VolumeInfo, error) {
+	volume := &types.VolumeInfo{}
+	if err := json.Unmarshal(pair.Value, volume); err != nil {
+		return nil, errors.Wrapf(err, "fail to unmarshall json for volume %v", pair.Key)
+	}
+	volume.Revision = pair.Revision
+	return volume, nil
+}
+
+func (m *memoryOrc) getVolume(name string) (*types.VolumeInfo, error) {
+	pair, err := m.cluster.volumes.Get(volumeKey(name))
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return pair2Volume(pair)
+}
+
+// setVolume only succeeds if the stored volume is still at volume.Revision
+func (m *memoryOrc) setVolume(volume *types.VolumeInfo) error {
+	value, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+	revision, err := m.cluster.volumes.CompareAndSet(volumeKey(volume.Name), value, volume.Revision)
+	if err != nil {
+		return err
+	}
+	volume.Revision = revision
+	return nil
+}
+
+func (m *memoryOrc) GetSettings() (*types.SettingsInfo, error) {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	if m.cluster.settings == nil {
+		return &types.SettingsInfo{
+			BackupTarget: "",
+			EngineImage:  m.EngineImage,
+		}, nil
+	}
+	settings := *m.cluster.settings
+	return &settings, nil
+}
+
+func (m *memoryOrc) SetSettings(settings *types.SettingsInfo) error {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	s := *settings
+	m.cluster.settings = &s
+	return nil
+}
+
+func copyCredential(credential *types.CredentialInfo) *types.CredentialInfo {
+	c := &types.CredentialInfo{Name: credential.Name, Values: map[string]string{}}
+	for key, value := range credential.Values {
+		c.Values[key] = value
+	}
+	return c
+}
+
+func (m *memoryOrc) ListCredentials() (map[string]*types.CredentialInfo, error) {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	credentials := map[string]*types.CredentialInfo{}
+	for name, credential := range m.cluster.credentials {
+		credentials[name] = copyCredential(credential)
+	}
+	return credentials, nil
+}
+
+func (m *memoryOrc) GetCredential(name string) (*types.CredentialInfo, error) {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	credential := m.cluster.credentials[name]
+	if credential == nil {
+		return nil, nil
+	}
+	return copyCredential(credential), nil
+}
+
+func (m *memoryOrc) SetCredential(credential *types.CredentialInfo) error {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	m.cluster.credentials[credential.Name] = copyCredential(credential)
+	return nil
+}
+
+func (m *memoryOrc) DeleteCredential(name string) error {
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	delete(m.cluster.credentials, name)
+	return nil
+}
+
+func (m *memoryOrc) Scheduler() types.Scheduler {
+	return m.scheduler
+}
@@ -0,0 +1,368 @@
+package memory
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rancher/longhorn-manager/api"
+	"github.com/rancher/longhorn-manager/orch"
+	"github.com/rancher/longhorn-manager/types"
+
+	. "gopkg.in/check.v1"
+)
+
+const (
+	TestPrefix      = "longhorn-manager-test"
+	TestEngineImage = "rancher/longhorn-engine:test"
+)
+
+var (
+	VolumeName     = TestPrefix + "-vol"
+	ControllerName = VolumeName + "-controller"
+	Replica1Name   = VolumeName + "-replica1"
+	Replica2Name   = VolumeName + "-replica2"
+	Replica3Name   = VolumeName + "-replica3"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	m *memoryOrc
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpTest(c *C) {
+	orc, err := NewWithConfig(&Config{
+		Hosts:       DefaultHosts,
+		EngineImage: TestEngineImage,
+	})
+	c.Assert(err, IsNil)
+	s.m = orc.(*memoryOrc)
+}
+
+func (s *TestSuite) TestHosts(c *C) {
+	hosts, err := s.m.ListHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts, HasLen, DefaultHosts)
+
+	host, err := s.m.GetHost(s.m.GetCurrentHostID())
+	c.Assert(err, IsNil)
+	c.Assert(hosts[host.UUID], DeepEquals, host)
+
+	_, err = s.m.GetHost("nonexistent")
+	c.Assert(err, NotNil)
+
+	// every simulated host has its own API server
+	orcs := Hosts(s.m)
+	c.Assert(orcs, HasLen, DefaultHosts)
+	c.Assert(orcs[0], Equals, types.Orchestrator(s.m))
+	addresses := map[string]bool{}
+	for _, orc := range orcs {
+		address, err := s.m.GetAddress(orc.GetCurrentHostID())
+		c.Assert(err, IsNil)
+		addresses[address] = true
+	}
+	c.Assert(addresses, HasLen, DefaultHosts)
+	c.Assert(addresses[fmt.Sprintf("127.0.0.1:%d", api.DefaultPort)], Equals, true)
+
+	_, err = NewWithConfig(&Config{})
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestUpdateHostLabels(c *C) {
+	id := s.m.GetCurrentHostID()
+	host, err := s.m.UpdateHostLabels(id, map[string]string{types.HostLabelZone: "zone-a"})
+	c.Assert(err, IsNil)
+	c.Assert(host.Labels[types.HostLabelZone], Equals, "zone-a")
+
+	host, err = s.m.GetHost(id)
+	c.Assert(err, IsNil)
+	c.Assert(host.Labels, DeepEquals, map[string]string{types.HostLabelZone: "zone-a"})
+
+	_, err = s.m.UpdateHostLabels(id, map[string]string{"": "zone-b"})
+	c.Assert(err, NotNil)
+	_, err = s.m.UpdateHostLabels("nonexistent", map[string]string{})
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestSpreadFailureDomains(c *C) {
+	orc, err := NewWithConfig(&Config{
+		Hosts:       4,
+		EngineImage: TestEngineImage,
+	})
+	c.Assert(err, IsNil)
+	m := orc.(*memoryOrc)
+
+	hosts, err := m.ListHosts()
+	c.Assert(err, IsNil)
+	domains := []map[string]string{
+		{types.HostLabelZone: "zone-a", types.HostLabelRack: "rack-1"},
+		{types.HostLabelZone: "zone-a", types.HostLabelRack: "rack-1"},
+		{types.HostLabelZone: "zone-a", types.HostLabelRack: "rack-2"},
+		{types.HostLabelZone: "zone-b", types.HostLabelRack: "rack-3"},
+	}
+	i := 0
+	for id := range hosts {
+		_, err := m.UpdateHostLabels(id, domains[i])
+		c.Assert(err, IsNil)
+		i++
+	}
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("%s-%d", VolumeName, i)
+		_, err := m.CreateVolume(&types.VolumeInfo{
+			Name:             name,
+			Size:             8 * 1024 * 1024, // 8M
+			NumberOfReplicas: 3,
+			EngineImage:      TestEngineImage,
+		})
+		c.Assert(err, IsNil)
+		used := map[string]int{}
+		for j := 0; j < 3; j++ {
+			replica, err := m.CreateReplica(name, fmt.Sprintf("%s-replica%d", name, j))
+			c.Assert(err, IsNil)
+			host, err := m.GetHost(replica.HostID)
+			c.Assert(err, IsNil)
+			used[host.Labels[types.HostLabelRack]]++
+		}
+		// one replica in each rack, zone-b is picked before the second
+		// rack of zone-a
+		c.Assert(used, DeepEquals, map[string]int{"rack-1": 1, "rack-2": 1, "rack-3": 1})
+	}
+}
+
+func (s *TestSuite) TestScheduleBySpace(c *C) {
+	orc, err := NewWithConfig(&Config{
+		Hosts:       DefaultHosts,
+		EngineImage: TestEngineImage,
+		HostStorage: &types.HostStorage{
+			Total:    24 * 1024 * 1024,
+			Used:     1024 * 1024,
+			Reserved: 4 * 1024 * 1024,
+		},
+	})
+	c.Assert(err, IsNil)
+	m := orc.(*memoryOrc)
+
+	createReplicas := func(name string, count int) error {
+		if _, err := m.CreateVolume(&types.VolumeInfo{
+			Name:             name,
+			Size:             8 * 1024 * 1024, // 8M
+			NumberOfReplicas: count,
+			EngineImage:      TestEngineImage,
+		}); err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			if _, err := m.CreateReplica(name, fmt.Sprintf("%s-replica%d", name, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// 20M schedulable on each host, for two 8M replicas
+	c.Assert(createReplicas(VolumeName+"-1", 3), IsNil)
+	// the hosts with the most space go first
+	c.Assert(createReplicas(VolumeName+"-2", 1), IsNil)
+	c.Assert(createReplicas(VolumeName+"-3", 1), IsNil)
+	c.Assert(createReplicas(VolumeName+"-4", 1), IsNil)
+	hosts, err := m.ListHosts()
+	c.Assert(err, IsNil)
+	for _, host := range hosts {
+		c.Assert(host.Storage.Scheduled, Equals, int64(16*1024*1024))
+	}
+	err = createReplicas(VolumeName+"-5", 1)
+	c.Assert(err, ErrorMatches, ".*no host has enough space.*")
+
+	settings, err := m.GetSettings()
+	c.Assert(err, IsNil)
+	settings.StorageOverProvisioningPercentage = 200
+	c.Assert(m.SetSettings(settings), IsNil)
+	_, err = m.CreateReplica(VolumeName+"-5", VolumeName+"-5-replica0")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestSettings(c *C) {
+	settings, err := s.m.GetSettings()
+	c.Assert(err, IsNil)
+	c.Assert(settings.EngineImage, Equals, TestEngineImage)
+	c.Assert(settings.BackupTarget, Equals, "")
+
+	settings.BackupTarget = "vfs:///var/lib/longhorn/backups"
+	err = s.m.SetSettings(settings)
+	c.Assert(err, IsNil)
+
+	settings, err = s.m.GetSettings()
+	c.Assert(err, IsNil)
+	c.Assert(settings.BackupTarget, Equals, "vfs:///var/lib/longhorn/backups")
+}
+
+func (s *TestSuite) TestCredentials(c *C) {
+	defer func(key []byte) { orch.CredentialKey = key }(orch.CredentialKey)
+	orch.CredentialKey = []byte("test-key")
+
+	credential := &types.CredentialInfo{
+		Name:   "s3",
+		Values: map[string]string{"AWS_ACCESS_KEY_ID": "key", "AWS_SECRET_ACCESS_KEY": "secret"},
+	}
+	c.Assert(orch.ValidateCredential(credential), IsNil)
+	encrypted, err := orch.EncryptCredential(credential)
+	c.Assert(err, IsNil)
+	c.Assert(encrypted.Values["AWS_SECRET_ACCESS_KEY"], Not(Equals), "secret")
+	c.Assert(s.m.SetCredential(encrypted), IsNil)
+
+	credentials, err := s.m.ListCredentials()
+	c.Assert(err, IsNil)
+	c.Assert(credentials, HasLen, 1)
+	c.Assert(credentials["s3"], DeepEquals, encrypted)
+
+	env, err := orch.CredentialEnv(s.m, "s3")
+	c.Assert(err, IsNil)
+	c.Assert(env, DeepEquals, []string{"AWS_ACCESS_KEY_ID=key", "AWS_SECRET_ACCESS_KEY=secret"})
+	c.Assert(orch.EngineEnv(s.m), HasLen, 0)
+
+	settings, err := s.m.GetSettings()
+	c.Assert(err, IsNil)
+	settings.BackupTargetCredential = "s3"
+	c.Assert(s.m.SetSettings(settings), IsNil)
+	c.Assert(orch.EngineEnv(s.m), DeepEquals, env)
+
+	orch.CredentialKey = []byte("wrong-key")
+	_, err = orch.CredentialEnv(s.m, "s3")
+	c.Assert(err, NotNil)
+	_, err = orch.CredentialEnv(s.m, "nonexistent")
+	c.Assert(err, NotNil)
+	c.Assert(orch.ValidateCredential(&types.CredentialInfo{Name: "bad", Values: map[string]string{"BAD KEY": "v"}}), NotNil)
+
+	c.Assert(s.m.DeleteCredential("s3"), IsNil)
+	credential, err = s.m.GetCredential("s3")
+	c.Assert(err, IsNil)
+	c.Assert(credential, IsNil)
+}
+
+func (s *TestSuite) TestCreateVolume(c *C) {
+	volume := &types.VolumeInfo{
+		Name:             VolumeName,
+		Size:             8 * 1024 * 1024, // 8M
+		NumberOfReplicas: 3,
+		EngineImage:      TestEngineImage,
+	}
+	_, err := s.m.CreateVolume(volume)
+	c.Assert(err, IsNil)
+	_, err = s.m.CreateVolume(volume)
+	c.Assert(err, NotNil)
+
+	hostIDs := map[string]struct{}{}
+	replicas := map[string]*types.ReplicaInfo{}
+	for _, name := range []string{Replica1Name, Replica2Name, Replica3Name} {
+		replica, err := s.m.CreateReplica(VolumeName, name)
+		c.Assert(err, IsNil)
+		c.Assert(replica.Name, Equals, name)
+		c.Assert(replica.Running, Equals, false)
+		hostIDs[replica.HostID] = struct{}{}
+
+		instance, err := s.m.StartInstance(&replica.InstanceInfo)
+		c.Assert(err, IsNil)
+		c.Assert(instance.ID, Equals, replica.ID)
+		c.Assert(instance.Running, Equals, true)
+		replicas[name] = &types.ReplicaInfo{InstanceInfo: *instance}
+	}
+	// soft anti-affinity should spread replicas over all the hosts
+	c.Assert(hostIDs, HasLen, DefaultHosts)
+
+	controller, err := s.m.CreateController(VolumeName, ControllerName, replicas)
+	c.Assert(err, IsNil)
+	c.Assert(controller.HostID, Equals, s.m.GetCurrentHostID())
+	c.Assert(controller.Running, Equals, true)
+	c.Assert(controller.Address, Not(Equals), "")
+
+	volume, err = s.m.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Controller, NotNil)
+	c.Assert(volume.Controller.ID, Equals, controller.ID)
+	c.Assert(volume.Replicas, HasLen, 3)
+	for name, replica := range volume.Replicas {
+		c.Assert(replica.Running, Equals, true)
+		c.Assert(replica.ID, Equals, replicas[name].ID)
+	}
+
+	err = s.m.MarkBadReplica(VolumeName, replicas[Replica1Name])
+	c.Assert(err, IsNil)
+	volume, err = s.m.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Replicas[Replica1Name].BadTimestamp.IsZero(), Equals, false)
+	c.Assert(volume.Replicas[Replica2Name].BadTimestamp.IsZero(), Equals, true)
+
+	instance, err := s.m.StopInstance(&volume.Controller.InstanceInfo)
+	c.Assert(err, IsNil)
+	c.Assert(instance.Running, Equals, false)
+	_, err = s.m.RemoveInstance(&volume.Controller.InstanceInfo)
+	c.Assert(err, IsNil)
+
+	for _, replica := range volume.Replicas {
+		instance, err := s.m.StopInstance(&replica.InstanceInfo)
+		c.Assert(err, IsNil)
+		c.Assert(instance.Running, Equals, false)
+		_, err = s.m.RemoveInstance(&replica.InstanceInfo)
+		c.Assert(err, IsNil)
+	}
+	_, err = s.m.RemoveInstance(&volume.Controller.InstanceInfo)
+	c.Assert(err, NotNil)
+
+	volume, err = s.m.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Controller, IsNil)
+	c.Assert(volume.Replicas, HasLen, 0)
+
+	volumes, err := s.m.ListVolumes()
+	c.Assert(err, IsNil)
+	c.Assert(volumes, HasLen, 1)
+
+	err = s.m.DeleteVolume(VolumeName)
+	c.Assert(err, IsNil)
+	volume, err = s.m.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume, IsNil)
+}
+
+func (s *TestSuite) TestUpdateVolumeConflict(c *C) {
+	volume := &types.VolumeInfo{
+		Name:             VolumeName,
+		Size:             8 * 1024 * 1024, // 8M
+		NumberOfReplicas: 3,
+		EngineImage:      TestEngineImage,
+	}
+	_, err := s.m.CreateVolume(volume)
+	c.Assert(err, IsNil)
+
+	v1, err := s.m.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	v2, err := s.m.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(v1.Revision, Not(Equals), int64(0))
+
+	v1.RecurringJobs = []*types.RecurringJob{{Name: "snap", Task: types.SnapshotTaskName, Cron: "* * * * *", Retain: 1}}
+	c.Assert(s.m.UpdateVolume(v1), IsNil)
+	v2.NumberOfReplicas = 2
+	err = s.m.UpdateVolume(v2)
+	c.Assert(types.IsConflict(err), Equals, true)
+
+	// replicas started at the same time on different hosts shouldn't lose
+	// each other's metadata
+	errs := make(chan error)
+	for _, name := range []string{Replica1Name, Replica2Name, Replica3Name} {
+		go func(name string) {
+			_, err := s.m.CreateReplica(VolumeName, name)
+			errs <- err
+		}(name)
+	}
+	for i := 0; i < 3; i++ {
+		c.Assert(<-errs, IsNil)
+	}
+	volume, err = s.m.GetVolume(VolumeName)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Replicas, HasLen, 3)
+	c.Assert(volume.RecurringJobs, HasLen, 1)
+}
@@ -0,0 +1,57 @@
+package orch
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// ReplicaFailureDomains are the host labels to spread the replicas of a
+// volume across
+var ReplicaFailureDomains = []string{types.HostLabelZone, types.HostLabelRack}
+
+// ValidateSchedulePolicyBinding accepts the supported bindings, empty means
+// the default one
+func ValidateSchedulePolicyBinding(binding types.SchedulePolicyBinding) error {
+	switch binding {
+	case "", types.SchedulePolicyBindingSoftAntiAffinity, types.SchedulePolicyBindingHardAntiAffinity:
+		return nil
+	}
+	return errors.Errorf("invalid schedule policy binding '%v', should be %v or %v", binding,
+		types.SchedulePolicyBindingSoftAntiAffinity, types.SchedulePolicyBindingHardAntiAffinity)
+}
+
+// ReplicaScheduleBinding returns the binding of the volume, or the one in
+// the settings if the volume doesn't have one
+func ReplicaScheduleBinding(volume *types.VolumeInfo, settings *types.SettingsInfo) types.SchedulePolicyBinding {
+	if volume.ReplicaSchedulePolicy != "" {
+		return volume.ReplicaSchedulePolicy
+	}
+	if settings != nil && settings.ReplicaSchedulePolicy != "" {
+		return settings.ReplicaSchedulePolicy
+	}
+	return types.SchedulePolicyBindingSoftAntiAffinity
+}
+
+// ReplicaSchedulePolicy keeps the new replica of the volume away from the
+// hosts and the failure domains of the good replicas, on a host matching the
+// selectors of the volume with enough space for it
+func ReplicaSchedulePolicy(volume *types.VolumeInfo, settings *types.SettingsInfo) *types.SchedulePolicy {
+	policy := &types.SchedulePolicy{
+		Binding:        ReplicaScheduleBinding(volume, settings),
+		HostIDMap:      map[string]struct{}{},
+		FailureDomains: ReplicaFailureDomains,
+		Size:           volume.Size,
+		HostSelector:   volume.HostSelector,
+		DiskSelector:   volume.DiskSelector,
+	}
+	if settings != nil {
+		policy.OverProvisioningPercentage = settings.StorageOverProvisioningPercentage
+	}
+	for _, replica := range volume.Replicas {
+		if replica.BadTimestamp.IsZero() {
+			policy.HostIDMap[replica.HostID] = struct{}{}
+		}
+	}
+	return policy
+}
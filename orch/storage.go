@@ -0,0 +1,76 @@
+package orch
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	StoragePathParam     = "storage-path"
+	StorageReservedParam = "storage-reserved"
+)
+
+// StorageReportPeriod is how often the managers report the storage of their
+// hosts
+var StorageReportPeriod = 30 * time.Second
+
+// StorageConfig is where the replicas keep the data on the current host, and
+// how much space of it is kept away from the replicas
+type StorageConfig struct {
+	Path     string
+	Reserved int64
+}
+
+// ParseStorageConfig reads the storage options, defaultPath is used if the
+// path isn't specified
+func ParseStorageConfig(c *cli.Context, defaultPath string) (*StorageConfig, error) {
+	cfg := &StorageConfig{
+		Path: c.String(StoragePathParam),
+	}
+	if cfg.Path == "" {
+		cfg.Path = defaultPath
+	}
+	if reserved := c.String(StorageReservedParam); reserved != "" {
+		size, err := util.ConvertSize(reserved)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %v %v", StorageReservedParam, reserved)
+		}
+		cfg.Reserved = size
+	}
+	return cfg, nil
+}
+
+// GetHostStorage reports the capacity of the filesystem of the replicas on
+// host, along with the size of the replicas scheduled on it
+func GetHostStorage(cfg *StorageConfig, hostID string, volumes []*types.VolumeInfo) (*types.HostStorage, error) {
+	total, available, err := util.GetDiskStat(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &types.HostStorage{
+		Total:     total,
+		Used:      total - available,
+		Reserved:  cfg.Reserved,
+		Scheduled: ScheduledStorage(hostID, volumes),
+		Updated:   util.Now(),
+	}, nil
+}
+
+// ScheduledStorage sums up the sizes of the replicas on host, the bad ones
+// included as they keep the data until removed
+func ScheduledStorage(hostID string, volumes []*types.VolumeInfo) int64 {
+	scheduled := int64(0)
+	for _, volume := range volumes {
+		for _, replica := range volume.Replicas {
+			if replica.HostID == hostID {
+				scheduled += volume.Size
+			}
+		}
+	}
+	return scheduled
+}
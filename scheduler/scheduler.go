@@ -1,19 +1,33 @@
 package scheduler
 
 import (
+	"sort"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
+	"github.com/rancher/longhorn-manager/orch"
 	"github.com/rancher/longhorn-manager/types"
 )
 
+// RemoteSchedule hands the schedule item over to the manager running on host
+type RemoteSchedule func(host *types.HostInfo, item *types.ScheduleItem) (*types.InstanceInfo, error)
+
 type OrcScheduler struct {
-	ops types.ScheduleOps
+	ops    types.ScheduleOps
+	remote RemoteSchedule
 }
 
 func NewOrcScheduler(ops types.ScheduleOps) *OrcScheduler {
+	return NewOrcSchedulerWithRemote(ops, func(host *types.HostInfo, item *types.ScheduleItem) (*types.InstanceInfo, error) {
+		return newSchedulerClient(host).Schedule(item)
+	})
+}
+
+func NewOrcSchedulerWithRemote(ops types.ScheduleOps, remote RemoteSchedule) *OrcScheduler {
 	return &OrcScheduler{
-		ops: ops,
+		ops:    ops,
+		remote: remote,
 	}
 }
 
@@ -39,18 +53,47 @@ func (s *OrcScheduler) Schedule(item *types.ScheduleItem, policy *types.Schedule
 		return nil, errors.Wrap(err, "fail to schedule")
 	}
 
+	ids := []string{}
+	for id, host := range hosts {
+		// nothing new goes to the hosts in maintenance or down
+		if host.Maintenance || !orch.IsHostUp(host) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if policy != nil && (len(policy.HostSelector) > 0 || len(policy.DiskSelector) > 0) {
+		ids = filterBySelector(hosts, policy, ids)
+		if len(ids) == 0 {
+			return nil, errors.Errorf("no host matches host selector %v and disk selector %v of volume %v",
+				policy.HostSelector, policy.DiskSelector, item.Instance.VolumeName)
+		}
+	}
+	if policy != nil && policy.Size > 0 {
+		ids = filterBySpace(hosts, policy, ids)
+		if len(ids) == 0 {
+			return nil, errors.Errorf("no host has enough space for %v bytes of volume %v",
+				policy.Size, item.Instance.VolumeName)
+		}
+	}
+
 	normalPriorityList := []string{}
 	lowPriorityList := []string{}
 
-	for id := range hosts {
+	for _, id := range ids {
 		if policy != nil {
-			if policy.Binding == types.SchedulePolicyBindingSoftAntiAffinity {
-				if _, ok := policy.HostIDMap[id]; ok {
+			_, occupied := policy.HostIDMap[id]
+			switch policy.Binding {
+			case types.SchedulePolicyBindingSoftAntiAffinity:
+				if occupied {
 					lowPriorityList = append(lowPriorityList, id)
 				} else {
 					normalPriorityList = append(normalPriorityList, id)
 				}
-			} else {
+			case types.SchedulePolicyBindingHardAntiAffinity:
+				if !occupied {
+					normalPriorityList = append(normalPriorityList, id)
+				}
+			default:
 				return nil, errors.Errorf("Unsupported schedule policy binding %v", policy.Binding)
 			}
 		} else {
@@ -58,7 +101,14 @@ func (s *OrcScheduler) Schedule(item *types.ScheduleItem, policy *types.Schedule
 		}
 	}
 
+	if policy != nil {
+		normalPriorityList = spreadFailureDomains(hosts, policy, normalPriorityList)
+	}
 	priorityList := append(normalPriorityList, lowPriorityList...)
+	if len(priorityList) == 0 && policy != nil && policy.Binding == types.SchedulePolicyBindingHardAntiAffinity {
+		return nil, errors.Errorf("unable to find a host without the instances of volume %v for %v",
+			item.Instance.VolumeName, policy.Binding)
+	}
 
 	for _, id := range priorityList {
 		ret, err := s.ScheduleProcess(&types.ScheduleSpec{HostID: id}, item)
@@ -72,6 +122,104 @@ func (s *OrcScheduler) Schedule(item *types.ScheduleItem, policy *types.Schedule
 	return nil, errors.Errorf("unable to find suitable host for scheduling")
 }
 
+// filterBySelector drops the hosts without the tags in the selectors
+func filterBySelector(hosts map[string]*types.HostInfo, policy *types.SchedulePolicy, ids []string) []string {
+	filtered := []string{}
+	for _, id := range ids {
+		if orch.MatchHost(hosts[id], policy.HostSelector, policy.DiskSelector) {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered
+}
+
+// DefaultOverProvisioningPercentage is used if the policy doesn't have one
+const DefaultOverProvisioningPercentage = 100
+
+// schedulableSpace is how much more can be scheduled to the host, -1 if the
+// storage of the host is unknown
+func schedulableSpace(host *types.HostInfo, policy *types.SchedulePolicy) int64 {
+	storage := host.Storage
+	if storage == nil {
+		return -1
+	}
+	percentage := policy.OverProvisioningPercentage
+	if percentage <= 0 {
+		percentage = DefaultOverProvisioningPercentage
+	}
+	if storage.Used+storage.Reserved >= storage.Total {
+		return 0
+	}
+	space := (storage.Total-storage.Reserved)*int64(percentage)/100 - storage.Scheduled
+	if space < 0 {
+		return 0
+	}
+	return space
+}
+
+// filterBySpace drops the hosts without enough space for policy.Size, and
+// orders the rest by the schedulable space, the most first. The hosts with
+// unknown storage are kept at the end.
+func filterBySpace(hosts map[string]*types.HostInfo, policy *types.SchedulePolicy, ids []string) []string {
+	spaces := map[string]int64{}
+	filtered := []string{}
+	for _, id := range ids {
+		space := schedulableSpace(hosts[id], policy)
+		if space >= 0 && space < policy.Size {
+			logrus.Debugf("Skip host %v for %v bytes, only %v bytes schedulable", id, policy.Size, space)
+			continue
+		}
+		spaces[id] = space
+		filtered = append(filtered, id)
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return spaces[filtered[i]] > spaces[filtered[j]]
+	})
+	return filtered
+}
+
+// spreadFailureDomains orders the hosts by the first failure domain already
+// used by the hosts in the policy, the hosts in the unused zones go first,
+// then the ones in the unused racks of the used zones, and so on. A host
+// without the label is in the same domain as the other hosts without it.
+func spreadFailureDomains(hosts map[string]*types.HostInfo, policy *types.SchedulePolicy, ids []string) []string {
+	if len(policy.FailureDomains) == 0 {
+		return ids
+	}
+	used := make([]map[string]struct{}, len(policy.FailureDomains))
+	for i := range used {
+		used[i] = map[string]struct{}{}
+	}
+	for id := range policy.HostIDMap {
+		host := hosts[id]
+		if host == nil {
+			continue
+		}
+		for i, label := range policy.FailureDomains {
+			used[i][host.Labels[label]] = struct{}{}
+		}
+	}
+
+	// ranks[i] has the hosts whose widest unused domain is FailureDomains[i]
+	ranks := make([][]string, len(policy.FailureDomains)+1)
+	for _, id := range ids {
+		rank := len(policy.FailureDomains)
+		for i, label := range policy.FailureDomains {
+			if _, ok := used[i][hosts[id].Labels[label]]; ok {
+				continue
+			}
+			rank = i
+			break
+		}
+		ranks[rank] = append(ranks[rank], id)
+	}
+	ordered := []string{}
+	for _, rank := range ranks {
+		ordered = append(ordered, rank...)
+	}
+	return ordered
+}
+
 func (s *OrcScheduler) ScheduleProcess(spec *types.ScheduleSpec, item *types.ScheduleItem) (*types.InstanceInfo, error) {
 	if s.ops.GetCurrentHostID() == spec.HostID {
 		return s.Process(spec, item)
@@ -81,8 +229,10 @@ func (s *OrcScheduler) ScheduleProcess(spec *types.ScheduleSpec, item *types.Sch
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot find host %v", spec.HostID)
 	}
-	client := newSchedulerClient(host)
-	ret, err := client.Schedule(item)
+	if !orch.IsHostUp(host) {
+		return nil, errors.Errorf("host %v(%v) is down", host.UUID, host.Name)
+	}
+	ret, err := s.remote(host, item)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Fail to schedule on host %v(%v %v)", host.UUID, host.Name, host.Address)
 	}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	DefaultBoltPath = "/var/lib/rancher/longhorn/longhorn.db"
+)
+
+var (
+	boltBucket = []byte("longhorn")
+
+	BoltOpenTimeout = 10 * time.Second
+)
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens the embedded database at path, creating it if needed.
+// Only one process can open the database at a time.
+func NewBoltStore(path string) (types.MetadataStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrapf(err, "fail to create directory for %v", path)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BoltOpenTimeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to open bolt database %v", path)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "fail to initialize bolt database %v", path)
+	}
+	return &boltStore{db: db}, nil
+}
+
+// Every value is stored with its revision in the first 8 bytes
+func decodeBoltPair(key, value []byte) (*types.KVPair, error) {
+	if len(value) < 8 {
+		return nil, errors.Errorf("invalid value of key %s in bolt database", key)
+	}
+	v := make([]byte, len(value)-8)
+	copy(v, value[8:])
+	return &types.KVPair{
+		Key:      string(key),
+		Value:    v,
+		Revision: int64(binary.BigEndian.Uint64(value[:8])),
+	}, nil
+}
+
+func (b *boltStore) Get(key string) (*types.KVPair, error) {
+	var pair *types.KVPair
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltBucket).Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		var err error
+		pair, err = decodeBoltPair([]byte(key), value)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to get key %v", key)
+	}
+	return pair, nil
+}
+
+// boltPut stores value with the next revision of the database
+func boltPut(bucket *bolt.Bucket, key string, value []byte) (int64, error) {
+	revision, err := bucket.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	v := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(v, revision)
+	copy(v[8:], value)
+	if err := bucket.Put([]byte(key), v); err != nil {
+		return 0, err
+	}
+	return int64(revision), nil
+}
+
+func (b *boltStore) Set(key string, value []byte) (int64, error) {
+	var revision int64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		revision, err = boltPut(tx.Bucket(boltBucket), key, value)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to set key %v", key)
+	}
+	return revision, nil
+}
+
+func (b *boltStore) CompareAndSet(key string, value []byte, revision int64) (int64, error) {
+	var newRevision int64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		var current int64
+		if v := bucket.Get([]byte(key)); v != nil {
+			pair, err := decodeBoltPair([]byte(key), v)
+			if err != nil {
+				return err
+			}
+			current = pair.Revision
+		}
+		if current != revision {
+			return &types.ConflictError{Key: key}
+		}
+		var err error
+		newRevision, err = boltPut(bucket, key, value)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to set key %v", key)
+	}
+	return newRevision, nil
+}
+
+func (b *boltStore) Delete(key string) error {
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	}); err != nil {
+		return errors.Wrapf(err, "fail to delete key %v", key)
+	}
+	return nil
+}
+
+func (b *boltStore) List(dir string) ([]*types.KVPair, error) {
+	prefix := []byte(dirPrefix(dir))
+	pairs := []*types.KVPair{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			pair, err := decodeBoltPair(k, v)
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, pair)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to list %v", dir)
+	}
+	return pairs, nil
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
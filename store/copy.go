@@ -0,0 +1,29 @@
+package store
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// Copy copies the keys under dir from one store to another, e.g. when moving
+// the metadata from etcd v2 API to v3, which keep separate keyspaces. The keys
+// already in the destination are kept, so copying again is harmless. It
+// returns the number of keys copied.
+func Copy(from, to types.MetadataStore, dir string) (int, error) {
+	pairs, err := from.List(dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to list %v", dir)
+	}
+	copied := 0
+	for _, pair := range pairs {
+		if _, err := to.CompareAndSet(pair.Key, pair.Value, 0); err != nil {
+			if types.IsConflict(err) {
+				continue
+			}
+			return copied, errors.Wrapf(err, "fail to copy key %v", pair.Key)
+		}
+		copied++
+	}
+	return copied, nil
+}
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	Etcd3RequestTimeout = 5 * time.Second
+)
+
+// etcd3Store talks to etcd v3 through its gRPC gateway, which serves the KV
+// API as JSON over HTTP on the client port, so no gRPC client is needed
+type etcd3Store struct {
+	endpoints  []string
+	apiPrefix  string
+	httpClient *http.Client
+}
+
+type etcd3KV struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcd3Header struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcd3RangeRequest struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end,omitempty"`
+}
+
+type etcd3RangeResponse struct {
+	Header etcd3Header `json:"header"`
+	KVs    []*etcd3KV  `json:"kvs"`
+}
+
+type etcd3PutRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type etcd3PutResponse struct {
+	Header etcd3Header `json:"header"`
+}
+
+// etcd3Compare compares the revision of the key. The revisions are members
+// of a oneof, etcd picks one at random or rejects the request if both are
+// set, so only the one of Target is set. A missing revision counts as 0.
+type etcd3Compare struct {
+	Key            string `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	ModRevision    int64  `json:"mod_revision,string,omitempty"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+}
+
+type etcd3RequestOp struct {
+	RequestPut *etcd3PutRequest `json:"request_put,omitempty"`
+}
+
+type etcd3TxnRequest struct {
+	Compare []*etcd3Compare   `json:"compare"`
+	Success []*etcd3RequestOp `json:"success"`
+}
+
+type etcd3TxnResponse struct {
+	Header    etcd3Header `json:"header"`
+	Succeeded bool        `json:"succeeded"`
+}
+
+// NewEtcd3Store connects to the etcd v3 cluster at endpoints, e.g.
+// http://etcd1:2379
+func NewEtcd3Store(endpoints []string) (types.MetadataStore, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("unspecified etcd servers")
+	}
+	s := &etcd3Store{
+		httpClient: &http.Client{Timeout: Etcd3RequestTimeout},
+	}
+	for _, e := range endpoints {
+		s.endpoints = append(s.endpoints, strings.TrimSuffix(e, "/"))
+	}
+	version, err := s.serverVersion()
+	if err != nil {
+		return nil, err
+	}
+	s.apiPrefix = etcd3APIPrefix(version)
+	logrus.Infof("Connected to etcd %v, using API %v", version, s.apiPrefix)
+	return s, nil
+}
+
+// etcd3APIPrefix returns the path of the gateway, which changed between the
+// etcd releases
+func etcd3APIPrefix(version string) string {
+	switch {
+	case strings.HasPrefix(version, "3.0.") || strings.HasPrefix(version, "3.1.") || strings.HasPrefix(version, "3.2."):
+		return "/v3alpha"
+	case strings.HasPrefix(version, "3.3."):
+		return "/v3beta"
+	}
+	return "/v3"
+}
+
+func (s *etcd3Store) serverVersion() (string, error) {
+	version := struct {
+		Server string `json:"etcdserver"`
+	}{}
+	if err := s.do("GET", "/version", nil, &version); err != nil {
+		return "", errors.Wrap(err, "fail to get etcd version")
+	}
+	if !strings.HasPrefix(version.Server, "3.") {
+		return "", errors.Errorf("etcd server version %v doesn't support v3 API", version.Server)
+	}
+	return version.Server, nil
+}
+
+func encodeKey(key string) string {
+	return base64.StdEncoding.EncodeToString([]byte(key))
+}
+
+// prefixRangeEnd returns the end of the range covering all the keys starting
+// with prefix
+func prefixRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return base64.StdEncoding.EncodeToString(end[:i+1])
+		}
+	}
+	// all the keys after prefix
+	return base64.StdEncoding.EncodeToString([]byte{0})
+}
+
+func decodeEtcd3KV(kv *etcd3KV) (*types.KVPair, error) {
+	key, err := base64.StdEncoding.DecodeString(kv.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key %v", kv.Key)
+	}
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid value of key %s", key)
+	}
+	return &types.KVPair{
+		Key:      string(key),
+		Value:    value,
+		Revision: kv.ModRevision,
+	}, nil
+}
+
+func (s *etcd3Store) Get(key string) (*types.KVPair, error) {
+	resp := &etcd3RangeResponse{}
+	if err := s.do("POST", s.apiPrefix+"/kv/range", &etcd3RangeRequest{
+		Key: encodeKey(key),
+	}, resp); err != nil {
+		return nil, errors.Wrapf(err, "fail to get key %v", key)
+	}
+	if len(resp.KVs) == 0 {
+		return nil, nil
+	}
+	return decodeEtcd3KV(resp.KVs[0])
+}
+
+func (s *etcd3Store) Set(key string, value []byte) (int64, error) {
+	resp := &etcd3PutResponse{}
+	if err := s.do("POST", s.apiPrefix+"/kv/put", &etcd3PutRequest{
+		Key:   encodeKey(key),
+		Value: base64.StdEncoding.EncodeToString(value),
+	}, resp); err != nil {
+		return 0, errors.Wrapf(err, "fail to set key %v", key)
+	}
+	return resp.Header.Revision, nil
+}
+
+func (s *etcd3Store) CompareAndSet(key string, value []byte, revision int64) (int64, error) {
+	compare := &etcd3Compare{
+		Key:         encodeKey(key),
+		Target:      "MOD",
+		Result:      "EQUAL",
+		ModRevision: revision,
+	}
+	if revision == 0 {
+		// the key doesn't exist
+		compare.Target = "CREATE"
+	}
+	resp := &etcd3TxnResponse{}
+	if err := s.do("POST", s.apiPrefix+"/kv/txn", &etcd3TxnRequest{
+		Compare: []*etcd3Compare{compare},
+		Success: []*etcd3RequestOp{{
+			RequestPut: &etcd3PutRequest{
+				Key:   encodeKey(key),
+				Value: base64.StdEncoding.EncodeToString(value),
+			},
+		}},
+	}, resp); err != nil {
+		return 0, errors.Wrapf(err, "fail to set key %v", key)
+	}
+	if !resp.Succeeded {
+		return 0, &types.ConflictError{Key: key}
+	}
+	return resp.Header.Revision, nil
+}
+
+func (s *etcd3Store) Delete(key string) error {
+	if err := s.do("POST", s.apiPrefix+"/kv/deleterange", &etcd3RangeRequest{
+		Key: encodeKey(key),
+	}, nil); err != nil {
+		return errors.Wrapf(err, "fail to delete key %v", key)
+	}
+	return nil
+}
+
+func (s *etcd3Store) List(dir string) ([]*types.KVPair, error) {
+	prefix := dirPrefix(dir)
+	resp := &etcd3RangeResponse{}
+	if err := s.do("POST", s.apiPrefix+"/kv/range", &etcd3RangeRequest{
+		Key:      encodeKey(prefix),
+		RangeEnd: prefixRangeEnd(prefix),
+	}, resp); err != nil {
+		return nil, errors.Wrapf(err, "fail to list %v", dir)
+	}
+	pairs := []*types.KVPair{}
+	for _, kv := range resp.KVs {
+		pair, err := decodeEtcd3KV(kv)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+func (s *etcd3Store) Close() error {
+	return nil
+}
+
+// do sends the request to the endpoints in turn, until one of them responds
+func (s *etcd3Store) do(method, path string, input, output interface{}) error {
+	var body []byte
+	if input != nil {
+		var err error
+		if body, err = json.Marshal(input); err != nil {
+			return err
+		}
+	}
+
+	var lastErr error
+	for _, endpoint := range s.endpoints {
+		req, err := http.NewRequest(method, endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			logrus.Debugf("etcd endpoint %v failed: %v", endpoint, err)
+			lastErr = err
+			continue
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrapf(err, "fail to read response of %v %v", method, endpoint+path)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("error response of %v %v: %v %s",
+				method, endpoint+path, resp.StatusCode, bytes.TrimSpace(content))
+		}
+		if output == nil {
+			return nil
+		}
+		if err := json.Unmarshal(content, output); err != nil {
+			return errors.Wrapf(err, "fail to decode response of %v %v", method, endpoint+path)
+		}
+		return nil
+	}
+	return errors.Wrap(lastErr, "no etcd endpoint available")
+}
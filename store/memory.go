@@ -0,0 +1,91 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+type memoryStore struct {
+	sync.Mutex
+
+	pairs    map[string]*types.KVPair
+	revision int64
+}
+
+// NewMemoryStore returns a store which keeps everything in memory, it's only
+// useful for testing and single node experiments
+func NewMemoryStore() types.MetadataStore {
+	return &memoryStore{pairs: map[string]*types.KVPair{}}
+}
+
+// dirPrefix returns the prefix of all the keys under dir
+func dirPrefix(dir string) string {
+	return strings.TrimSuffix(dir, "/") + "/"
+}
+
+func copyPair(p *types.KVPair) *types.KVPair {
+	value := make([]byte, len(p.Value))
+	copy(value, p.Value)
+	return &types.KVPair{Key: p.Key, Value: value, Revision: p.Revision}
+}
+
+func (m *memoryStore) Get(key string) (*types.KVPair, error) {
+	m.Lock()
+	defer m.Unlock()
+	p := m.pairs[key]
+	if p == nil {
+		return nil, nil
+	}
+	return copyPair(p), nil
+}
+
+func (m *memoryStore) Set(key string, value []byte) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.revision++
+	m.pairs[key] = copyPair(&types.KVPair{Key: key, Value: value, Revision: m.revision})
+	return m.revision, nil
+}
+
+func (m *memoryStore) CompareAndSet(key string, value []byte, revision int64) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	var current int64
+	if p := m.pairs[key]; p != nil {
+		current = p.Revision
+	}
+	if current != revision {
+		return 0, &types.ConflictError{Key: key}
+	}
+	m.revision++
+	m.pairs[key] = copyPair(&types.KVPair{Key: key, Value: value, Revision: m.revision})
+	return m.revision, nil
+}
+
+func (m *memoryStore) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.pairs, key)
+	return nil
+}
+
+func (m *memoryStore) List(dir string) ([]*types.KVPair, error) {
+	m.Lock()
+	defer m.Unlock()
+	prefix := dirPrefix(dir)
+	pairs := []*types.KVPair{}
+	for key, p := range m.pairs {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, copyPair(p))
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,306 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	EnvEtcdServer = "LONGHORN_MANAGER_TEST_ETCD_SERVER"
+)
+
+func testStore(t *testing.T, s types.MetadataStore) {
+	assert := require.New(t)
+
+	pair, err := s.Get("/longhorn/volumes/vol1")
+	assert.Nil(err)
+	assert.Nil(pair)
+
+	pairs, err := s.List("/longhorn/volumes")
+	assert.Nil(err)
+	assert.Len(pairs, 0)
+
+	rev1, err := s.Set("/longhorn/volumes/vol1", []byte("v1"))
+	assert.Nil(err)
+	rev2, err := s.Set("/longhorn/volumes/vol2", []byte("v2"))
+	assert.Nil(err)
+	assert.True(rev2 > rev1)
+	_, err = s.Set("/longhorn/volumesx", []byte("other"))
+	assert.Nil(err)
+	_, err = s.Set("/longhorn/settings", []byte("settings"))
+	assert.Nil(err)
+
+	pair, err = s.Get("/longhorn/volumes/vol1")
+	assert.Nil(err)
+	assert.Equal("/longhorn/volumes/vol1", pair.Key)
+	assert.Equal([]byte("v1"), pair.Value)
+	assert.Equal(rev1, pair.Revision)
+
+	rev3, err := s.Set("/longhorn/volumes/vol1", []byte("v1-updated"))
+	assert.Nil(err)
+	assert.True(rev3 > rev2)
+	pair, err = s.Get("/longhorn/volumes/vol1")
+	assert.Nil(err)
+	assert.Equal([]byte("v1-updated"), pair.Value)
+	assert.Equal(rev3, pair.Revision)
+
+	pairs, err = s.List("/longhorn/volumes/")
+	assert.Nil(err)
+	assert.Len(pairs, 2)
+	assert.Equal("/longhorn/volumes/vol1", pairs[0].Key)
+	assert.Equal(rev3, pairs[0].Revision)
+	assert.Equal("/longhorn/volumes/vol2", pairs[1].Key)
+	assert.Equal([]byte("v2"), pairs[1].Value)
+
+	_, err = s.CompareAndSet("/longhorn/volumes/vol1", []byte("stale"), rev1)
+	assert.True(types.IsConflict(err))
+	_, err = s.CompareAndSet("/longhorn/volumes/vol1", []byte("new"), 0)
+	assert.True(types.IsConflict(err))
+	rev4, err := s.CompareAndSet("/longhorn/volumes/vol1", []byte("v1-cas"), rev3)
+	assert.Nil(err)
+	assert.True(rev4 > rev3)
+	pair, err = s.Get("/longhorn/volumes/vol1")
+	assert.Nil(err)
+	assert.Equal([]byte("v1-cas"), pair.Value)
+	assert.Equal(rev4, pair.Revision)
+
+	_, err = s.CompareAndSet("/longhorn/volumes/vol3", []byte("v3"), rev4)
+	assert.True(types.IsConflict(err))
+	rev5, err := s.CompareAndSet("/longhorn/volumes/vol3", []byte("v3"), 0)
+	assert.Nil(err)
+	assert.True(rev5 > rev4)
+	assert.Nil(s.Delete("/longhorn/volumes/vol3"))
+
+	assert.Nil(s.Delete("/longhorn/volumes/vol1"))
+	assert.Nil(s.Delete("/longhorn/volumes/vol1"))
+	pair, err = s.Get("/longhorn/volumes/vol1")
+	assert.Nil(err)
+	assert.Nil(pair)
+	pairs, err = s.List("/longhorn/volumes")
+	assert.Nil(err)
+	assert.Len(pairs, 1)
+
+	assert.Nil(s.Close())
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "longhorn-store")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db", "longhorn.db")
+
+	s, err := NewBoltStore(path)
+	assert.Nil(err)
+	testStore(t, s)
+
+	// the metadata survives restart
+	s, err = NewBoltStore(path)
+	assert.Nil(err)
+	defer s.Close()
+	pair, err := s.Get("/longhorn/volumes/vol2")
+	assert.Nil(err)
+	assert.Equal([]byte("v2"), pair.Value)
+	rev, err := s.Set("/longhorn/volumes/vol3", []byte("v3"))
+	assert.Nil(err)
+	assert.True(rev > pair.Revision)
+}
+
+// fakeEtcd3Gateway serves the subset of the etcd v3 JSON gateway used by the
+// store
+type fakeEtcd3Gateway struct {
+	sync.Mutex
+
+	version  string
+	kvs      map[string]*etcd3KV
+	revision int64
+}
+
+func (f *fakeEtcd3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.URL.Path == "/version" {
+		json.NewEncoder(w).Encode(map[string]string{"etcdserver": f.version, "etcdcluster": f.version})
+		return
+	}
+	req := struct {
+		Key      string `json:"key"`
+		RangeEnd string `json:"range_end"`
+		Value    string `json:"value"`
+
+		Compare []map[string]string `json:"compare"`
+		Success []*etcd3RequestOp   `json:"success"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, _ := base64.StdEncoding.DecodeString(req.Key)
+	end, _ := base64.StdEncoding.DecodeString(req.RangeEnd)
+	header := map[string]string{"revision": strconv.FormatInt(f.revision, 10)}
+
+	switch r.URL.Path {
+	case "/v3beta/kv/range":
+		kvs := []*etcd3KV{}
+		for k, kv := range f.kvs {
+			if k == string(key) || len(end) != 0 && k >= string(key) && k < string(end) {
+				kvs = append(kvs, kv)
+			}
+		}
+		sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+		resp := map[string]interface{}{"header": header}
+		// empty result has no kvs, like the real gateway
+		if len(kvs) != 0 {
+			resp["kvs"] = kvs
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/v3beta/kv/put":
+		f.revision++
+		f.kvs[string(key)] = &etcd3KV{Key: req.Key, Value: req.Value, ModRevision: f.revision}
+		header["revision"] = strconv.FormatInt(f.revision, 10)
+		json.NewEncoder(w).Encode(map[string]interface{}{"header": header})
+	case "/v3beta/kv/txn":
+		// only the single comparison of the revision is supported
+		cmp := req.Compare[0]
+		_, hasMod := cmp["mod_revision"]
+		_, hasCreate := cmp["create_revision"]
+		if hasMod && hasCreate {
+			// the revisions are members of a oneof
+			http.Error(w, "target_union has more than one member set", http.StatusBadRequest)
+			return
+		}
+		key, _ := base64.StdEncoding.DecodeString(cmp["key"])
+		kv := f.kvs[string(key)]
+		// a missing revision counts as 0
+		modRevision, _ := strconv.ParseInt(cmp["mod_revision"], 10, 64)
+		createRevision, _ := strconv.ParseInt(cmp["create_revision"], 10, 64)
+		succeeded := false
+		switch cmp["target"] {
+		case "MOD":
+			succeeded = kv != nil && kv.ModRevision == modRevision
+		case "CREATE":
+			succeeded = kv == nil && createRevision == 0
+		}
+		if succeeded {
+			put := req.Success[0].RequestPut
+			f.revision++
+			f.kvs[string(key)] = &etcd3KV{Key: put.Key, Value: put.Value, ModRevision: f.revision}
+			header["revision"] = strconv.FormatInt(f.revision, 10)
+		}
+		resp := map[string]interface{}{"header": header}
+		if succeeded {
+			resp["succeeded"] = true
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/v3beta/kv/deleterange":
+		if f.kvs[string(key)] != nil {
+			f.revision++
+			delete(f.kvs, string(key))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"header": header})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcd3Store(t *testing.T) {
+	assert := require.New(t)
+
+	gateway := &fakeEtcd3Gateway{version: "3.3.1", kvs: map[string]*etcd3KV{}}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	_, err := NewEtcd3Store(nil)
+	assert.NotNil(err)
+
+	// the first endpoint is down
+	s, err := NewEtcd3Store([]string{"http://127.0.0.1:1", server.URL + "/"})
+	assert.Nil(err)
+	testStore(t, s)
+
+	gateway.version = "2.3.8"
+	_, err = NewEtcd3Store([]string{server.URL})
+	assert.NotNil(err)
+}
+
+// TestEtcd3StoreServer runs against the etcd server started by
+// scripts/heavy-test, the fake gateway can't tell if the requests are encoded
+// the way etcd expects
+func TestEtcd3StoreServer(t *testing.T) {
+	assert := require.New(t)
+
+	etcdIP := os.Getenv(EnvEtcdServer)
+	if etcdIP == "" {
+		t.Skipf("%v not set", EnvEtcdServer)
+	}
+	s, err := NewEtcd3Store([]string{"http://" + etcdIP + ":2379"})
+	assert.Nil(err)
+	// the keys left by the last run
+	for _, key := range []string{"/longhorn/volumes/vol1", "/longhorn/volumes/vol2", "/longhorn/volumes/vol3", "/longhorn/volumesx", "/longhorn/settings"} {
+		assert.Nil(s.Delete(key))
+	}
+	testStore(t, s)
+}
+
+func TestCopy(t *testing.T) {
+	assert := require.New(t)
+
+	from := NewMemoryStore()
+	to := NewMemoryStore()
+	_, err := from.Set("/longhorn/volumes/vol1", []byte("v1"))
+	assert.Nil(err)
+	_, err = from.Set("/longhorn/hosts/host1", []byte("host1"))
+	assert.Nil(err)
+	_, err = from.Set("/other/key", []byte("other"))
+	assert.Nil(err)
+	_, err = to.Set("/longhorn/hosts/host1", []byte("host1-updated"))
+	assert.Nil(err)
+
+	copied, err := Copy(from, to, "/longhorn")
+	assert.Nil(err)
+	assert.Equal(1, copied)
+	pair, err := to.Get("/longhorn/volumes/vol1")
+	assert.Nil(err)
+	assert.Equal([]byte("v1"), pair.Value)
+	pair, err = to.Get("/longhorn/hosts/host1")
+	assert.Nil(err)
+	assert.Equal([]byte("host1-updated"), pair.Value)
+	pair, err = to.Get("/other/key")
+	assert.Nil(err)
+	assert.Nil(pair)
+
+	copied, err = Copy(from, to, "/longhorn")
+	assert.Nil(err)
+	assert.Equal(0, copied)
+}
+
+func TestEtcd3APIPrefix(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("/v3alpha", etcd3APIPrefix("3.2.18"))
+	assert.Equal("/v3beta", etcd3APIPrefix("3.3.1"))
+	assert.Equal("/v3", etcd3APIPrefix("3.4.0"))
+	assert.Equal("/v3", etcd3APIPrefix("3.10.1"))
+
+	assert.Equal(base64.StdEncoding.EncodeToString([]byte("/a0")), prefixRangeEnd("/a/"))
+	assert.Equal(base64.StdEncoding.EncodeToString([]byte("b")), prefixRangeEnd("a\xff"))
+}
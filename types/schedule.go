@@ -12,6 +12,7 @@ type SchedulePolicyBinding string
 
 const (
 	SchedulePolicyBindingSoftAntiAffinity = "soft.anti-affinity"
+	SchedulePolicyBindingHardAntiAffinity = "hard.anti-affinity"
 )
 
 type Scheduler interface {
@@ -51,4 +52,20 @@ type ScheduleData struct {
 type SchedulePolicy struct {
 	Binding   SchedulePolicyBinding
 	HostIDMap map[string]struct{}
+
+	// FailureDomains are the host labels to spread the instances across,
+	// from the widest domain, e.g. zone then rack. The hosts in the domains
+	// without any host in HostIDMap are preferred.
+	FailureDomains []string
+
+	// Size is the storage needed on the host, the hosts without enough
+	// space are skipped. OverProvisioningPercentage is how much of the
+	// storage of a host can be scheduled, 100 if 0.
+	Size                       int64
+	OverProvisioningPercentage int
+
+	// HostSelector and DiskSelector are the tags the host and its disk
+	// must have
+	HostSelector []string
+	DiskSelector []string
 }
@@ -1,19 +1,40 @@
 package types
 
 import (
+	"fmt"
 	"io"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type VolumeState string
 
 const (
-	VolumeStateNone     = VolumeState("")
-	VolumeStateCreated  = VolumeState("created")
-	VolumeStateDetached = VolumeState("detached")
-	VolumeStateFaulted  = VolumeState("faulted")
-	VolumeStateHealthy  = VolumeState("healthy")
-	VolumeStateDegraded = VolumeState("degraded")
+	VolumeStateNone      = VolumeState("")
+	VolumeStateCreated   = VolumeState("created")
+	VolumeStateDetached  = VolumeState("detached")
+	VolumeStateFaulted   = VolumeState("faulted")
+	VolumeStateHealthy   = VolumeState("healthy")
+	VolumeStateDegraded  = VolumeState("degraded")
+	VolumeStateRestoring = VolumeState("restoring")
+)
+
+type EngineUpgradeState string
+
+const (
+	EngineUpgradeStateUpgrading  = EngineUpgradeState("upgrading")
+	EngineUpgradeStateCompleted  = EngineUpgradeState("completed")
+	EngineUpgradeStateRolledBack = EngineUpgradeState("rolledBack")
+	EngineUpgradeStateFailed     = EngineUpgradeState("failed")
+)
+
+type RestoreState string
+
+const (
+	RestoreStateRestoring = RestoreState("restoring")
+	RestoreStateCompleted = RestoreState("completed")
+	RestoreStateFailed    = RestoreState("failed")
 )
 
 type ReplicaMode string
@@ -33,7 +54,9 @@ const (
 )
 
 type VolumeManager interface {
-	Start() error
+	// Start resumes monitoring the volumes, and watches the hosts and the
+	// backup targets until stopCh is closed
+	Start(stopCh <-chan struct{}) error
 	Create(volume *VolumeInfo) (*VolumeInfo, error)
 	Delete(name string) error
 	Get(name string) (*VolumeInfo, error)
@@ -41,10 +64,19 @@ type VolumeManager interface {
 	Attach(name string) error
 	Detach(name string) error
 	UpdateRecurring(name string, jobs []*RecurringJob) error
+	Expand(name string, size int64) error
+	RestoreBackup(name, backupURL string) error
+	UpdateReplicaCount(name string, count int) error
+	EngineUpgrade(name, image string) error
+	EngineUpgradeDetached(image string) error
 	ReplicaRemove(volumeName, replicaName string) error
 
 	ListHosts() (map[string]*HostInfo, error)
 	GetHost(id string) (*HostInfo, error)
+	UpdateHostLabels(id string, labels map[string]string) (*HostInfo, error)
+	UpdateHostTags(id string, tags, diskTags []string) (*HostInfo, error)
+	UpdateHostMaintenance(id string, maintenance bool) (*HostInfo, error)
+	EvictHost(id string) error
 
 	CheckController(ctrl Controller, volume *VolumeInfo) error
 	Cleanup(volume *VolumeInfo) error
@@ -53,7 +85,12 @@ type VolumeManager interface {
 	SnapshotOps(name string) (SnapshotOps, error)
 	VolumeBackupOps(name string) (VolumeBackupOps, error)
 	Settings() Settings
-	ManagerBackupOps(backupTarget string) ManagerBackupOps
+	Credentials() Credentials
+	BackupTargetEnv(target *BackupTarget) ([]string, error)
+	ManagerBackupOps(target *BackupTarget) (ManagerBackupOps, error)
+	CheckBackupTarget(target *BackupTarget) error
+	ListBackupTargetStatus() ([]*BackupTargetStatus, error)
+	GetBackupTargetStatus(name string) (*BackupTargetStatus, error)
 
 	ProcessSchedule(spec *ScheduleSpec, item *ScheduleItem) (*InstanceInfo, error)
 }
@@ -63,6 +100,15 @@ type Settings interface {
 	SetSettings(*SettingsInfo) error
 }
 
+// Credentials keeps the credentials of the backup targets as they are given,
+// the values are supposed to be encrypted by the callers
+type Credentials interface {
+	ListCredentials() (map[string]*CredentialInfo, error)
+	GetCredential(name string) (*CredentialInfo, error) // For non-existing credential, return (nil, nil)
+	SetCredential(credential *CredentialInfo) error
+	DeleteCredential(name string) error // Deleting non-existing credential is not an error
+}
+
 type SnapshotOps interface {
 	Create(name string, labels map[string]string) (string, error)
 	List() ([]*SnapshotInfo, error)
@@ -72,13 +118,17 @@ type SnapshotOps interface {
 	Purge() error
 }
 
+// VolumeBackupOps runs the backup commands with env, which carries the
+// credential of the backup target
 type VolumeBackupOps interface {
-	StartBackup(snapName, backupTarget string) error
-	Restore(backup string) error
-	DeleteBackup(backup string) error
+	StartBackup(snapName, backupTarget string, env []string) error
+	// Backup backs up the snapshot right away, and returns the backup URL
+	Backup(snapName, backupTarget string, env []string) (string, error)
+	Restore(backup string, env []string) error
+	DeleteBackup(backup string, env []string) error
 }
 
-type GetManagerBackupOps func(backupTarget string) ManagerBackupOps
+type GetManagerBackupOps func(backupTarget string, env []string) ManagerBackupOps
 
 type ManagerBackupOps interface {
 	List(volumeName string) ([]*BackupInfo, error)
@@ -87,6 +137,9 @@ type ManagerBackupOps interface {
 
 	ListVolumes() ([]*BackupVolumeInfo, error)
 	GetVolume(volumeName string) (*BackupVolumeInfo, error)
+
+	// Check fails if the backup target cannot be reached
+	Check() error
 }
 
 type Event interface{}
@@ -94,6 +147,8 @@ type Event interface{}
 type Monitor interface {
 	io.Closer
 	CronCh() chan<- Event
+	// Wait waits for the monitor to stop after it's closed
+	Wait()
 }
 
 type BeginMonitoring func(volume *VolumeInfo, man VolumeManager) Monitor
@@ -106,6 +161,10 @@ type Controller interface {
 	GetReplicaStates() ([]*ReplicaInfo, error)
 	AddReplica(replica *ReplicaInfo) error
 	RemoveReplica(replica *ReplicaInfo) error
+	Expand(size int64) error
+	// RebuildStatus returns the progress of the replicas at the addresses
+	// being rebuilt, keyed by the address
+	RebuildStatus(addresses []string) (map[string]*RebuildStatus, error)
 
 	BgTaskQueue() TaskQueue
 	LatestBgTasks() []*BgTask
@@ -114,13 +173,22 @@ type Controller interface {
 	BackupOps() VolumeBackupOps
 }
 
+// EngineCLI runs the longhorn engine command line, returning its stdout
+type EngineCLI interface {
+	Execute(args ...string) (string, error)
+	ExecuteWithTimeout(timeout time.Duration, args ...string) (string, error)
+	// WithEnv returns the EngineCLI running the commands with the extra
+	// environment variables, in the form of "key=value"
+	WithEnv(env []string) EngineCLI
+}
+
 type Orchestrator interface {
 	CreateVolume(volume *VolumeInfo) (*VolumeInfo, error) // creates volume metadata and prepare for volume
 	DeleteVolume(volumeName string) error                 // removes volume metadata
 	GetVolume(volumeName string) (*VolumeInfo, error)     // For non-existing volume, return (nil, nil)
 	ListVolumes() ([]*VolumeInfo, error)
 	MarkBadReplica(volumeName string, replica *ReplicaInfo) error // find replica by Address
-	UpdateVolume(volume *VolumeInfo) error
+	UpdateVolume(volume *VolumeInfo) error                        // fails with ConflictError if volume.Revision is not the latest
 
 	CreateController(volumeName, controllerName string, replicas map[string]*ReplicaInfo) (*ControllerInfo, error)
 	CreateReplica(volumeName, replicaName string) (*ReplicaInfo, error)
@@ -131,11 +199,72 @@ type Orchestrator interface {
 
 	ListHosts() (map[string]*HostInfo, error)
 	GetHost(id string) (*HostInfo, error)
+	UpdateHostLabels(id string, labels map[string]string) (*HostInfo, error)
+	UpdateHostTags(id string, tags, diskTags []string) (*HostInfo, error)
+	// UpdateHostMaintenance and UpdateHostEviction only update the host if
+	// check, when given, passes on the host in the store, so the eviction
+	// state can guard them
+	UpdateHostMaintenance(id string, maintenance bool, check func(host *HostInfo) error) (*HostInfo, error)
+	UpdateHostEviction(id string, eviction *EvictionInfo, check func(host *HostInfo) error) error
 
 	Scheduler() Scheduler // return nil if not supported
 
 	ServiceLocator
 	Settings
+	Credentials
+}
+
+// MetadataStore keeps values under hierarchical keys like
+// "/longhorn/volumes/vol1". Every change gets a new revision, which only
+// grows within a store.
+type MetadataStore interface {
+	io.Closer
+
+	Get(key string) (*KVPair, error)             // For non-existing key, return (nil, nil)
+	Set(key string, value []byte) (int64, error) // Return the new revision
+	Delete(key string) error                     // Deleting non-existing key is not an error
+	List(dir string) ([]*KVPair, error)          // All the keys under dir, sorted by key
+
+	// CompareAndSet only sets the value if the key is still at revision,
+	// or doesn't exist if revision is 0. Otherwise it fails with
+	// ConflictError.
+	CompareAndSet(key string, value []byte, revision int64) (int64, error)
+}
+
+type KVPair struct {
+	Key      string
+	Value    []byte
+	Revision int64
+}
+
+// ConflictError means the metadata has been changed by someone else since it
+// was read
+type ConflictError struct {
+	Key string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict: %v has been modified", e.Key)
+}
+
+func IsConflict(err error) bool {
+	_, ok := errors.Cause(err).(*ConflictError)
+	return ok
+}
+
+// UnsupportedError means the engine of the volume cannot do the operation,
+// e.g. it's older than the operation
+type UnsupportedError struct {
+	Operation string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported: the engine cannot %v", e.Operation)
+}
+
+func IsUnsupported(err error) bool {
+	_, ok := errors.Cause(err).(*UnsupportedError)
+	return ok
 }
 
 type ServiceLocator interface {
@@ -144,24 +273,183 @@ type ServiceLocator interface {
 }
 
 type SettingsInfo struct {
+	// BackupTarget is the URL of the default backup target
 	BackupTarget string `json:"backupTarget" mapstructure:"backupTarget"`
 	EngineImage  string `json:"engineImage" mapstructure:"engineImage"`
+
+	// BackupTargetCredential is the name of the credential of the default
+	// backup target, which is also passed to the engine containers
+	BackupTargetCredential string `json:"backupTargetCredential,omitempty" mapstructure:"backupTargetCredential"`
+
+	// BackupTargets are the named backup targets besides the default one
+	BackupTargets []*BackupTarget `json:"backupTargets,omitempty" mapstructure:"backupTargets"`
+
+	// ReplicaSchedulePolicy is the anti-affinity of the replicas of the
+	// volumes that don't have their own, soft.anti-affinity if empty
+	ReplicaSchedulePolicy SchedulePolicyBinding `json:"replicaSchedulePolicy" mapstructure:"replicaSchedulePolicy"`
+
+	// StorageOverProvisioningPercentage is how much of the storage of a
+	// host can be scheduled to the replicas, 100 if 0
+	StorageOverProvisioningPercentage int `json:"storageOverProvisioningPercentage" mapstructure:"storageOverProvisioningPercentage"`
+}
+
+// DefaultBackupTargetName is the name of the target of the backupTarget
+// setting
+const DefaultBackupTargetName = "default"
+
+// BackupTarget is a named destination of the backups, e.g. nfs-local or
+// s3-offsite
+type BackupTarget struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+
+	// Credential is the name of the credential to access the target, none
+	// if empty
+	Credential string `json:"credential,omitempty"`
+}
+
+// ListBackupTargets returns the default backup target if it's set, followed
+// by the named ones
+func (s *SettingsInfo) ListBackupTargets() []*BackupTarget {
+	targets := []*BackupTarget{}
+	if s.BackupTarget != "" {
+		targets = append(targets, s.defaultBackupTarget())
+	}
+	return append(targets, s.BackupTargets...)
+}
+
+func (s *SettingsInfo) defaultBackupTarget() *BackupTarget {
+	return &BackupTarget{Name: DefaultBackupTargetName, URL: s.BackupTarget, Credential: s.BackupTargetCredential}
+}
+
+// GetBackupTarget returns the backup target by name, the default one if the
+// name is empty
+func (s *SettingsInfo) GetBackupTarget(name string) (*BackupTarget, error) {
+	if name == "" || name == DefaultBackupTargetName {
+		if s.BackupTarget == "" {
+			return nil, errors.New("backupTarget not set")
+		}
+		return s.defaultBackupTarget(), nil
+	}
+	for _, target := range s.BackupTargets {
+		if target.Name == name {
+			return target, nil
+		}
+	}
+	return nil, errors.Errorf("cannot find backup target '%s'", name)
+}
+
+// BackupTargetStatus is the result of the last connectivity check of the
+// backup target
+type BackupTargetStatus struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Available   bool   `json:"available"`
+	LastChecked string `json:"lastChecked"`
+	Message     string `json:"message"`
+}
+
+// CredentialInfo is a set of environment variables for accessing a backup
+// target, e.g. AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY for s3. The values
+// are encrypted in the metadata store.
+type CredentialInfo struct {
+	Name   string            `json:"name"`
+	Values map[string]string `json:"values"`
 }
 
 type VolumeInfo struct {
-	Name                string
-	Size                int64
-	BaseImage           string
-	FromBackup          string
-	NumberOfReplicas    int
-	StaleReplicaTimeout time.Duration
-	Controller          *ControllerInfo
-	Replicas            map[string]*ReplicaInfo //key is replicaName
-	State               VolumeState
-	EngineImage         string
-	Endpoint            string
-	Created             string
-	RecurringJobs       []*RecurringJob
+	Name                  string
+	Size                  int64
+	BaseImage             string
+	FromBackup            string
+	FromVolume            string
+	FromSnapshot          string
+	NumberOfReplicas      int
+	StaleReplicaTimeout   time.Duration
+	ReplicaSchedulePolicy SchedulePolicyBinding
+	HostSelector          []string // tags the hosts of the replicas must have
+	DiskSelector          []string // tags the disks of the replicas must have
+	Controller            *ControllerInfo
+	Replicas              map[string]*ReplicaInfo //key is replicaName
+	State                 VolumeState
+	EngineImage           string
+	Endpoint              string
+	Created               string
+	RecurringJobs         []*RecurringJob
+	EngineUpgrade         *EngineUpgradeInfo
+	FailoverPolicy        FailoverPolicy
+	// Lease is held by the manager monitoring the attached volume
+	Lease    *VolumeLease
+	Failover *FailoverInfo
+	// Restore is the status of the last restore of a backup to the volume
+	Restore *RestoreInfo
+
+	// Revision of the metadata in the store, it's not a part of the value
+	Revision int64 `json:"-"`
+}
+
+// EngineUpgradeInfo is the status of the last engine image upgrade of a
+// volume, which runs in the background on the host of the manager starting
+// it. Replaced counts the replicas replaced by ones with the new image out of
+// Replicas. PendingController is set if the controller keeps running the old
+// image until the next attach, because the volume was in use.
+type EngineUpgradeInfo struct {
+	FromImage         string             `json:"fromImage"`
+	ToImage           string             `json:"toImage"`
+	HostID            string             `json:"hostId"`
+	State             EngineUpgradeState `json:"state"`
+	Replicas          int                `json:"replicas"`
+	Replaced          int                `json:"replaced"`
+	PendingController bool               `json:"pendingController,omitempty"`
+	Error             string             `json:"error,omitempty"`
+	Started           string             `json:"started"`
+	Finished          string             `json:"finished,omitempty"`
+}
+
+// RestoreInfo is the status of restoring a backup to a volume, which runs in
+// the background on the host of the manager starting it
+type RestoreInfo struct {
+	BackupURL    string       `json:"backupURL"`
+	BackupTarget string       `json:"backupTarget"`
+	HostID       string       `json:"hostId"`
+	State        RestoreState `json:"state"`
+	Progress     int          `json:"progress"` // percent
+	Error        string       `json:"error,omitempty"`
+	Started      string       `json:"started"`
+	Finished     string       `json:"finished,omitempty"`
+	// InPlace is set when the backup is restored into an existing volume,
+	// Snapshot is the snapshot taken before the restore in that case
+	InPlace  bool   `json:"inPlace,omitempty"`
+	Snapshot string `json:"snapshot,omitempty"`
+	// RemoveBackup is set when the backup is taken to clone another volume,
+	// it's removed once restored
+	RemoveBackup bool `json:"removeBackup,omitempty"`
+}
+
+// FailoverPolicy is what to do with an attached volume once the controller
+// is orphaned, i.e. its host is down or its manager stops renewing the lease
+type FailoverPolicy string
+
+const (
+	FailoverPolicyDetach   = FailoverPolicy("detach")
+	FailoverPolicyReattach = FailoverPolicy("reattach")
+)
+
+type VolumeLease struct {
+	HostID  string `json:"hostID"`
+	Renewed string `json:"renewed"`
+}
+
+// FailoverInfo is the last failover of the controller of a volume. The volume
+// is faulted if it's left detached, until it's attached again.
+type FailoverInfo struct {
+	FromHostID string         `json:"fromHostID"`
+	ToHostID   string         `json:"toHostID,omitempty"`
+	Policy     FailoverPolicy `json:"policy"`
+	Faulted    bool           `json:"faulted,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Started    string         `json:"started"`
+	Finished   string         `json:"finished,omitempty"`
 }
 
 type InstanceInfo struct {
@@ -183,6 +471,32 @@ type ReplicaInfo struct {
 
 	Mode         ReplicaMode
 	BadTimestamp time.Time
+	Rebuild      *RebuildInfo `json:",omitempty"`
+	// Evicting replica is replaced by a new one on another host, then
+	// removed
+	Evicting bool `json:",omitempty"`
+
+	// StaleDeadline is when the bad replica is going to be removed, it's
+	// not a part of the metadata
+	StaleDeadline time.Time `json:"-"`
+}
+
+// RebuildInfo is the progress of a replica being added to the controller. The
+// bytes are counted by snapshot file, as the files are copied one by one.
+type RebuildInfo struct {
+	Started     string `json:"started"`
+	SyncedBytes int64  `json:"syncedBytes"`
+	TotalBytes  int64  `json:"totalBytes"`
+	// ETA is estimated from the average speed since the rebuild started
+	ETA     string `json:"eta,omitempty"`
+	Updated string `json:"updated,omitempty"`
+}
+
+// RebuildStatus is the progress of a replica being rebuilt, as far as the
+// engine can tell
+type RebuildStatus struct {
+	SyncedBytes int64 `json:"syncedBytes"`
+	TotalBytes  int64 `json:"totalBytes"`
 }
 
 type SnapshotInfo struct {
@@ -197,11 +511,76 @@ type SnapshotInfo struct {
 }
 
 type HostInfo struct {
-	UUID    string `json:"uuid"`
-	Name    string `json:"name"`
-	Address string `json:"address"`
+	UUID    string            `json:"uuid"`
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Labels  map[string]string `json:"labels,omitempty"`
+
+	// Tags of the host and its disk, for the volumes to select the hosts
+	// with, e.g. "ssd"
+	Tags     []string `json:"tags,omitempty"`
+	DiskTags []string `json:"diskTags,omitempty"`
+
+	// Storage is reported by the manager on the host, nil if unknown
+	Storage *HostStorage `json:"storage,omitempty"`
+
+	// No new replica is scheduled to the host in maintenance
+	Maintenance bool          `json:"maintenance,omitempty"`
+	Eviction    *EvictionInfo `json:"eviction,omitempty"`
+
+	// LastSeen is the last heartbeat of the manager on the host, the
+	// Status is worked out from it
+	Status   HostStatus `json:"status,omitempty"`
+	LastSeen string     `json:"lastSeen,omitempty"`
 }
 
+type HostStatus string
+
+const (
+	HostStatusUp   = HostStatus("up")
+	HostStatusDown = HostStatus("down")
+)
+
+type EvictionState string
+
+const (
+	EvictionStateEvicting  = EvictionState("evicting")
+	EvictionStateCompleted = EvictionState("completed")
+	EvictionStateFailed    = EvictionState("failed")
+)
+
+// EvictionInfo is the progress of moving the replicas off a host, run by the
+// manager on HostID. Current is the replica being moved, and Attached the
+// detached volume attached to move it.
+type EvictionInfo struct {
+	State    EvictionState `json:"state"`
+	HostID   string        `json:"hostId,omitempty"`
+	Total    int           `json:"total"`
+	Evicted  int           `json:"evicted"`
+	Current  string        `json:"current,omitempty"`
+	Attached string        `json:"attached,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Started  string        `json:"started"`
+	Finished string        `json:"finished,omitempty"`
+}
+
+// HostStorage is the storage capacity of a host in bytes. Scheduled is the
+// sum of the sizes of the replicas on the host, which may be more than Used
+// as the replicas are sparse.
+type HostStorage struct {
+	Total     int64  `json:"total"`
+	Used      int64  `json:"used"`
+	Reserved  int64  `json:"reserved"`
+	Scheduled int64  `json:"scheduled"`
+	Updated   string `json:"updated"`
+}
+
+// The labels of the failure domains of a host
+const (
+	HostLabelZone = "zone"
+	HostLabelRack = "rack"
+)
+
 type BackupInfo struct {
 	Name            string `json:"name,omitempty"`
 	URL             string `json:"url,omitempty"`
@@ -234,9 +613,18 @@ type BackupBgTask struct {
 	Snapshot     string `json:"snapshot"`
 	BackupTarget string `json:"backupTarget"`
 
+	Env         []string     `json:"-"`
 	CleanupHook func() error `json:"-"`
 }
 
+type RebuildBgTask struct {
+	Replica string `json:"replica"`
+	Address string `json:"address"`
+	// Elapsed is the number of seconds since the rebuild started
+	Elapsed int `json:"elapsed"`
+	RebuildInfo
+}
+
 type BackupVolumeInfo struct {
 	Name    string `json:"name"`
 	Size    string `json:"size"`
@@ -253,4 +641,7 @@ type RecurringJob struct {
 	Cron   string `json:"cron,omitempty"`
 	Task   string `json:"task,omitempty"`
 	Retain int    `json:"retain,omitempty"`
+	// BackupTarget is the name of the target of the backup task, the
+	// default one if empty
+	BackupTarget string `json:"backupTarget,omitempty"`
 }
@@ -0,0 +1,17 @@
+package util
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// GetDiskStat returns the total and the available bytes of the filesystem
+// of path
+func GetDiskStat(path string) (total, available int64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, errors.Wrapf(err, "unable to get disk stat of %v", path)
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -143,6 +144,23 @@ func WaitForDevice(dev string, timeout int) error {
 	return fmt.Errorf("timeout waiting for %v", dev)
 }
 
+// IsDeviceBusy tells if the block device is mounted or opened exclusively,
+// e.g. by device mapper. A device that doesn't exist isn't busy.
+func IsDeviceBusy(dev string) (bool, error) {
+	f, err := os.OpenFile(dev, os.O_RDONLY|syscall.O_EXCL, 0)
+	if err == nil {
+		f.Close()
+		return false, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EBUSY {
+		return true, nil
+	}
+	return false, errors.Wrapf(err, "failed to open device %v", dev)
+}
+
 func RandomID() string {
 	return UUID()[:18]
 }
@@ -1,8 +1,11 @@
 package util
 
 import (
-	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestConvertSize(t *testing.T) {
@@ -35,3 +38,31 @@ func TestReplicaName(t *testing.T) {
 	assert.Equal("replica-XX", ReplicaName("tcp://replica-XX.rancher.internal:9502", "tt"))
 	assert.Equal("replica-XX", ReplicaName("tcp://replica-XX.volume-tt:9502", "tt"))
 }
+
+func TestGetDiskStat(t *testing.T) {
+	assert := require.New(t)
+
+	total, available, err := GetDiskStat("/")
+	assert.Nil(err)
+	assert.True(total > 0)
+	assert.True(available <= total)
+
+	_, _, err = GetDiskStat("/nonexistent/path")
+	assert.NotNil(err)
+}
+
+func TestIsDeviceBusy(t *testing.T) {
+	assert := require.New(t)
+
+	busy, err := IsDeviceBusy("/dev/longhorn/nonexistent")
+	assert.Nil(err)
+	assert.False(busy)
+
+	f, err := ioutil.TempFile("", "device")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	f.Close()
+	busy, err = IsDeviceBusy(f.Name())
+	assert.Nil(err)
+	assert.False(busy)
+}